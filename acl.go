@@ -0,0 +1,481 @@
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+// OtherUsersPrefix is the prefix of "Other Users" namespace (RFC 2342).
+//
+// Mailbox "Helpdesk" of user "support" shared with other users using ACL is
+// visible for them as "Other Users.support.Helpdesk".
+const OtherUsersPrefix = "Other Users" + MailboxPathSep
+
+// Rights defined by RFC 4314.
+const (
+	RightLookup     = 'l'
+	RightRead       = 'r'
+	RightSeen       = 's'
+	RightWrite      = 'w'
+	RightInsert     = 'i'
+	RightPost       = 'p'
+	RightCreate     = 'k'
+	RightDeleteMbox = 'x'
+	RightDeleteMsg  = 't'
+	RightExpunge    = 'e'
+	RightAdmin      = 'a'
+)
+
+// AllRights is the set of rights the owner of the mailbox implicitly has.
+const AllRights = "lrswipkxtea"
+
+// AnyoneIdentifier is the ACL identifier that matches all users.
+const AnyoneIdentifier = "anyone"
+
+var (
+	ErrPermissionDenied = errors.New("imap: permission denied")
+	ErrInvalidRights    = errors.New("imap: invalid rights")
+	ErrCrossAccount     = errors.New("imap: operation across accounts is not supported")
+)
+
+// normalizeRights validates the rights string and returns it with
+// rights in canonical order and obsolete RFC 2086 rights expanded.
+func normalizeRights(rights string) (string, error) {
+	set := make(map[rune]struct{}, len(rights))
+	for _, r := range rights {
+		switch {
+		case r == 'c':
+			set[RightCreate] = struct{}{}
+		case r == 'd':
+			set[RightDeleteMbox] = struct{}{}
+			set[RightDeleteMsg] = struct{}{}
+			set[RightExpunge] = struct{}{}
+		case strings.ContainsRune(AllRights, r):
+			set[r] = struct{}{}
+		default:
+			return "", ErrInvalidRights
+		}
+	}
+
+	var res strings.Builder
+	for _, r := range AllRights {
+		if _, ok := set[r]; ok {
+			res.WriteRune(r)
+		}
+	}
+	return res.String(), nil
+}
+
+// mergeRights returns the union of two normalized rights strings.
+func mergeRights(a, b string) string {
+	res, _ := normalizeRights(a + b)
+	return res
+}
+
+func (m *Mailbox) hasRight(r rune) bool {
+	// Mailbox is accessed by its owner.
+	if m.viewer == nil {
+		return true
+	}
+	return strings.ContainsRune(m.rights, r)
+}
+
+// resolveDest resolves the target mailbox name for COPY and MOVE as seen by
+// the viewer and returns its name in the namespace of the mailbox owner.
+//
+// Messages can't be copied between accounts since message blobs are owned
+// by a single user.
+func (m *Mailbox) resolveDest(dest string) (string, error) {
+	viewer := m.viewer
+	if viewer == nil {
+		viewer = &m.user
+	}
+
+	owner, _, ownerName, rights, err := viewer.resolveMailbox(dest)
+	if err != nil {
+		return "", err
+	}
+	if !strings.ContainsRune(rights, RightInsert) {
+		return "", ErrPermissionDenied
+	}
+	if owner.id != m.user.id {
+		return "", ErrCrossAccount
+	}
+	return ownerName, nil
+}
+
+// resolveMailbox looks up the mailbox by the name as seen by the user.
+//
+// For mailboxes in the "Other Users" and "Shared" namespaces it returns the
+// owner account and the name of the mailbox in the owner's namespace.
+// backend.ErrNoSuchMailbox is returned if the user has no rights on the
+// mailbox to not disclose its existence.
+func (u *User) resolveMailbox(name string) (owner *User, mboxId uint64, ownerName, rights string, err error) {
+	if strings.HasPrefix(name, SharedPrefix) {
+		owner, err := u.parent.sharedUser(nil)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, 0, "", "", backend.ErrNoSuchMailbox
+			}
+			return nil, 0, "", "", err
+		}
+		return u.resolveForeign(owner, strings.TrimPrefix(name, SharedPrefix))
+	}
+
+	if !strings.HasPrefix(name, OtherUsersPrefix) {
+		if strings.EqualFold(name, "INBOX") {
+			return u, u.inboxId, "INBOX", u.restrictRights(AllRights), nil
+		}
+		if err := u.parent.mboxId.QueryRow(u.id, name).Scan(&mboxId); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, 0, "", "", backend.ErrNoSuchMailbox
+			}
+			return nil, 0, "", "", err
+		}
+		return u, mboxId, name, u.restrictRights(AllRights), nil
+	}
+
+	// Usernames can contain the hierarchy separator so we try all possible
+	// splits of the name.
+	parts := strings.Split(strings.TrimPrefix(name, OtherUsersPrefix), MailboxPathSep)
+	for i := 1; i < len(parts); i++ {
+		username := normalizeUsername(strings.Join(parts[:i], MailboxPathSep))
+		if username == SharedUsername {
+			// Mailboxes of the pseudo-user are accessible only via "Shared"
+			// namespace.
+			continue
+		}
+
+		uid, inboxId, err := u.parent.getUserMeta(nil, username)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return nil, 0, "", "", err
+		}
+		owner := &User{id: uid, username: username, parent: u.parent, inboxId: inboxId}
+
+		owner, mboxId, ownerName, rights, err := u.resolveForeign(owner, strings.Join(parts[i:], MailboxPathSep))
+		if err == backend.ErrNoSuchMailbox {
+			continue
+		}
+		return owner, mboxId, ownerName, rights, err
+	}
+
+	return nil, 0, "", "", backend.ErrNoSuchMailbox
+}
+
+// resolveForeign looks up the mailbox by its name in the owner's namespace
+// and returns rights the user has on it.
+func (u *User) resolveForeign(owner *User, ownerName string) (*User, uint64, string, string, error) {
+	var mboxId uint64
+	if strings.EqualFold(ownerName, "INBOX") {
+		mboxId, ownerName = owner.inboxId, "INBOX"
+	} else if err := u.parent.mboxId.QueryRow(owner.id, ownerName).Scan(&mboxId); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, 0, "", "", backend.ErrNoSuchMailbox
+		}
+		return nil, 0, "", "", err
+	}
+
+	if owner.id == u.id {
+		return u, mboxId, ownerName, u.restrictRights(AllRights), nil
+	}
+
+	rights, err := u.rightsFor(mboxId)
+	if err != nil {
+		return nil, 0, "", "", err
+	}
+	rights = u.restrictRights(rights)
+	if rights == "" {
+		return nil, 0, "", "", backend.ErrNoSuchMailbox
+	}
+	return owner, mboxId, ownerName, rights, nil
+}
+
+// renameShadowedMboxes renames personal mailboxes that can't be accessed
+// since their names start with one of the namespace prefixes. The top-level
+// mailbox is renamed to "NAME (personal)" together with its children,
+// a number is added if that name is already used.
+func (b *Backend) renameShadowedMboxes(tx *sql.Tx, prefixes []string) error {
+	rows, err := tx.Query(b.db.rewriteSQL(`
+		SELECT mboxes.id, mboxes.uid, users.username, mboxes.name
+		FROM mboxes
+		INNER JOIN users
+		ON users.id = mboxes.uid
+		WHERE users.username <> ?`), SharedUsername)
+	if err != nil {
+		return err
+	}
+	type mbox struct {
+		id, uid        uint64
+		username, name string
+	}
+	var mboxes []mbox
+	names := make(map[uint64][]string)
+	for rows.Next() {
+		var m mbox
+		if err := rows.Scan(&m.id, &m.uid, &m.username, &m.name); err != nil {
+			rows.Close()
+			return err
+		}
+		mboxes = append(mboxes, m)
+		names[m.uid] = append(names[m.uid], m.name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Checks whether the mailbox or any of its children exists.
+	treeExists := func(uid uint64, top string) bool {
+		for _, name := range names[uid] {
+			if name == top || strings.HasPrefix(name, top+MailboxPathSep) {
+				return true
+			}
+		}
+		return false
+	}
+
+	rename, err := tx.Prepare(b.db.rewriteSQL(`
+		UPDATE mboxes SET name = ?
+		WHERE id = ?`))
+	if err != nil {
+		return err
+	}
+	defer rename.Close()
+	for _, prefix := range prefixes {
+		top := strings.TrimSuffix(prefix, MailboxPathSep)
+		newTops := make(map[uint64]string)
+		for _, m := range mboxes {
+			if m.name != top && !strings.HasPrefix(m.name, prefix) {
+				continue
+			}
+			newTop, ok := newTops[m.uid]
+			if !ok {
+				newTop = top + " (personal)"
+				for i := 2; treeExists(m.uid, newTop); i++ {
+					newTop = fmt.Sprintf("%s (personal %d)", top, i)
+				}
+				newTops[m.uid] = newTop
+			}
+
+			newName := newTop + strings.TrimPrefix(m.name, top)
+			b.Opts.Log.Printf("renaming mailbox %s of %s to %s, its name is reserved for the namespace", m.name, m.username, newName)
+			if _, err := rename.Exec(newName, m.id); err != nil {
+				return err
+			}
+			names[m.uid] = append(names[m.uid], newName)
+		}
+	}
+	return nil
+}
+
+// rightsFor returns the rights of the user on the mailbox owned by another
+// user.
+func (u *User) rightsFor(mboxId uint64) (string, error) {
+	return u.parent.rightsOf(mboxId, u.username)
+}
+
+// rightsOf returns the rights granted on the mailbox to the identifier,
+// including ones granted to AnyoneIdentifier.
+func (b *Backend) rightsOf(mboxId uint64, identifier string) (string, error) {
+	rows, err := b.aclRights.Query(mboxId, identifier, AnyoneIdentifier)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	rights := ""
+	for rows.Next() {
+		var entry string
+		if err := rows.Scan(&entry); err != nil {
+			return "", err
+		}
+		rights = mergeRights(rights, entry)
+	}
+	return rights, rows.Err()
+}
+
+// resolveAdmin resolves the mailbox and checks that the user has the
+// RightAdmin right on it.
+func (u *User) resolveAdmin(mboxName string) (owner *User, mboxId uint64, err error) {
+	owner, mboxId, _, rights, err := u.resolveMailbox(mboxName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !strings.ContainsRune(rights, RightAdmin) {
+		return nil, 0, ErrPermissionDenied
+	}
+	return owner, mboxId, nil
+}
+
+// GetACL returns the access control list of the mailbox as a map from
+// identifier to rights.
+//
+// The owner of the mailbox is always included with AllRights.
+func (u *User) GetACL(mboxName string) (map[string]string, error) {
+	owner, mboxId, err := u.resolveAdmin(mboxName)
+	if err != nil {
+		if err != backend.ErrNoSuchMailbox && err != ErrPermissionDenied {
+			u.parent.logUserErr(u, err, "GetACL", mboxName)
+			return nil, wrapErrf(err, "GetACL %s", mboxName)
+		}
+		return nil, err
+	}
+
+	rows, err := u.parent.aclList.Query(mboxId)
+	if err != nil {
+		u.parent.logUserErr(u, err, "GetACL", mboxName)
+		return nil, wrapErrf(err, "GetACL %s", mboxName)
+	}
+	defer rows.Close()
+
+	acl := map[string]string{owner.username: AllRights}
+	for rows.Next() {
+		var identifier, rights string
+		if err := rows.Scan(&identifier, &rights); err != nil {
+			u.parent.logUserErr(u, err, "GetACL (scan)", mboxName)
+			return nil, wrapErrf(err, "GetACL %s", mboxName)
+		}
+		acl[identifier] = rights
+	}
+	if err := rows.Err(); err != nil {
+		u.parent.logUserErr(u, err, "GetACL", mboxName)
+		return nil, wrapErrf(err, "GetACL %s", mboxName)
+	}
+
+	return acl, nil
+}
+
+// SetACL changes rights of the identifier on the mailbox.
+//
+// Rights string can be prefixed with "+" or "-" to add or remove the
+// specified rights as defined by RFC 4314 SETACL command. Empty resulting
+// rights remove the identifier from the access control list.
+//
+// Rights of the mailbox owner cannot be changed.
+func (u *User) SetACL(mboxName, identifier, rights string) error {
+	if strings.HasPrefix(identifier, "-") {
+		// Negative rights are not supported.
+		return ErrInvalidRights
+	}
+	if identifier != AnyoneIdentifier {
+		identifier = normalizeUsername(identifier)
+	}
+
+	owner, mboxId, err := u.resolveAdmin(mboxName)
+	if err != nil {
+		if err != backend.ErrNoSuchMailbox && err != ErrPermissionDenied {
+			u.parent.logUserErr(u, err, "SetACL", mboxName, identifier, rights)
+			return wrapErrf(err, "SetACL %s", mboxName)
+		}
+		return err
+	}
+	if identifier == owner.username {
+		return ErrPermissionDenied
+	}
+
+	var mod rune
+	if strings.HasPrefix(rights, "+") || strings.HasPrefix(rights, "-") {
+		mod = rune(rights[0])
+		rights = rights[1:]
+	}
+	rights, err = normalizeRights(rights)
+	if err != nil {
+		return err
+	}
+
+	tx, err := u.parent.db.Begin(false)
+	if err != nil {
+		u.parent.logUserErr(u, err, "SetACL (tx start)", mboxName, identifier, rights)
+		return wrapErrf(err, "SetACL %s", mboxName)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if mod != 0 {
+		var current string
+		err := tx.Stmt(u.parent.aclEntry).QueryRow(mboxId, identifier).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			u.parent.logUserErr(u, err, "SetACL (current)", mboxName, identifier, rights)
+			return wrapErrf(err, "SetACL %s", mboxName)
+		}
+
+		if mod == '+' {
+			rights = mergeRights(current, rights)
+		} else {
+			rights = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(rights, r) {
+					return -1
+				}
+				return r
+			}, current)
+		}
+	}
+
+	if _, err := tx.Stmt(u.parent.aclDel).Exec(mboxId, identifier); err != nil {
+		u.parent.logUserErr(u, err, "SetACL (del)", mboxName, identifier, rights)
+		return wrapErrf(err, "SetACL %s", mboxName)
+	}
+	if rights != "" {
+		if _, err := tx.Stmt(u.parent.aclAdd).Exec(mboxId, identifier, rights); err != nil {
+			u.parent.logUserErr(u, err, "SetACL (add)", mboxName, identifier, rights)
+			return wrapErrf(err, "SetACL %s", mboxName)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		u.parent.logUserErr(u, err, "SetACL (tx commit)", mboxName, identifier, rights)
+		return wrapErrf(err, "SetACL %s", mboxName)
+	}
+	return nil
+}
+
+// DeleteACL removes the identifier from the access control list of the
+// mailbox.
+func (u *User) DeleteACL(mboxName, identifier string) error {
+	return u.SetACL(mboxName, identifier, "")
+}
+
+// MyRights returns rights the user has on the mailbox.
+func (u *User) MyRights(mboxName string) (string, error) {
+	_, _, _, rights, err := u.resolveMailbox(mboxName)
+	if err != nil {
+		if err != backend.ErrNoSuchMailbox {
+			u.parent.logUserErr(u, err, "MyRights", mboxName)
+			return "", wrapErrf(err, "MyRights %s", mboxName)
+		}
+		return "", err
+	}
+	return rights, nil
+}
+
+// ListRights returns rights that can be granted to the identifier on the
+// mailbox as defined by RFC 4314 LISTRIGHTS command.
+//
+// Owner of the mailbox always has all rights, other identifiers can be granted
+// any right independently.
+func (u *User) ListRights(mboxName, identifier string) (required string, optional []string, err error) {
+	owner, _, err := u.resolveAdmin(mboxName)
+	if err != nil {
+		if err != backend.ErrNoSuchMailbox && err != ErrPermissionDenied {
+			u.parent.logUserErr(u, err, "ListRights", mboxName, identifier)
+			return "", nil, wrapErrf(err, "ListRights %s", mboxName)
+		}
+		return "", nil, err
+	}
+
+	if normalizeUsername(identifier) == owner.username {
+		return AllRights, nil, nil
+	}
+
+	optional = make([]string, 0, len(AllRights))
+	for _, r := range AllRights {
+		optional = append(optional, string(r))
+	}
+	return "", optional, nil
+}
@@ -0,0 +1,202 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func initACLUsers(t *testing.T, b *Backend) (owner, other *User) {
+	assert.NilError(t, b.CreateUser(t.Name()+"-owner"))
+	assert.NilError(t, b.CreateUser(t.Name()+"-other"))
+	ownerI, err := b.GetUser(t.Name() + "-owner")
+	assert.NilError(t, err)
+	otherI, err := b.GetUser(t.Name() + "-other")
+	assert.NilError(t, err)
+	owner, other = ownerI.(*User), otherI.(*User)
+
+	assert.NilError(t, owner.CreateMailbox("Shared"))
+	return owner, other
+}
+
+func TestACLManagement(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	owner, other := initACLUsers(t, b)
+	sharedName := OtherUsersPrefix + owner.Username() + MailboxPathSep + "Shared"
+
+	acl, err := owner.GetACL("Shared")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, acl, map[string]string{owner.Username(): AllRights})
+
+	assert.NilError(t, owner.SetACL("Shared", other.Username(), "rl"))
+	assert.NilError(t, owner.SetACL("Shared", other.Username(), "+wc"))
+	assert.NilError(t, owner.SetACL("Shared", AnyoneIdentifier, "l"))
+
+	acl, err = owner.GetACL("Shared")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, acl, map[string]string{
+		owner.Username(): AllRights,
+		other.Username(): "lrwk",
+		AnyoneIdentifier: "l",
+	})
+
+	rights, err := other.MyRights(sharedName)
+	assert.NilError(t, err)
+	assert.Equal(t, rights, "lrwk")
+
+	// No 'a' right - can't view or change ACL.
+	_, err = other.GetACL(sharedName)
+	assert.Equal(t, err, ErrPermissionDenied)
+	assert.Equal(t, other.SetACL(sharedName, other.Username(), "a"), ErrPermissionDenied)
+
+	assert.Equal(t, owner.SetACL("Shared", owner.Username(), "l"), ErrPermissionDenied)
+	assert.Equal(t, owner.SetACL("Shared", other.Username(), "z"), ErrInvalidRights)
+	assert.Equal(t, owner.SetACL("Shared", "-"+other.Username(), "l"), ErrInvalidRights)
+
+	required, optional, err := owner.ListRights("Shared", other.Username())
+	assert.NilError(t, err)
+	assert.Equal(t, required, "")
+	assert.Equal(t, len(optional), len(AllRights))
+	required, _, err = owner.ListRights("Shared", owner.Username())
+	assert.NilError(t, err)
+	assert.Equal(t, required, AllRights)
+
+	assert.NilError(t, owner.SetACL("Shared", other.Username(), "-rwk"))
+	assert.NilError(t, owner.DeleteACL("Shared", AnyoneIdentifier))
+	acl, err = owner.GetACL("Shared")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, acl, map[string]string{
+		owner.Username(): AllRights,
+		other.Username(): "l",
+	})
+
+	assert.NilError(t, owner.DeleteACL("Shared", other.Username()))
+	_, err = other.MyRights(sharedName)
+	assert.Equal(t, err, backend.ErrNoSuchMailbox)
+}
+
+func TestACLSharedMailbox(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	owner, other := initACLUsers(t, b)
+	sharedName := OtherUsersPrefix + owner.Username() + MailboxPathSep + "Shared"
+
+	assert.NilError(t, owner.CreateMessage("Shared", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	// Mailbox existence is not disclosed without any rights.
+	_, _, err := other.GetMailbox(sharedName, false, &noopConn{})
+	assert.Equal(t, err, backend.ErrNoSuchMailbox)
+	list, err := other.ListMailboxes(false)
+	assert.NilError(t, err)
+	for _, info := range list {
+		assert.Assert(t, info.Name != sharedName)
+	}
+
+	assert.NilError(t, owner.SetACL("Shared", other.Username(), "lrs"))
+
+	list, err = other.ListMailboxes(false)
+	assert.NilError(t, err)
+	found := false
+	for _, info := range list {
+		if info.Name == sharedName {
+			found = true
+		}
+	}
+	assert.Assert(t, found, "shared mailbox is not listed")
+
+	status, err := other.Status(sharedName, []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(1))
+
+	_, mboxI, err := other.GetMailbox(sharedName, false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+	assert.Equal(t, mbox.Name(), sharedName)
+
+	seq, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchUid}, ch))
+	assert.Equal(t, len(ch), 1)
+
+	// No 'i' right.
+	assert.Equal(t, mbox.CreateMessage([]string{}, time.Now(), strings.NewReader(testMsg)), ErrPermissionDenied)
+
+	// Only 's' right - other flags are dropped.
+	assert.Equal(t, mbox.UpdateMessagesFlags(false, seq, imap.AddFlags, true, []string{imap.DeletedFlag}), ErrPermissionDenied)
+	assert.Equal(t, mbox.UpdateMessagesFlags(false, seq, imap.SetFlags, true, []string{imap.SeenFlag}), ErrPermissionDenied)
+	assert.NilError(t, mbox.UpdateMessagesFlags(false, seq, imap.AddFlags, true, []string{imap.SeenFlag, imap.FlaggedFlag}))
+
+	// No 'e' and 't' rights.
+	assert.Equal(t, mbox.Expunge(), ErrPermissionDenied)
+	assert.Equal(t, mbox.MoveMessages(false, seq, "INBOX"), ErrPermissionDenied)
+
+	// Copy to the own mailbox of the viewer is not supported.
+	assert.Equal(t, mbox.CopyMessages(false, seq, "INBOX"), ErrCrossAccount)
+
+	// Mailboxes can't be created in the other users namespace.
+	assert.Equal(t, other.CreateMailbox(sharedName+MailboxPathSep+"Child"), ErrPermissionDenied)
+	assert.Equal(t, other.DeleteMailbox(sharedName), ErrPermissionDenied)
+
+	_, ownerMbox, err := owner.GetMailbox("Shared", true, &noopConn{})
+	assert.NilError(t, err)
+	defer ownerMbox.Close()
+	ch = make(chan *imap.Message, 10)
+	assert.NilError(t, ownerMbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchFlags}, ch))
+	msg := <-ch
+	assert.DeepEqual(t, msg.Flags, []string{imap.SeenFlag})
+}
+
+func TestACLDeleteUser(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	owner, other := initACLUsers(t, b)
+
+	assert.NilError(t, owner.SetACL("Shared", other.Username(), "lr"))
+	assert.NilError(t, b.DeleteUser(other.Username()))
+
+	acl, err := owner.GetACL("Shared")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, acl, map[string]string{owner.Username(): AllRights})
+}
+
+func TestRenameShadowedMboxes(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	owner, _ := initACLUsers(t, b)
+	for _, name := range []string{"A", "A.Work", "Other Users (personal)"} {
+		assert.NilError(t, owner.CreateMailbox(name))
+	}
+	// Mailboxes created before namespaces were added.
+	_, err := b.db.Exec(`UPDATE mboxes SET name = ? WHERE uid = ? AND name = ?`, "Other Users", owner.id, "A")
+	assert.NilError(t, err)
+	_, err = b.db.Exec(`UPDATE mboxes SET name = ? WHERE uid = ? AND name = ?`, "Other Users.Work", owner.id, "A.Work")
+	assert.NilError(t, err)
+	_, _, err = owner.GetMailbox("Other Users.Work", true, &noopConn{})
+	assert.Equal(t, err, backend.ErrNoSuchMailbox)
+
+	tx, err := b.db.Begin(false)
+	assert.NilError(t, err)
+	assert.NilError(t, b.renameShadowedMboxes(tx, []string{OtherUsersPrefix}))
+	assert.NilError(t, tx.Commit())
+
+	list, err := owner.ListMailboxes(false)
+	assert.NilError(t, err)
+	names := make([]string, 0, len(list))
+	for _, info := range list {
+		assert.Assert(t, info.Name != "Other Users" && !strings.HasPrefix(info.Name, OtherUsersPrefix), info.Name)
+		names = append(names, info.Name)
+	}
+	for _, name := range []string{"Other Users (personal)", "Other Users (personal 2)", "Other Users (personal 2).Work"} {
+		assert.Assert(t, is.Contains(names, name))
+	}
+	_, mbox, err := owner.GetMailbox("Other Users (personal 2).Work", true, &noopConn{})
+	assert.NilError(t, err)
+	assert.NilError(t, mbox.Close())
+}
@@ -0,0 +1,179 @@
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrAliasExists      = errors.New("imap: alias already exists")
+	ErrAliasDoesntExist = errors.New("imap: alias doesn't exist")
+	ErrAliasLoop        = errors.New("imap: alias loop detected")
+)
+
+// Alias maps an alternate address to the account.
+//
+// If Alias starts with '@', it is the catch-all for the domain and matches
+// any address in it not matched by an account or another alias.
+type Alias struct {
+	Alias string
+	// Username of the account or another alias.
+	Target string
+}
+
+func (b *Backend) lookupAlias(tx *sql.Tx, alias string) (string, error) {
+	stmt := b.aliasTarget
+	if tx != nil {
+		stmt = tx.Stmt(stmt)
+	}
+	var target string
+	err := stmt.QueryRow(alias).Scan(&target)
+	return target, err
+}
+
+// resolveAlias follows aliases starting with name until it gets a name that
+// is not an alias, which is returned without checking whether such account
+// exists. Accounts take precedence over aliases with the same name.
+//
+// If catchAll is set, domain catch-alls are used for names that are not
+// matched otherwise.
+func (b *Backend) resolveAlias(tx *sql.Tx, name string, catchAll bool) (string, error) {
+	seen := make(map[string]struct{})
+	for {
+		if _, ok := seen[name]; ok {
+			return "", ErrAliasLoop
+		}
+		seen[name] = struct{}{}
+
+		if _, _, err := b.getUserMeta(tx, name); err != sql.ErrNoRows {
+			if err != nil {
+				return "", err
+			}
+			return name, nil
+		}
+
+		target, err := b.lookupAlias(tx, name)
+		if err == sql.ErrNoRows && catchAll {
+			if i := strings.LastIndexByte(name, '@'); i > 0 {
+				target, err = b.lookupAlias(tx, name[i:])
+			}
+		}
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return name, nil
+			}
+			return "", err
+		}
+		name = target
+	}
+}
+
+// ResolveAlias returns the username of the account messages addressed to the
+// address are delivered to, following aliases and domain catch-alls the same
+// way as Delivery.AddRcpt. ErrUserDoesntExists is returned if there is no
+// such account.
+func (b *Backend) ResolveAlias(address string) (string, error) {
+	username, err := b.resolveAlias(nil, normalizeUsername(address), true)
+	if err != nil {
+		if err == ErrAliasLoop {
+			return "", err
+		}
+		return "", wrapErr(err, "ResolveAlias")
+	}
+	if _, _, err := b.getUserMeta(nil, username); err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrUserDoesntExists
+		}
+		return "", wrapErr(err, "ResolveAlias")
+	}
+	return username, nil
+}
+
+// AddAlias creates the alias for the account or another alias. Use
+// "@domain" as alias to create the catch-all for the domain.
+//
+// ErrAliasLoop is returned if the alias would (indirectly) point to itself
+// and ErrUserDoesntExists if it does not lead to an existing account.
+// ErrUserAlreadyExists is returned if there is an account with the same
+// name as alias.
+func (b *Backend) AddAlias(alias, target string) error {
+	alias, target = normalizeUsername(alias), normalizeUsername(target)
+	if alias == "" || alias == "@" {
+		return errors.New("AddAlias: empty alias")
+	}
+	if alias == SharedUsername || target == SharedUsername {
+		return ErrPermissionDenied
+	}
+
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return wrapErr(err, "AddAlias")
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, _, err := b.getUserMeta(tx, alias); err != sql.ErrNoRows {
+		if err != nil {
+			return wrapErr(err, "AddAlias")
+		}
+		return ErrUserAlreadyExists
+	}
+
+	if _, err := tx.Stmt(b.addAlias).Exec(alias, target); err != nil {
+		if isForeignKeyErr(err) {
+			return ErrAliasExists
+		}
+		return wrapErr(err, "AddAlias")
+	}
+
+	username, err := b.resolveAlias(tx, alias, true)
+	if err != nil {
+		if err == ErrAliasLoop {
+			return err
+		}
+		return wrapErr(err, "AddAlias")
+	}
+	if _, _, err := b.getUserMeta(tx, username); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "AddAlias")
+	}
+
+	return wrapErr(tx.Commit(), "AddAlias")
+}
+
+// RemoveAlias removes the alias. Aliases pointing to it are not removed.
+func (b *Backend) RemoveAlias(alias string) error {
+	stats, err := b.delAlias.Exec(normalizeUsername(alias))
+	if err != nil {
+		return wrapErr(err, "RemoveAlias")
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		return wrapErr(err, "RemoveAlias")
+	}
+	if affected == 0 {
+		return ErrAliasDoesntExist
+	}
+	return nil
+}
+
+// ListAliases returns all aliases sorted by name.
+func (b *Backend) ListAliases() ([]Alias, error) {
+	rows, err := b.listAliases.Query()
+	if err != nil {
+		return nil, wrapErr(err, "ListAliases")
+	}
+	defer rows.Close()
+
+	var res []Alias
+	for rows.Next() {
+		var alias Alias
+		if err := rows.Scan(&alias.Alias, &alias.Target); err != nil {
+			return nil, wrapErr(err, "ListAliases")
+		}
+		res = append(res, alias)
+	}
+	return res, wrapErr(rows.Err(), "ListAliases")
+}
@@ -0,0 +1,123 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func TestAliases(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	assert.NilError(t, b.CreateUser("other@example.org"))
+
+	assert.NilError(t, b.AddAlias("Postmaster@example.org", "USER@example.org"))
+	assert.NilError(t, b.AddAlias("abuse@example.org", "postmaster@example.org"))
+	assert.Equal(t, b.AddAlias("abuse@example.org", "other@example.org"), ErrAliasExists)
+	assert.Equal(t, b.AddAlias("other@example.org", "user@example.org"), ErrUserAlreadyExists)
+	assert.Equal(t, b.AddAlias("info@example.org", "nobody@example.org"), ErrUserDoesntExists)
+	assert.Equal(t, b.AddAlias("info@example.org", SharedUsername), ErrPermissionDenied)
+
+	for address, username := range map[string]string{
+		"user@example.org":       "user@example.org",
+		"POSTMASTER@example.org": "user@example.org",
+		"abuse@example.org":      "user@example.org",
+	} {
+		resolved, err := b.ResolveAlias(address)
+		assert.NilError(t, err)
+		assert.Equal(t, resolved, username, address)
+	}
+	_, err := b.ResolveAlias("info@example.org")
+	assert.Equal(t, err, ErrUserDoesntExists)
+
+	// Catch-all matches only addresses not matched otherwise.
+	assert.NilError(t, b.AddAlias("@example.org", "other@example.org"))
+	resolved, err := b.ResolveAlias("info@example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, resolved, "other@example.org")
+	resolved, err = b.ResolveAlias("abuse@example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, resolved, "user@example.org")
+	_, err = b.ResolveAlias("info@example.com")
+	assert.Equal(t, err, ErrUserDoesntExists)
+
+	list, err := b.ListAliases()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, list, []Alias{
+		{Alias: "@example.org", Target: "other@example.org"},
+		{Alias: "abuse@example.org", Target: "postmaster@example.org"},
+		{Alias: "postmaster@example.org", Target: "user@example.org"},
+	})
+
+	assert.Equal(t, b.RemoveAlias("info@example.org"), ErrAliasDoesntExist)
+	assert.NilError(t, b.RemoveAlias("@EXAMPLE.org"))
+	_, err = b.ResolveAlias("info@example.org")
+	assert.Equal(t, err, ErrUserDoesntExists)
+
+	// Aliases follow renamed accounts and are removed with them.
+	assert.NilError(t, b.RenameUser("user@example.org", "renamed@example.org"))
+	resolved, err = b.ResolveAlias("abuse@example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, resolved, "renamed@example.org")
+	assert.NilError(t, b.DeleteUser("renamed@example.org"))
+	list, err = b.ListAliases()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, list, []Alias{
+		{Alias: "abuse@example.org", Target: "postmaster@example.org"},
+	})
+}
+
+func TestAliasLoop(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+
+	assert.NilError(t, b.AddAlias("a@example.org", "user@example.org"))
+	assert.NilError(t, b.AddAlias("b@example.org", "a@example.org"))
+	assert.Equal(t, b.AddAlias("c@example.org", "c@example.org"), ErrAliasLoop)
+	assert.Equal(t, b.AddAlias("@example.org", "nobody@example.org"), ErrAliasLoop)
+
+	// Loop created by concurrent changes.
+	assert.NilError(t, b.RemoveAlias("a@example.org"))
+	_, err := b.db.Exec(`INSERT INTO aliases(alias, target) VALUES (?, ?)`, "a@example.org", "b@example.org")
+	assert.NilError(t, err)
+	_, err = b.ResolveAlias("a@example.org")
+	assert.Equal(t, err, ErrAliasLoop)
+
+	delivery := b.NewDelivery()
+	assert.Equal(t, delivery.AddRcpt("b@example.org", textproto.Header{}), ErrAliasLoop)
+	assert.NilError(t, delivery.Abort())
+	_, err = b.Login(nil, "a@example.org", "")
+	assert.Equal(t, err, ErrAliasLoop)
+}
+
+func TestAliasDelivery(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	assert.NilError(t, b.AddAlias("alias@example.org", "user@example.org"))
+	assert.NilError(t, b.AddAlias("@example.org", "user@example.org"))
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt("ALIAS@example.org", textproto.Header{}))
+	assert.NilError(t, delivery.AddRcpt("user@example.org", textproto.Header{}))
+	assert.NilError(t, delivery.AddRcpt("anything@example.org", textproto.Header{}))
+	assert.Equal(t, delivery.AddRcpt("user@example.com", textproto.Header{}), ErrUserDoesntExists)
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	// Delivered once.
+	assert.Equal(t, inboxMessages(t, b, "user@example.org"), uint32(1))
+
+	u, err := b.Login(nil, "alias@example.org", "")
+	assert.NilError(t, err)
+	assert.Equal(t, u.Username(), "user@example.org")
+
+	// Catch-all is not used for Login, the account is created instead.
+	u, err = b.Login(nil, "anything@example.org", "")
+	assert.NilError(t, err)
+	assert.Equal(t, u.Username(), "anything@example.org")
+}
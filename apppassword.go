@@ -0,0 +1,218 @@
+package imapsql
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+// App password scopes.
+const (
+	// ScopeFull gives the same access as the main password.
+	ScopeFull = ""
+	// ScopeReadOnly allows only to list and read mailboxes. Mailboxes are
+	// always selected read-only.
+	ScopeReadOnly = "read-only"
+	// ScopeDelivery allows only to list mailboxes and append messages to
+	// them.
+	ScopeDelivery = "delivery-only"
+)
+
+// scopeRights maps scopes to rights the user has on own mailboxes when
+// logged in using an app password with such scope. Rights on mailboxes of
+// other users are limited to the same set.
+var scopeRights = map[string]string{
+	ScopeFull:     AllRights,
+	ScopeReadOnly: string([]rune{RightLookup, RightRead}),
+	ScopeDelivery: string([]rune{RightLookup, RightInsert, RightPost}),
+}
+
+var (
+	ErrAppPasswordExists      = errors.New("imap: app password with this name already exists")
+	ErrAppPasswordDoesntExist = errors.New("imap: app password doesn't exist")
+	ErrUnknownScope           = errors.New("imap: unknown app password scope")
+)
+
+// AppPassword describes the app password of the user. The password itself
+// is not stored and can't be recovered.
+type AppPassword struct {
+	Name    string
+	Scope   string
+	Created time.Time
+	// Zero if the password was never used.
+	LastUsed time.Time
+}
+
+// appPasswordHash returns the value stored in the database for the app
+// password.
+//
+// App passwords are generated randomly with enough entropy to make brute
+// force infeasible so a single unsalted SHA-256 is enough and allows to look
+// up the password without checking each one. Dashes and case are ignored to
+// make typing it easier.
+func appPasswordHash(password string) string {
+	password = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(password))
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAppPassword returns a random 120-bit password encoded as six
+// dash-separated groups of four characters.
+func generateAppPassword() (string, error) {
+	raw := make([]byte, 15)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	encoded := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+func (b *Backend) userId(username, when string) (uint64, error) {
+	uid, _, err := b.getUserMeta(nil, normalizeUsername(username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserDoesntExists
+		}
+		return 0, wrapErr(err, when)
+	}
+	return uid, nil
+}
+
+// CreateAppPassword generates a new app password for the user and returns
+// it. Name is used to tell passwords apart (e.g. the name of the device)
+// and should be unique for the user, ErrAppPasswordExists is returned
+// otherwise.
+//
+// App passwords are checked by Login only if Opts.Authenticate is set.
+func (b *Backend) CreateAppPassword(username, name, scope string) (string, error) {
+	if _, ok := scopeRights[scope]; !ok {
+		return "", ErrUnknownScope
+	}
+	uid, err := b.userId(username, "CreateAppPassword")
+	if err != nil {
+		return "", err
+	}
+
+	password, err := generateAppPassword()
+	if err != nil {
+		return "", wrapErr(err, "CreateAppPassword")
+	}
+	if _, err := b.addAppPassword.Exec(uid, name, appPasswordHash(password), scope, time.Now().Unix()); err != nil {
+		if isForeignKeyErr(err) {
+			return "", ErrAppPasswordExists
+		}
+		return "", wrapErr(err, "CreateAppPassword")
+	}
+	return password, nil
+}
+
+// ListAppPasswords returns app passwords of the user sorted by name.
+func (b *Backend) ListAppPasswords(username string) ([]AppPassword, error) {
+	uid, err := b.userId(username, "ListAppPasswords")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := b.listAppPasswords.Query(uid)
+	if err != nil {
+		return nil, wrapErr(err, "ListAppPasswords")
+	}
+	defer rows.Close()
+
+	var res []AppPassword
+	for rows.Next() {
+		var (
+			pass     AppPassword
+			created  int64
+			lastUsed sql.NullInt64
+		)
+		if err := rows.Scan(&pass.Name, &pass.Scope, &created, &lastUsed); err != nil {
+			return nil, wrapErr(err, "ListAppPasswords")
+		}
+		pass.Created = time.Unix(created, 0)
+		if lastUsed.Valid {
+			pass.LastUsed = time.Unix(lastUsed.Int64, 0)
+		}
+		res = append(res, pass)
+	}
+	return res, wrapErr(rows.Err(), "ListAppPasswords")
+}
+
+// RevokeAppPassword removes the app password of the user.
+// Already established sessions are not affected.
+func (b *Backend) RevokeAppPassword(username, name string) error {
+	uid, err := b.userId(username, "RevokeAppPassword")
+	if err != nil {
+		return err
+	}
+
+	stats, err := b.delAppPassword.Exec(uid, name)
+	if err != nil {
+		return wrapErr(err, "RevokeAppPassword")
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		return wrapErr(err, "RevokeAppPassword")
+	}
+	if affected == 0 {
+		return ErrAppPasswordDoesntExist
+	}
+	return nil
+}
+
+// checkAppPassword looks up the app password of the user and returns its
+// scope. It returns backend.ErrInvalidCredentials if there is no such
+// password.
+func (b *Backend) checkAppPassword(username, password string) (string, error) {
+	var (
+		id    uint64
+		scope string
+	)
+	if err := b.appPasswordByHash.QueryRow(username, appPasswordHash(password)).Scan(&id, &scope); err != nil {
+		if err == sql.ErrNoRows {
+			return "", backend.ErrInvalidCredentials
+		}
+		return "", err
+	}
+	if _, ok := scopeRights[scope]; !ok {
+		return "", errors.New("unknown app password scope: " + scope)
+	}
+
+	if _, err := b.touchAppPassword.Exec(time.Now().Unix(), id); err != nil {
+		b.Opts.Log.Printf("failed to update last use time of app password of %s: %v", username, err)
+	}
+	return scope, nil
+}
+
+// restrictRights returns rights limited by the scope of the app password
+// used to log in.
+func (u *User) restrictRights(rights string) string {
+	if u.scope == ScopeFull {
+		return rights
+	}
+	allowed := scopeRights[u.scope]
+	var res strings.Builder
+	for _, r := range rights {
+		if strings.ContainsRune(allowed, r) {
+			res.WriteRune(r)
+		}
+	}
+	return res.String()
+}
+
+// scopeAllows reports whether the scope of the app password used to log in
+// allows operations that require the right on own mailboxes.
+func (u *User) scopeAllows(r rune) bool {
+	return strings.ContainsRune(scopeRights[u.scope], r)
+}
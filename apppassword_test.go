@@ -0,0 +1,153 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"gotest.tools/assert"
+)
+
+func TestAppPasswords(t *testing.T) {
+	b := initTestBackendOpts(Opts{Authenticate: true}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user"))
+
+	_, err := b.CreateAppPassword("nobody", "phone", ScopeFull)
+	assert.Equal(t, err, ErrUserDoesntExists)
+	_, err = b.CreateAppPassword("user", "phone", "everything")
+	assert.Equal(t, err, ErrUnknownScope)
+
+	pass, err := b.CreateAppPassword("user", "phone", ScopeFull)
+	assert.NilError(t, err)
+	_, err = b.CreateAppPassword("USER", "phone", ScopeReadOnly)
+	assert.Equal(t, err, ErrAppPasswordExists)
+
+	// Main password is not required.
+	_, err = b.Login(nil, "user", "")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	u, err := b.Login(nil, "user", pass)
+	assert.NilError(t, err)
+	assert.Equal(t, u.(*User).scope, ScopeFull)
+	_, err = b.Login(nil, "user", strings.ToUpper(strings.Replace(pass, "-", "", -1)))
+	assert.NilError(t, err)
+
+	// Password of one user does not work for another one.
+	assert.NilError(t, b.CreateUser("other"))
+	_, err = b.Login(nil, "other", pass)
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	// Main password still works.
+	assert.NilError(t, b.SetUserPassword("user", "password"))
+	_, err = b.Login(nil, "user", "password")
+	assert.NilError(t, err)
+
+	list, err := b.ListAppPasswords("user")
+	assert.NilError(t, err)
+	assert.Equal(t, len(list), 1)
+	assert.Equal(t, list[0].Name, "phone")
+	assert.Equal(t, list[0].Scope, ScopeFull)
+	assert.Assert(t, !list[0].Created.IsZero())
+	assert.Assert(t, !list[0].LastUsed.IsZero())
+
+	assert.Equal(t, b.RevokeAppPassword("user", "laptop"), ErrAppPasswordDoesntExist)
+	assert.NilError(t, b.RevokeAppPassword("user", "phone"))
+	_, err = b.Login(nil, "user", pass)
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	list, err = b.ListAppPasswords("user")
+	assert.NilError(t, err)
+	assert.Equal(t, len(list), 0)
+
+	// App passwords are removed along with the user.
+	_, err = b.CreateAppPassword("user", "phone", ScopeFull)
+	assert.NilError(t, err)
+	assert.NilError(t, b.DeleteUser("user"))
+	var count int
+	assert.NilError(t, b.db.QueryRow(`SELECT COUNT(*) FROM appPasswords`).Scan(&count))
+	assert.Equal(t, count, 0)
+}
+
+func TestAppPasswordReadOnly(t *testing.T) {
+	b := initTestBackendOpts(Opts{Authenticate: true}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user"))
+	full, err := b.GetUser("user")
+	assert.NilError(t, err)
+	assert.NilError(t, full.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	pass, err := b.CreateAppPassword("user", "reader", ScopeReadOnly)
+	assert.NilError(t, err)
+	u, err := b.Login(nil, "user", pass)
+	assert.NilError(t, err)
+
+	rights, err := u.(*User).MyRights("INBOX")
+	assert.NilError(t, err)
+	assert.Equal(t, rights, "lr")
+	_, err = u.(*User).Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+
+	_, mboxI, err := u.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+	assert.Assert(t, mbox.readOnly)
+
+	// SELECT does not clear \Recent, unlike one using the main password.
+	recentCount := func() int {
+		var count int
+		assert.NilError(t, b.DB.QueryRow(`SELECT COUNT(*) FROM msgs WHERE recent = 1`).Scan(&count))
+		return count
+	}
+	assert.Equal(t, recentCount(), 1)
+	_, fullMbox, err := full.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	assert.NilError(t, fullMbox.Close())
+	assert.Equal(t, recentCount(), 0)
+
+	seq, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchUid}, ch))
+	assert.Equal(t, len(ch), 1)
+
+	assert.Equal(t, mbox.CreateMessage([]string{}, time.Now(), strings.NewReader(testMsg)), ErrPermissionDenied)
+	assert.Equal(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil), ErrPermissionDenied)
+	assert.Equal(t, mbox.UpdateMessagesFlags(false, seq, imap.AddFlags, true, []string{imap.SeenFlag}), ErrPermissionDenied)
+	assert.Equal(t, mbox.Expunge(), ErrPermissionDenied)
+	assert.Equal(t, mbox.MoveMessages(false, seq, "INBOX"), ErrPermissionDenied)
+	assert.Equal(t, mbox.CopyMessages(false, seq, "INBOX"), ErrPermissionDenied)
+	assert.Equal(t, mbox.SetMessageLimit(nil), ErrPermissionDenied)
+
+	assert.Equal(t, u.CreateMailbox("Box"), ErrPermissionDenied)
+	assert.Equal(t, u.RenameMailbox("INBOX", "Box"), ErrPermissionDenied)
+	assert.Equal(t, u.DeleteMailbox("Box"), ErrPermissionDenied)
+	assert.Equal(t, u.(*User).SetACL("INBOX", "other", "lr"), ErrPermissionDenied)
+	assert.Equal(t, u.(*User).SetQuota("", map[string]uint64{QuotaMessage: 1}), ErrPermissionDenied)
+
+	// Full access using the main password is not affected.
+	assert.NilError(t, full.CreateMailbox("Box"))
+}
+
+func TestAppPasswordDelivery(t *testing.T) {
+	b := initTestBackendOpts(Opts{Authenticate: true}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user"))
+
+	pass, err := b.CreateAppPassword("user", "scanner", ScopeDelivery)
+	assert.NilError(t, err)
+	u, err := b.Login(nil, "user", pass)
+	assert.NilError(t, err)
+
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	_, _, err = u.GetMailbox("INBOX", true, &noopConn{})
+	assert.Equal(t, err, ErrPermissionDenied)
+	_, err = u.(*User).Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.Equal(t, err, ErrPermissionDenied)
+	assert.Equal(t, u.CreateMailbox("Box"), ErrPermissionDenied)
+
+	list, err := u.ListMailboxes(false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(list), 1)
+}
@@ -0,0 +1,564 @@
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// MIME parts bigger than Opts.AttachmentThreshold are cut out of the message
+// body and stored as separate objects (parts) in the external store. Parts are
+// deduplicated the same way as bodies so the same attachment sent in
+// different messages is stored only once.
+//
+// The body object contains the message with part contents removed, extParts
+// table lists offsets in the body object where contents of parts should be
+// inserted to get the original message. Parts reference counters count bodies
+// that use them.
+
+// bodyPart is the MIME part content stored as a separate object.
+type bodyPart struct {
+	pos  int64
+	key  string
+	hash string
+}
+
+// storedBody describes the message body written to the external store.
+type storedBody struct {
+	key     string
+	hash    string
+	parts   []bodyPart
+	dataKey *dataKey
+
+	// Hash of the message itself, stored in msgs.bodyHash.
+	contentHash string
+}
+
+// keys returns keys of all objects written for the body.
+func (sb storedBody) keys() []string {
+	keys := make([]string, 0, len(sb.parts)+1)
+	keys = append(keys, sb.key)
+	for _, part := range sb.parts {
+		keys = append(keys, part.key)
+	}
+	return keys
+}
+
+const (
+	splitHeader = iota
+	splitText
+	splitLeaf
+	splitPassthrough
+)
+
+const (
+	// Longer lines can't be boundary delimiters and are processed in pieces.
+	maxSplitLine = 1024
+	// Entities with bigger header and more deeply nested multiparts are never
+	// split.
+	maxSplitHeader = 64 * 1024
+	maxSplitDepth  = 32
+)
+
+// partSplitter writes the message to the body object, moving contents of big
+// non-multipart entities to separate objects.
+//
+// The message is processed line by line. Lines of non-multipart entities are
+// buffered until there are more than threshold bytes, after that they are
+// written to the part object.
+type partSplitter struct {
+	b         *Backend
+	tx        *sql.Tx
+	dk        *dataKey
+	w         io.Writer
+	threshold int64
+
+	// Amount of bytes written to w.
+	pos int64
+
+	line     []byte
+	longLine bool
+
+	state      int
+	header     []byte
+	boundaries []string
+
+	pending []byte
+	part    *partWriter
+	parts   []bodyPart
+}
+
+func (b *Backend) newPartSplitter(tx *sql.Tx, dk *dataKey, w io.Writer) *partSplitter {
+	s := &partSplitter{
+		b:         b,
+		tx:        tx,
+		dk:        dk,
+		w:         w,
+		threshold: b.Opts.AttachmentThreshold,
+	}
+	if s.threshold <= 0 {
+		s.state = splitPassthrough
+	}
+	return s
+}
+
+func (s *partSplitter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.state == splitPassthrough && len(s.line) == 0 {
+		return n, s.writeMain(p)
+	}
+
+	for len(p) != 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			s.line = append(s.line, p...)
+			if len(s.line) > maxSplitLine {
+				s.longLine = true
+				if err := s.processLine(s.line); err != nil {
+					return 0, err
+				}
+				s.line = s.line[:0]
+			}
+			break
+		}
+
+		s.line = append(s.line, p[:i+1]...)
+		p = p[i+1:]
+		if err := s.processLine(s.line); err != nil {
+			return 0, err
+		}
+		s.line = s.line[:0]
+		s.longLine = false
+	}
+	return n, nil
+}
+
+// Close processes the remaining data and finishes the last part. It does not
+// close the underlying writer.
+func (s *partSplitter) Close() error {
+	if len(s.line) != 0 {
+		if err := s.processLine(s.line); err != nil {
+			return err
+		}
+		s.line = s.line[:0]
+	}
+	return s.finishLeaf()
+}
+
+// abort discards all written parts.
+func (s *partSplitter) abort() {
+	keys := make([]string, 0, len(s.parts)+1)
+	if s.part != nil {
+		s.part.discard()
+		keys = append(keys, s.part.key)
+		s.part = nil
+	}
+	for _, part := range s.parts {
+		keys = append(keys, part.key)
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if err := s.b.deleteExtObjs(s.tx, keys); err != nil {
+		s.b.Opts.Log.Printf("failed to remove parts %v: %v", keys, err)
+	}
+}
+
+// body returns the description of the stored body. Passed hash of the body
+// object is updated to cover the parts too, contentHash is the hash of the
+// message written to the splitter.
+func (s *partSplitter) body(key string, bodyHash, contentHash hash.Hash) storedBody {
+	for _, part := range s.parts {
+		fmt.Fprintf(bodyHash, "\x00%d %s", part.pos, part.hash)
+	}
+	return storedBody{
+		key:         key,
+		hash:        hex.EncodeToString(bodyHash.Sum(nil)),
+		parts:       s.parts,
+		dataKey:     s.dk,
+		contentHash: hex.EncodeToString(contentHash.Sum(nil)),
+	}
+}
+
+func (s *partSplitter) processLine(line []byte) error {
+	switch s.state {
+	case splitPassthrough:
+		return s.writeMain(line)
+	case splitHeader:
+		if err := s.writeMain(line); err != nil {
+			return err
+		}
+		s.header = append(s.header, line...)
+		if len(s.header) > maxSplitHeader {
+			s.state = splitPassthrough
+			s.header = nil
+			return nil
+		}
+		if !s.longLine && isBlankLine(line) {
+			s.state = s.entityState()
+			s.header = s.header[:0]
+		}
+		return nil
+	}
+
+	if !s.longLine {
+		if i, closing := s.matchDelimiter(line); i != -1 {
+			if err := s.finishLeaf(); err != nil {
+				return err
+			}
+			if err := s.writeMain(line); err != nil {
+				return err
+			}
+			if closing {
+				// The rest is the epilogue of the multipart entity.
+				s.boundaries = s.boundaries[:i]
+				s.state = splitText
+			} else {
+				s.boundaries = s.boundaries[:i+1]
+				s.state = splitHeader
+			}
+			return nil
+		}
+	}
+
+	if s.state == splitText {
+		return s.writeMain(line)
+	}
+	return s.writeLeaf(line)
+}
+
+// entityState returns the state used for the body of the entity with the
+// buffered header.
+func (s *partSplitter) entityState() int {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(s.header)))
+	if err != nil {
+		return splitPassthrough
+	}
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return splitLeaf
+	}
+	if len(s.boundaries) >= maxSplitDepth {
+		return splitPassthrough
+	}
+	s.boundaries = append(s.boundaries, params["boundary"])
+	return splitText
+}
+
+// matchDelimiter checks whether the line is the boundary delimiter of any
+// enclosing multipart entity. It returns the index of the matched boundary or
+// -1.
+func (s *partSplitter) matchDelimiter(line []byte) (int, bool) {
+	if !bytes.HasPrefix(line, []byte("--")) {
+		return -1, false
+	}
+	for i := len(s.boundaries) - 1; i >= 0; i-- {
+		rest := line[2:]
+		if !bytes.HasPrefix(rest, []byte(s.boundaries[i])) {
+			continue
+		}
+		rest = rest[len(s.boundaries[i]):]
+		closing := bytes.HasPrefix(rest, []byte("--"))
+		if closing {
+			rest = rest[2:]
+		}
+		if len(bytes.TrimRight(rest, " \t\r\n")) == 0 {
+			return i, closing
+		}
+	}
+	return -1, false
+}
+
+func (s *partSplitter) writeMain(p []byte) error {
+	n, err := s.w.Write(p)
+	s.pos += int64(n)
+	return err
+}
+
+func (s *partSplitter) writeLeaf(line []byte) error {
+	if s.part != nil {
+		return s.part.write(line)
+	}
+
+	s.pending = append(s.pending, line...)
+	if int64(len(s.pending)) <= s.threshold {
+		return nil
+	}
+
+	part, err := s.b.createPart(s.tx, s.dk)
+	if err != nil {
+		return err
+	}
+	s.part = part
+	if err := part.write(s.pending); err != nil {
+		return err
+	}
+	s.pending = s.pending[:0]
+	return nil
+}
+
+// finishLeaf is called at the end of the non-multipart entity.
+func (s *partSplitter) finishLeaf() error {
+	if s.part == nil {
+		if len(s.pending) == 0 {
+			return nil
+		}
+		err := s.writeMain(s.pending)
+		s.pending = s.pending[:0]
+		return err
+	}
+
+	part := s.part
+	partHash, err := part.finish()
+	if err != nil {
+		return err
+	}
+	s.part = nil
+	s.parts = append(s.parts, bodyPart{pos: s.pos, key: part.key, hash: partHash})
+	return nil
+}
+
+func isBlankLine(line []byte) bool {
+	return len(line) == 1 || (len(line) == 2 && line[0] == '\r')
+}
+
+// partWriter writes the part object.
+type partWriter struct {
+	key       string
+	obj       ExtStoreObj
+	encW      io.WriteCloser
+	compressW io.WriteCloser
+	hash      hash.Hash
+}
+
+func (b *Backend) createPart(tx *sql.Tx, dk *dataKey) (*partWriter, error) {
+	key, err := randomKey()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := b.createExtObj(tx, key, -1)
+	if err != nil {
+		return nil, err
+	}
+	part := &partWriter{key: key, obj: obj, hash: newBodyHash(dk)}
+	part.encW, err = wrapEncrypt(obj, dk, key)
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	part.compressW, err = b.compressAlgo.WrapCompress(io.MultiWriter(part.encW, part.hash), b.Opts.CompressAlgoParams)
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return part, nil
+}
+
+func (p *partWriter) write(b []byte) error {
+	_, err := p.compressW.Write(b)
+	return err
+}
+
+// finish completes the object and returns its hash.
+func (p *partWriter) finish() (string, error) {
+	if err := p.compressW.Close(); err != nil {
+		p.obj.Close()
+		return "", err
+	}
+	if err := p.encW.Close(); err != nil {
+		p.obj.Close()
+		return "", err
+	}
+	if err := p.obj.Sync(); err != nil {
+		p.obj.Close()
+		return "", err
+	}
+	if err := p.obj.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(p.hash.Sum(nil)), nil
+}
+
+// discard closes the object without completing it.
+func (p *partWriter) discard() {
+	p.compressW.Close()
+	p.obj.Close()
+}
+
+// addBody adds keys of the stored message body and its parts to extKeys.
+//
+// It returns the key that should be used by the message and keys of objects
+// that are not shared with other messages. These should be deleted if the
+// message is not added.
+func (b *Backend) addBody(tx *sql.Tx, uid uint64, body storedBody) (key string, newKeys []string, err error) {
+	key, dup, err := b.addBodyKey(tx, uid, body.key, body.hash, body.dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if dup {
+		// Body hash covers parts so the existing body already uses
+		// identical parts.
+		if len(body.parts) != 0 {
+			keys := body.keys()[1:]
+			if err := b.deleteExtObjs(tx, keys); err != nil {
+				b.Opts.Log.Printf("failed to remove duplicate parts %v: %v", keys, err)
+			}
+		}
+		return key, nil, nil
+	}
+
+	newKeys = []string{key}
+	for _, part := range body.parts {
+		partKey, dup, err := b.addBodyKey(tx, uid, part.key, part.hash, body.dataKey)
+		if err != nil {
+			return "", nil, err
+		}
+		if !dup {
+			newKeys = append(newKeys, partKey)
+		}
+		if _, err := tx.Stmt(b.addBodyPart).Exec(key, part.pos, partKey, b.Opts.CompressAlgo); err != nil {
+			return "", nil, err
+		}
+	}
+	return key, newKeys, nil
+}
+
+// releaseParts removes the part list of the deleted body and returns keys of
+// parts that are no longer used.
+func (b *Backend) releaseParts(tx *sql.Tx, bodyKey string) ([]string, error) {
+	if _, err := tx.Stmt(b.decreaseRefForParts).Exec(bodyKey, bodyKey); err != nil {
+		return nil, err
+	}
+	keys, err := scanKeys(tx.Stmt(b.zeroRefParts).Query(bodyKey))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Stmt(b.delBodyParts).Exec(bodyKey); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if _, err := tx.Stmt(b.deleteZeroRef).Exec(key); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+type storedPart struct {
+	pos          int64
+	key          string
+	compressAlgo string
+	dataKey      string
+}
+
+// getParts returns the ID of the data key used for the body and its part
+// list. The ID is empty if the body is not encrypted.
+func (b *Backend) getParts(tx *sql.Tx, bodyKey string) (string, []storedPart, error) {
+	stmt := b.bodyParts
+	if tx != nil {
+		stmt = tx.Stmt(stmt)
+	}
+	rows, err := stmt.Query(bodyKey)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	var (
+		dataKey sql.NullString
+		parts   []storedPart
+	)
+	for rows.Next() {
+		var (
+			pos                            sql.NullInt64
+			key, compressAlgo, partDataKey sql.NullString
+		)
+		if err := rows.Scan(&dataKey, &pos, &key, &compressAlgo, &partDataKey); err != nil {
+			return "", nil, err
+		}
+		if !key.Valid {
+			continue
+		}
+		parts = append(parts, storedPart{
+			pos:          pos.Int64,
+			key:          key.String,
+			compressAlgo: compressAlgo.String,
+			dataKey:      partDataKey.String,
+		})
+	}
+	return dataKey.String, parts, rows.Err()
+}
+
+// partsReader reads the body object inserting contents of parts.
+type partsReader struct {
+	b  *Backend
+	tx *sql.Tx
+
+	body   io.Reader
+	closer io.Closer
+	pos    int64
+	parts  []storedPart
+
+	part       io.Reader
+	partCloser io.Closer
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.part != nil {
+			n, err := r.part.Read(p)
+			if err == io.EOF {
+				r.partCloser.Close()
+				r.part, r.partCloser = nil, nil
+				if n == 0 {
+					continue
+				}
+				err = nil
+			}
+			return n, err
+		}
+
+		if len(r.parts) != 0 && r.parts[0].pos == r.pos {
+			part := r.parts[0]
+			rdr, closer, err := r.b.openDecompressed(r.tx, part.compressAlgo, part.dataKey, part.key)
+			if err != nil {
+				return 0, err
+			}
+			r.part, r.partCloser = rdr, closer
+			r.parts = r.parts[1:]
+			continue
+		}
+
+		buf := p
+		if len(r.parts) != 0 && int64(len(buf)) > r.parts[0].pos-r.pos {
+			buf = buf[:r.parts[0].pos-r.pos]
+		}
+		n, err := r.body.Read(buf)
+		r.pos += int64(n)
+		if err == io.EOF && len(r.parts) != 0 {
+			if r.parts[0].pos != r.pos {
+				return n, io.ErrUnexpectedEOF
+			}
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.partCloser != nil {
+		r.partCloser.Close()
+	}
+	return r.closer.Close()
+}
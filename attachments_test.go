@@ -0,0 +1,270 @@
+package imapsql
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	backendtests "github.com/foxcpp/go-imap-backend-tests"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// attachmentMsg builds the multipart message with the base64-encoded
+// attachment.
+func attachmentMsg(subject, text string, attachment []byte, delim string) string {
+	encoded := base64.StdEncoding.EncodeToString(attachment)
+	lines := make([]string, 0, len(encoded)/76+1)
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	lines = append(lines, encoded)
+
+	msg := []string{
+		"From: <foxcpp@foxcpp.dev>",
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="outer"`,
+		"",
+		"This is a multi-part message in MIME format.",
+		"--outer",
+		`Content-Type: multipart/alternative; boundary=inner`,
+		"",
+		"--inner",
+		"Content-Type: text/plain",
+		"",
+		text,
+		"--inner--",
+		"",
+		"--outer",
+		"Content-Type: application/octet-stream",
+		"Content-Transfer-Encoding: base64",
+		`Content-Disposition: attachment; filename="report.bin"`,
+		"",
+		strings.Join(lines, delim),
+		"--outer--",
+		"Epilogue.",
+		"",
+	}
+	return strings.Join(msg, delim)
+}
+
+func testAttachment(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func fetchRaw(t *testing.T, mbox *Mailbox, uid uint32, items ...imap.FetchItem) *imap.Message {
+	t.Helper()
+	seq := imap.SeqSet{}
+	seq.AddNum(uid)
+	ch := make(chan *imap.Message, 1)
+	assert.NilError(t, mbox.ListMessages(true, &seq, items, ch))
+	assert.Assert(t, is.Len(ch, 1))
+	return <-ch
+}
+
+func sectionBytes(t *testing.T, msg *imap.Message, item imap.FetchItem) []byte {
+	t.Helper()
+	for sect, lit := range msg.Body {
+		if sect.FetchItem() != item {
+			continue
+		}
+		data, err := ioutil.ReadAll(lit)
+		assert.NilError(t, err)
+		return data
+	}
+	t.Fatal("missing", item)
+	return nil
+}
+
+func TestAttachmentSplit(t *testing.T) {
+	b := initTestBackendOpts(Opts{AttachmentThreshold: 1024}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	attachment := testAttachment(16 * 1024)
+	msg1 := attachmentMsg("First", "Hello!", attachment, "\r\n")
+	msg2 := attachmentMsg("Second", "Hello again!", attachment, "\r\n")
+
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg1), mbox))
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(msg2), mbox))
+	// Two bodies and the shared attachment.
+	assert.Assert(t, checkKeysCount(b, 3), "Attachment is not deduplicated")
+
+	// Reference message stored without splitting.
+	b.Opts.AttachmentThreshold = 0
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg1), mbox))
+	b.Opts.AttachmentThreshold = 1024
+	assert.NilError(t, mbox.Poll(true))
+
+	items := []imap.FetchItem{imap.FetchBodyStructure, imap.FetchRFC822Size, "BODY.PEEK[]", "BODY.PEEK[2]", "BODY.PEEK[]<1000.200>", "BODY.PEEK[TEXT]"}
+	split := fetchRaw(t, mbox, 1, items...)
+	ref := fetchRaw(t, mbox, 3, items...)
+
+	assert.Equal(t, string(sectionBytes(t, split, "BODY.PEEK[]")), msg1)
+	assert.Equal(t, split.Size, uint32(len(msg1)))
+	assert.DeepEqual(t, split.BodyStructure, ref.BodyStructure)
+	for _, sect := range []imap.FetchItem{"BODY.PEEK[2]", "BODY.PEEK[]<1000.200>", "BODY.PEEK[TEXT]"} {
+		assert.DeepEqual(t, sectionBytes(t, split, sect), sectionBytes(t, ref, sect))
+	}
+	assert.Equal(t, string(sectionBytes(t, fetchRaw(t, mbox, 2, "BODY.PEEK[]"), "BODY.PEEK[]")), msg2)
+
+	// One message using the attachment is removed, it should be kept.
+	assert.NilError(t, mbox.Expunge())
+	assert.Assert(t, checkKeysCount(b, 3), "Shared attachment is removed")
+	assert.Equal(t, string(sectionBytes(t, fetchRaw(t, mbox, 1, "BODY.PEEK[]"), "BODY.PEEK[]")), msg1)
+
+	// No messages use the attachment anymore.
+	assert.NilError(t, b.DeleteUser(t.Name()))
+	assert.Assert(t, checkKeysCount(b, 0), "Attachment is not removed")
+}
+
+func TestAttachmentSplitMessages(t *testing.T) {
+	b := initTestBackendOpts(Opts{AttachmentThreshold: 512}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	longLine := strings.Repeat("0123456789", 300)
+	cases := map[string]string{
+		"LF line endings":  attachmentMsg("LF", "Hello!", testAttachment(4096), "\n"),
+		"single part":      "Subject: Big\r\nContent-Type: text/plain\r\n\r\n" + strings.Repeat("Hello, world!\r\n", 200),
+		"long lines":       "Subject: Long\r\nContent-Type: text/plain\r\n\r\n" + longLine + "\r\n" + longLine,
+		"no final newline": attachmentMsg("EOF", "Hello!", testAttachment(4096), "\r\n") + "--outer",
+	}
+
+	// Messages are compared with copies stored without splitting.
+	uid := uint32(0)
+	for name, msg := range cases {
+		msg := msg
+		uid += 2
+		t.Run(name, func(t *testing.T) {
+			assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), mbox))
+			b.Opts.AttachmentThreshold = 0
+			assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), mbox))
+			b.Opts.AttachmentThreshold = 512
+			assert.NilError(t, mbox.Poll(true))
+
+			items := []imap.FetchItem{imap.FetchBodyStructure, imap.FetchRFC822Size, "BODY.PEEK[]"}
+			split := fetchRaw(t, mbox, uid-1, items...)
+			ref := fetchRaw(t, mbox, uid, items...)
+			assert.Equal(t, string(sectionBytes(t, split, "BODY.PEEK[]")), string(sectionBytes(t, ref, "BODY.PEEK[]")))
+			assert.Equal(t, split.Size, uint32(len(msg)))
+			assert.DeepEqual(t, split.BodyStructure, ref.BodyStructure)
+		})
+	}
+
+	var parts int
+	assert.NilError(t, b.DB.QueryRow(`SELECT COUNT(*) FROM extParts`).Scan(&parts))
+	assert.Assert(t, parts >= len(cases), "Messages are not split")
+}
+
+func TestAttachmentSplitDelivery(t *testing.T) {
+	b := initTestBackendOpts(Opts{AttachmentThreshold: 1024, CompressAlgo: "lz4"}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()+"-1"))
+	assert.NilError(t, b.CreateUser(t.Name()+"-2"))
+
+	msg := attachmentMsg("Delivery", "Hello!", testAttachment(16*1024), "\r\n")
+
+	delivery := b.NewDelivery()
+	hdr := textproto.Header{}
+	hdr.Add("Delivered-To", "1@example.org")
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-1", hdr))
+	hdr = textproto.Header{}
+	hdr.Add("Delivered-To", "2@example.org")
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-2", hdr))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(msg)))
+	assert.NilError(t, delivery.Commit())
+
+	// Bodies are different due to per-recipient header but the attachment is
+	// shared.
+	assert.Assert(t, checkKeysCount(b, 3), "Attachment is not deduplicated")
+
+	usr, err := b.GetUser(t.Name() + "-2")
+	assert.NilError(t, err)
+	_, mbox, err := usr.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+
+	body := sectionBytes(t, fetchRaw(t, mbox.(*Mailbox), 1, "BODY.PEEK[]"), "BODY.PEEK[]")
+	assert.Equal(t, string(body), "Delivered-To: 2@example.org\r\n"+msg)
+
+	// Text inside split parts is searchable.
+	res, err := mbox.SearchMessages(true, &imap.SearchCriteria{Body: []string{"Epilogue"}})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []uint32{1})
+
+	assert.NilError(t, b.DeleteUser(t.Name()+"-1"))
+	assert.Assert(t, checkKeysCount(b, 2), "Shared attachment is removed")
+	assert.NilError(t, b.DeleteUser(t.Name()+"-2"))
+	assert.Assert(t, checkKeysCount(b, 0), "Attachment is not removed")
+}
+
+func TestPartSplitterWrites(t *testing.T) {
+	b := initTestBackendOpts(Opts{AttachmentThreshold: 100}).(*Backend)
+	defer cleanBackend(b)
+
+	msg := attachmentMsg("Writes", "Hello!", testAttachment(2048), "\r\n")
+
+	// Result should not depend on how the message is split into writes.
+	var first storedBody
+	for _, chunk := range []int{1, 7, 1000, len(msg)} {
+		main := bytes.Buffer{}
+		s := b.newPartSplitter(nil, nil, &main)
+		for data := []byte(msg); len(data) != 0; {
+			n := chunk
+			if n > len(data) {
+				n = len(data)
+			}
+			_, err := s.Write(data[:n])
+			assert.NilError(t, err)
+			data = data[n:]
+		}
+		assert.NilError(t, s.Close())
+		body := s.body("", sha256.New(), sha256.New())
+		assert.Equal(t, len(body.parts), 1)
+		assert.Assert(t, main.Len() < len(msg)-2048)
+
+		if first.hash == "" {
+			first = body
+			continue
+		}
+		assert.Equal(t, body.hash, first.hash)
+		assert.Equal(t, body.parts[0].pos, first.parts[0].pos)
+		assert.Equal(t, body.parts[0].hash, first.parts[0].hash)
+	}
+}
+
+func TestWithAttachmentSplit(t *testing.T) {
+	backendtests.RunTests(t, func() backendtests.Backend {
+		// Small threshold makes sure parts of most messages are split.
+		return initTestBackendOpts(Opts{AttachmentThreshold: 16})
+	}, cleanBackend)
+}
+
+func TestWithAttachmentSplitSQLBlobStore(t *testing.T) {
+	runTestsSQLStore(t, Opts{AttachmentThreshold: 16}, 64)
+}
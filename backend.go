@@ -21,7 +21,7 @@ import (
 const VersionStr = "0.4.0"
 
 // SchemaVersion is incremented each time DB schema changes.
-const SchemaVersion = 6
+const SchemaVersion = 22
 
 var (
 	ErrUserAlreadyExists = errors.New("imap: user already exists")
@@ -102,6 +102,99 @@ type Opts struct {
 	// performance significantly.
 	DisableRecent bool
 
+	// Maintain full-text index of messages and use it for BODY, TEXT and
+	// HEADER search criteria instead of reading all messages in the mailbox.
+	//
+	// Supported for SQLite3 (requires FTS5, build with sqlite_fts5 tag)
+	// and PostgreSQL. Search falls back to reading messages if index is not
+	// supported.
+	//
+	// Index is not updated while this option is disabled, use
+	// Backend.Reindex after enabling it for the existing database.
+	FullTextIndex bool
+
+	// Store contents of MIME parts bigger than this amount of bytes as
+	// separate objects in the external store. Identical parts (e.g. the same
+	// attachment in different messages) are stored only once. Zero value
+	// disables splitting.
+	//
+	// Messages are reassembled when they are read so the option does not
+	// change anything for clients.
+	AttachmentThreshold int64
+
+	// Encrypt new message bodies using AES-256-GCM. Each user gets a random
+	// data key that is stored in the database encrypted using the first
+	// master key. Remaining keys are used only to decrypt data keys, e.g.
+	// during rotation (see Backend.RotateMasterKey).
+	//
+	// Keys should be 32 bytes long, ReadMasterKeys can be used to load them
+	// from a file. Encryption is disabled if no keys are set, existing
+	// encrypted messages can't be read then.
+	//
+	// Encrypted messages are not added to the header index and the
+	// full-text index unless IndexEncrypted is set, search reads messages
+	// instead of using these indexes while keys are set.
+	MasterKeys [][]byte
+
+	// Also encrypt cached header and body structure of new messages stored
+	// in the database. Has no effect if MasterKeys is not set. Message-Id
+	// values used for threading are still stored in plaintext.
+	EncryptMetadata bool
+
+	// Add messages encrypted using MasterKeys to the header index and the
+	// full-text index. Both store message contents in plaintext, so this
+	// makes search faster at the cost of leaving these contents
+	// unencrypted. Messages added while it was not set are indexed only by
+	// Backend.Reindex (full-text index only).
+	IndexEncrypted bool
+
+	// Check length and hash of message bodies when they are read completely
+	// during FETCH. Corrupted bodies are logged and the message is skipped,
+	// CorruptedBodyError is returned by the body reader. Messages added
+	// before schema version 14 are checked only for length.
+	//
+	// Backend.VerifyBodies checks bodies regardless of this option.
+	VerifyBodies bool
+
+	// Interval between runs of the background worker that removes objects of
+	// deleted messages from the external store if that failed right after
+	// the deletion (e.g. due to a crash). Zero means 1 minute, negative value
+	// disables the worker.
+	GCInterval time.Duration
+
+	// Objects in the external store not used by any message are removed by
+	// the background worker once they were not modified for that amount of
+	// time. Zero means 24 hours, negative value disables removal. Such
+	// objects are found only for FSStore and SQLBlobStore.
+	OrphanGracePeriod time.Duration
+
+	// UIDs of expunged messages are remembered for QRESYNC for that amount
+	// of time and then removed by the background worker. Zero means 30 days,
+	// negative value disables removal. Clients resynchronizing from an older
+	// state get all UIDs they know that no longer exist instead.
+	ExpungedRetention time.Duration
+
+	// Check passwords set using Backend.SetUserPassword in Login. Users
+	// without a password can't log in. If not set, the password is ignored
+	// and authentication is supposed to be implemented by the wrapper.
+	Authenticate bool
+
+	// Don't create accounts for unknown users in Login, return
+	// backend.ErrInvalidCredentials instead. Accounts are never created if
+	// Authenticate is set.
+	NoAutoCreate bool
+
+	// Password hashing algorithm used for new passwords. Empty string means
+	// bcrypt. Passwords hashed using other algorithms (or parameters) are
+	// rehashed on successful login.
+	//
+	// Algorithms should be registered before using RegisterPassHashAlgo.
+	PassHashAlgo string
+
+	// PassHashParams is passed directly to the password hashing algorithm
+	// without changes, e.g. bcrypt cost or "m=65536,t=1,p=4" for argon2id.
+	PassHashParams string
+
 	Log Logger
 }
 
@@ -122,6 +215,8 @@ type Backend struct {
 	// - ExclusiveLock
 	// - CacheSize
 	// - NoWAL
+	// - FullTextIndex
+	// - GCInterval (only whether the worker is disabled)
 	Opts Opts
 
 	// database/sql.DB object created by New.
@@ -135,6 +230,9 @@ type Backend struct {
 	listUsers          *sql.Stmt
 	addUser            *sql.Stmt
 	delUser            *sql.Stmt
+	userState          *sql.Stmt
+	setUserState       *sql.Stmt
+	renameUser         *sql.Stmt
 	listMboxes         *sql.Stmt
 	listSubbedMboxes   *sql.Stmt
 	createMboxExistsOk *sql.Stmt
@@ -159,6 +257,8 @@ type Backend struct {
 	addMsg             *sql.Stmt
 	copyMsgsUid        *sql.Stmt
 	copyMsgFlagsUid    *sql.Stmt
+	addMsgHeader       *sql.Stmt
+	copyMsgHeadersUid  *sql.Stmt
 	massClearFlagsUid  *sql.Stmt
 	msgFlagsUid        *sql.Stmt
 	usedFlags          *sql.Stmt
@@ -207,18 +307,79 @@ type Backend struct {
 	remFlagsStmtsLck      sync.RWMutex
 	remFlagsStmtsCache    map[string]*sql.Stmt
 
+	// Hash checked for users without a password, see checkDummyPassword.
+	dummyHashLck    sync.Mutex
+	dummyHashParams string
+	dummyHash       string
+
 	// extkeys table
 	addExtKey             *sql.Stmt
+	extKeyByHash          *sql.Stmt
+	incrementRef          *sql.Stmt
 	decreaseRefForMarked  *sql.Stmt
 	decreaseRefForDeleted *sql.Stmt
 	incrementRefUid       *sql.Stmt
 	zeroRef               *sql.Stmt
+	zeroRefMbox           *sql.Stmt
 	zeroRefUser           *sql.Stmt
-	refUser               *sql.Stmt
 	deleteZeroRef         *sql.Stmt
-	deleteUserRef         *sql.Stmt
+	decreaseRefForUser    *sql.Stmt
 	decreaseRefForMbox    *sql.Stmt
 
+	// Used by VerifyBodies.
+	userBodies *sql.Stmt
+
+	// Used by password authentication.
+	userPassword       *sql.Stmt
+	setUserPassword    *sql.Stmt
+	rehashUserPassword *sql.Stmt
+
+	// domains table
+	addDomain         *sql.Stmt
+	delDomain         *sql.Stmt
+	listDomains       *sql.Stmt
+	domainSettings    *sql.Stmt
+	setDomainSettings *sql.Stmt
+	domainDisabled    *sql.Stmt
+	domainMboxes      *sql.Stmt
+	listDomainUsers   *sql.Stmt
+
+	// aliases table
+	aliasTarget       *sql.Stmt
+	addAlias          *sql.Stmt
+	delAlias          *sql.Stmt
+	listAliases       *sql.Stmt
+	delAliasesTo      *sql.Stmt
+	renameAliasTarget *sql.Stmt
+
+	// appPasswords table
+	addAppPassword    *sql.Stmt
+	listAppPasswords  *sql.Stmt
+	delAppPassword    *sql.Stmt
+	appPasswordByHash *sql.Stmt
+	touchAppPassword  *sql.Stmt
+
+	// extDeletes table
+	queueExtDelete   *sql.Stmt
+	queuedExtDelete  *sql.Stmt
+	dequeueExtDelete *sql.Stmt
+
+	// dataKeys table
+	dataKeysLck   sync.RWMutex
+	dataKeysCache map[string][]byte
+	addDataKey    *sql.Stmt
+	dataKeyById   *sql.Stmt
+	userDataKeyId *sql.Stmt
+	oldDataKeys   *sql.Stmt
+	rewrapDataKey *sql.Stmt
+
+	// extParts table
+	addBodyPart         *sql.Stmt
+	bodyParts           *sql.Stmt
+	decreaseRefForParts *sql.Stmt
+	zeroRefParts        *sql.Stmt
+	delBodyParts        *sql.Stmt
+
 	// Used by Delivery.SpecialMailbox.
 	specialUseMbox *sql.Stmt
 
@@ -230,7 +391,63 @@ type Backend struct {
 
 	cachedHeaderUid *sql.Stmt
 
+	// For CONDSTORE and QRESYNC extensions.
+	bumpModSeq         *sql.Stmt
+	highestModSeq      *sql.Stmt
+	setModSeqUid       *sql.Stmt
+	msgModSeqUid       *sql.Stmt
+	addExpungedDeleted *sql.Stmt
+	addExpungedMarked  *sql.Stmt
+	vanishedUids       *sql.Stmt
+	prunedModSeq       *sql.Stmt
+	setPrunedModSeq    *sql.Stmt
+	delPrunedExpunged  *sql.Stmt
+
+	// For OBJECTID extension.
+	mboxObjectId    *sql.Stmt
+	threadIdByMsgId *sql.Stmt
+	addMsgThread    *sql.Stmt
+
+	// For UIDPLUS extension.
+	msgIdsUid      *sql.Stmt
+	markDeletedUid *sql.Stmt
+
+	// For QUOTA extension.
+	addMboxSize  *sql.Stmt
+	addUserUsage *sql.Stmt
+	delMboxUsage *sql.Stmt
+	mboxQuota    *sql.Stmt
+	userQuota    *sql.Stmt
+	setMboxQuota *sql.Stmt
+	setUserQuota *sql.Stmt
+	markedSize   *sql.Stmt
+	deletedSize  *sql.Stmt
+	msgsSizeUid  *sql.Stmt
+
+	// For ACL extension.
+	aclRights           *sql.Stmt
+	aclEntry            *sql.Stmt
+	aclList             *sql.Stmt
+	aclAdd              *sql.Stmt
+	aclDel              *sql.Stmt
+	aclDelIdentifier    *sql.Stmt
+	aclRenameIdentifier *sql.Stmt
+	sharedMboxes        *sql.Stmt
+
+	// For full-text index, prepared only if fts is true.
+	fts             bool
+	ftsAddKey       *sql.Stmt
+	ftsAdd          *sql.Stmt
+	ftsDelKey       *sql.Stmt
+	ftsDelKeyRow    *sql.Stmt
+	ftsClear        *sql.Stmt
+	ftsClearKeys    *sql.Stmt
+	ftsSearchHeader *sql.Stmt
+	ftsSearchBody   *sql.Stmt
+	ftsSearchText   *sql.Stmt
+
 	sqliteOptimizeLoopStop chan struct{}
+	gcLoopStop             chan struct{}
 }
 
 var defaultPassHashAlgo = "bcrypt"
@@ -248,6 +465,7 @@ func New(driver, dsn string, extStore ExternalStore, opts Opts) (*Backend, error
 		flagsSearchStmtsCache: make(map[string]*sql.Stmt),
 		addFlagsStmtsCache:    make(map[string]*sql.Stmt),
 		remFlagsStmtsCache:    make(map[string]*sql.Stmt),
+		dataKeysCache:         make(map[string][]byte),
 
 		sqliteOptimizeLoopStop: make(chan struct{}),
 
@@ -271,6 +489,15 @@ func New(driver, dsn string, extStore ExternalStore, opts Opts) (*Backend, error
 
 	b.Opts = opts
 
+	for _, key := range b.Opts.MasterKeys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("New: master key should be 32 bytes long, got %d", len(key))
+		}
+	}
+	if _, ok := passHashAlgos[b.passHashAlgo()]; !ok {
+		return nil, fmt.Errorf("New: unknown password hash algorithm: %s", b.passHashAlgo())
+	}
+
 	if b.Opts.Log == nil {
 		b.Opts.Log = globalLogger{}
 	}
@@ -322,12 +549,31 @@ func New(driver, dsn string, extStore ExternalStore, opts Opts) (*Backend, error
 	if err := b.prepareStmts(); err != nil {
 		return nil, wrapErr(err, "NewBackend (prepareStmts)")
 	}
+	if err := b.initSharedUser(); err != nil {
+		return nil, wrapErr(err, "NewBackend (initSharedUser)")
+	}
+	if store, ok := b.extStore.(*SQLBlobStore); ok {
+		if err := store.init(b.db); err != nil {
+			return nil, wrapErr(err, "NewBackend (SQLBlobStore)")
+		}
+	}
+	if b.Opts.FullTextIndex {
+		b.fts, err = b.initFTSSchema()
+		if err != nil {
+			return nil, wrapErr(err, "NewBackend (initFTSSchema)")
+		}
+		if !b.fts {
+			b.Opts.Log.Println("full-text index is not supported by the database, falling back to scanning")
+		} else if err := b.prepareFTSStmts(); err != nil {
+			return nil, wrapErr(err, "NewBackend (prepareFTSStmts)")
+		}
+	}
 
 	for _, item := range [...]imap.FetchItem{
 		imap.FetchFlags, imap.FetchEnvelope,
 		imap.FetchBodyStructure, "BODY[]", "BODY[HEADER.FIELDS (From To)]"} {
 
-		if _, err := b.getFetchStmt([]imap.FetchItem{item}); err != nil {
+		if _, err := b.getFetchStmt([]imap.FetchItem{item}, false); err != nil {
 			return nil, wrapErrf(err, "fetchStmt prime (%s)", item)
 		}
 	}
@@ -335,6 +581,10 @@ func New(driver, dsn string, extStore ExternalStore, opts Opts) (*Backend, error
 	if b.db.driver == "sqlite3" {
 		go b.sqliteOptimizeLoop()
 	}
+	if b.Opts.GCInterval >= 0 {
+		b.gcLoopStop = make(chan struct{})
+		go b.gcLoop()
+	}
 
 	return b, nil
 }
@@ -359,6 +609,11 @@ func (b *Backend) sqliteOptimizeLoop() {
 }
 
 func (b *Backend) Close() error {
+	if b.gcLoopStop != nil {
+		// Waits for the running collection to finish.
+		b.gcLoopStop <- struct{}{}
+	}
+
 	if b.db.driver == "sqlite3" {
 		// These operations are not critical, so it's not a problem if they fail.
 		if b.Opts.MinimizeOnClose {
@@ -408,7 +663,7 @@ func (b *Backend) createUser(tx *sql.Tx, username string) (uid, inboxId uint64,
 		shouldCommit = true
 	}
 
-	_, err = tx.Stmt(b.addUser).Exec(username)
+	_, err = tx.Stmt(b.addUser).Exec(username, domainOf(username))
 	if err != nil && isForeignKeyErr(err) {
 		return 0, 0, ErrUserAlreadyExists
 	}
@@ -420,7 +675,11 @@ func (b *Backend) createUser(tx *sql.Tx, username string) (uid, inboxId uint64,
 	}
 
 	// Every new user needs to have at least one mailbox (INBOX).
-	if _, err := tx.Stmt(b.createMbox).Exec(uid, "INBOX", b.prng.Uint32(), nil); err != nil {
+	objectId, err := newObjectId(mailboxIdPrefix)
+	if err != nil {
+		return 0, 0, wrapErr(err, "CreateUser")
+	}
+	if _, err := tx.Stmt(b.createMbox).Exec(uid, "INBOX", b.prng.Uint32(), nil, objectId); err != nil {
 		return 0, 0, wrapErr(err, "CreateUser")
 	}
 
@@ -432,6 +691,11 @@ func (b *Backend) createUser(tx *sql.Tx, username string) (uid, inboxId uint64,
 		return 0, 0, wrapErr(err, "CreateUser")
 	}
 
+	u := &User{id: uid, username: username, parent: b, inboxId: inboxId}
+	if err := b.createDefaultMboxes(tx, u); err != nil {
+		return 0, 0, wrapErr(err, "CreateUser (default mailboxes)")
+	}
+
 	if shouldCommit {
 		return uid, inboxId, tx.Commit()
 	}
@@ -451,19 +715,12 @@ func (b *Backend) DeleteUser(username string) error {
 	}
 	defer tx.Rollback()
 
-	// TODO: These queries definitely can be merged on PostgreSQL.
-	var keys []string
-	rows, err := tx.Stmt(b.refUser).Query(username)
-	if err != nil {
-		return wrapErr(err, "DeleteUser")
+	if _, err := tx.Stmt(b.decreaseRefForUser).Exec(username, username); err != nil {
+		return wrapErr(err, "DeleteUser (decrease ref)")
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var key string
-		if err := rows.Scan(&key); err != nil {
-			return wrapErr(err, "DeleteUser")
-		}
-		keys = append(keys, key)
+	keys, err := scanKeys(tx.Stmt(b.zeroRefUser).Query(username))
+	if err != nil {
+		return wrapErr(err, "DeleteUser (zero ref)")
 	}
 
 	stats, err := tx.Stmt(b.delUser).Exec(username)
@@ -478,15 +735,23 @@ func (b *Backend) DeleteUser(username string) error {
 		return ErrUserDoesntExists
 	}
 
-	if err := b.extStore.Delete(keys); err != nil {
+	if _, err := tx.Stmt(b.aclDelIdentifier).Exec(username); err != nil {
+		return wrapErr(err, "DeleteUser")
+	}
+	if _, err := tx.Stmt(b.delAliasesTo).Exec(username); err != nil {
 		return wrapErr(err, "DeleteUser")
 	}
 
-	if _, err := tx.Stmt(b.deleteUserRef).Exec(username); err != nil {
+	keys, err = b.deleteZeroRefKeys(tx, keys)
+	if err != nil {
 		return wrapErr(err, "DeleteUser")
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	b.flushExtDeletes(keys)
+	return nil
 }
 
 // ListUsers returns list of existing usernames.
@@ -504,6 +769,9 @@ func (b *Backend) ListUsers() ([]string, error) {
 		if err := rows.Scan(&id, &name); err != nil {
 			return res, wrapErr(err, "ListUsers")
 		}
+		if name == SharedUsername {
+			continue
+		}
 		res = append(res, name)
 	}
 	if err := rows.Err(); err != nil {
@@ -513,8 +781,14 @@ func (b *Backend) ListUsers() ([]string, error) {
 }
 
 // GetUser creates backend.User object for the user credentials.
+//
+// SharedUsername can be used to get the pseudo-user owning mailboxes in the
+// "Shared" namespace, see SharedUser.
 func (b *Backend) GetUser(username string) (backend.User, error) {
 	username = normalizeUsername(username)
+	if username == SharedUsername {
+		return b.SharedUser()
+	}
 
 	uid, inboxId, err := b.getUserMeta(nil, username)
 	if err != nil {
@@ -553,11 +827,81 @@ func (b *Backend) GetOrCreateUser(username string) (backend.User, error) {
 	return &User{id: uid, username: username, parent: b, inboxId: inboxId}, tx.Commit()
 }
 
+// Login returns the user object for the username. Aliases added using AddAlias
+// are accepted as username too, domain catch-alls are not. ErrAliasLoop is
+// returned if the alias points to itself.
+//
+// If Opts.Authenticate is set, the password is checked against one set using
+// SetUserPassword and app passwords created using CreateAppPassword, access
+// of users logged in using an app password is limited by its scope.
+// Otherwise it is ignored and the account is created if it does not exist,
+// unless Opts.NoAutoCreate is set.
+//
+// ErrUserLocked or ErrUserDisabled is returned for accounts that are not
+// active, see SetUserState. With Opts.Authenticate, it is returned only if
+// the password is correct. ErrDomainDisabled is returned the same way for
+// users of disabled domains.
 func (b *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
-	u, err := b.GetOrCreateUser(username)
+	username = normalizeUsername(username)
+	// Names that are not aliases are returned as is, so a missing account
+	// is reported below.
+	resolved, err := b.resolveAlias(nil, username, false)
+	if err != nil {
+		b.Opts.Log.Printf("failed to resolve login alias %s: %v", username, err)
+		if err == ErrAliasLoop {
+			return nil, err
+		}
+		return nil, wrapErr(err, "Login (resolveAlias)")
+	}
+	username = resolved
+	if username == SharedUsername {
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	scope := ScopeFull
+	if b.Opts.Authenticate {
+		// App passwords are checked first since that's cheap compared to
+		// hashing the main password.
+		scope, err = b.checkAppPassword(username, password)
+		if err == backend.ErrInvalidCredentials {
+			scope, err = ScopeFull, b.checkPassword(username, password)
+		}
+		if err != nil {
+			if err != backend.ErrInvalidCredentials {
+				b.Opts.Log.Printf("failed to check password of %s: %v", username, err)
+			}
+			return nil, backend.ErrInvalidCredentials
+		}
+	}
+	// Checked after the password, same as the account state, to not
+	// disclose it to clients not knowing the password.
+	if err := b.checkDomain(username); err != nil {
+		if err != ErrDomainDisabled {
+			return nil, wrapErr(err, "Login")
+		}
+		return nil, err
+	}
+
+	var u backend.User
+	if b.Opts.Authenticate || b.Opts.NoAutoCreate {
+		u, err = b.GetUser(username)
+	} else {
+		u, err = b.GetOrCreateUser(username)
+	}
+	if err != nil {
+		if err == ErrUserDoesntExists {
+			return nil, backend.ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	state, err := b.stateOf(u.(*User).id)
 	if err != nil {
+		return nil, wrapErr(err, "Login")
+	}
+	if err := state.loginErr(); err != nil {
 		return nil, err
 	}
+	u.(*User).scope = scope
 	b.Opts.Log.Debugln(username, "logged in")
 	return u, nil
 }
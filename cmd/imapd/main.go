@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"time"
 
 	sortthread "github.com/emersion/go-imap-sortthread"
 	"github.com/emersion/go-imap/server"
@@ -38,6 +40,7 @@ func main() {
 	if len(os.Args) < 5 {
 		fmt.Fprintf(os.Stderr, "imapd - Dumb IMAP4rev1 server providing unauthenticated access a go-imap-sql db\n")
 		fmt.Fprintf(os.Stderr, "Usage: %s <endpoint> <driver> <dsn> <fsstore>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Use 'sql:' as <fsstore> to store message bodies in the database\n")
 		os.Exit(2)
 	}
 
@@ -47,11 +50,45 @@ func main() {
 	endpoint := os.Args[1]
 	driver := os.Args[2]
 	dsn := os.Args[3]
-	fsStore := imapsql.FSStore{Root: os.Args[4]}
+	shardDepth, _ := strconv.Atoi(os.Getenv("IMAPSQL_FSSTORE_SHARDS"))
+	attachmentThreshold, _ := strconv.ParseInt(os.Getenv("IMAPSQL_ATTACHMENT_THRESHOLD"), 10, 64)
+	gcInterval, _ := time.ParseDuration(os.Getenv("IMAPSQL_GC_INTERVAL"))
+	orphanGracePeriod, _ := time.ParseDuration(os.Getenv("IMAPSQL_ORPHAN_GRACE_PERIOD"))
+	expungedRetention, _ := time.ParseDuration(os.Getenv("IMAPSQL_EXPUNGED_RETENTION"))
+	var masterKeys [][]byte
+	if path := os.Getenv("IMAPSQL_MASTER_KEY_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+		masterKeys, err = imapsql.ReadMasterKeys(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+	}
+	var extStore imapsql.ExternalStore = &imapsql.FSStore{Root: os.Args[4], ShardDepth: shardDepth}
+	if os.Args[4] == "sql:" {
+		extStore = &imapsql.SQLBlobStore{}
+	}
 
-	bkd, err := imapsql.New(driver, dsn, &fsStore, imapsql.Opts{
-		BusyTimeout: 100000,
-		Log:         stdLogger{},
+	bkd, err := imapsql.New(driver, dsn, extStore, imapsql.Opts{
+		BusyTimeout:         100000,
+		FullTextIndex:       os.Getenv("IMAPSQL_FTS") == "1",
+		AttachmentThreshold: attachmentThreshold,
+		MasterKeys:          masterKeys,
+		EncryptMetadata:     os.Getenv("IMAPSQL_ENCRYPT_METADATA") == "1",
+		IndexEncrypted:      os.Getenv("IMAPSQL_INDEX_ENCRYPTED") == "1",
+		VerifyBodies:        os.Getenv("IMAPSQL_VERIFY_BODIES") == "1",
+		GCInterval:          gcInterval,
+		OrphanGracePeriod:   orphanGracePeriod,
+		ExpungedRetention:   expungedRetention,
+		Authenticate:        os.Getenv("IMAPSQL_AUTH") == "1",
+		PassHashAlgo:        os.Getenv("IMAPSQL_PASS_HASH"),
+		PassHashParams:      os.Getenv("IMAPSQL_PASS_HASH_PARAMS"),
+		Log:                 stdLogger{},
 	})
 	defer bkd.Close()
 	if err != nil {
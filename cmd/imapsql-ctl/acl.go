@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/urfave/cli"
+)
+
+// ACLUser is extension for backend.User interface which allows to
+// query and change mailbox access control lists.
+type ACLUser interface {
+	GetACL(mbox string) (map[string]string, error)
+	SetACL(mbox, identifier, rights string) error
+}
+
+func mboxesACL(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return errors.New("Error: MAILBOX is required")
+	}
+	identifier := ctx.Args().Get(2)
+
+	u, err := backend.GetUser(username)
+	if err != nil {
+		return err
+	}
+	aclUser := u.(ACLUser)
+
+	if identifier != "" {
+		return aclUser.SetACL(name, identifier, ctx.Args().Get(3))
+	}
+
+	acl, err := aclUser.GetACL(name)
+	if err != nil {
+		return err
+	}
+	identifiers := make([]string, 0, len(acl))
+	for identifier := range acl {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+	for _, identifier := range identifiers {
+		fmt.Println(identifier, acl[identifier])
+	}
+	return nil
+}
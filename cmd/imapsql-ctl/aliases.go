@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+func aliasesAdd(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	alias := ctx.Args().First()
+	if alias == "" {
+		return errors.New("Error: ALIAS is required")
+	}
+	target := ctx.Args().Get(1)
+	if target == "" {
+		return errors.New("Error: TARGET is required")
+	}
+
+	return backend.AddAlias(alias, target)
+}
+
+func aliasesRemove(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	alias := ctx.Args().First()
+	if alias == "" {
+		return errors.New("Error: ALIAS is required")
+	}
+
+	return backend.RemoveAlias(alias)
+}
+
+func aliasesList(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	list, err := backend.ListAliases()
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No aliases.")
+	}
+
+	for _, alias := range list {
+		fmt.Printf("%s\t%s\n", alias.Alias, alias.Target)
+	}
+	return nil
+}
+
+func aliasesResolve(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	address := ctx.Args().First()
+	if address == "" {
+		return errors.New("Error: ADDRESS is required")
+	}
+
+	username, err := backend.ResolveAlias(address)
+	if err != nil {
+		return err
+	}
+	fmt.Println(username)
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+func appPasswordsCreate(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return errors.New("Error: NAME is required")
+	}
+
+	pass, err := backend.CreateAppPassword(username, name, ctx.String("scope"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(pass)
+	return nil
+}
+
+func appPasswordsList(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	list, err := backend.ListAppPasswords(username)
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No app passwords.")
+	}
+
+	for _, pass := range list {
+		scope := pass.Scope
+		if scope == "" {
+			scope = "full"
+		}
+		lastUsed := "never"
+		if !pass.LastUsed.IsZero() {
+			lastUsed = pass.LastUsed.Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", pass.Name, scope, pass.Created.Format(time.RFC3339), lastUsed)
+	}
+	return nil
+}
+
+func appPasswordsRevoke(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return errors.New("Error: NAME is required")
+	}
+
+	return backend.RevokeAppPassword(username, name)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/urfave/cli"
+)
+
+func domainsCreate(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	domain := ctx.Args().First()
+	if domain == "" {
+		return errors.New("Error: DOMAIN is required")
+	}
+
+	return backend.CreateDomain(domain)
+}
+
+func domainsRemove(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	domain := ctx.Args().First()
+	if domain == "" {
+		return errors.New("Error: DOMAIN is required")
+	}
+
+	return backend.DeleteDomain(domain)
+}
+
+func domainsList(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	list, err := backend.ListDomains()
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No domains.")
+	}
+
+	for _, domain := range list {
+		fmt.Println(domain)
+	}
+	return nil
+}
+
+func domainsSettings(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	domain := ctx.Args().First()
+	if domain == "" {
+		return errors.New("Error: DOMAIN is required")
+	}
+	if ctx.Bool("enable") && ctx.Bool("disable") {
+		return errors.New("Error: --enable and --disable can't be used together")
+	}
+
+	settings, err := backend.GetDomainSettings(domain)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, flag := range []string{"appendlimit", "storage", "messages", "mailbox", "no-mailboxes", "enable", "disable"} {
+		if ctx.IsSet(flag) {
+			changed = true
+		}
+	}
+	if !changed {
+		printDomainSettings(settings)
+		return nil
+	}
+
+	if ctx.IsSet("appendlimit") {
+		if val := ctx.Int("appendlimit"); val == -1 {
+			settings.MsgSizeLimit = nil
+		} else {
+			val32 := uint32(val)
+			settings.MsgSizeLimit = &val32
+		}
+	}
+	for flag, name := range map[string]string{
+		"storage":  imapsql.QuotaStorage,
+		"messages": imapsql.QuotaMessage,
+	} {
+		if !ctx.IsSet(flag) {
+			continue
+		}
+		if val := ctx.Int64(flag); val == -1 {
+			delete(settings.Quota, name)
+		} else {
+			settings.Quota[name] = uint64(val)
+		}
+	}
+	if ctx.Bool("no-mailboxes") {
+		settings.DefaultMailboxes = nil
+	}
+	if ctx.IsSet("mailbox") {
+		settings.DefaultMailboxes = nil
+		for _, spec := range ctx.StringSlice("mailbox") {
+			mbox := imapsql.DefaultMailbox{Name: spec}
+			if i := strings.LastIndex(spec, ":\\"); i != -1 {
+				mbox = imapsql.DefaultMailbox{Name: spec[:i], SpecialUse: spec[i+1:]}
+			}
+			settings.DefaultMailboxes = append(settings.DefaultMailboxes, mbox)
+		}
+	}
+	if ctx.Bool("enable") {
+		settings.Disabled = false
+	}
+	if ctx.Bool("disable") {
+		settings.Disabled = true
+	}
+
+	return backend.SetDomainSettings(domain, *settings)
+}
+
+func printDomainSettings(settings *imapsql.DomainSettings) {
+	if settings.MsgSizeLimit == nil {
+		fmt.Println("APPENDLIMIT: No limit")
+	} else {
+		fmt.Println("APPENDLIMIT:", *settings.MsgSizeLimit)
+	}
+
+	names := make([]string, 0, len(settings.Quota))
+	for name := range settings.Quota {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s: %d\n", name, settings.Quota[name])
+	}
+
+	mboxes := make([]string, 0, len(settings.DefaultMailboxes))
+	for _, mbox := range settings.DefaultMailboxes {
+		if mbox.SpecialUse != "" {
+			mboxes = append(mboxes, mbox.Name+" ("+mbox.SpecialUse+")")
+		} else {
+			mboxes = append(mboxes, mbox.Name)
+		}
+	}
+	fmt.Println("Default mailboxes:", strings.Join(mboxes, ", "))
+
+	if settings.Disabled {
+		fmt.Println("Disabled")
+	} else {
+		fmt.Println("Enabled")
+	}
+}
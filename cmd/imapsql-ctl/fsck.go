@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/urfave/cli"
+)
+
+func fsck(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	problems, err := backend.Fsck(imapsql.FsckOpts{
+		Repair:    ctx.Bool("repair"),
+		OrphanAge: ctx.Duration("orphan-age"),
+	})
+	// Problems found (and possibly repaired) before the error are still
+	// reported.
+	if ctx.Bool("json") {
+		if problems == nil {
+			problems = []imapsql.FsckProblem{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(problems); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			status := "found"
+			if p.Repaired {
+				status = "repaired"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", p.Kind, p.Username, p.Mailbox, p.Key, status, p.Description)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if !ctx.GlobalBool("quiet") {
+		repaired := 0
+		for _, p := range problems {
+			if p.Repaired {
+				repaired++
+			}
+		}
+		fmt.Fprintln(os.Stderr, len(problems), "problems found,", repaired, "repaired.")
+	}
+	if len(problems) != 0 && !ctx.Bool("repair") {
+		return fmt.Errorf("Error: %d problems found, use --repair to fix them", len(problems))
+	}
+	return nil
+}
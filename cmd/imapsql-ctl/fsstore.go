@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/urfave/cli"
+)
+
+func fsstoreMigrate(ctx *cli.Context) error {
+	root := ctx.GlobalString("fsstore")
+	if root == "" {
+		return errors.New("Error: --fsstore is required")
+	}
+	depth := ctx.GlobalInt("fsstore-shards")
+	if depth <= 0 {
+		return errors.New("Error: --fsstore-shards is required")
+	}
+
+	store := imapsql.FSStore{Root: root, ShardDepth: depth}
+	moved, err := store.MigrateToShards()
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Moved", moved, "objects.")
+	}
+	return err
+}
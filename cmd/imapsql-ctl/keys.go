@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/urfave/cli"
+)
+
+func readMasterKeys(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys, err := imapsql.ReadMasterKeys(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Error: no keys in %s", path)
+	}
+	return keys, nil
+}
+
+func keysRotateMaster(ctx *cli.Context) error {
+	if !ctx.GlobalIsSet("master-key-file") {
+		return errors.New("Error: --master-key-file is required")
+	}
+
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	rewrapped, err := backend.RotateMasterKey()
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Rewrapped", rewrapped, "data keys.")
+	}
+	return err
+}
+
+func keysRotateUser(ctx *cli.Context) error {
+	if !ctx.GlobalIsSet("master-key-file") {
+		return errors.New("Error: --master-key-file is required")
+	}
+	if ctx.NArg() == 0 {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	for _, username := range ctx.Args() {
+		if err := backend.RotateUserKey(username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/urfave/cli"
@@ -28,15 +29,39 @@ func connectToDB(ctx *cli.Context) error {
 	if dsn == "" {
 		return errors.New("Error: dsn is required")
 	}
-	if fsstore == "" {
-		return errors.New("Error: fsstrore is required")
+	sqlstore := ctx.GlobalIsSet("sqlstore")
+	if fsstore == "" && !sqlstore {
+		return errors.New("Error: fsstrore or sqlstore is required")
+	}
+	if fsstore != "" && sqlstore {
+		return errors.New("Error: fsstore and sqlstore can't be used together")
 	}
 
 	opts := imapsql.Opts{}
 	opts.NoWAL = ctx.GlobalIsSet("no-wal")
+	opts.FullTextIndex = ctx.GlobalIsSet("fts")
+	opts.EncryptMetadata = ctx.GlobalIsSet("encrypt-metadata")
+	opts.IndexEncrypted = ctx.GlobalIsSet("index-encrypted")
+	opts.PassHashAlgo = ctx.GlobalString("pass-hash")
+	opts.PassHashParams = ctx.GlobalString("pass-hash-params")
+	if path := ctx.GlobalString("master-key-file"); path != "" {
+		keys, err := readMasterKeys(path)
+		if err != nil {
+			return err
+		}
+		opts.MasterKeys = keys
+	}
+
+	var extStore imapsql.ExternalStore = &imapsql.FSStore{
+		Root:       fsstore,
+		ShardDepth: ctx.GlobalInt("fsstore-shards"),
+	}
+	if sqlstore {
+		extStore = &imapsql.SQLBlobStore{}
+	}
 
 	var err error
-	backend, err = imapsql.New(driver, dsn, &imapsql.FSStore{Root: fsstore}, opts)
+	backend, err = imapsql.New(driver, dsn, extStore, opts)
 	if err != nil {
 		return err
 	}
@@ -88,11 +113,51 @@ func main() {
 			Name:  "no-wal",
 			Usage: "(SQLite only) Don't force WAL mode",
 		},
+		cli.BoolFlag{
+			Name:   "fts",
+			Usage:  "Maintain full-text index for added messages, should match server configuration",
+			EnvVar: "IMAPSQL_FTS",
+		},
 		cli.StringFlag{
 			Name:   "fsstore",
 			Usage:  "Use fsstore with specified directory",
 			EnvVar: "IMAPSQL_FSSTORE",
 		},
+		cli.IntFlag{
+			Name:   "fsstore-shards",
+			Usage:  "Number of directory levels used by fsstore, should match server configuration",
+			EnvVar: "IMAPSQL_FSSTORE_SHARDS",
+		},
+		cli.BoolFlag{
+			Name:   "sqlstore",
+			Usage:  "Use message bodies stored in the database itself instead of fsstore",
+			EnvVar: "IMAPSQL_SQLSTORE",
+		},
+		cli.StringFlag{
+			Name:   "master-key-file",
+			Usage:  "Encrypt message bodies using keys from the file (hex-encoded, one per line), should match server configuration",
+			EnvVar: "IMAPSQL_MASTER_KEY_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "encrypt-metadata",
+			Usage:  "Encrypt cached header and body structure of added messages, should match server configuration",
+			EnvVar: "IMAPSQL_ENCRYPT_METADATA",
+		},
+		cli.BoolFlag{
+			Name:   "index-encrypted",
+			Usage:  "Add encrypted messages to the header and full-text indexes (stored in plaintext), should match server configuration",
+			EnvVar: "IMAPSQL_INDEX_ENCRYPTED",
+		},
+		cli.StringFlag{
+			Name:   "pass-hash",
+			Usage:  "Password hashing algorithm for new passwords (bcrypt, argon2id), should match server configuration",
+			EnvVar: "IMAPSQL_PASS_HASH",
+		},
+		cli.StringFlag{
+			Name:   "pass-hash-params",
+			Usage:  "Parameters of the password hashing algorithm, e.g. bcrypt cost or m=65536,t=1,p=4 for argon2id",
+			EnvVar: "IMAPSQL_PASS_HASH_PARAMS",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -156,6 +221,29 @@ func main() {
 					},
 					Action: mboxesAppendLimit,
 				},
+				{
+					Name:      "quota",
+					Usage:     "Query or set mailbox's QUOTA limits",
+					ArgsUsage: "USERNAME MAILBOX",
+					Flags: []cli.Flag{
+						cli.Int64Flag{
+							Name:  "storage,s",
+							Usage: "Set STORAGE limit to specified value (in KiB). Pass -1 to disable limit.",
+						},
+						cli.Int64Flag{
+							Name:  "messages,m",
+							Usage: "Set MESSAGE limit to specified value. Pass -1 to disable limit.",
+						},
+					},
+					Action: mboxesQuota,
+				},
+				{
+					Name:        "acl",
+					Usage:       "Query or change mailbox's access control list",
+					ArgsUsage:   "USERNAME MAILBOX [IDENTIFIER RIGHTS]",
+					Description: "Prints the ACL if IDENTIFIER is not specified. RIGHTS can be prefixed with + or - to add or remove rights, empty RIGHTS remove IDENTIFIER from the ACL. Use " + imapsql.SharedUsername + " as USERNAME to manage mailboxes in the shared namespace.",
+					Action:      mboxesACL,
+				},
 			},
 		},
 		{
@@ -297,8 +385,14 @@ func main() {
 			Usage: "User accounts management",
 			Subcommands: []cli.Command{
 				{
-					Name:   "list",
-					Usage:  "List created user accounts",
+					Name:  "list",
+					Usage: "List created user accounts",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "domain,d",
+							Usage: "List only users in the domain",
+						},
+					},
 					Action: usersList,
 				},
 				{
@@ -319,6 +413,37 @@ func main() {
 					},
 					Action: usersRemove,
 				},
+				{
+					Name:        "password",
+					Usage:       "Change user's password",
+					ArgsUsage:   "USERNAME",
+					Description: "Password is checked only if server is configured to authenticate users.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "hash",
+							Usage: "Read password hash created using the specified algorithm (e.g. sha512-crypt for $6$ hashes) instead of password",
+						},
+						cli.BoolFlag{
+							Name:  "reset",
+							Usage: "Remove password, user will not be able to log in",
+						},
+					},
+					Action: usersPassword,
+				},
+				{
+					Name:        "state",
+					Usage:       "Query or change state of user account",
+					ArgsUsage:   "USERNAME [active|locked|disabled]",
+					Description: "Locked users can't log in but still receive messages, disabled users can't log in and messages addressed to them are rejected. Data of inactive users is kept.",
+					Action:      usersState,
+				},
+				{
+					Name:        "rename",
+					Usage:       "Change username of user account",
+					ArgsUsage:   "USERNAME NEWNAME",
+					Description: "Mailboxes, messages and access rights of the user are kept.",
+					Action:      usersRename,
+				},
 				{
 					Name:      "appendlimit",
 					Usage:     "Query or set user's APPENDLIMIT value",
@@ -326,11 +451,225 @@ func main() {
 					Flags: []cli.Flag{
 						cli.IntFlag{
 							Name:  "value,v",
-							Usage: "Set APPENDLIMIT to specified value (in bytes)",
+							Usage: "Set APPENDLIMIT to specified value (in bytes). Pass -1 to disable limit.",
+						},
+						cli.BoolFlag{
+							Name:  "default,d",
+							Usage: "Remove user's APPENDLIMIT to use the default of its domain",
 						},
 					},
 					Action: usersAppendLimit,
 				},
+				{
+					Name:      "quota",
+					Usage:     "Query or set user's QUOTA limits",
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						cli.Int64Flag{
+							Name:  "storage,s",
+							Usage: "Set STORAGE limit to specified value (in KiB). Pass -1 to disable limit.",
+						},
+						cli.Int64Flag{
+							Name:  "messages,m",
+							Usage: "Set MESSAGE limit to specified value. Pass -1 to disable limit.",
+						},
+						cli.BoolFlag{
+							Name:  "default,d",
+							Usage: "Remove user's limits to use defaults of its domain",
+						},
+					},
+					Action: usersQuota,
+				},
+			},
+		},
+		{
+			Name:  "domains",
+			Usage: "Domains management",
+			Subcommands: []cli.Command{
+				{
+					Name:        "create",
+					Usage:       "Add domain",
+					ArgsUsage:   "DOMAIN",
+					Description: "Settings can be changed only for added domains. Users can be created in any domain.",
+					Action:      domainsCreate,
+				},
+				{
+					Name:        "remove",
+					Usage:       "Remove domain settings",
+					ArgsUsage:   "DOMAIN",
+					Description: "Users of the domain are not removed.",
+					Action:      domainsRemove,
+				},
+				{
+					Name:   "list",
+					Usage:  "List added domains",
+					Action: domainsList,
+				},
+				{
+					Name:        "settings",
+					Usage:       "Query or change domain settings",
+					ArgsUsage:   "DOMAIN",
+					Description: "Limits are used for users of the domain without own limits. Default mailboxes are created for new users.",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "appendlimit",
+							Usage: "Set default APPENDLIMIT to specified value (in bytes). Pass -1 to disable limit.",
+						},
+						cli.Int64Flag{
+							Name:  "storage,s",
+							Usage: "Set default STORAGE limit to specified value (in KiB). Pass -1 to disable limit.",
+						},
+						cli.Int64Flag{
+							Name:  "messages,m",
+							Usage: "Set default MESSAGE limit to specified value. Pass -1 to disable limit.",
+						},
+						cli.StringSliceFlag{
+							Name:  "mailbox",
+							Usage: "Set default mailboxes, NAME or NAME:ATTR to set SPECIAL-USE attribute (e.g. Sent:\\Sent). Can be specified multiple times",
+						},
+						cli.BoolFlag{
+							Name:  "no-mailboxes",
+							Usage: "Remove default mailboxes",
+						},
+						cli.BoolFlag{
+							Name:  "disable",
+							Usage: "Disable domain, its users can't log in and receive messages",
+						},
+						cli.BoolFlag{
+							Name:  "enable",
+							Usage: "Enable domain",
+						},
+					},
+					Action: domainsSettings,
+				},
+			},
+		},
+		{
+			Name:  "aliases",
+			Usage: "Alternate addresses management",
+			Subcommands: []cli.Command{
+				{
+					Name:        "add",
+					Usage:       "Create alias",
+					ArgsUsage:   "ALIAS TARGET",
+					Description: "TARGET is the username or another alias. Use @domain as ALIAS to create catch-all for the domain.",
+					Action:      aliasesAdd,
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove alias",
+					ArgsUsage: "ALIAS",
+					Action:    aliasesRemove,
+				},
+				{
+					Name:        "list",
+					Usage:       "List aliases",
+					Description: "Prints one alias per line: alias, target.",
+					Action:      aliasesList,
+				},
+				{
+					Name:      "resolve",
+					Usage:     "Show username messages for the address are delivered to",
+					ArgsUsage: "ADDRESS",
+					Action:    aliasesResolve,
+				},
+			},
+		},
+		{
+			Name:  "app-passwords",
+			Usage: "Per-device passwords management",
+			Subcommands: []cli.Command{
+				{
+					Name:        "create",
+					Usage:       "Create app password",
+					ArgsUsage:   "USERNAME NAME",
+					Description: "Prints the generated password, it can't be shown again later. Password is checked only if server is configured to authenticate users.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "scope,s",
+							Usage: "Limit access using the password (" + imapsql.ScopeReadOnly + ", " + imapsql.ScopeDelivery + ")",
+						},
+					},
+					Action: appPasswordsCreate,
+				},
+				{
+					Name:        "list",
+					Usage:       "List app passwords of the user",
+					ArgsUsage:   "USERNAME",
+					Description: "Prints one password per line: name, scope, creation time, last use time.",
+					Action:      appPasswordsList,
+				},
+				{
+					Name:      "revoke",
+					Usage:     "Remove app password",
+					ArgsUsage: "USERNAME NAME",
+					Action:    appPasswordsRevoke,
+				},
+			},
+		},
+		{
+			Name:        "reindex",
+			Usage:       "Rebuild full-text index",
+			Description: "Requires --fts flag. Should be used after enabling full-text index for the existing database.",
+			Action:      reindex,
+		},
+		{
+			Name:        "verify",
+			Usage:       "Check message bodies for corruption",
+			ArgsUsage:   "[USERNAME...]",
+			Description: "Reads bodies of all messages of specified users (or all users) and reports\n   missing, truncated or mismatched ones, one per line: user, mailbox, UID, key, problem, error.",
+			Action:      verify,
+		},
+		{
+			Name:        "fsck",
+			Usage:       "Check consistency of counters, references and stored bodies",
+			Description: "Checks message counters and UIDNEXT of mailboxes, usage counters and INBOX of users,\n   reference counters of stored bodies and bodies not used by any message (fsstore and sqlstore only).\n   Problems are printed one per line: kind, user, mailbox, key, status, description.\n   Safe to use while server is running.",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "Fix found problems",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print problems as JSON array",
+				},
+				cli.DurationFlag{
+					Name:  "orphan-age",
+					Usage: "Report only unused bodies older than that to skip ones being added",
+					Value: time.Hour,
+				},
+			},
+			Action: fsck,
+		},
+		{
+			Name:  "fsstore",
+			Usage: "Message bodies storage management",
+			Subcommands: []cli.Command{
+				{
+					Name:        "migrate",
+					Usage:       "Move bodies stored using flat layout to shard directories",
+					Description: "Requires --fsstore and --fsstore-shards flags. Safe to use while server is running.",
+					Action:      fsstoreMigrate,
+				},
+			},
+		},
+		{
+			Name:  "keys",
+			Usage: "Encryption keys management",
+			Subcommands: []cli.Command{
+				{
+					Name:        "rotate-master",
+					Usage:       "Re-encrypt data keys using the first master key",
+					Description: "Requires --master-key-file flag. Put the new key first in the file and keep old keys after it,\n   old keys can be removed once the command succeeds.",
+					Action:      keysRotateMaster,
+				},
+				{
+					Name:        "rotate-user",
+					Usage:       "Create new data keys for users",
+					ArgsUsage:   "USERNAME...",
+					Description: "Requires --master-key-file flag. New messages are encrypted using the new key, existing messages remain readable.",
+					Action:      keysRotateUser,
+				},
 			},
 		},
 	}
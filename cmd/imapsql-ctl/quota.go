@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/urfave/cli"
+)
+
+// QuotaUser is extension for backend.User interface which allows to
+// query QUOTA extension limits.
+type QuotaUser interface {
+	GetQuota(root string) (*imapsql.QuotaStatus, error)
+}
+
+func usersQuota(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	u, err := backend.GetUser(username)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("default") {
+		return backend.SetQuota(username, "", nil)
+	}
+	return quota(ctx, username, u.(QuotaUser), "")
+}
+
+func mboxesQuota(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return errors.New("Error: MAILBOX is required")
+	}
+
+	u, err := backend.GetUser(username)
+	if err != nil {
+		return err
+	}
+
+	return quota(ctx, username, u.(QuotaUser), name)
+}
+
+func quota(ctx *cli.Context, username string, u QuotaUser, root string) error {
+	status, err := u.GetQuota(root)
+	if err != nil {
+		return err
+	}
+
+	if !ctx.IsSet("storage") && !ctx.IsSet("messages") {
+		if len(status.Resources) == 0 {
+			fmt.Println("No limit")
+			return nil
+		}
+
+		names := make([]string, 0, len(status.Resources))
+		for name := range status.Resources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s %d/%d\n", name, status.Resources[name][0], status.Resources[name][1])
+		}
+		return nil
+	}
+
+	resources := make(map[string]uint64, len(status.Resources))
+	for name, val := range status.Resources {
+		resources[name] = val[1]
+	}
+	for flag, name := range map[string]string{
+		"storage":  imapsql.QuotaStorage,
+		"messages": imapsql.QuotaMessage,
+	} {
+		if !ctx.IsSet(flag) {
+			continue
+		}
+		if val := ctx.Int64(flag); val == -1 {
+			if root == "" {
+				// Otherwise the default of the user's domain is used.
+				resources[name] = imapsql.NoLimit
+			} else {
+				delete(resources, name)
+			}
+		} else {
+			resources[name] = uint64(val)
+		}
+	}
+
+	return backend.SetQuota(username, root, resources)
+}
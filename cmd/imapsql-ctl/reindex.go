@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/urfave/cli"
+)
+
+func reindex(ctx *cli.Context) error {
+	if !ctx.GlobalIsSet("fts") {
+		return errors.New("Error: --fts is required")
+	}
+
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	return backend.Reindex()
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 
+	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/urfave/cli"
 )
 
@@ -13,7 +14,15 @@ func usersList(ctx *cli.Context) error {
 		return err
 	}
 
-	list, err := backend.ListUsers()
+	var (
+		list []string
+		err  error
+	)
+	if ctx.IsSet("domain") {
+		list, err = backend.ListDomainUsers(ctx.String("domain"))
+	} else {
+		list, err = backend.ListUsers()
+	}
 	if err != nil {
 		return err
 	}
@@ -74,6 +83,89 @@ func usersRemove(ctx *cli.Context) error {
 	return backend.DeleteUser(username)
 }
 
+func usersPassword(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	if ctx.Bool("reset") {
+		return backend.ResetUserPassword(username)
+	}
+
+	if algo := ctx.String("hash"); algo != "" {
+		hash, err := ReadPassword("Enter password hash")
+		if err != nil {
+			return err
+		}
+		return backend.SetUserPasswordHash(username, algo, hash)
+	}
+
+	pass, err := ReadPassword("Enter new password")
+	if err != nil {
+		return err
+	}
+	if pass == "" {
+		return errors.New("Error: Empty password, use --reset to remove it")
+	}
+	repeated, err := ReadPassword("Repeat new password")
+	if err != nil {
+		return err
+	}
+	if pass != repeated {
+		return errors.New("Error: Passwords don't match")
+	}
+
+	return backend.SetUserPassword(username, pass)
+}
+
+func usersState(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	if ctx.NArg() == 1 {
+		state, err := backend.GetUserState(username)
+		if err != nil {
+			return err
+		}
+		fmt.Println(state)
+		return nil
+	}
+
+	state, err := imapsql.ParseUserState(ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	return backend.SetUserState(username, state)
+}
+
+func usersRename(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	newName := ctx.Args().Get(1)
+	if newName == "" {
+		return errors.New("Error: NEWNAME is required")
+	}
+
+	return backend.RenameUser(username, newName)
+}
+
 func usersAppendLimit(ctx *cli.Context) error {
 	if err := connectToDB(ctx); err != nil {
 		return err
@@ -90,12 +182,16 @@ func usersAppendLimit(ctx *cli.Context) error {
 	}
 	userAL := u.(AppendLimitUser)
 
+	if ctx.Bool("default") {
+		return userAL.SetMessageLimit(nil)
+	}
 	if ctx.IsSet("value") {
 		val := ctx.Int("value")
 
 		var err error
 		if val == -1 {
-			err = userAL.SetMessageLimit(nil)
+			noLimit := imapsql.NoMsgSizeLimit
+			err = userAL.SetMessageLimit(&noLimit)
 		} else {
 			val32 := uint32(val)
 			err = userAL.SetMessageLimit(&val32)
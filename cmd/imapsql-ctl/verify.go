@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/urfave/cli"
+)
+
+func verify(ctx *cli.Context) error {
+	if err := connectToDB(ctx); err != nil {
+		return err
+	}
+
+	problems := 0
+	checked, err := backend.VerifyBodies(ctx.Args(), func(p imapsql.BodyProblem) {
+		problems++
+		fmt.Printf("%s\t%s\t%d\t%s\t%s\t%v\n", p.Username, p.Mailbox, p.UID, p.Key, p.Kind, p.Err)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Checked", checked, "messages,", problems, "problems found.")
+	}
+	if problems != 0 {
+		return fmt.Errorf("Error: %d messages with missing or corrupted bodies", problems)
+	}
+	return nil
+}
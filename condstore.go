@@ -0,0 +1,229 @@
+package imapsql
+
+import (
+	"database/sql"
+
+	"github.com/emersion/go-imap"
+)
+
+// FetchModSeq is the FETCH item that requests per-message modification
+// sequence value as defined by RFC 7162.
+//
+// The value is returned in imap.Message.Items in the form suitable for
+// direct serialization (parenthesized list with a single number).
+const FetchModSeq imap.FetchItem = "MODSEQ"
+
+// StatusHighestModSeq is the STATUS item (and SELECT response code) that
+// contains the highest modification sequence value used in the mailbox.
+const StatusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+// incrementModSeq allocates a new modification sequence value for the mailbox.
+//
+// All changes made within one transaction should share a single value
+// so it should be called at most once per transaction and mailbox.
+func (b *Backend) incrementModSeq(tx *sql.Tx, mboxId uint64) (uint64, error) {
+	var modSeq uint64
+
+	// On PostgreSQL we can just do everything in one query.
+	if b.db.driver == "postgres" {
+		err := tx.Stmt(b.bumpModSeq).QueryRow(mboxId).Scan(&modSeq)
+		return modSeq, err
+	}
+
+	if _, err := tx.Stmt(b.bumpModSeq).Exec(mboxId); err != nil {
+		return 0, err
+	}
+	err := tx.Stmt(b.highestModSeq).QueryRow(mboxId).Scan(&modSeq)
+	return modSeq, err
+}
+
+// HighestModSeq returns the highest modification sequence value used in the
+// mailbox.
+func (m *Mailbox) HighestModSeq() (uint64, error) {
+	var modSeq uint64
+	if err := m.parent.highestModSeq.QueryRow(m.id).Scan(&modSeq); err != nil {
+		m.parent.logMboxErr(m, err, "HighestModSeq")
+		return 0, wrapErr(err, "HighestModSeq")
+	}
+	return modSeq, nil
+}
+
+// ListMessagesChangedSince is a version of ListMessages that implements
+// the CHANGEDSINCE FETCH modifier.
+//
+// Only messages with modification sequence greater than changedSince are
+// returned. MODSEQ item is implicitly added to the requested items list
+// as required by RFC 7162.
+func (m *Mailbox) ListMessagesChangedSince(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, changedSince uint64, ch chan<- *imap.Message) error {
+	hasModSeq := false
+	for _, item := range items {
+		if item == FetchModSeq {
+			hasModSeq = true
+		}
+	}
+	if !hasModSeq {
+		items = append(items, FetchModSeq)
+	}
+
+	return m.listMessages(uid, seqset, items, changedSince, ch)
+}
+
+// UpdateMessagesFlagsUnchangedSince is a version of UpdateMessagesFlags that
+// implements the UNCHANGEDSINCE STORE modifier.
+//
+// Messages with modification sequence greater than unchangedSince are left
+// untouched and are returned as a set suitable for use in the MODIFIED
+// response code (UIDs if uid = true, sequence numbers otherwise).
+func (m *Mailbox) UpdateMessagesFlagsUnchangedSince(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, silent bool, flags []string, unchangedSince uint64) (*imap.SeqSet, error) {
+	return m.updateMessagesFlags(uid, seqset, operation, silent, flags, &unchangedSince)
+}
+
+// Vanished returns the set of UIDs that were expunged from the mailbox after
+// the specified modification sequence value.
+//
+// If uidSet is not nil, only UIDs from this set are returned. This is used to
+// implement VANISHED (EARLIER) responses for QRESYNC-enabled SELECT and
+// UID FETCH with VANISHED modifier.
+//
+// Note that information about messages expunged before database
+// schema upgrade to version 7 is not available. If information about
+// messages expunged after changedSince was removed already (see
+// Opts.ExpungedRetention), all UIDs that no longer exist are returned as
+// allowed by RFC 7162.
+func (m *Mailbox) Vanished(uidSet *imap.SeqSet, changedSince uint64) (*imap.SeqSet, error) {
+	var prunedModSeq uint64
+	if err := m.parent.prunedModSeq.QueryRow(m.id).Scan(&prunedModSeq); err != nil {
+		m.parent.logMboxErr(m, err, "Vanished (pruned modseq)", uidSet, changedSince)
+		return nil, wrapErr(err, "Vanished")
+	}
+	if changedSince < prunedModSeq {
+		res, err := m.missingUids(uidSet)
+		if err != nil {
+			m.parent.logMboxErr(m, err, "Vanished (missing uids)", uidSet, changedSince)
+			return nil, wrapErr(err, "Vanished")
+		}
+		return res, nil
+	}
+
+	rows, err := m.parent.vanishedUids.Query(m.id, changedSince)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "Vanished", uidSet, changedSince)
+		return nil, wrapErr(err, "Vanished")
+	}
+	defer rows.Close()
+
+	res := &imap.SeqSet{}
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			m.parent.logMboxErr(m, err, "Vanished (scan)", uidSet, changedSince)
+			return nil, wrapErr(err, "Vanished")
+		}
+		if uidSet != nil && !uidSet.Contains(uid) {
+			continue
+		}
+		res.AddNum(uid)
+	}
+	if err := rows.Err(); err != nil {
+		m.parent.logMboxErr(m, err, "Vanished", uidSet, changedSince)
+		return nil, wrapErr(err, "Vanished")
+	}
+
+	return res, nil
+}
+
+// missingUids returns UIDs from uidSet (or all assigned UIDs if it is nil)
+// that are not used by any message in the mailbox.
+func (m *Mailbox) missingUids(uidSet *imap.SeqSet) (*imap.SeqSet, error) {
+	var uidNext uint32
+	if err := m.parent.uidNext.QueryRow(m.id).Scan(&uidNext); err != nil {
+		return nil, err
+	}
+	if uidNext <= 1 {
+		return &imap.SeqSet{}, nil
+	}
+	if uidSet == nil {
+		uidSet = &imap.SeqSet{}
+		uidSet.AddRange(1, uidNext-1)
+	}
+
+	res := &imap.SeqSet{}
+	for _, seq := range uidSet.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 || start >= uidNext {
+			start = uidNext - 1
+		}
+		if stop == 0 || stop >= uidNext {
+			stop = uidNext - 1
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+
+		// Gaps between existing messages are added as ranges so large
+		// sets are handled without enumerating them.
+		rows, err := m.parent.msgIdsUid.Query(m.id, start, stop)
+		if err != nil {
+			return nil, err
+		}
+		next := start
+		for rows.Next() {
+			var uid uint32
+			if err := rows.Scan(&uid); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if uid > next {
+				res.AddRange(next, uid-1)
+			}
+			next = uid + 1
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rows.Close()
+		if next <= stop {
+			res.AddRange(next, stop)
+		}
+	}
+
+	return res, nil
+}
+
+// filterUnchangedSince splits the UID set into messages that have
+// modification sequence not greater than unchangedSince (returned as
+// unchanged) and messages that were changed after it.
+func (m *Mailbox) filterUnchangedSince(tx *sql.Tx, seqset *imap.SeqSet, unchangedSince uint64) (unchanged, modified *imap.SeqSet, err error) {
+	unchanged = &imap.SeqSet{}
+	modified = &imap.SeqSet{}
+
+	for _, seq := range seqset.Set {
+		rows, err := tx.Stmt(m.parent.msgModSeqUid).Query(m.id, seq.Start, seq.Stop)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var (
+				msgId  uint32
+				modSeq uint64
+			)
+			if err := rows.Scan(&msgId, &modSeq); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			if modSeq > unchangedSince {
+				modified.AddNum(msgId)
+			} else {
+				unchanged.AddNum(msgId)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		rows.Close()
+	}
+
+	return unchanged, modified, nil
+}
@@ -0,0 +1,216 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestModSeqIncrements(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	initial, err := mbox.HighestModSeq()
+	assert.NilError(t, err)
+
+	for i := 0; i < 3; i++ {
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	afterCreate, err := mbox.HighestModSeq()
+	assert.NilError(t, err)
+	assert.Equal(t, afterCreate, initial+3)
+
+	seq, _ := imap.ParseSeqSet("2")
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.FlaggedFlag}))
+
+	afterStore, err := mbox.HighestModSeq()
+	assert.NilError(t, err)
+	assert.Equal(t, afterStore, afterCreate+1)
+
+	t.Run("fetch modseq", func(t *testing.T) {
+		seq, _ := imap.ParseSeqSet("1:*")
+		ch := make(chan *imap.Message, 10)
+		assert.NilError(t, mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, FetchModSeq}, ch))
+		assert.Assert(t, is.Len(ch, 3))
+		for msg := range ch {
+			modSeq := msg.Items[FetchModSeq].([]interface{})[0].(uint64)
+			if msg.Uid == 2 {
+				assert.Equal(t, modSeq, afterStore)
+			} else {
+				assert.Assert(t, modSeq <= afterCreate)
+			}
+		}
+	})
+	t.Run("changedsince", func(t *testing.T) {
+		seq, _ := imap.ParseSeqSet("1:*")
+		ch := make(chan *imap.Message, 10)
+		assert.NilError(t, mbox.ListMessagesChangedSince(true, seq, []imap.FetchItem{imap.FetchUid}, afterCreate, ch))
+		assert.Assert(t, is.Len(ch, 1))
+		msg := <-ch
+		assert.Equal(t, msg.Uid, uint32(2))
+		_, ok := msg.Items[FetchModSeq]
+		assert.Assert(t, ok, "MODSEQ is not implicitly included")
+	})
+	t.Run("status", func(t *testing.T) {
+		status, err := usr.Status(mbox.Name(), []imap.StatusItem{StatusHighestModSeq})
+		assert.NilError(t, err)
+		assert.Equal(t, status.Items[StatusHighestModSeq], afterStore)
+	})
+}
+
+func TestUnchangedSince(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for i := 0; i < 3; i++ {
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	base, err := mbox.HighestModSeq()
+	assert.NilError(t, err)
+
+	seq, _ := imap.ParseSeqSet("3")
+	assert.NilError(t, mbox.UpdateMessagesFlags(false, seq, imap.AddFlags, true, []string{"flag1"}))
+
+	seq, _ = imap.ParseSeqSet("1:3")
+	modified, err := mbox.UpdateMessagesFlagsUnchangedSince(false, seq, imap.AddFlags, true, []string{"flag2"}, base)
+	assert.NilError(t, err)
+	assert.Equal(t, modified.String(), "3")
+
+	res, err := mbox.SearchMessages(false, &imap.SearchCriteria{WithFlags: []string{"flag2"}})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []uint32{1, 2})
+
+	// All messages have modseq > 0, so nothing should be changed.
+	modified, err = mbox.UpdateMessagesFlagsUnchangedSince(true, seq, imap.AddFlags, true, []string{"flag3"}, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, modified.String(), "1:3")
+}
+
+func TestVanished(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	assert.NilError(t, usr.CreateMailbox(t.Name()+"-dst"))
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for i := 0; i < 4; i++ {
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	base, err := mbox.HighestModSeq()
+	assert.NilError(t, err)
+
+	seq, _ := imap.ParseSeqSet("2")
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+	assert.NilError(t, mbox.Expunge())
+
+	afterExpunge, err := mbox.HighestModSeq()
+	assert.NilError(t, err)
+
+	seq, _ = imap.ParseSeqSet("4")
+	assert.NilError(t, mbox.MoveMessages(true, seq, t.Name()+"-dst"))
+
+	vanished, err := mbox.Vanished(nil, base)
+	assert.NilError(t, err)
+	assert.Equal(t, vanished.String(), "2,4")
+
+	vanished, err = mbox.Vanished(nil, afterExpunge)
+	assert.NilError(t, err)
+	assert.Equal(t, vanished.String(), "4")
+
+	known, _ := imap.ParseSeqSet("1:3")
+	vanished, err = mbox.Vanished(known, base)
+	assert.NilError(t, err)
+	assert.Equal(t, vanished.String(), "2")
+}
+
+func TestPruneExpunged(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for i := 0; i < 5; i++ {
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	base, err := mbox.HighestModSeq()
+	assert.NilError(t, err)
+
+	seq, _ := imap.ParseSeqSet("2:3")
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+	assert.NilError(t, mbox.Expunge())
+
+	pruned, err := b.pruneExpunged(time.Now().Add(time.Second))
+	assert.NilError(t, err)
+	assert.Equal(t, pruned, int64(2))
+
+	afterPrune, err := mbox.HighestModSeq()
+	assert.NilError(t, err)
+
+	seq, _ = imap.ParseSeqSet("5")
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+	assert.NilError(t, mbox.Expunge())
+
+	// Entries are kept until the retention period ends.
+	pruned, err = b.pruneExpunged(time.Now().Add(-time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, pruned, int64(0))
+
+	// Older states get all missing UIDs.
+	vanished, err := mbox.Vanished(nil, base)
+	assert.NilError(t, err)
+	assert.Equal(t, vanished.String(), "2:3,5")
+	known, _ := imap.ParseSeqSet("3:*")
+	vanished, err = mbox.Vanished(known, base)
+	assert.NilError(t, err)
+	assert.Equal(t, vanished.String(), "3,5")
+
+	vanished, err = mbox.Vanished(nil, afterPrune)
+	assert.NilError(t, err)
+	assert.Equal(t, vanished.String(), "5")
+
+	// Entries are removed with the mailbox.
+	assert.NilError(t, usr.DeleteMailbox(t.Name()))
+	var count int
+	assert.NilError(t, b.DB.QueryRow(`SELECT COUNT(*) FROM expunged`).Scan(&count))
+	assert.Equal(t, count, 0)
+}
@@ -45,6 +45,22 @@ func (d db) BeginLevel(isolation sql.IsolationLevel, readOnly bool) (*sql.Tx, er
 	})
 }
 
+// execer is implemented by both db and dbTx so schema can be created both by
+// initSchema and by the schema upgrade code.
+type execer interface {
+	Exec(req string, args ...interface{}) (sql.Result, error)
+}
+
+// dbTx wraps the transaction to rewrite queries the same way db does.
+type dbTx struct {
+	d  db
+	tx *sql.Tx
+}
+
+func (t dbTx) Exec(req string, args ...interface{}) (sql.Result, error) {
+	return t.tx.Exec(t.d.rewriteSQL(req), args...)
+}
+
 func (d db) Close() error {
 	return d.DB.Close()
 }
@@ -65,6 +81,7 @@ func (d db) rewriteSQL(req string) (res string) {
 		}
 		res = strings.TrimLeft(res, "\n\t")
 		if strings.HasPrefix(res, "CREATE TABLE") || strings.HasPrefix(res, "ALERT TABLE") {
+			res = strings.Replace(res, "LONGBLOB", "BYTEA", -1)
 			res = strings.Replace(res, "BLOB", "BYTEA", -1)
 			res = strings.Replace(res, "LONGTEXT", "BYTEA", -1)
 			res = strings.Replace(res, "AUTOINCREMENT", "", -1)
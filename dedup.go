@@ -0,0 +1,110 @@
+package imapsql
+
+import (
+	"database/sql"
+)
+
+// Message bodies are deduplicated using the hash of the stored object. Keys
+// in extKeys are shared by all messages with the identical body, including
+// messages of different users, refs counts all of them.
+//
+// The new body is always written to the external store first since its hash
+// is known only after that. If the identical body is already stored, the new
+// object is removed and the existing key is used instead.
+
+// addBodyKey adds the key of the new message body to extKeys and returns the
+// key that should be used by the message. dk is the data key used to encrypt
+// the object, nil if it is not encrypted.
+//
+// If the identical body is already stored, its reference counter is
+// incremented, the new object is deleted from the external store and
+// existing key is returned with dup = true.
+func (b *Backend) addBodyKey(tx *sql.Tx, uid uint64, extBodyKey, bodyHash string, dk *dataKey) (key string, dup bool, err error) {
+	var existing string
+	err = tx.Stmt(b.extKeyByHash).QueryRow(bodyHash).Scan(&existing)
+	switch err {
+	case nil:
+		// refs > 0 condition makes sure the key is not removed by the
+		// concurrent transaction, the row is locked until the end of ours
+		// after that.
+		stats, err := tx.Stmt(b.incrementRef).Exec(existing)
+		if err != nil {
+			return "", false, err
+		}
+		affected, err := stats.RowsAffected()
+		if err != nil {
+			return "", false, err
+		}
+		if affected != 0 {
+			if err := b.deleteExtObjs(tx, []string{extBodyKey}); err != nil {
+				b.Opts.Log.Printf("failed to remove duplicate body %s: %v", extBodyKey, err)
+			}
+			return existing, true, nil
+		}
+	case sql.ErrNoRows:
+	default:
+		return "", false, err
+	}
+
+	if _, err := tx.Stmt(b.addExtKey).Exec(extBodyKey, uid, 1, bodyHash, dk.column()); err != nil {
+		return "", false, err
+	}
+	return extBodyKey, false, nil
+}
+
+// deleteZeroRefKeys removes keys no longer referenced by any messages from
+// extKeys and the full-text index. Messages using them should be removed
+// already.
+//
+// It returns keys of all objects that should be deleted from the external
+// store, including parts no longer used by any body. These are scheduled for
+// deletion using scheduleExtDelete, flushExtDeletes should be called once tx
+// is committed.
+func (b *Backend) deleteZeroRefKeys(tx *sql.Tx, keys []string) ([]string, error) {
+	if err := b.ftsDelete(tx, keys); err != nil {
+		return nil, err
+	}
+	objs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		stats, err := tx.Stmt(b.deleteZeroRef).Exec(key)
+		if err != nil {
+			return nil, err
+		}
+		affected, err := stats.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if affected == 0 {
+			continue
+		}
+		objs = append(objs, key)
+
+		parts, err := b.releaseParts(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, parts...)
+	}
+	if err := b.scheduleExtDelete(tx, objs); err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+// scanKeys reads external store keys returned by the query.
+func scanKeys(rows *sql.Rows, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0, 16)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
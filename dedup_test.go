@@ -0,0 +1,109 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestDedupAcrossUsers(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()+"-1"))
+	assert.NilError(t, b.CreateUser(t.Name()+"-2"))
+	u1, err := b.GetUser(t.Name() + "-1")
+	assert.NilError(t, err)
+	u2, err := b.GetUser(t.Name() + "-2")
+	assert.NilError(t, err)
+
+	_, mbox1, err := u1.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox1.Close()
+	_, mbox2, err := u2.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox2.Close()
+
+	// The identical message is stored by both users, there should be only
+	// one key.
+	assert.NilError(t, u1.CreateMessage("INBOX", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), mbox1))
+	assert.NilError(t, u2.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), mbox2))
+	assert.Assert(t, checkKeysCount(b, 1), "Body is not deduplicated")
+
+	// Different message gets a new key.
+	assert.NilError(t, u2.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg+"\r\nP.S."), mbox2))
+	assert.Assert(t, checkKeysCount(b, 2), "Wrong amount of external store keys")
+
+	// The message is removed by the first user, the second one still uses
+	// the key.
+	assert.NilError(t, mbox1.Poll(true))
+	assert.NilError(t, mbox1.Expunge())
+	assert.Assert(t, checkKeysCount(b, 2), "Shared key is removed")
+
+	assert.NilError(t, mbox2.Poll(true))
+	seq, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox2.ListMessages(false, seq, testMsgFetchItems, ch))
+	assert.Assert(t, is.Len(ch, 1))
+	checkTestMsg(t, <-ch)
+
+	// The user account is removed, no keys should be left.
+	assert.NilError(t, b.DeleteUser(u2.Username()))
+	assert.Assert(t, checkKeysCount(b, 0), "Key is not removed after user removal")
+}
+
+func TestDedupDelivery(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()+"-1"))
+	assert.NilError(t, b.CreateUser(t.Name()+"-2"))
+	assert.NilError(t, b.CreateUser(t.Name()+"-3"))
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-1", textproto.Header{}))
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-2", textproto.Header{}))
+	hdr := textproto.Header{}
+	hdr.Add("Delivered-To", "3@example.org")
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-3", hdr))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	// Recipients without the per-recipient header share the same body.
+	assert.Assert(t, checkKeysCount(b, 2), "Wrong amount of external store keys")
+
+	assert.NilError(t, b.DeleteUser(t.Name()+"-1"))
+	assert.Assert(t, checkKeysCount(b, 2), "Shared key is removed")
+	assert.NilError(t, b.DeleteUser(t.Name()+"-2"))
+	assert.Assert(t, checkKeysCount(b, 1), "Key is not removed after user removal")
+}
+
+func TestDedupDelMessages(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+
+	assert.NilError(t, usr.CreateMailbox(t.Name()+"-1"))
+	_, mbox1, err := usr.GetMailbox(t.Name()+"-1", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox1.Close()
+	assert.NilError(t, usr.CreateMailbox(t.Name()+"-2"))
+
+	// Messages are appended separately and not copied.
+	assert.NilError(t, usr.CreateMessage(mbox1.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox1))
+	assert.NilError(t, usr.CreateMessage(t.Name()+"-2", []string{}, time.Now(), strings.NewReader(testMsg), mbox1))
+	assert.NilError(t, mbox1.Poll(true))
+	assert.Assert(t, checkKeysCount(b, 1), "Body is not deduplicated")
+
+	seq, _ := imap.ParseSeqSet("1")
+	assert.NilError(t, mbox1.(*Mailbox).DelMessages(false, seq))
+	assert.Assert(t, checkKeysCount(b, 1), "Shared key is removed")
+
+	assert.NilError(t, usr.DeleteMailbox(t.Name()+"-2"))
+	assert.Assert(t, checkKeysCount(b, 0), "Key is not removed after mbox removal")
+}
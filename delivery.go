@@ -7,6 +7,7 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-imap/backend"
@@ -35,6 +36,7 @@ func (b *Backend) NewDelivery() Delivery {
 func (d *Delivery) clean() {
 	d.users = d.users[0:0]
 	d.mboxes = d.mboxes[0:0]
+	d.sharedMboxes = d.sharedMboxes[0:0]
 	d.extKey = ""
 	for k := range d.perRcptHeader {
 		delete(d.perRcptHeader, k)
@@ -46,6 +48,7 @@ type Delivery struct {
 	tx            *sql.Tx
 	users         []User
 	mboxes        []Mailbox
+	sharedMboxes  []Mailbox
 	extKey        string
 	perRcptHeader map[string]textproto.Header
 	flagOverrides map[string][]string
@@ -65,8 +68,45 @@ type Delivery struct {
 // Fields from userHeader, if any, will be prepended to the message header
 // *only* for that recipient. Use this to add Received and Delivered-To
 // fields with recipient-specific information (e.g. its address).
+//
+// ErrUserDisabled is returned for disabled accounts, messages are still
+// delivered to locked ones. ErrDomainDisabled is returned for accounts in
+// disabled domains.
+//
+// username can be an alias or match a domain catch-all, see
+// Backend.AddAlias. The message is delivered only once to each account, the
+// userHeader passed first is used.
+//
+// If username starts with SharedPrefix (in any case), the message is
+// delivered to the corresponding mailbox in the "Shared" namespace if
+// AnyoneIdentifier has RightPost on it, ErrPermissionDenied is returned
+// otherwise. Mailbox and SpecialMailbox calls do not change the target
+// mailbox for such recipients. SharedUsername itself is not a valid
+// recipient.
 func (d *Delivery) AddRcpt(username string, userHeader textproto.Header) error {
-	username = normalizeUsername(username)
+	username = normalizeRcpt(username)
+	if strings.HasPrefix(username, SharedPrefix) {
+		return d.addSharedRcpt(strings.TrimPrefix(username, SharedPrefix), userHeader)
+	}
+
+	username, err := d.b.resolveAlias(nil, username, true)
+	if err != nil {
+		return err
+	}
+	// Mailboxes of the pseudo-user are accessible only using SharedPrefix
+	// so ACL is checked.
+	if username == SharedUsername {
+		return ErrUserDoesntExists
+	}
+	if err := d.b.checkDomain(username); err != nil {
+		return err
+	}
+	for _, u := range d.users {
+		// Both the alias and the account itself are recipients.
+		if u.username == username {
+			return nil
+		}
+	}
 
 	uid, inboxId, err := d.b.getUserMeta(nil, username)
 	if err != nil {
@@ -75,6 +115,13 @@ func (d *Delivery) AddRcpt(username string, userHeader textproto.Header) error {
 		}
 		return err
 	}
+	state, err := d.b.stateOf(uid)
+	if err != nil {
+		return err
+	}
+	if state == UserDisabled {
+		return ErrUserDisabled
+	}
 	d.users = append(d.users, User{id: uid, username: username, parent: d.b, inboxId: inboxId})
 
 	d.perRcptHeader[username] = userHeader
@@ -82,6 +129,55 @@ func (d *Delivery) AddRcpt(username string, userHeader textproto.Header) error {
 	return nil
 }
 
+func (d *Delivery) addSharedRcpt(mboxName string, userHeader textproto.Header) error {
+	owner, err := d.b.sharedUser(nil)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return backend.ErrNoSuchMailbox
+		}
+		return err
+	}
+
+	_, mboxI, err := owner.GetMailbox(mboxName, false, nil)
+	if err != nil {
+		return err
+	}
+	mbox := mboxI.(*Mailbox)
+
+	// Senders are not authenticated so only rights granted to anyone apply.
+	rights, err := d.b.rightsOf(mbox.id, AnyoneIdentifier)
+	if err != nil {
+		return err
+	}
+	if !strings.ContainsRune(rights, RightPost) {
+		return ErrPermissionDenied
+	}
+	d.sharedMboxes = append(d.sharedMboxes, *mbox)
+
+	d.perRcptHeader[rcptKey(mbox)] = userHeader
+
+	return nil
+}
+
+// normalizeRcpt returns the recipient in the form used as the key for
+// per-recipient information. The SharedPrefix is matched case-insensitively,
+// names of shared mailboxes are case-sensitive.
+func normalizeRcpt(rcpt string) string {
+	if len(rcpt) >= len(SharedPrefix) && strings.EqualFold(rcpt[:len(SharedPrefix)], SharedPrefix) {
+		return SharedPrefix + rcpt[len(SharedPrefix):]
+	}
+	return normalizeUsername(rcpt)
+}
+
+// rcptKey returns the key used to store per-recipient information for the
+// target mailbox.
+func rcptKey(mbox *Mailbox) string {
+	if mbox.user.username == SharedUsername {
+		return SharedPrefix + mbox.name
+	}
+	return mbox.user.username
+}
+
 // FIXME: Fix that goddamned code duplication.
 
 // Mailbox command changes the target mailbox for all recipients.
@@ -184,6 +280,7 @@ func (d *Delivery) UserMailbox(username, mailbox string, flags []string) {
 		d.flagOverrides = make(map[string][]string)
 	}
 
+	username = normalizeRcpt(username)
 	d.mboxOverrides[username] = mailbox
 	d.flagOverrides[username] = flags
 }
@@ -227,12 +324,16 @@ func (d *Delivery) BodyParsed(header textproto.Header, bodyLen int, body Buffer)
 		}
 	}
 
+	targets := make([]Mailbox, 0, len(d.mboxes)+len(d.sharedMboxes))
+	targets = append(targets, d.mboxes...)
+	targets = append(targets, d.sharedMboxes...)
+
 	// Make sure all auto-generated statements are generated before we start transaction
 	// so it will not cause deadlocks on SQlite when statement is prepared outside
 	// of transaction while transaction is running.
-	for _, mbox := range d.mboxes {
-		if len(d.flagOverrides[mbox.user.username]) != 0 {
-			_, err := d.b.getFlagsAddStmt(len(d.flagOverrides[mbox.user.username]))
+	for _, mbox := range targets {
+		if flags := d.flagOverrides[rcptKey(&mbox)]; len(flags) != 0 {
+			_, err := d.b.getFlagsAddStmt(len(flags))
 			if err != nil {
 				return wrapErr(err, "Body")
 			}
@@ -247,10 +348,10 @@ func (d *Delivery) BodyParsed(header textproto.Header, bodyLen int, body Buffer)
 		return wrapErr(err, "Body")
 	}
 
-	for _, mbox := range d.mboxes {
+	for _, mbox := range targets {
 		var flagsStmt *sql.Stmt
-		if len(d.flagOverrides[mbox.user.username]) != 0 {
-			flagsStmt, err = d.b.getFlagsAddStmt(len(d.flagOverrides[mbox.user.username]))
+		if flags := d.flagOverrides[rcptKey(&mbox)]; len(flags) != 0 {
+			flagsStmt, err = d.b.getFlagsAddStmt(len(flags))
 			if err != nil {
 				return wrapErr(err, "Body")
 			}
@@ -267,7 +368,7 @@ func (d *Delivery) BodyParsed(header textproto.Header, bodyLen int, body Buffer)
 
 func (d *Delivery) mboxDelivery(header textproto.Header, mbox Mailbox, bodyLen int64, body Buffer, date time.Time, flagsStmt *sql.Stmt) (err error) {
 	header = header.Copy()
-	userHeader := d.perRcptHeader[mbox.user.username]
+	userHeader := d.perRcptHeader[rcptKey(&mbox)]
 	for fields := userHeader.Fields(); fields.Next(); {
 		header.Add(fields.Key(), fields.Value())
 	}
@@ -283,26 +384,68 @@ func (d *Delivery) mboxDelivery(header textproto.Header, mbox Mailbox, bodyLen i
 		return err
 	}
 
-	bodyStruct, cachedHeader, extBodyKey, err := d.b.processParsedBody(headerBlob.Bytes(), header, bodyReader, bodyLen)
+	dk, err := d.b.userDataKey(d.tx, mbox.user.id)
+	if err != nil {
+		return wrapErr(err, "Body (userDataKey)")
+	}
+	bodyStruct, cachedHeader, stored, err := d.b.processParsedBody(d.tx, dk, headerBlob.Bytes(), header, bodyReader, bodyLen)
 	if err != nil {
 		return err
 	}
 
-	if _, err = d.tx.Stmt(d.b.addExtKey).Exec(extBodyKey, mbox.user.id, 1); err != nil {
-		d.b.extStore.Delete([]string{extBodyKey})
+	// Recipients without per-recipient header fields get the identical body
+	// and share the same object.
+	extBodyKey, newKeys, err := d.b.addBody(d.tx, mbox.user.id, stored)
+	if err != nil {
+		d.b.deleteExtObjs(d.tx, stored.keys())
 		return wrapErr(err, "Body (addExtKey)")
 	}
+	if len(newKeys) != 0 && d.b.indexMessage(dk) {
+		if err := d.b.ftsIndex(d.tx, extBodyKey, d.b.Opts.CompressAlgo); err != nil {
+			d.b.deleteExtObjs(d.tx, newKeys)
+			return wrapErr(err, "Body (ftsIndex)")
+		}
+	}
 
 	// Note that we are extremely careful here with ordering to
 	// decrease change of deadlocks as a result of transaction
 	// serialization.
 
+	emailId, threadId, err := d.b.newMessageIds(d.tx, mbox.user.id, cachedHeader)
+	if err != nil {
+		d.b.deleteExtObjs(d.tx, newKeys)
+		return wrapErr(err, "Body (newMessageIds)")
+	}
+
 	// --- operations that involve mboxes table ---
 	msgId, err := mbox.incrementMsgCounters(d.tx)
 	if err != nil {
-		d.b.extStore.Delete([]string{extBodyKey})
+		d.b.deleteExtObjs(d.tx, newKeys)
 		return wrapErr(err, "Body (incrementMsgCounters)")
 	}
+	modSeq, err := d.b.incrementModSeq(d.tx, mbox.id)
+	if err != nil {
+		d.b.deleteExtObjs(d.tx, newKeys)
+		return wrapErr(err, "Body (incrementModSeq)")
+	}
+	if err := d.b.addUsage(d.tx, mbox.user.id, mbox.id, 1, length); err != nil {
+		d.b.deleteExtObjs(d.tx, newKeys)
+		return wrapErr(err, "Body (addUsage)")
+	}
+	if err := d.b.checkMboxQuota(d.tx, mbox.id); err != nil {
+		d.b.deleteExtObjs(d.tx, newKeys)
+		if err == ErrQuotaExceeded {
+			return err
+		}
+		return wrapErr(err, "Body (checkMboxQuota)")
+	}
+	if err := d.b.checkUserQuota(d.tx, mbox.user.id); err != nil {
+		d.b.deleteExtObjs(d.tx, newKeys)
+		if err == ErrQuotaExceeded {
+			return err
+		}
+		return wrapErr(err, "Body (checkUserQuota)")
+	}
 
 	// --- operations that involve msgs table ---
 	persistRecent := 0
@@ -310,25 +453,37 @@ func (d *Delivery) mboxDelivery(header textproto.Header, mbox Mailbox, bodyLen i
 		persistRecent = 1
 	}
 
+	sealedStruct, sealedHeader, err := d.b.sealMetadata(dk, bodyStruct, cachedHeader)
+	if err != nil {
+		d.b.deleteExtObjs(d.tx, newKeys)
+		return wrapErr(err, "Body (sealMetadata)")
+	}
 	_, err = d.tx.Stmt(d.b.addMsg).Exec(
 		mbox.id, msgId, date.Unix(),
 		length,
-		bodyStruct, cachedHeader, extBodyKey,
-		0, d.b.Opts.CompressAlgo, persistRecent,
+		sealedStruct, sealedHeader, extBodyKey,
+		0, d.b.Opts.CompressAlgo, persistRecent, modSeq,
+		emailId, threadId, stored.contentHash,
 	)
 	if err != nil {
-		d.b.extStore.Delete([]string{extBodyKey})
+		d.b.deleteExtObjs(d.tx, newKeys)
 		return wrapErr(err, "Body (addMsg)")
 	}
+	if d.b.indexMessage(dk) {
+		if err := d.b.addMsgHeaders(d.tx, mbox.id, msgId, cachedHeader); err != nil {
+			d.b.deleteExtObjs(d.tx, newKeys)
+			return wrapErr(err, "Body (addMsgHeaders)")
+		}
+	}
 	// --- end of operations that involve msgs table ---
 
 	// --- operations that involve flags table ---
-	flags := d.flagOverrides[mbox.user.username]
+	flags := d.flagOverrides[rcptKey(&mbox)]
 	if len(flags) != 0 {
 
 		params := mbox.makeFlagsAddStmtArgs(flags, msgId, msgId)
 		if _, err := d.tx.Stmt(flagsStmt).Exec(params...); err != nil {
-			d.b.extStore.Delete([]string{extBodyKey})
+			d.b.deleteExtObjs(d.tx, newKeys)
 			return wrapErr(err, "Body (flagsStmt)")
 		}
 	}
@@ -344,7 +499,7 @@ func (d *Delivery) Abort() error {
 		}
 	}
 	if d.extKey != "" {
-		if err := d.b.extStore.Delete([]string{d.extKey}); err != nil {
+		if err := d.b.deleteExtObjs(nil, []string{d.extKey}); err != nil {
 			return err
 		}
 	}
@@ -371,10 +526,10 @@ func (d *Delivery) Commit() error {
 	return nil
 }
 
-func (b *Backend) processParsedBody(headerInput []byte, header textproto.Header, bodyLiteral io.Reader, bodyLen int64) (bodyStruct, cachedHeader []byte, extBodyKey string, err error) {
-	extBodyKey, err = randomKey()
+func (b *Backend) processParsedBody(tx *sql.Tx, dk *dataKey, headerInput []byte, header textproto.Header, bodyLiteral io.Reader, bodyLen int64) (bodyStruct, cachedHeader []byte, body storedBody, err error) {
+	extBodyKey, err := randomKey()
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, storedBody{}, err
 	}
 
 	objSize := int64(len(headerInput)) + bodyLen
@@ -382,41 +537,84 @@ func (b *Backend) processParsedBody(headerInput []byte, header textproto.Header,
 		objSize = -1
 	}
 
-	extWriter, err := b.extStore.Create(extBodyKey, objSize)
+	extWriter, err := b.createExtObj(tx, extBodyKey, objSize)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, storedBody{}, err
 	}
 	defer extWriter.Close()
 
-	compressW, err := b.compressAlgo.WrapCompress(extWriter, b.Opts.CompressAlgoParams)
+	hash := newBodyHash(dk)
+	encW, err := wrapEncrypt(extWriter, dk, extBodyKey)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, storedBody{}, err
 	}
-	defer compressW.Close()
+	compressW, err := b.compressAlgo.WrapCompress(io.MultiWriter(encW, hash), b.Opts.CompressAlgoParams)
+	if err != nil {
+		return nil, nil, storedBody{}, err
+	}
+	defer func() {
+		if compressW != nil {
+			compressW.Close()
+		}
+	}()
 
-	if _, err := compressW.Write(headerInput); err != nil {
-		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", err
+	splitter := b.newPartSplitter(tx, dk, compressW)
+	success := false
+	defer func() {
+		if !success {
+			splitter.abort()
+		}
+	}()
+
+	contentHash := newBodyHash(dk)
+	contentHash.Write(headerInput)
+	if _, err := splitter.Write(headerInput); err != nil {
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, err
 	}
 
-	bufferedBody := bufio.NewReader(io.TeeReader(bodyLiteral, compressW))
+	bufferedBody := bufio.NewReader(io.TeeReader(bodyLiteral, io.MultiWriter(splitter, contentHash)))
 	bodyStruct, cachedHeader, err = extractCachedData(header, bufferedBody)
 	if err != nil {
-		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", err
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, err
 	}
 
 	// Consume all remaining body so io.TeeReader used with external store will
 	// copy everything to extWriter.
 	_, err = io.Copy(ioutil.Discard, bufferedBody)
 	if err != nil {
-		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", err
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, err
+	}
+
+	if err := splitter.Close(); err != nil {
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, err
+	}
+
+	// Compressed stream should be finished before the object is synced,
+	// some ExternalStore implementations do not accept writes after that.
+	err = compressW.Close()
+	compressW = nil
+	if err != nil {
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, err
+	}
+	if err := encW.Close(); err != nil {
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, err
 	}
 
 	if err := extWriter.Sync(); err != nil {
-		return nil, nil, "", err
+		return nil, nil, storedBody{}, err
+	}
+	// Object may become visible only after it is closed (e.g. FSStore).
+	if err := extWriter.Close(); err != nil {
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, err
 	}
 
-	return
+	success = true
+	return bodyStruct, cachedHeader, splitter.body(extBodyKey, hash, contentHash), nil
 }
@@ -0,0 +1,337 @@
+package imapsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+var (
+	ErrDomainAlreadyExists = errors.New("imap: domain already exists")
+	ErrDomainDoesntExist   = errors.New("imap: domain doesn't exist")
+	ErrDomainDisabled      = errors.New("imap: domain is disabled")
+)
+
+// NoLimit can be used as the resource value for Backend.SetQuota to remove the
+// per-user limit without falling back to the default of the user's domain.
+const NoLimit = ^uint64(0)
+
+// NoMsgSizeLimit can be passed to User.SetMessageLimit to remove the per-user
+// APPENDLIMIT without falling back to the default of the user's domain,
+// Opts.MaxMsgBytes is used instead.
+const NoMsgSizeLimit = ^uint32(0)
+
+// noLimitValue is stored in per-user limit columns for NoLimit and
+// NoMsgSizeLimit. NULL means that the default of the domain is used.
+const noLimitValue = -1
+
+// limitValue converts the limit to the value stored in the database, unit is
+// the number of stored units in one unit of val. NoLimit is stored as NULL
+// unless perUser is set.
+func limitValue(val, unit uint64, perUser bool) sql.NullInt64 {
+	if val == NoLimit {
+		if perUser {
+			return sql.NullInt64{Int64: noLimitValue, Valid: true}
+		}
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(val * unit), Valid: true}
+}
+
+// DomainSettings are defaults and restrictions applied to all users with
+// usernames in the domain.
+type DomainSettings struct {
+	// APPENDLIMIT for users without own limit, nil means that
+	// Opts.MaxMsgBytes is used. Users can be excluded by setting their
+	// limit to NoMsgSizeLimit.
+	MsgSizeLimit *uint32
+
+	// Limits of the per-user quota root for users without own limits, in
+	// the same format as for Backend.SetQuota. Users can be excluded by setting
+	// their limits to NoLimit.
+	Quota map[string]uint64
+
+	// Mailboxes created along with INBOX for new users.
+	DefaultMailboxes []DefaultMailbox
+
+	// Users of the disabled domain can't log in and messages addressed to
+	// them are rejected with ErrDomainDisabled.
+	Disabled bool
+}
+
+// DefaultMailbox is the mailbox created for new users of the domain.
+type DefaultMailbox struct {
+	Name string
+	// SPECIAL-USE attribute of the mailbox, optional.
+	SpecialUse string `json:",omitempty"`
+}
+
+// SplitUsername splits the username into the local part and the domain at
+// the last @. Domain is empty if username does not contain @.
+func SplitUsername(username string) (localPart, domain string) {
+	i := strings.LastIndexByte(username, '@')
+	if i == -1 {
+		return username, ""
+	}
+	return username[:i], username[i+1:]
+}
+
+func domainOf(username string) string {
+	_, domain := SplitUsername(username)
+	return domain
+}
+
+// backfillUserDomains sets domain column for users created before schema
+// version 20.
+func (b *Backend) backfillUserDomains(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, username FROM users`)
+	if err != nil {
+		return err
+	}
+	domains := make(map[uint64]string)
+	for rows.Next() {
+		var (
+			id       uint64
+			username string
+		)
+		if err := rows.Scan(&id, &username); err != nil {
+			rows.Close()
+			return err
+		}
+		if domain := domainOf(username); domain != "" {
+			domains[id] = domain
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	setDomain, err := tx.Prepare(b.db.rewriteSQL(`
+		UPDATE users SET domain = ?
+		WHERE id = ?`))
+	if err != nil {
+		return err
+	}
+	defer setDomain.Close()
+	for id, domain := range domains {
+		if _, err := setDomain.Exec(domain, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDomain returns ErrDomainDisabled if the domain of the username is
+// disabled.
+func (b *Backend) checkDomain(username string) error {
+	domain := domainOf(username)
+	if domain == "" {
+		return nil
+	}
+	var disabled bool
+	if err := b.domainDisabled.QueryRow(domain).Scan(&disabled); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if disabled {
+		return ErrDomainDisabled
+	}
+	return nil
+}
+
+// createDefaultMboxes creates mailboxes listed in settings of the domain of
+// the new user.
+func (b *Backend) createDefaultMboxes(tx *sql.Tx, u *User) error {
+	domain := domainOf(u.username)
+	if domain == "" {
+		return nil
+	}
+	var encoded string
+	if err := tx.Stmt(b.domainMboxes).QueryRow(domain).Scan(&encoded); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	mboxes, err := decodeDefaultMboxes(encoded)
+	if err != nil {
+		return err
+	}
+
+	for _, mbox := range mboxes {
+		if err := u.createParentDirs(tx, mbox.Name); err != nil {
+			return err
+		}
+		objectId, err := newObjectId(mailboxIdPrefix)
+		if err != nil {
+			return err
+		}
+		var specialUse interface{}
+		if mbox.SpecialUse != "" {
+			specialUse = mbox.SpecialUse
+		}
+		if _, err := tx.Stmt(b.createMbox).Exec(u.id, mbox.Name, b.prng.Uint32(), specialUse, objectId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeDefaultMboxes(encoded string) ([]DefaultMailbox, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	var mboxes []DefaultMailbox
+	if err := json.Unmarshal([]byte(encoded), &mboxes); err != nil {
+		return nil, err
+	}
+	return mboxes, nil
+}
+
+// CreateDomain adds the domain so settings can be set for it using
+// SetDomainSettings. Users can be created in domains that were not added,
+// no settings are applied to them.
+func (b *Backend) CreateDomain(name string) error {
+	if _, err := b.addDomain.Exec(strings.ToLower(name)); err != nil {
+		if isForeignKeyErr(err) {
+			return ErrDomainAlreadyExists
+		}
+		return wrapErr(err, "CreateDomain")
+	}
+	return nil
+}
+
+// DeleteDomain removes settings of the domain. Users of the domain are not
+// removed.
+func (b *Backend) DeleteDomain(name string) error {
+	stats, err := b.delDomain.Exec(strings.ToLower(name))
+	if err != nil {
+		return wrapErr(err, "DeleteDomain")
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		return wrapErr(err, "DeleteDomain")
+	}
+	if affected == 0 {
+		return ErrDomainDoesntExist
+	}
+	return nil
+}
+
+// ListDomains returns names of domains added using CreateDomain.
+func (b *Backend) ListDomains() ([]string, error) {
+	names, err := scanKeys(b.listDomains.Query())
+	return names, wrapErr(err, "ListDomains")
+}
+
+// ListDomainUsers returns usernames of users in the domain, the domain
+// doesn't have to be added using CreateDomain. Use empty domain to list
+// users without domain part.
+func (b *Backend) ListDomainUsers(domain string) ([]string, error) {
+	names, err := scanKeys(b.listDomainUsers.Query(strings.ToLower(domain)))
+	if err != nil {
+		return nil, wrapErr(err, "ListDomainUsers")
+	}
+	res := names[:0]
+	for _, name := range names {
+		if name != SharedUsername {
+			res = append(res, name)
+		}
+	}
+	return res, nil
+}
+
+// GetDomainSettings returns settings of the domain.
+func (b *Backend) GetDomainSettings(name string) (*DomainSettings, error) {
+	var (
+		msgSizeLimit, msgsLimit, storageLimit sql.NullInt64
+		encodedMboxes                         string
+		settings                              DomainSettings
+	)
+	err := b.domainSettings.QueryRow(strings.ToLower(name)).Scan(&msgSizeLimit, &msgsLimit, &storageLimit, &encodedMboxes, &settings.Disabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrDomainDoesntExist
+		}
+		return nil, wrapErr(err, "GetDomainSettings")
+	}
+
+	if msgSizeLimit.Valid {
+		val := uint32(msgSizeLimit.Int64)
+		settings.MsgSizeLimit = &val
+	}
+	settings.Quota = make(map[string]uint64)
+	if msgsLimit.Valid {
+		settings.Quota[QuotaMessage] = uint64(msgsLimit.Int64)
+	}
+	if storageLimit.Valid {
+		settings.Quota[QuotaStorage] = uint64(storageLimit.Int64) / 1024
+	}
+	settings.DefaultMailboxes, err = decodeDefaultMboxes(encodedMboxes)
+	if err != nil {
+		return nil, wrapErr(err, "GetDomainSettings")
+	}
+	return &settings, nil
+}
+
+// SetDomainSettings replaces settings of the domain. Changes of default
+// mailboxes apply only to users created later.
+func (b *Backend) SetDomainSettings(name string, settings DomainSettings) error {
+	var msgSizeLimit, msgsLimit, storageLimit sql.NullInt64
+	if settings.MsgSizeLimit != nil && *settings.MsgSizeLimit != NoMsgSizeLimit {
+		msgSizeLimit = sql.NullInt64{Int64: int64(*settings.MsgSizeLimit), Valid: true}
+	}
+	for resource, val := range settings.Quota {
+		switch resource {
+		case QuotaMessage:
+			msgsLimit = limitValue(val, 1, false)
+		case QuotaStorage:
+			storageLimit = limitValue(val, 1024, false)
+		default:
+			return ErrUnsupportedQuotaResource
+		}
+	}
+
+	for _, mbox := range settings.DefaultMailboxes {
+		if mbox.Name == "" || strings.EqualFold(mbox.Name, "INBOX") || isForeignMailbox(mbox.Name) {
+			return errors.New("SetDomainSettings: invalid default mailbox name: " + mbox.Name)
+		}
+		switch mbox.SpecialUse {
+		case "", imap.ArchiveAttr, imap.DraftsAttr, imap.JunkAttr, imap.SentAttr, imap.TrashAttr:
+		default:
+			return ErrUnsupportedSpecialAttr
+		}
+	}
+	encodedMboxes := ""
+	if len(settings.DefaultMailboxes) != 0 {
+		encoded, err := json.Marshal(settings.DefaultMailboxes)
+		if err != nil {
+			return wrapErr(err, "SetDomainSettings")
+		}
+		encodedMboxes = string(encoded)
+	}
+
+	disabled := 0
+	if settings.Disabled {
+		disabled = 1
+	}
+
+	stats, err := b.setDomainSettings.Exec(msgSizeLimit, msgsLimit, storageLimit, encodedMboxes, disabled, strings.ToLower(name))
+	if err != nil {
+		return wrapErr(err, "SetDomainSettings")
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		return wrapErr(err, "SetDomainSettings")
+	}
+	if affected == 0 {
+		return ErrDomainDoesntExist
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestSplitUsername(t *testing.T) {
+	for _, c := range []struct {
+		username, local, domain string
+	}{
+		{"user", "user", ""},
+		{"user@example.org", "user", "example.org"},
+		{"\"a@b\"@example.org", "\"a@b\"", "example.org"},
+		{"user@", "user", ""},
+	} {
+		local, domain := SplitUsername(c.username)
+		assert.Equal(t, local, c.local, c.username)
+		assert.Equal(t, domain, c.domain, c.username)
+	}
+}
+
+func TestDomainSettings(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+
+	_, err := b.GetDomainSettings("example.org")
+	assert.Equal(t, err, ErrDomainDoesntExist)
+	assert.Equal(t, b.SetDomainSettings("example.org", DomainSettings{}), ErrDomainDoesntExist)
+	assert.NilError(t, b.CreateDomain("Example.org"))
+	assert.Equal(t, b.CreateDomain("example.org"), ErrDomainAlreadyExists)
+	list, err := b.ListDomains()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, list, []string{"example.org"})
+
+	// User created before settings are changed.
+	assert.NilError(t, b.CreateUser("old@example.org"))
+
+	limit := uint32(100000)
+	settings := DomainSettings{
+		MsgSizeLimit: &limit,
+		Quota:        map[string]uint64{QuotaMessage: 1},
+		DefaultMailboxes: []DefaultMailbox{
+			{Name: "Sent", SpecialUse: imap.SentAttr},
+			{Name: "Archive.2020"},
+		},
+	}
+	assert.Equal(t, b.SetDomainSettings("example.org", DomainSettings{
+		DefaultMailboxes: []DefaultMailbox{{Name: "inbox"}},
+	}).Error(), "SetDomainSettings: invalid default mailbox name: inbox")
+	assert.Equal(t, b.SetDomainSettings("example.org", DomainSettings{
+		DefaultMailboxes: []DefaultMailbox{{Name: "All", SpecialUse: imap.AllAttr}},
+	}), ErrUnsupportedSpecialAttr)
+	assert.NilError(t, b.SetDomainSettings("example.org", settings))
+	stored, err := b.GetDomainSettings("EXAMPLE.org")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *stored, settings)
+
+	assert.NilError(t, b.CreateUser("User@Example.org"))
+	assert.NilError(t, b.CreateUser("user@example.com"))
+	u, err := b.GetUser("user@example.org")
+	assert.NilError(t, err)
+	other, err := b.GetUser("user@example.com")
+	assert.NilError(t, err)
+
+	mboxes, err := u.ListMailboxes(false)
+	assert.NilError(t, err)
+	attrs := make(map[string][]string, len(mboxes))
+	for _, info := range mboxes {
+		attrs[info.Name] = info.Attributes
+	}
+	assert.Equal(t, len(attrs), 4)
+	assert.Assert(t, is.Contains(attrs["Sent"], imap.SentAttr))
+	assert.Assert(t, is.Contains(attrs, "Archive"))
+	assert.Assert(t, is.Contains(attrs, "Archive.2020"))
+	mboxes, err = other.ListMailboxes(false)
+	assert.NilError(t, err)
+	assert.Equal(t, len(mboxes), 1)
+
+	// Limits apply to users without own ones, including existing users.
+	assert.Equal(t, *u.(*User).CreateMessageLimit(), limit)
+	assert.Assert(t, other.(*User).CreateMessageLimit() == nil)
+	old, err := b.GetUser("old@example.org")
+	assert.NilError(t, err)
+	quota, err := old.(*User).GetQuota("")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, quota.Resources, map[string][2]uint64{QuotaMessage: {0, 1}})
+
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	err = u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil)
+	assert.Equal(t, err, ErrQuotaExceeded)
+	assert.NilError(t, b.SetQuota("user@example.org", "", map[string]uint64{QuotaMessage: 2}))
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	userLimit := uint32(10)
+	assert.NilError(t, u.(*User).SetMessageLimit(&userLimit))
+	assert.Equal(t, *u.(*User).CreateMessageLimit(), userLimit)
+
+	// Users can be explicitly unlimited.
+	noLimit := NoMsgSizeLimit
+	assert.NilError(t, u.(*User).SetMessageLimit(&noLimit))
+	assert.Assert(t, u.(*User).CreateMessageLimit() == nil)
+	assert.NilError(t, b.SetQuota("user@example.org", "", map[string]uint64{QuotaMessage: NoLimit}))
+	quota, err = u.(*User).GetQuota("")
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(quota.Resources, 0))
+	assert.NilError(t, u.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, b.SetQuota("user@example.org", "", nil))
+	quota, err = u.(*User).GetQuota("")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, quota.Resources, map[string][2]uint64{QuotaMessage: {3, 1}})
+	assert.NilError(t, u.(*User).SetMessageLimit(nil))
+	assert.Equal(t, *u.(*User).CreateMessageLimit(), limit)
+
+	users, err := b.ListDomainUsers("EXAMPLE.ORG")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, users, []string{"old@example.org", "user@example.org"})
+
+	// Users move between domains when renamed.
+	assert.NilError(t, b.RenameUser("old@example.org", "old@example.com"))
+	users, err = b.ListDomainUsers("example.com")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, users, []string{"old@example.com", "user@example.com"})
+
+	// Settings are no longer applied once the domain is removed.
+	assert.NilError(t, b.DeleteDomain("example.org"))
+	assert.Equal(t, b.DeleteDomain("example.org"), ErrDomainDoesntExist)
+	assert.NilError(t, u.(*User).SetMessageLimit(nil))
+	assert.Assert(t, u.(*User).CreateMessageLimit() == nil)
+}
+
+func TestDomainDisabled(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateDomain("example.org"))
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	assert.NilError(t, b.CreateUser("user@example.com"))
+	assert.NilError(t, b.AddAlias("alias@example.com", "user@example.org"))
+
+	assert.NilError(t, b.SetDomainSettings("example.org", DomainSettings{Disabled: true}))
+
+	_, err := b.Login(nil, "user@example.org", "")
+	assert.Equal(t, err, ErrDomainDisabled)
+	_, err = b.Login(nil, "user@example.com", "")
+	assert.NilError(t, err)
+	// Accounts are not created in disabled domains.
+	_, err = b.Login(nil, "new@example.org", "")
+	assert.Equal(t, err, ErrDomainDisabled)
+	_, err = b.GetUser("new@example.org")
+	assert.Equal(t, err, ErrUserDoesntExists)
+
+	delivery := b.NewDelivery()
+	assert.Equal(t, delivery.AddRcpt("user@example.org", textproto.Header{}), ErrDomainDisabled)
+	assert.Equal(t, delivery.AddRcpt("alias@example.com", textproto.Header{}), ErrDomainDisabled)
+	assert.NilError(t, delivery.AddRcpt("user@example.com", textproto.Header{}))
+	assert.NilError(t, delivery.Abort())
+
+	assert.NilError(t, b.SetDomainSettings("example.org", DomainSettings{}))
+	_, err = b.Login(nil, "user@example.org", "")
+	assert.NilError(t, err)
+}
+
+func TestDomainDisabledAuthenticate(t *testing.T) {
+	b := initTestBackendOpts(Opts{Authenticate: true, PassHashParams: "4"}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateDomain("example.org"))
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	assert.NilError(t, b.SetUserPassword("user@example.org", "password"))
+	assert.NilError(t, b.SetDomainSettings("example.org", DomainSettings{Disabled: true}))
+
+	// Domain state is not disclosed without the correct password.
+	_, err := b.Login(nil, "user@example.org", "wrong")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.Login(nil, "nobody@example.org", "password")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.Login(nil, "user@example.org", "password")
+	assert.Equal(t, err, ErrDomainDisabled)
+}
+
+func TestBackfillUserDomains(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user@example.org"))
+	assert.NilError(t, b.CreateUser("user"))
+
+	// Database created before schema version 20.
+	_, err := b.db.Exec(`UPDATE users SET domain = ''`)
+	assert.NilError(t, err)
+
+	tx, err := b.db.Begin(false)
+	assert.NilError(t, err)
+	assert.NilError(t, b.backfillUserDomains(tx))
+	assert.NilError(t, tx.Commit())
+
+	users, err := b.ListDomainUsers("example.org")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, users, []string{"user@example.org"})
+	users, err = b.ListDomainUsers("")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, users, []string{"user"})
+}
@@ -0,0 +1,552 @@
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+)
+
+// Message bodies are encrypted using per-user data keys if Opts.MasterKeys
+// is set. Data keys are generated randomly, wrapped (encrypted) using the
+// master key and stored in the dataKeys table. Data keys are never removed
+// since messages can be copied to mailboxes of other users.
+//
+// Objects are encrypted using AES-256-GCM in chunks of encChunkSize bytes so
+// they can be written and read without buffering. The nonce of each chunk
+// consists of the random per-object prefix, the chunk counter and the flag
+// marking the last chunk so chunks can't be reordered, dropped or truncated.
+// The object key is used as the additional data.
+//
+// Object format: version byte, nonce prefix, sealed chunks.
+
+const (
+	encVersion    = 1
+	encChunkSize  = 64 * 1024
+	encPrefixSize = 7
+
+	// Prefix of encrypted cached header and body structure values.
+	metadataPrefix = "enc1:"
+)
+
+var ErrDecryptionFailed = errors.New("imapsql: message data can't be decrypted")
+
+// dataKey is the unwrapped per-user data key.
+type dataKey struct {
+	id  string
+	key []byte
+}
+
+// column returns the value stored in the dataKey column of extKeys.
+func (dk *dataKey) column() sql.NullString {
+	if dk == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: dk.id, Valid: true}
+}
+
+// ReadMasterKeys reads hex-encoded master keys, one per line. Empty lines
+// and lines starting with # are ignored.
+//
+// The result can be used as Opts.MasterKeys, so the first key in the file is
+// used for new data keys.
+func ReadMasterKeys(r io.Reader) ([][]byte, error) {
+	var keys [][]byte
+	scnr := bufio.NewScanner(r)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("ReadMasterKeys: %v", err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("ReadMasterKeys: key should be 32 bytes long, got %d", len(key))
+		}
+		keys = append(keys, key)
+	}
+	return keys, scnr.Err()
+}
+
+// masterKeyId returns the identifier of the master key stored along with
+// data keys wrapped using it.
+func masterKeyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(key, plaintext, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func open(key, sealed, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+func (b *Backend) wrapKey(id string, key []byte) (masterId string, wrapped []byte, err error) {
+	master := b.Opts.MasterKeys[0]
+	wrapped, err = seal(master, key, []byte(id))
+	return masterKeyId(master), wrapped, err
+}
+
+func (b *Backend) unwrapKey(id, masterId string, wrapped []byte) ([]byte, error) {
+	for _, master := range b.Opts.MasterKeys {
+		if masterKeyId(master) == masterId {
+			return open(master, wrapped, []byte(id))
+		}
+	}
+	return nil, fmt.Errorf("data key %s is wrapped using unknown master key %s", id, masterId)
+}
+
+// userDataKey returns the data key used to encrypt new messages of the user.
+// The key is created if the user has none. nil is returned if encryption is
+// disabled.
+func (b *Backend) userDataKey(tx *sql.Tx, uid uint64) (*dataKey, error) {
+	if len(b.Opts.MasterKeys) == 0 {
+		return nil, nil
+	}
+
+	var id string
+	err := tx.Stmt(b.userDataKeyId).QueryRow(uid).Scan(&id)
+	if err == sql.ErrNoRows {
+		return b.newDataKey(tx, uid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.getDataKey(tx, id)
+}
+
+func (b *Backend) newDataKey(tx *sql.Tx, uid uint64) (*dataKey, error) {
+	id, err := randomKey()
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	masterId, wrapped, err := b.wrapKey(id, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Stmt(b.addDataKey).Exec(id, uid, masterId, wrapped, time.Now().UnixNano()); err != nil {
+		return nil, err
+	}
+	return &dataKey{id: id, key: key}, nil
+}
+
+// getDataKey returns the data key with the specified ID. Unwrapped keys are
+// cached.
+func (b *Backend) getDataKey(tx *sql.Tx, id string) (*dataKey, error) {
+	b.dataKeysLck.RLock()
+	key, ok := b.dataKeysCache[id]
+	b.dataKeysLck.RUnlock()
+	if ok {
+		return &dataKey{id: id, key: key}, nil
+	}
+
+	stmt := b.dataKeyById
+	if tx != nil {
+		stmt = tx.Stmt(stmt)
+	}
+	var (
+		masterId string
+		wrapped  []byte
+	)
+	if err := stmt.QueryRow(id).Scan(&masterId, &wrapped); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("data key %s does not exist", id)
+		}
+		return nil, err
+	}
+	key, err := b.unwrapKey(id, masterId, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	b.dataKeysLck.Lock()
+	b.dataKeysCache[id] = key
+	b.dataKeysLck.Unlock()
+	return &dataKey{id: id, key: key}, nil
+}
+
+// RotateMasterKey rewraps all data keys using the first key from
+// Opts.MasterKeys. Other master keys can be removed from Opts.MasterKeys
+// after that. It returns the number of rewrapped keys.
+func (b *Backend) RotateMasterKey() (int, error) {
+	if len(b.Opts.MasterKeys) == 0 {
+		return 0, errors.New("RotateMasterKey: no master keys configured")
+	}
+
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return 0, wrapErr(err, "RotateMasterKey")
+	}
+	defer tx.Rollback()
+
+	type wrappedKey struct {
+		id, masterId string
+		wrapped      []byte
+	}
+	var keys []wrappedKey
+	rows, err := tx.Stmt(b.oldDataKeys).Query(masterKeyId(b.Opts.MasterKeys[0]))
+	if err != nil {
+		return 0, wrapErr(err, "RotateMasterKey")
+	}
+	for rows.Next() {
+		var key wrappedKey
+		if err := rows.Scan(&key.id, &key.masterId, &key.wrapped); err != nil {
+			rows.Close()
+			return 0, wrapErr(err, "RotateMasterKey")
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, wrapErr(err, "RotateMasterKey")
+	}
+
+	for _, key := range keys {
+		plain, err := b.unwrapKey(key.id, key.masterId, key.wrapped)
+		if err != nil {
+			return 0, wrapErr(err, "RotateMasterKey")
+		}
+		masterId, wrapped, err := b.wrapKey(key.id, plain)
+		if err != nil {
+			return 0, wrapErr(err, "RotateMasterKey")
+		}
+		if _, err := tx.Stmt(b.rewrapDataKey).Exec(masterId, wrapped, key.id); err != nil {
+			return 0, wrapErr(err, "RotateMasterKey")
+		}
+	}
+
+	return len(keys), tx.Commit()
+}
+
+// RotateUserKey creates the new data key for the user. It is used for
+// messages added after that, existing messages remain encrypted using
+// previous keys.
+func (b *Backend) RotateUserKey(username string) error {
+	if len(b.Opts.MasterKeys) == 0 {
+		return errors.New("RotateUserKey: no master keys configured")
+	}
+
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return wrapErr(err, "RotateUserKey")
+	}
+	defer tx.Rollback()
+
+	uid, _, err := b.getUserMeta(tx, normalizeUsername(username))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesntExists
+		}
+		return wrapErr(err, "RotateUserKey")
+	}
+	if _, err := b.newDataKey(tx, uid); err != nil {
+		return wrapErr(err, "RotateUserKey")
+	}
+	return tx.Commit()
+}
+
+// newBodyHash returns the hash used to find duplicate objects. Hashes of
+// encrypted objects are keyed using the data key so they can't be used to
+// check whether the storage contains a known message and so objects are
+// deduplicated only if they are encrypted using the same key.
+func newBodyHash(dk *dataKey) hash.Hash {
+	if dk == nil {
+		return sha256.New()
+	}
+	return hmac.New(sha256.New, dk.key)
+}
+
+// wrapEncrypt returns the writer that encrypts data using the data key and
+// writes it to w. Close should be called to write the last chunk, it does not
+// close w. Data is written to w unchanged if dk is nil.
+func wrapEncrypt(w io.Writer, dk *dataKey, objKey string) (io.WriteCloser, error) {
+	if dk == nil {
+		return nopCloser{w}, nil
+	}
+
+	aead, err := newAEAD(dk.key)
+	if err != nil {
+		return nil, err
+	}
+	ew := &encWriter{
+		w:    w,
+		aead: aead,
+		ad:   []byte(objKey),
+		buf:  make([]byte, 0, encChunkSize),
+		out:  make([]byte, 0, encChunkSize+aead.Overhead()),
+	}
+
+	header := make([]byte, 1+encPrefixSize)
+	header[0] = encVersion
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, err
+	}
+	copy(ew.nonce[:], header[1:])
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+type encWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	ad      []byte
+	nonce   [12]byte
+	counter uint32
+
+	buf, out []byte
+	closed   bool
+}
+
+func (ew *encWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, errors.New("imapsql: write to closed encWriter")
+	}
+	written := 0
+	for len(p) != 0 {
+		// Full chunk is sealed only once more data is written since the
+		// last chunk is marked differently.
+		if len(ew.buf) == encChunkSize {
+			if err := ew.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):encChunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ew *encWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	return ew.seal(true)
+}
+
+func (ew *encWriter) seal(last bool) error {
+	chunkNonce(&ew.nonce, ew.counter, last)
+	if ew.counter == ^uint32(0) {
+		return errors.New("imapsql: object is too big to be encrypted")
+	}
+	ew.counter++
+
+	ew.out = ew.aead.Seal(ew.out[:0], ew.nonce[:], ew.buf, ew.ad)
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(ew.out)
+	return err
+}
+
+func chunkNonce(nonce *[12]byte, counter uint32, last bool) {
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], counter)
+	nonce[11] = 0
+	if last {
+		nonce[11] = 1
+	}
+}
+
+// wrapDecrypt returns the reader that decrypts data written using
+// wrapEncrypt. r is returned unchanged if dk is nil.
+func wrapDecrypt(r io.Reader, dk *dataKey, objKey string) (io.Reader, error) {
+	if dk == nil {
+		return r, nil
+	}
+
+	aead, err := newAEAD(dk.key)
+	if err != nil {
+		return nil, err
+	}
+	dr := &decReader{
+		r:    r,
+		aead: aead,
+		ad:   []byte(objKey),
+		in:   make([]byte, 0, encChunkSize+aead.Overhead()+1),
+	}
+
+	header := make([]byte, 1+encPrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	if header[0] != encVersion {
+		return nil, fmt.Errorf("imapsql: unknown encryption format version: %d", header[0])
+	}
+	copy(dr.nonce[:], header[1:])
+	return dr, nil
+}
+
+type decReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	ad      []byte
+	nonce   [12]byte
+	counter uint32
+
+	// in contains the next sealed chunk and one more byte that is used to
+	// check whether the chunk is the last one.
+	in   []byte
+	out  []byte
+	done bool
+}
+
+func (dr *decReader) Read(p []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+func (dr *decReader) nextChunk() error {
+	sealedLen := encChunkSize + dr.aead.Overhead()
+
+	n, err := io.ReadFull(dr.r, dr.in[len(dr.in):sealedLen+1])
+	dr.in = dr.in[:len(dr.in)+n]
+	last := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	chunk := dr.in
+	if !last {
+		chunk = dr.in[:sealedLen]
+	}
+	chunkNonce(&dr.nonce, dr.counter, last)
+	dr.counter++
+
+	// Decrypted data is kept in a separate buffer so the lookahead byte
+	// is not overwritten.
+	out, err := dr.aead.Open(dr.out[:0], dr.nonce[:], chunk, dr.ad)
+	if err != nil {
+		return ErrDecryptionFailed
+	}
+	dr.out = out
+
+	if last {
+		dr.done = true
+		dr.in = dr.in[:0]
+	} else {
+		dr.in = append(dr.in[:0], dr.in[sealedLen])
+	}
+	return nil
+}
+
+// useIndexes reports whether the header index and the full-text index
+// contain all messages and can be used for search.
+func (b *Backend) useIndexes() bool {
+	return len(b.Opts.MasterKeys) == 0 || b.Opts.IndexEncrypted
+}
+
+// indexMessage reports whether the message encrypted using dk (nil for
+// plaintext ones) should be added to the header index and the full-text
+// index.
+func (b *Backend) indexMessage(dk *dataKey) bool {
+	return dk == nil || b.Opts.IndexEncrypted
+}
+
+// sealMetadata encrypts the body structure and cached header of the message
+// if Opts.EncryptMetadata is set.
+func (b *Backend) sealMetadata(dk *dataKey, bodyStruct, cachedHeader []byte) ([]byte, []byte, error) {
+	if dk == nil || !b.Opts.EncryptMetadata {
+		return bodyStruct, cachedHeader, nil
+	}
+	sealedStruct, err := sealMetadataBlob(dk, bodyStruct)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealedHeader, err := sealMetadataBlob(dk, cachedHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sealedStruct, sealedHeader, nil
+}
+
+func sealMetadataBlob(dk *dataKey, blob []byte) ([]byte, error) {
+	sealed, err := seal(dk.key, blob, []byte(dk.id))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(metadataPrefix + dk.id + ":" + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openMetadata decrypts the value encrypted by sealMetadata. Other values
+// are returned unchanged.
+func (b *Backend) openMetadata(tx *sql.Tx, blob []byte) ([]byte, error) {
+	if !bytes.HasPrefix(blob, []byte(metadataPrefix)) {
+		return blob, nil
+	}
+	parts := strings.SplitN(string(blob[len(metadataPrefix):]), ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrDecryptionFailed
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	dk, err := b.getDataKey(tx, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return open(dk.key, sealed, []byte(dk.id))
+}
@@ -0,0 +1,292 @@
+package imapsql
+
+import (
+	"bytes"
+	"io/ioutil"
+	nettextproto "net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	backendtests "github.com/foxcpp/go-imap-backend-tests"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func testMasterKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// storedObjects returns contents of all objects in the FSStore.
+func storedObjects(t *testing.T, b *Backend) [][]byte {
+	t.Helper()
+	var objs [][]byte
+	err := filepath.Walk(b.extStore.(*FSStore).Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		objs = append(objs, data)
+		return err
+	})
+	assert.NilError(t, err)
+	return objs
+}
+
+// forgetDataKeys makes the backend unwrap data keys again as if it was
+// restarted.
+func forgetDataKeys(b *Backend) {
+	b.dataKeysLck.Lock()
+	b.dataKeysCache = make(map[string][]byte)
+	b.dataKeysLck.Unlock()
+}
+
+func TestEncryptStream(t *testing.T) {
+	dk := &dataKey{id: "key", key: testMasterKey(1)}
+	for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3 * encChunkSize} {
+		plain := testAttachment(size)
+
+		sealed := bytes.Buffer{}
+		w, err := wrapEncrypt(&sealed, dk, "obj")
+		assert.NilError(t, err)
+		// Odd writes make sure chunking does not depend on them.
+		for data := plain; len(data) != 0; {
+			n := 1000
+			if n > len(data) {
+				n = len(data)
+			}
+			_, err := w.Write(data[:n])
+			assert.NilError(t, err)
+			data = data[n:]
+		}
+		assert.NilError(t, w.Close())
+
+		r, err := wrapDecrypt(bytes.NewReader(sealed.Bytes()), dk, "obj")
+		assert.NilError(t, err)
+		res, err := ioutil.ReadAll(r)
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(res, plain), "Wrong data for size %d", size)
+
+		// Object is bound to its key.
+		r, err = wrapDecrypt(bytes.NewReader(sealed.Bytes()), dk, "another")
+		assert.NilError(t, err)
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, err, ErrDecryptionFailed)
+
+		// Truncation is detected even at the chunk boundary.
+		if size > encChunkSize {
+			cut := 1 + encPrefixSize + encChunkSize + 16
+			r, err = wrapDecrypt(bytes.NewReader(sealed.Bytes()[:cut]), dk, "obj")
+			assert.NilError(t, err)
+			_, err = ioutil.ReadAll(r)
+			assert.Equal(t, err, ErrDecryptionFailed)
+		}
+
+		tampered := append([]byte{}, sealed.Bytes()...)
+		tampered[len(tampered)-1] ^= 1
+		r, err = wrapDecrypt(bytes.NewReader(tampered), dk, "obj")
+		assert.NilError(t, err)
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, err, ErrDecryptionFailed)
+	}
+}
+
+func TestReadMasterKeys(t *testing.T) {
+	keys, err := ReadMasterKeys(strings.NewReader("# New key.\n" + strings.Repeat("01", 32) + "\n\n" + strings.Repeat("AB", 32) + "\n"))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, keys, [][]byte{testMasterKey(0x01), testMasterKey(0xAB)})
+
+	_, err = ReadMasterKeys(strings.NewReader("0102\n"))
+	assert.ErrorContains(t, err, "32 bytes")
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	b := initTestBackendOpts(Opts{
+		MasterKeys:          [][]byte{testMasterKey(1)},
+		EncryptMetadata:     true,
+		AttachmentThreshold: 1024,
+	}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	msg := attachmentMsg("Secret", "Hello!", testAttachment(16*1024), "\r\n")
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), mbox))
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), mbox))
+	assert.NilError(t, mbox.Poll(true))
+	// Deduplication works for messages of the same user.
+	assert.Assert(t, checkKeysCount(b, 2), "Encrypted body is not deduplicated")
+
+	objs := storedObjects(t, b)
+	for _, obj := range objs {
+		assert.Assert(t, !bytes.Contains(obj, []byte("Secret")), "Body is stored in plaintext")
+		assert.Assert(t, !bytes.Contains(obj, []byte(msg[len(msg)-200:len(msg)-100])), "Attachment is stored in plaintext")
+	}
+
+	var cachedHeader, bodyStructure string
+	assert.NilError(t, b.DB.QueryRow(`SELECT cachedHeader, bodyStructure FROM msgs`).Scan(&cachedHeader, &bodyStructure))
+	assert.Assert(t, strings.HasPrefix(cachedHeader, metadataPrefix), "Cached header is not encrypted")
+	assert.Assert(t, strings.HasPrefix(bodyStructure, metadataPrefix), "Body structure is not encrypted")
+	var headersCount int
+	assert.NilError(t, b.DB.QueryRow(`SELECT COUNT(*) FROM msgs_headers`).Scan(&headersCount))
+	assert.Equal(t, headersCount, 0, "Encrypted message is in the header index")
+
+	fetched := fetchRaw(t, mbox, 1, imap.FetchEnvelope, imap.FetchBodyStructure, "BODY.PEEK[]", "BODY.PEEK[HEADER.FIELDS (Subject)]")
+	assert.Equal(t, fetched.Envelope.Subject, "Secret")
+	assert.Equal(t, fetched.BodyStructure.MIMEType, "multipart")
+	assert.Equal(t, string(sectionBytes(t, fetched, "BODY.PEEK[]")), msg)
+
+	res, err := mbox.SearchMessages(true, &imap.SearchCriteria{
+		Header: nettextproto.MIMEHeader{"Subject": {"Secret"}},
+		Body:   []string{"Epilogue"},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []uint32{1, 2})
+
+	// Data key can't be unwrapped without the master key.
+	forgetDataKeys(b)
+	b.Opts.MasterKeys = [][]byte{testMasterKey(2)}
+	seq := imap.SeqSet{}
+	seq.AddNum(1)
+	ch := make(chan *imap.Message, 1)
+	assert.NilError(t, mbox.ListMessages(true, &seq, []imap.FetchItem{"BODY.PEEK[]"}, ch))
+	assert.Assert(t, is.Len(ch, 0), "Message is read using the wrong key")
+
+	b.Opts.MasterKeys = [][]byte{testMasterKey(1)}
+	assert.NilError(t, b.DeleteUser(t.Name()))
+	assert.Assert(t, checkKeysCount(b, 0))
+}
+
+func TestEncryptionIndexEncrypted(t *testing.T) {
+	b := initTestBackendOpts(Opts{
+		MasterKeys:     [][]byte{testMasterKey(1)},
+		IndexEncrypted: true,
+	}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	var headersCount int
+	assert.NilError(t, b.DB.QueryRow(`SELECT COUNT(*) FROM msgs_headers`).Scan(&headersCount))
+	assert.Assert(t, headersCount != 0, "Encrypted message is not in the header index")
+
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mbox, err := usr.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+	res, err := mbox.SearchMessages(true, &imap.SearchCriteria{
+		Header: nettextproto.MIMEHeader{"From": {"foxcpp"}},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []uint32{1})
+}
+
+func TestEncryptionCompressed(t *testing.T) {
+	b := initTestBackendOpts(Opts{
+		MasterKeys:          [][]byte{testMasterKey(1)},
+		AttachmentThreshold: 1024,
+		CompressAlgo:        "lz4",
+	}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()+"-1"))
+	assert.NilError(t, b.CreateUser(t.Name()+"-2"))
+
+	msg := attachmentMsg("Delivery", "Hello!", testAttachment(200*1024), "\r\n")
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-1", textproto.Header{}))
+	assert.NilError(t, delivery.AddRcpt(t.Name()+"-2", textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(msg)))
+	assert.NilError(t, delivery.Commit())
+
+	// Bodies of different users are encrypted using different keys and
+	// are not shared.
+	assert.Assert(t, checkKeysCount(b, 4))
+
+	for _, name := range []string{t.Name() + "-1", t.Name() + "-2"} {
+		usr, err := b.GetUser(name)
+		assert.NilError(t, err)
+		_, mbox, err := usr.GetMailbox("INBOX", true, &noopConn{})
+		assert.NilError(t, err)
+		body := sectionBytes(t, fetchRaw(t, mbox.(*Mailbox), 1, "BODY.PEEK[]"), "BODY.PEEK[]")
+		assert.Equal(t, string(body), msg)
+		assert.NilError(t, mbox.Close())
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	b := initTestBackendOpts(Opts{
+		MasterKeys:      [][]byte{testMasterKey(1)},
+		EncryptMetadata: true,
+	}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	assert.NilError(t, b.RotateUserKey(t.Name()))
+	// The same message encrypted using the new key is not deduplicated.
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	assert.Assert(t, checkKeysCount(b, 2))
+	assert.Equal(t, b.RotateUserKey("nobody"), ErrUserDoesntExists)
+
+	var dataKeys int
+	assert.NilError(t, b.DB.QueryRow(`SELECT COUNT(*) FROM dataKeys`).Scan(&dataKeys))
+	assert.Equal(t, dataKeys, 2)
+
+	checkMsgs := func() {
+		t.Helper()
+		assert.NilError(t, mbox.Poll(true))
+		seq, _ := imap.ParseSeqSet("1:*")
+		ch := make(chan *imap.Message, 10)
+		assert.NilError(t, mbox.ListMessages(false, seq, testMsgFetchItems, ch))
+		assert.Assert(t, is.Len(ch, 2))
+		checkTestMsg(t, <-ch)
+		checkTestMsg(t, <-ch)
+	}
+	checkMsgs()
+
+	// New master key is used first, the old one is still needed to unwrap
+	// data keys.
+	b.Opts.MasterKeys = [][]byte{testMasterKey(2), testMasterKey(1)}
+	rewrapped, err := b.RotateMasterKey()
+	assert.NilError(t, err)
+	assert.Equal(t, rewrapped, 2)
+	rewrapped, err = b.RotateMasterKey()
+	assert.NilError(t, err)
+	assert.Equal(t, rewrapped, 0)
+
+	// The old master key is no longer needed.
+	forgetDataKeys(b)
+	b.Opts.MasterKeys = [][]byte{testMasterKey(2)}
+	checkMsgs()
+}
+
+func TestWithEncryption(t *testing.T) {
+	backendtests.RunTests(t, func() backendtests.Backend {
+		return initTestBackendOpts(Opts{
+			MasterKeys:          [][]byte{testMasterKey(1)},
+			EncryptMetadata:     true,
+			AttachmentThreshold: 16,
+		})
+	}, cleanBackend)
+}
@@ -2,9 +2,11 @@ package imapsql
 
 import (
 	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"time"
 )
 
 type ExtStoreObj interface {
@@ -44,6 +46,14 @@ ExternalStore is an interface used by go-imap-sql to store message bodies
 outside of main database.
 */
 type ExternalStore interface {
+	// Create returns the ExtStoreObj that writes the message body with
+	// the specified key. objectSize is the expected size of the object,
+	// it is -1 or 0 if it is not known in advance.
+	//
+	// The body is written completely once Sync and then Close return
+	// without an error, no writes are done after Sync. Implementations may
+	// discard objects that are closed without calling Sync. Close may be
+	// called multiple times.
 	Create(key string, objectSize int64) (ExtStoreObj, error)
 
 	// Open returns the ExtStoreObj that reads the message body specified by
@@ -57,6 +67,49 @@ type ExternalStore interface {
 	Delete(keys []string) error
 }
 
+// txExternalStore is implemented by ExternalStore implementations that keep
+// objects in the go-imap-sql database.
+//
+// Objects are accessed using the passed transaction so they can be used
+// while it holds database locks and changes are committed or rolled back
+// together with the rest of the data. nil tx means that no transaction is
+// running.
+type txExternalStore interface {
+	createTx(tx *sql.Tx, key string, objectSize int64) (ExtStoreObj, error)
+	openTx(tx *sql.Tx, key string) (ExtStoreObj, error)
+	deleteTx(tx *sql.Tx, keys []string) error
+}
+
+// listingExternalStore is implemented by ExternalStore implementations that
+// can enumerate stored objects. It is used by Fsck to find objects not
+// referenced by any message.
+//
+// modTime is the zero value if the store does not track it.
+type listingExternalStore interface {
+	listObjects(fn func(key string, modTime time.Time) error) error
+}
+
+func (b *Backend) createExtObj(tx *sql.Tx, key string, objectSize int64) (ExtStoreObj, error) {
+	if store, ok := b.extStore.(txExternalStore); ok {
+		return store.createTx(tx, key, objectSize)
+	}
+	return b.extStore.Create(key, objectSize)
+}
+
+func (b *Backend) openExtObj(tx *sql.Tx, key string) (ExtStoreObj, error) {
+	if store, ok := b.extStore.(txExternalStore); ok {
+		return store.openTx(tx, key)
+	}
+	return b.extStore.Open(key)
+}
+
+func (b *Backend) deleteExtObjs(tx *sql.Tx, keys []string) error {
+	if store, ok := b.extStore.(txExternalStore); ok {
+		return store.deleteTx(tx, keys)
+	}
+	return b.extStore.Delete(keys)
+}
+
 func randomKey() (string, error) {
 	b := make([]byte, 16)
 	if _, err := rand.Read(b); err != nil {
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	nettextproto "net/textproto"
@@ -17,10 +18,18 @@ import (
 )
 
 func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	return m.listMessages(uid, seqset, items, 0, ch)
+}
+
+func (m *Mailbox) listMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, changedSince uint64, ch chan<- *imap.Message) error {
 	defer close(ch)
 	var err error
 
-	setSeen := !m.readOnly && shouldSetSeen(items)
+	if !m.hasRight(RightRead) {
+		return ErrPermissionDenied
+	}
+
+	setSeen := !m.readOnly && m.hasRight(RightSeen) && shouldSetSeen(items)
 	var addSeenStmt *sql.Stmt
 	if setSeen {
 		addSeenStmt, err = m.parent.getFlagsAddStmt(1)
@@ -33,7 +42,7 @@ func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.Fetch
 		items = append(items, imap.FetchFlags)
 	}
 
-	stmt, err := m.parent.getFetchStmt(items)
+	stmt, err := m.parent.getFetchStmt(items, changedSince != 0)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "ListMessages (getFetchStmt)", uid, seqset, items)
 		return err
@@ -47,6 +56,14 @@ func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.Fetch
 	}
 	defer tx.Rollback()
 
+	// SQLite3 can't read bodies stored in the database (SQLBlobStore) using
+	// another connection while the transaction is running. Other databases
+	// can't execute queries on the transaction while the result set is open.
+	var bodyTx *sql.Tx
+	if m.parent.db.driver == "sqlite3" {
+		bodyTx = tx
+	}
+
 	seqset, err = m.handle.ResolveSeq(uid, seqset)
 	if err != nil {
 		if uid {
@@ -57,6 +74,15 @@ func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.Fetch
 
 	m.parent.Opts.Log.Debugln("resolved", uid, seqset, "to", seqset)
 
+	var modSeq uint64
+	if setSeen && len(seqset.Set) != 0 {
+		modSeq, err = m.parent.incrementModSeq(tx, m.id)
+		if err != nil {
+			m.parent.logMboxErr(m, err, "ListMessages (modseq)", uid, seqset, items)
+			return err
+		}
+	}
+
 	for _, seq := range seqset.Set {
 		if setSeen {
 			params := m.makeFlagsAddStmtArgs([]string{imap.SeenFlag}, seq.Start, seq.Stop)
@@ -70,14 +96,24 @@ func (m *Mailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.Fetch
 				m.parent.logMboxErr(m, err, "ListMessages (setSeenFlag)", uid, seqset, items)
 				return err
 			}
+
+			_, err = tx.Stmt(m.parent.setModSeqUid).Exec(modSeq, m.id, seq.Start, seq.Stop)
+			if err != nil {
+				m.parent.logMboxErr(m, err, "ListMessages (setModSeq)", uid, seqset, items)
+				return err
+			}
 		}
 
-		rows, err := tx.Stmt(stmt).Query(m.id, seq.Start, seq.Stop)
+		args := []interface{}{m.id, seq.Start, seq.Stop}
+		if changedSince != 0 {
+			args = append(args, changedSince)
+		}
+		rows, err := tx.Stmt(stmt).Query(args...)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "ListMessages", uid, seqset, items)
 			return err
 		}
-		if err := m.scanMessages(rows, items, ch); err != nil {
+		if err := m.scanMessages(bodyTx, rows, items, ch); err != nil {
 			m.parent.logMboxErr(m, err, "ListMessages (scan)", uid, seqset, items)
 			return err
 		}
@@ -94,7 +130,11 @@ type scanData struct {
 	bodyLen       uint32
 	flagStr       string
 	extBodyKey    string
+	bodyHash      string
 	compressAlgo  string
+	modSeq        uint64
+	emailId       string
+	threadId      string
 
 	bodyStructure *imap.BodyStructure
 	cachedHeader  map[string][]string
@@ -125,8 +165,16 @@ func makeScanArgs(data *scanData, rows *sql.Rows) ([]interface{}, error) {
 			scanOrder = append(scanOrder, &data.compressAlgo)
 		case "extBodyKey", "extbodykey":
 			scanOrder = append(scanOrder, &data.extBodyKey)
+		case "bodyHash", "bodyhash":
+			scanOrder = append(scanOrder, &data.bodyHash)
 		case "flags":
 			scanOrder = append(scanOrder, &data.flagStr)
+		case "modseq":
+			scanOrder = append(scanOrder, &data.modSeq)
+		case "emailId", "emailid":
+			scanOrder = append(scanOrder, &data.emailId)
+		case "threadId", "threadid":
+			scanOrder = append(scanOrder, &data.threadId)
 		default:
 			panic("unknown column: " + col)
 		}
@@ -135,7 +183,7 @@ func makeScanArgs(data *scanData, rows *sql.Rows) ([]interface{}, error) {
 	return scanOrder, nil
 }
 
-func (m *Mailbox) scanMessages(rows *sql.Rows, items []imap.FetchItem, ch chan<- *imap.Message) error {
+func (m *Mailbox) scanMessages(bodyTx *sql.Tx, rows *sql.Rows, items []imap.FetchItem, ch chan<- *imap.Message) error {
 	defer rows.Close()
 	data := scanData{}
 
@@ -155,12 +203,20 @@ messageLoop:
 		data.bodyStructure = nil
 
 		if data.cachedHeaderBlob != nil {
-			if err := json.Unmarshal(data.cachedHeaderBlob, &data.cachedHeader); err != nil {
+			blob, err := m.parent.openMetadata(bodyTx, data.cachedHeaderBlob)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(blob, &data.cachedHeader); err != nil {
 				return err
 			}
 		}
 		if data.bodyStructureBlob != nil {
-			if err := json.Unmarshal(data.bodyStructureBlob, &data.bodyStructure); err != nil {
+			blob, err := m.parent.openMetadata(bodyTx, data.bodyStructureBlob)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(blob, &data.bodyStructure); err != nil {
 				return err
 			}
 		}
@@ -195,8 +251,14 @@ messageLoop:
 				if m.handle.IsRecent(data.msgId) {
 					msg.Flags = append(msg.Flags, imap.RecentFlag)
 				}
+			case FetchModSeq:
+				msg.Items[FetchModSeq] = []interface{}{data.modSeq}
+			case FetchEmailId:
+				msg.Items[FetchEmailId] = []interface{}{imap.RawString(data.emailId)}
+			case FetchThreadId:
+				msg.Items[FetchThreadId] = []interface{}{imap.RawString(data.threadId)}
 			default:
-				if err := m.extractBodyPart(item, &data, msg); err != nil {
+				if err := m.extractBodyPart(bodyTx, item, &data, msg); err != nil {
 					m.parent.logMboxErr(m, err, "failed to read body, skipping", data.seqNum, data.extBodyKey)
 					continue messageLoop
 				}
@@ -214,7 +276,7 @@ messageLoop:
 	return nil
 }
 
-func (m *Mailbox) extractBodyPart(item imap.FetchItem, data *scanData, msg *imap.Message) error {
+func (m *Mailbox) extractBodyPart(bodyTx *sql.Tx, item imap.FetchItem, data *scanData, msg *imap.Message) error {
 	sect, part, err := getNeededPart(item)
 	if err != nil {
 		return err
@@ -230,7 +292,11 @@ func (m *Mailbox) extractBodyPart(item imap.FetchItem, data *scanData, msg *imap
 	case needHeader, needFullBody:
 		// We don't need to parse header once more if we already did, so we just skip it if we open body
 		// multiple times.
-		bufferedBody, err := m.openBody(data.parsedHeader == nil, data.compressAlgo, data.extBodyKey)
+		var check *bodyCheck
+		if m.parent.Opts.VerifyBodies {
+			check = &bodyCheck{len: int64(data.bodyLen), hash: data.bodyHash}
+		}
+		bufferedBody, err := m.openBody(bodyTx, data.parsedHeader == nil, data.compressAlgo, data.extBodyKey, check)
 		if err != nil {
 			return err
 		}
@@ -246,6 +312,10 @@ func (m *Mailbox) extractBodyPart(item imap.FetchItem, data *scanData, msg *imap
 
 		msg.Body[sect], err = backendutil.FetchBodySection(*data.parsedHeader, bufferedBody.Reader, sect)
 		if err != nil {
+			var corrupted CorruptedBodyError
+			if errors.As(err, &corrupted) {
+				return err
+			}
 			m.parent.logMboxErr(m, err, "failed to fetch body section", data.seqNum, sect)
 			msg.Body[sect] = bytes.NewReader(nil)
 		}
@@ -265,22 +335,38 @@ func (n nopCloser) Close() error {
 	return nil
 }
 
-func (m *Mailbox) openBody(needHeader bool, compressAlgoColumn, extBodyKey string) (BufferedReadCloser, error) {
-	rdr, err := m.parent.extStore.Open(extBodyKey)
+func (m *Mailbox) openBody(tx *sql.Tx, needHeader bool, compressAlgoColumn, extBodyKey string, check *bodyCheck) (BufferedReadCloser, error) {
+	return m.parent.openBody(tx, needHeader, compressAlgoColumn, extBodyKey, check)
+}
+
+// openBody opens the message body. If check is not nil, the body is verified
+// once it is read completely and CorruptedBodyError is returned if it does
+// not match.
+func (b *Backend) openBody(tx *sql.Tx, needHeader bool, compressAlgoColumn, extBodyKey string, check *bodyCheck) (BufferedReadCloser, error) {
+	dataKeyId, parts, err := b.getParts(tx, extBodyKey)
 	if err != nil {
-		return BufferedReadCloser{}, wrapErr(err, "openBody")
+		return BufferedReadCloser{}, wrapErr(err, "openBody (getParts)")
 	}
 
-	// compressAlgoColumn is in 'name params' format.
-	compressAlgoInfo := strings.Split(compressAlgoColumn, " ")
-	algoImpl, ok := compressionAlgos[compressAlgoInfo[0]]
-	if !ok {
-		return BufferedReadCloser{}, fmt.Errorf("openBody: unknown compression algorithm used for body: %s", compressAlgoInfo[0])
-	}
-	rdrDecomp, err := algoImpl.WrapDecompress(rdr)
+	rdrDecomp, rdr, err := b.openDecompressed(tx, compressAlgoColumn, dataKeyId, extBodyKey)
 	if err != nil {
 		return BufferedReadCloser{}, wrapErr(err, "openBody")
 	}
+	if len(parts) != 0 {
+		partsRdr := &partsReader{b: b, tx: tx, body: rdrDecomp, closer: rdr, parts: parts}
+		rdrDecomp, rdr = partsRdr, partsRdr
+	}
+	if check != nil {
+		var dk *dataKey
+		if dataKeyId != "" {
+			dk, err = b.getDataKey(tx, dataKeyId)
+			if err != nil {
+				rdr.Close()
+				return BufferedReadCloser{}, wrapErr(err, "openBody")
+			}
+		}
+		rdrDecomp = &verifyReader{r: rdrDecomp, key: extBodyKey, check: *check, hash: newBodyHash(dk)}
+	}
 
 	bufR := bufio.NewReader(rdrDecomp)
 	if !needHeader {
@@ -300,6 +386,44 @@ func (m *Mailbox) openBody(needHeader bool, compressAlgoColumn, extBodyKey strin
 	return BufferedReadCloser{Reader: bufR, Closer: rdr}, nil
 }
 
+// openDecompressed opens the object from the external store and wraps it
+// using the decryption and decompression algorithms. dataKeyId is empty if
+// the object is not encrypted. Returned io.Closer closes the object.
+func (b *Backend) openDecompressed(tx *sql.Tx, compressAlgoColumn, dataKeyId, key string) (io.Reader, io.Closer, error) {
+	var dk *dataKey
+	if dataKeyId != "" {
+		var err error
+		dk, err = b.getDataKey(tx, dataKeyId)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rdr, err := b.openExtObj(tx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	rdrDec, err := wrapDecrypt(rdr, dk, key)
+	if err != nil {
+		rdr.Close()
+		return nil, nil, err
+	}
+
+	// compressAlgoColumn is in 'name params' format.
+	compressAlgoInfo := strings.Split(compressAlgoColumn, " ")
+	algoImpl, ok := compressionAlgos[compressAlgoInfo[0]]
+	if !ok {
+		rdr.Close()
+		return nil, nil, fmt.Errorf("unknown compression algorithm used for body: %s", compressAlgoInfo[0])
+	}
+	rdrDecomp, err := algoImpl.WrapDecompress(rdrDec)
+	if err != nil {
+		rdr.Close()
+		return nil, nil, err
+	}
+	return rdrDecomp, rdr, nil
+}
+
 func headerSubsetFromCached(sect *imap.BodySectionName, cachedHeader map[string][]string) (imap.Literal, error) {
 	hdr := textproto.Header{}
 	for i := len(sect.Fields) - 1; i >= 0; i-- {
@@ -349,7 +473,8 @@ func shouldSetSeen(items []imap.FetchItem) bool {
 	for _, item := range items {
 		switch item {
 		case imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchUid, imap.FetchEnvelope,
-			imap.FetchBody, imap.FetchBodyStructure, imap.FetchFlags:
+			imap.FetchBody, imap.FetchBodyStructure, imap.FetchFlags, FetchModSeq,
+			FetchEmailId, FetchThreadId:
 			continue
 		default:
 			sect, err := imap.ParseBodySectionName(item)
@@ -8,8 +8,25 @@ import (
 )
 
 func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, silent bool, flags []string) error {
+	_, err := m.updateMessagesFlags(uid, seqset, operation, silent, flags, nil)
+	return err
+}
+
+func (m *Mailbox) updateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, silent bool, flags []string, unchangedSince *uint64) (*imap.SeqSet, error) {
 	defer m.handle.Sync(uid)
 
+	if m.viewer != nil {
+		// Replacing flags implicitly removes all other flags so all rights are needed.
+		if operation == imap.SetFlags && !(m.hasRight(RightSeen) && m.hasRight(RightWrite) && m.hasRight(RightDeleteMsg)) {
+			return nil, ErrPermissionDenied
+		}
+		allowed := m.allowedFlags(flags)
+		if len(allowed) == 0 && len(flags) != 0 {
+			return nil, ErrPermissionDenied
+		}
+		flags = allowed
+	}
+
 	seenModified := false
 	newFlagSet := make([]string, 0, len(flags))
 	for _, flag := range flags {
@@ -36,18 +53,38 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 		}
 	}
 	if err != nil {
-		return wrapErr(err, "UpdateMessagesFlags")
+		return nil, wrapErr(err, "UpdateMessagesFlags")
 	}
 
 	tx, err := m.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
 	if err != nil {
-		return wrapErr(err, "UpdateMessagesFlags")
+		return nil, wrapErr(err, "UpdateMessagesFlags")
 	}
 	defer tx.Rollback() // nolint:errcheck
 
 	seqset, err = m.handle.ResolveSeq(uid, seqset)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	modified := &imap.SeqSet{}
+	if unchangedSince != nil {
+		seqset, modified, err = m.filterUnchangedSince(tx, seqset, *unchangedSince)
+		if err != nil {
+			return nil, wrapErr(err, "UpdateMessagesFlags (unchangedSince)")
+		}
+		if !uid {
+			modified = m.uidsAsSeqs(modified)
+		}
+	}
+
+	if len(seqset.Set) == 0 {
+		return modified, nil
+	}
+
+	modSeq, err := m.parent.incrementModSeq(tx, m.id)
+	if err != nil {
+		return nil, wrapErr(err, "UpdateMessagesFlags (modseq)")
 	}
 
 	for _, seq := range seqset.Set {
@@ -55,41 +92,41 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 		case imap.SetFlags:
 			_, err = tx.Stmt(m.parent.massClearFlagsUid).Exec(m.id, seq.Start, seq.Stop)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			fallthrough
 		case imap.AddFlags:
 			if seenModified {
 				_, err = tx.Stmt(m.parent.setSeenFlagUid).Exec(1, m.id, seq.Start, seq.Stop)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
 
-			if len(flags) == 0 {
-				continue
-			}
-
-			args := m.makeFlagsAddStmtArgs(flags, seq.Start, seq.Stop)
-			if _, err := tx.Stmt(addQuery).Exec(args...); err != nil {
-				return err
+			if len(flags) != 0 {
+				args := m.makeFlagsAddStmtArgs(flags, seq.Start, seq.Stop)
+				if _, err := tx.Stmt(addQuery).Exec(args...); err != nil {
+					return nil, err
+				}
 			}
 		case imap.RemoveFlags:
 			if seenModified {
 				_, err = tx.Stmt(m.parent.setSeenFlagUid).Exec(0, m.id, seq.Start, seq.Stop)
 				if err != nil {
-					return err
+					return nil, err
 				}
 			}
 
-			if len(flags) == 0 {
-				continue
+			if len(flags) != 0 {
+				args := m.makeFlagsRemStmtArgs(flags, seq.Start, seq.Stop)
+				if _, err := tx.Stmt(remQuery).Exec(args...); err != nil {
+					return nil, err
+				}
 			}
+		}
 
-			args := m.makeFlagsRemStmtArgs(flags, seq.Start, seq.Stop)
-			if _, err := tx.Stmt(remQuery).Exec(args...); err != nil {
-				return err
-			}
+		if _, err := tx.Stmt(m.parent.setModSeqUid).Exec(modSeq, m.id, seq.Start, seq.Stop); err != nil {
+			return nil, err
 		}
 	}
 
@@ -97,18 +134,32 @@ func (m *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation i
 	// will not send them if tx.Commit fails.
 	updatesBuffer, err := m.flagUpdates(tx, uid, seqset)
 	if err != nil {
-		return wrapErr(err, "UpdateMessagesFlags")
+		return nil, wrapErr(err, "UpdateMessagesFlags")
 	}
 	m.parent.Opts.Log.Debugln("UpdateMessageFlags: emitting", len(updatesBuffer), "flag updates")
 
 	if err := tx.Commit(); err != nil {
-		return wrapErr(err, "UpdateMessagesFlags")
+		return nil, wrapErr(err, "UpdateMessagesFlags")
 	}
 
 	for _, upd := range updatesBuffer {
 		m.handle.FlagsChanged(upd.uid, upd.flags, silent)
 	}
-	return nil
+	return modified, nil
+}
+
+// uidsAsSeqs converts the set of UIDs into the set of sequence numbers.
+// UIDs that are not known to the handle are silently dropped.
+func (m *Mailbox) uidsAsSeqs(uids *imap.SeqSet) *imap.SeqSet {
+	res := &imap.SeqSet{}
+	for _, seq := range uids.Set {
+		for uid := seq.Start; uid <= seq.Stop; uid++ {
+			if seqNum, ok := m.handle.UidAsSeq(uid); ok {
+				res.AddNum(seqNum)
+			}
+		}
+	}
+	return res
 }
 
 type flagUpdate struct {
@@ -151,3 +202,29 @@ func (m *Mailbox) flagUpdates(tx *sql.Tx, uid bool, seqset *imap.SeqSet) ([]flag
 
 	return updatesBuffer, nil
 }
+
+// allowedFlags returns the list of flags without ones the viewer is not
+// allowed to change.
+//
+// RFC 4314 requires RightSeen to change \Seen flag, RightDeleteMsg to change
+// \Deleted flag and RightWrite for all other flags.
+func (m *Mailbox) allowedFlags(flags []string) []string {
+	if m.viewer == nil {
+		return flags
+	}
+
+	res := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		right := RightWrite
+		switch flag {
+		case imap.SeenFlag:
+			right = RightSeen
+		case imap.DeletedFlag:
+			right = RightDeleteMsg
+		}
+		if m.hasRight(right) {
+			res = append(res, flag)
+		}
+	}
+	return res
+}
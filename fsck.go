@@ -0,0 +1,428 @@
+package imapsql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Kinds of problems reported by Fsck.
+const (
+	// Message count or total size of the mailbox does not match its
+	// messages.
+	FsckMboxCounters = "mbox-counters"
+	// Message count or total size of the user does not match messages in
+	// its mailboxes.
+	FsckUserCounters = "user-counters"
+	// UIDNEXT of the mailbox is not greater than UIDs of its messages.
+	FsckUidNext = "uidnext"
+	// Reference counter of the external store key does not match the
+	// number of messages and bodies using it.
+	FsckRefs = "refs"
+	// INBOX ID of the user does not point to its INBOX.
+	FsckInbox = "inbox"
+	// Object in the external store is not used by any message.
+	FsckOrphanedObject = "orphaned-object"
+)
+
+// fsckDefaultOrphanAge is used if FsckOpts.OrphanAge is not set.
+const fsckDefaultOrphanAge = time.Hour
+
+type FsckOpts struct {
+	// Fix found problems. Counters are recalculated, keys with wrong
+	// reference counters are updated and removed if they are not used, and
+	// orphaned objects are deleted.
+	Repair bool
+
+	// Objects in the external store are considered orphaned only if they
+	// were modified before that amount of time since they may be written
+	// by the running transaction. Default is 1 hour.
+	OrphanAge time.Duration
+}
+
+// FsckProblem describes the inconsistency found by Fsck.
+type FsckProblem struct {
+	// One of Fsck* constants.
+	Kind string `json:"kind"`
+
+	Username string `json:"username,omitempty"`
+	Mailbox  string `json:"mailbox,omitempty"`
+	Key      string `json:"key,omitempty"`
+
+	Description string `json:"description"`
+	Repaired    bool   `json:"repaired"`
+}
+
+// Fsck checks invariants not enforced by the database schema. If
+// opts.Repair is set, found problems are fixed.
+//
+// Each group of checks runs in a separate transaction and repair statements
+// recalculate values from the current state so Fsck can be used while the
+// server is running.
+//
+// Orphaned objects are found only for ExternalStore implementations that
+// allow listing stored objects (FSStore and SQLBlobStore).
+func (b *Backend) Fsck(opts FsckOpts) ([]FsckProblem, error) {
+	var problems []FsckProblem
+	for _, check := range []func(tx *sql.Tx, repair bool) ([]FsckProblem, error){
+		b.fsckMboxes,
+		b.fsckUsers,
+		b.fsckRefs,
+	} {
+		tx, err := b.db.Begin(!opts.Repair)
+		if err != nil {
+			return problems, wrapErr(err, "Fsck")
+		}
+		found, err := check(tx, opts.Repair)
+		if err != nil {
+			tx.Rollback()
+			return problems, wrapErr(err, "Fsck")
+		}
+		if err := tx.Commit(); err != nil {
+			return problems, wrapErr(err, "Fsck")
+		}
+		problems = append(problems, found...)
+	}
+
+	if opts.Repair {
+		if _, err := b.deleteQueued(); err != nil {
+			return problems, wrapErr(err, "Fsck")
+		}
+	}
+
+	found, err := b.fsckOrphans(opts)
+	problems = append(problems, found...)
+	return problems, wrapErr(err, "Fsck")
+}
+
+func (b *Backend) fsckMboxes(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	type mboxInfo struct {
+		id             uint64
+		username, name string
+
+		msgsCount, actualCount int64
+		msgsSize, actualSize   int64
+		uidNext, maxUid        int64
+	}
+
+	rows, err := tx.Query(b.db.rewriteSQL(`
+		SELECT mboxes.id, users.username, mboxes.name,
+			mboxes.msgsCount, COUNT(msgs.msgId),
+			mboxes.msgsSize, COALESCE(SUM(msgs.bodyLen), 0),
+			mboxes.uidnext, COALESCE(MAX(msgs.msgId), 0)
+		FROM mboxes
+		INNER JOIN users
+		ON users.id = mboxes.uid
+		LEFT JOIN msgs
+		ON msgs.mboxId = mboxes.id
+		GROUP BY mboxes.id, users.username, mboxes.name, mboxes.msgsCount, mboxes.msgsSize, mboxes.uidnext
+		ORDER BY users.username, mboxes.name`))
+	if err != nil {
+		return nil, err
+	}
+	var mboxes []mboxInfo
+	for rows.Next() {
+		var mbox mboxInfo
+		if err := rows.Scan(&mbox.id, &mbox.username, &mbox.name,
+			&mbox.msgsCount, &mbox.actualCount,
+			&mbox.msgsSize, &mbox.actualSize,
+			&mbox.uidNext, &mbox.maxUid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		mboxes = append(mboxes, mbox)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var problems []FsckProblem
+	for _, mbox := range mboxes {
+		if mbox.msgsCount != mbox.actualCount || mbox.msgsSize != mbox.actualSize {
+			problem := FsckProblem{
+				Kind:     FsckMboxCounters,
+				Username: mbox.username,
+				Mailbox:  mbox.name,
+				Description: fmt.Sprintf("%d messages (%d bytes) counted, %d messages (%d bytes) stored",
+					mbox.msgsCount, mbox.msgsSize, mbox.actualCount, mbox.actualSize),
+			}
+			if repair {
+				_, err := tx.Exec(b.db.rewriteSQL(`
+					UPDATE mboxes
+					SET msgsCount = (
+						SELECT COUNT(*)
+						FROM msgs
+						WHERE mboxId = mboxes.id
+					), msgsSize = (
+						SELECT COALESCE(SUM(bodyLen), 0)
+						FROM msgs
+						WHERE mboxId = mboxes.id
+					)
+					WHERE id = ?`), mbox.id)
+				if err != nil {
+					return nil, err
+				}
+				problem.Repaired = true
+			}
+			problems = append(problems, problem)
+		}
+
+		if mbox.uidNext <= mbox.maxUid {
+			problem := FsckProblem{
+				Kind:        FsckUidNext,
+				Username:    mbox.username,
+				Mailbox:     mbox.name,
+				Description: fmt.Sprintf("UIDNEXT is %d, highest UID is %d", mbox.uidNext, mbox.maxUid),
+			}
+			if repair {
+				_, err := tx.Exec(b.db.rewriteSQL(`
+					UPDATE mboxes
+					SET uidnext = (
+						SELECT COALESCE(MAX(msgId), 0) + 1
+						FROM msgs
+						WHERE mboxId = mboxes.id
+					)
+					WHERE id = ?`), mbox.id)
+				if err != nil {
+					return nil, err
+				}
+				problem.Repaired = true
+			}
+			problems = append(problems, problem)
+		}
+	}
+	return problems, nil
+}
+
+func (b *Backend) fsckUsers(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	type userInfo struct {
+		id       uint64
+		username string
+
+		msgsCount, actualCount int64
+		msgsSize, actualSize   int64
+		inboxId                sql.NullInt64
+		inboxName              sql.NullString
+	}
+
+	rows, err := tx.Query(b.db.rewriteSQL(`
+		SELECT users.id, users.username,
+			users.msgsCount, (
+				SELECT COUNT(*)
+				FROM msgs
+				INNER JOIN mboxes
+				ON msgs.mboxId = mboxes.id
+				WHERE mboxes.uid = users.id
+			),
+			users.msgsSize, (
+				SELECT COALESCE(SUM(bodyLen), 0)
+				FROM msgs
+				INNER JOIN mboxes
+				ON msgs.mboxId = mboxes.id
+				WHERE mboxes.uid = users.id
+			),
+			users.inboxId, inbox.name
+		FROM users
+		LEFT JOIN mboxes inbox
+		ON inbox.id = users.inboxId AND inbox.uid = users.id
+		ORDER BY users.username`))
+	if err != nil {
+		return nil, err
+	}
+	var users []userInfo
+	for rows.Next() {
+		var user userInfo
+		if err := rows.Scan(&user.id, &user.username,
+			&user.msgsCount, &user.actualCount,
+			&user.msgsSize, &user.actualSize,
+			&user.inboxId, &user.inboxName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var problems []FsckProblem
+	for _, user := range users {
+		if user.msgsCount != user.actualCount || user.msgsSize != user.actualSize {
+			problem := FsckProblem{
+				Kind:     FsckUserCounters,
+				Username: user.username,
+				Description: fmt.Sprintf("%d messages (%d bytes) counted, %d messages (%d bytes) stored",
+					user.msgsCount, user.msgsSize, user.actualCount, user.actualSize),
+			}
+			if repair {
+				_, err := tx.Exec(b.db.rewriteSQL(`
+					UPDATE users
+					SET msgsCount = (
+						SELECT COUNT(*)
+						FROM msgs
+						INNER JOIN mboxes
+						ON msgs.mboxId = mboxes.id
+						WHERE mboxes.uid = users.id
+					), msgsSize = (
+						SELECT COALESCE(SUM(bodyLen), 0)
+						FROM msgs
+						INNER JOIN mboxes
+						ON msgs.mboxId = mboxes.id
+						WHERE mboxes.uid = users.id
+					)
+					WHERE id = ?`), user.id)
+				if err != nil {
+					return nil, err
+				}
+				problem.Repaired = true
+			}
+			problems = append(problems, problem)
+		}
+
+		if user.inboxName.String != "INBOX" {
+			problem := FsckProblem{
+				Kind:        FsckInbox,
+				Username:    user.username,
+				Description: fmt.Sprintf("INBOX ID %d does not refer to INBOX of the user", user.inboxId.Int64),
+			}
+			if repair {
+				if err := b.repairInbox(tx, user.id); err != nil {
+					return nil, err
+				}
+				problem.Repaired = true
+			}
+			problems = append(problems, problem)
+		}
+	}
+	return problems, nil
+}
+
+// repairInbox points inboxId of the user to its INBOX, creating it if
+// necessary.
+func (b *Backend) repairInbox(tx *sql.Tx, uid uint64) error {
+	objectId, err := newObjectId(mailboxIdPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(b.createMboxExistsOk).Exec(uid, "INBOX", b.prng.Uint32(), objectId); err != nil {
+		return err
+	}
+	var inboxId uint64
+	if err := tx.Stmt(b.mboxId).QueryRow(uid, "INBOX").Scan(&inboxId); err != nil {
+		return err
+	}
+	_, err = tx.Stmt(b.setInboxId).Exec(inboxId, uid)
+	return err
+}
+
+func (b *Backend) fsckRefs(tx *sql.Tx, repair bool) ([]FsckProblem, error) {
+	type keyInfo struct {
+		id           string
+		refs, actual int64
+	}
+
+	// Keys of bodies are referenced by messages, keys of parts are
+	// referenced by bodies (see extParts).
+	rows, err := tx.Query(b.db.rewriteSQL(`
+		SELECT id, refs, (
+			SELECT COUNT(*)
+			FROM msgs
+			WHERE msgs.extBodyKey = extKeys.id
+		) + (
+			SELECT COUNT(*)
+			FROM extParts
+			WHERE extParts.partKey = extKeys.id
+		) AS actual
+		FROM extKeys
+		ORDER BY id`))
+	if err != nil {
+		return nil, err
+	}
+	var keys []keyInfo
+	for rows.Next() {
+		var key keyInfo
+		if err := rows.Scan(&key.id, &key.refs, &key.actual); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if key.refs != key.actual {
+			keys = append(keys, key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var (
+		problems []FsckProblem
+		unused   []string
+	)
+	for _, key := range keys {
+		problem := FsckProblem{
+			Kind:        FsckRefs,
+			Key:         key.id,
+			Description: fmt.Sprintf("%d references counted, %d found", key.refs, key.actual),
+		}
+		if repair {
+			_, err := tx.Exec(b.db.rewriteSQL(`
+				UPDATE extKeys
+				SET refs = (
+					SELECT COUNT(*)
+					FROM msgs
+					WHERE msgs.extBodyKey = extKeys.id
+				) + (
+					SELECT COUNT(*)
+					FROM extParts
+					WHERE extParts.partKey = extKeys.id
+				)
+				WHERE id = ?`), key.id)
+			if err != nil {
+				return nil, err
+			}
+			if key.actual == 0 {
+				unused = append(unused, key.id)
+			}
+			problem.Repaired = true
+		}
+		problems = append(problems, problem)
+	}
+	if len(unused) == 0 {
+		return problems, nil
+	}
+
+	// Objects are removed by Fsck after the commit.
+	if _, err := b.deleteZeroRefKeys(tx, unused); err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
+func (b *Backend) fsckOrphans(opts FsckOpts) ([]FsckProblem, error) {
+	orphanAge := opts.OrphanAge
+	if orphanAge == 0 {
+		orphanAge = fsckDefaultOrphanAge
+	}
+	orphans, err := b.findOrphans(time.Now().Add(-orphanAge))
+	if err != nil {
+		return nil, err
+	}
+
+	problems := make([]FsckProblem, 0, len(orphans))
+	for _, key := range orphans {
+		problems = append(problems, FsckProblem{
+			Kind:        FsckOrphanedObject,
+			Key:         key,
+			Description: "object is not used by any message",
+			Repaired:    opts.Repair,
+		})
+	}
+	if opts.Repair && len(orphans) != 0 {
+		if err := b.deleteExtObjs(nil, orphans); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,98 @@
+package imapsql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func fsckKinds(t *testing.T, b *Backend, repair bool) []string {
+	t.Helper()
+	problems, err := b.Fsck(FsckOpts{Repair: repair})
+	assert.NilError(t, err)
+	kinds := make([]string, 0, len(problems))
+	for _, p := range problems {
+		assert.Equal(t, p.Repaired, repair)
+		kinds = append(kinds, p.Kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func TestFsck(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox("Other"))
+	for _, mbox := range []string{"INBOX", "INBOX", "Other"} {
+		assert.NilError(t, usr.CreateMessage(mbox, []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	}
+
+	assert.Assert(t, is.Len(fsckKinds(t, b, false), 0))
+
+	var otherId uint64
+	assert.NilError(t, b.db.QueryRow(`SELECT id FROM mboxes WHERE name = ?`, "Other").Scan(&otherId))
+	for _, query := range []string{
+		`UPDATE mboxes SET uidnext = 1 WHERE name = 'Other'`,
+		`UPDATE users SET msgsSize = 0`,
+		`UPDATE extKeys SET refs = refs + 1`,
+	} {
+		_, err := b.DB.Exec(query)
+		assert.NilError(t, err)
+	}
+	uid := usr.(*User).id
+	_, err = b.db.Exec(`UPDATE mboxes SET msgsCount = 5 WHERE id = ?`, usr.(*User).inboxId)
+	assert.NilError(t, err)
+	_, err = b.db.Exec(`UPDATE users SET inboxId = ? WHERE id = ?`, otherId, uid)
+	assert.NilError(t, err)
+
+	// Key with objects leaked by a failed delete.
+	root := b.extStore.(*FSStore).Root
+	_, err = b.db.Exec(`INSERT INTO extKeys(id, uid, refs) VALUES (?, ?, 1)`, "leaked", uid)
+	assert.NilError(t, err)
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, "leaked"), []byte("leaked"), 0600))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, "orphan"), []byte("orphan"), 0600))
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NilError(t, os.Chtimes(filepath.Join(root, "orphan"), old, old))
+	// Objects written recently may belong to a running transaction.
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, "fresh"), []byte("fresh"), 0600))
+
+	expected := []string{
+		FsckInbox,
+		FsckMboxCounters,
+		FsckOrphanedObject,
+		FsckRefs,
+		FsckRefs,
+		FsckUidNext,
+		FsckUserCounters,
+	}
+	assert.DeepEqual(t, fsckKinds(t, b, false), expected)
+	// Nothing is changed without Repair.
+	assert.DeepEqual(t, fsckKinds(t, b, false), expected)
+
+	assert.DeepEqual(t, fsckKinds(t, b, true), expected)
+	assert.Assert(t, is.Len(fsckKinds(t, b, false), 0))
+	// Body and the fresh object are left.
+	assert.Assert(t, checkKeysCount(b, 2))
+
+	var inboxName string
+	assert.NilError(t, b.db.QueryRow(`SELECT mboxes.name FROM users INNER JOIN mboxes ON mboxes.id = users.inboxId WHERE users.id = ?`, uid).Scan(&inboxName))
+	assert.Equal(t, inboxName, "INBOX")
+
+	// Repaired counters are used further.
+	assert.NilError(t, usr.CreateMessage("Other", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	status, err := usr.Status("Other", []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(2))
+	assert.Equal(t, status.UidNext, uint32(3))
+}
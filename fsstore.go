@@ -1,32 +1,87 @@
 package imapsql
 
 import (
+	"errors"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 // FSStore struct represents directory on FS used to store message bodies.
 //
+// Objects are written to temporary files and renamed into place once they are
+// complete so Open never returns partially written bodies, even after
+// a crash.
+//
 // Always use field names on initialization because new fields may be added
 // without a major version change.
 type FSStore struct {
 	Root string
+
+	// ShardDepth is the number of directory levels new objects are stored
+	// in. Each level is named after the next two characters of the key, e.g.
+	// key 0a1b2c3d is stored as 0a/1b/0a1b2c3d if ShardDepth is 2. Zero
+	// means that all objects are stored directly in Root.
+	//
+	// Objects stored using the flat layout are still accessible when
+	// ShardDepth is set, use MigrateToShards to move them.
+	ShardDepth int
+}
+
+// shardedPath returns the path of the object in the sharded layout.
+func (s *FSStore) shardedPath(key string) string {
+	if s.ShardDepth <= 0 || len(key) < 2*s.ShardDepth || strings.HasPrefix(key, ".") {
+		return filepath.Join(s.Root, key)
+	}
+	parts := make([]string, 0, s.ShardDepth+2)
+	parts = append(parts, s.Root)
+	for i := 0; i < s.ShardDepth; i++ {
+		parts = append(parts, key[2*i:2*i+2])
+	}
+	return filepath.Join(append(parts, key)...)
 }
 
 func (s *FSStore) Open(key string) (ExtStoreObj, error) {
-	f, err := os.Open(filepath.Join(s.Root, key))
-	if err != nil {
-		return nil, ExternalError{
-			Key:         key,
-			Err:         err,
-			NonExistent: os.IsNotExist(err),
+	flatPath := filepath.Join(s.Root, key)
+	paths := []string{flatPath}
+	if shardedPath := s.shardedPath(key); shardedPath != flatPath {
+		// Sharded path is checked again after the flat one since the object
+		// could be moved by MigrateToShards in between.
+		paths = []string{shardedPath, flatPath, shardedPath}
+	}
+
+	var err error
+	for _, path := range paths {
+		var f *os.File
+		f, err = os.Open(path)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			break
 		}
 	}
-	return f, nil
+	return nil, ExternalError{
+		Key:         key,
+		Err:         err,
+		NonExistent: os.IsNotExist(err),
+	}
 }
 
 func (s *FSStore) Create(key string, blobSize int64) (ExtStoreObj, error) {
-	f, err := os.Create(filepath.Join(s.Root, key))
+	path := s.shardedPath(key)
+	dir, name := filepath.Split(path)
+	if err := s.mkdirAll(dir); err != nil {
+		return nil, ExternalError{
+			Key: key,
+			Err: err,
+		}
+	}
+	// Temporary files start with a dot and can't be confused with keys.
+	f, err := ioutil.TempFile(dir, "."+name+fsTempSuffix)
 	if err != nil {
 		return nil, ExternalError{
 			Key:         key,
@@ -34,28 +89,226 @@ func (s *FSStore) Create(key string, blobSize int64) (ExtStoreObj, error) {
 			NonExistent: false,
 		}
 	}
-	if blobSize != -1 {
+	if blobSize > 0 {
 		if err := f.Truncate(blobSize); err != nil {
+			f.Close()
+			os.Remove(f.Name())
 			return nil, ExternalError{
 				Key: key,
 				Err: err,
 			}
 		}
 	}
-	return f, nil
+	return &fsWriter{f: f, key: key, path: path}, nil
 }
 
 func (s *FSStore) Delete(keys []string) error {
 	for _, key := range keys {
-		if err := os.Remove(filepath.Join(s.Root, key)); err != nil {
-			if os.IsNotExist(err) {
+		flatPath := filepath.Join(s.Root, key)
+		paths := []string{flatPath}
+		if shardedPath := s.shardedPath(key); shardedPath != flatPath {
+			paths = []string{flatPath, shardedPath}
+		}
+
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return ExternalError{
+					Key: key,
+					Err: err,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// MigrateToShards moves objects stored directly in Root to the directories
+// used by the sharded layout. It returns the number of moved objects.
+//
+// Objects are renamed one by one so the migration can be done while the
+// store is used by the running server.
+func (s *FSStore) MigrateToShards() (int, error) {
+	if s.ShardDepth <= 0 {
+		return 0, errors.New("fsstore: ShardDepth is not set")
+	}
+
+	root, err := os.Open(s.Root)
+	if err != nil {
+		return 0, err
+	}
+	defer root.Close()
+
+	moved := 0
+	for {
+		infos, err := root.Readdir(1024)
+		for _, info := range infos {
+			key := info.Name()
+			if !info.Mode().IsRegular() {
 				continue
 			}
-			return ExternalError{
-				Key: key,
-				Err: err,
+			path := s.shardedPath(key)
+			if path == filepath.Join(s.Root, key) {
+				// Temporary files and keys too short for the sharding.
+				continue
+			}
+
+			if err := s.mkdirAll(filepath.Dir(path)); err != nil {
+				return moved, err
+			}
+			if err := os.Rename(filepath.Join(s.Root, key), path); err != nil {
+				if os.IsNotExist(err) {
+					// Deleted concurrently.
+					continue
+				}
+				return moved, err
+			}
+			if err := syncDir(filepath.Dir(path)); err != nil {
+				return moved, err
 			}
+			moved++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	return moved, syncDir(s.Root)
+}
+
+// fsTempSuffix is added to the name of the object when creating a temporary
+// file for it, followed by a random string.
+const fsTempSuffix = ".tmp"
+
+// listObjects calls fn for each object in both flat and sharded layouts.
+//
+// Temporary files are reported too since ones left behind by a crash are
+// never renamed. Their keys are paths relative to Root so Delete can remove
+// them, they never match a key of any message.
+func (s *FSStore) listObjects(fn func(key string, modTime time.Time) error) error {
+	return filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed concurrently.
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name := info.Name()
+		if !strings.HasPrefix(name, ".") {
+			return fn(name, info.ModTime())
+		}
+		if !strings.Contains(name, fsTempSuffix) {
+			return nil
+		}
+		key, err := filepath.Rel(s.Root, path)
+		if err != nil {
+			return err
+		}
+		return fn(key, info.ModTime())
+	})
+}
+
+// mkdirAll creates the shard directory and its parents if they do not exist
+// yet. Parent directories are synced so created entries are durable.
+func (s *FSStore) mkdirAll(dir string) error {
+	dir = filepath.Clean(dir)
+	if _, err := os.Stat(dir); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	root := filepath.Clean(s.Root)
+	for ; dir != root && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if err := syncDir(filepath.Dir(dir)); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+// fsWriter writes the object to the temporary file.
+//
+// Sync flushes the file to the disk and Close renames it to the final path.
+// Objects closed without Sync are removed.
+type fsWriter struct {
+	f       *os.File
+	key     string
+	path    string
+	written int64
+	synced  bool
+	closed  bool
+}
+
+func (w *fsWriter) Read([]byte) (int, error) {
+	return 0, errors.New("fsstore: object is opened for writing")
+}
+
+func (w *fsWriter) Write(b []byte) (int, error) {
+	if w.synced {
+		return 0, errors.New("fsstore: write after sync")
+	}
+	n, err := w.f.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *fsWriter) Sync() error {
+	if w.synced {
+		return nil
+	}
+	// Drop the remaining space if the size hint was bigger than the object.
+	if err := w.f.Truncate(w.written); err != nil {
+		return ExternalError{Key: w.key, Err: err}
+	}
+	if err := w.f.Sync(); err != nil {
+		return ExternalError{Key: w.key, Err: err}
+	}
+	w.synced = true
+	return nil
+}
+
+func (w *fsWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return ExternalError{Key: w.key, Err: err}
+	}
+	if !w.synced {
+		os.Remove(w.f.Name())
+		return nil
+	}
+
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		os.Remove(w.f.Name())
+		return ExternalError{Key: w.key, Err: err}
+	}
+	if err := syncDir(filepath.Dir(w.path)); err != nil {
+		return ExternalError{Key: w.key, Err: err}
+	}
+	return nil
+}
+
+// syncDir flushes the directory entries to the disk so renames and removals
+// of files in it are durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -1,23 +1,34 @@
 package imapsql
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-imap"
 	backendtests "github.com/foxcpp/go-imap-backend-tests"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"gotest.tools/assert"
 )
 
 var TestDB = os.Getenv("TEST_DB")
 var TestDSN = os.Getenv("TEST_DSN")
 
 func initTestBackend() backendtests.Backend {
+	return initTestBackendOpts(Opts{})
+}
+
+func initTestBackendOpts(opts Opts) backendtests.Backend {
 	driver := TestDB
 	dsn := TestDSN
 
@@ -53,10 +64,9 @@ func initTestBackend() backendtests.Backend {
 		log = DummyLogger{}
 	}
 
-	b, err := New(driver, dsn, &FSStore{Root: storeDir}, Opts{
-		PRNG:            prng,
-		Log:             log,
-	})
+	opts.PRNG = prng
+	opts.Log = log
+	b, err := New(driver, dsn, &FSStore{Root: storeDir}, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -78,21 +88,68 @@ func cleanBackend(bi backendtests.Backend) {
 		if _, err := b.DB.Exec(`DROP TABLE flags`); err != nil {
 			log.Println("DROP TABLE flags", err)
 		}
+		if _, err := b.DB.Exec(`DROP TABLE expunged`); err != nil {
+			log.Println("DROP TABLE expunged", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE acl`); err != nil {
+			log.Println("DROP TABLE acl", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE msgs_headers`); err != nil {
+			log.Println("DROP TABLE msgs_headers", err)
+		}
+		if b.fts {
+			if _, err := b.DB.Exec(`DROP TABLE msgs_fts`); err != nil {
+				log.Println("DROP TABLE msgs_fts", err)
+			}
+			if b.db.driver == "sqlite3" {
+				if _, err := b.DB.Exec(`DROP TABLE msgs_fts_keys`); err != nil {
+					log.Println("DROP TABLE msgs_fts_keys", err)
+				}
+			}
+		}
 		if _, err := b.DB.Exec(`DROP TABLE msgs`); err != nil {
 			log.Println("DROP TABLE msgs", err)
 		}
+		if _, err := b.DB.Exec(`DROP TABLE msgThreads`); err != nil {
+			log.Println("DROP TABLE msgThreads", err)
+		}
 		if _, err := b.DB.Exec(`DROP TABLE mboxes`); err != nil {
 			log.Println("DROP TABLE mboxes", err)
 		}
+		if _, err := b.DB.Exec(`DROP TABLE appPasswords`); err != nil {
+			log.Println("DROP TABLE appPasswords", err)
+		}
 		if _, err := b.DB.Exec(`DROP TABLE users`); err != nil {
 			log.Println("DROP TABLE users", err)
 		}
+		if _, err := b.DB.Exec(`DROP TABLE aliases`); err != nil {
+			log.Println("DROP TABLE aliases", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE domains`); err != nil {
+			log.Println("DROP TABLE domains", err)
+		}
 		if _, err := b.DB.Exec(`DROP TABLE extKeys`); err != nil {
 			log.Println("DROP TABLE extKeys", err)
 		}
+		if _, err := b.DB.Exec(`DROP TABLE extParts`); err != nil {
+			log.Println("DROP TABLE extParts", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE dataKeys`); err != nil {
+			log.Println("DROP TABLE dataKeys", err)
+		}
+		if _, err := b.DB.Exec(`DROP TABLE extDeletes`); err != nil {
+			log.Println("DROP TABLE extDeletes", err)
+		}
 
-		if err := os.RemoveAll(b.extStore.(*FSStore).Root); err != nil {
-			log.Println(err)
+		if _, ok := b.extStore.(*SQLBlobStore); ok {
+			if _, err := b.DB.Exec(`DROP TABLE extBlobs`); err != nil {
+				log.Println("DROP TABLE extBlobs", err)
+			}
+		}
+		if store, ok := b.extStore.(*FSStore); ok {
+			if err := os.RemoveAll(store.Root); err != nil {
+				log.Println(err)
+			}
 		}
 	}
 	b.Close()
@@ -101,3 +158,291 @@ func cleanBackend(bi backendtests.Backend) {
 func TestWithFSStore(t *testing.T) {
 	backendtests.RunTests(t, initTestBackend, cleanBackend)
 }
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	assert.NilError(t, err)
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestFSStoreAtomicWrites(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-sql-tests-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(root)
+	store := &FSStore{Root: root}
+
+	write := func(t *testing.T, key string, data []byte) {
+		t.Helper()
+		w, err := store.Create(key, int64(len(data)))
+		assert.NilError(t, err)
+		_, err = w.Write(data)
+		assert.NilError(t, err)
+		assert.NilError(t, w.Sync())
+		assert.NilError(t, w.Close())
+	}
+	read := func(t *testing.T, key string) ([]byte, error) {
+		t.Helper()
+		r, err := store.Open(key)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	assertNonExistent := func(t *testing.T, key string) {
+		t.Helper()
+		_, err := read(t, key)
+		assert.Assert(t, err != nil)
+		extErr, ok := err.(ExternalError)
+		assert.Assert(t, ok, "%T", err)
+		assert.Assert(t, extErr.NonExistent)
+	}
+	cleanTemp := func(t *testing.T) {
+		t.Helper()
+		for _, name := range listDir(t, root) {
+			if strings.HasPrefix(name, ".") {
+				assert.NilError(t, os.Remove(filepath.Join(root, name)))
+			}
+		}
+	}
+
+	t.Run("complete write", func(t *testing.T) {
+		write(t, "complete", []byte("Hello!"))
+		data, err := read(t, "complete")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, data, []byte("Hello!"))
+	})
+	t.Run("crash during write", func(t *testing.T) {
+		defer cleanTemp(t)
+		// Writer is abandoned without Sync and Close, as if the process was
+		// killed.
+		w, err := store.Create("interrupted", 12)
+		assert.NilError(t, err)
+		_, err = w.Write([]byte("Hello"))
+		assert.NilError(t, err)
+		assertNonExistent(t, "interrupted")
+	})
+	t.Run("crash after sync", func(t *testing.T) {
+		defer cleanTemp(t)
+		w, err := store.Create("synced", 6)
+		assert.NilError(t, err)
+		_, err = w.Write([]byte("Hello!"))
+		assert.NilError(t, err)
+		assert.NilError(t, w.Sync())
+		assertNonExistent(t, "synced")
+	})
+	t.Run("crash during overwrite", func(t *testing.T) {
+		defer cleanTemp(t)
+		w, err := store.Create("complete", 12)
+		assert.NilError(t, err)
+		_, err = w.Write([]byte("Bye"))
+		assert.NilError(t, err)
+		data, err := read(t, "complete")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, data, []byte("Hello!"))
+	})
+	t.Run("close without sync", func(t *testing.T) {
+		w, err := store.Create("discarded", 6)
+		assert.NilError(t, err)
+		_, err = w.Write([]byte("Hello!"))
+		assert.NilError(t, err)
+		assert.NilError(t, w.Close())
+		assertNonExistent(t, "discarded")
+		assert.DeepEqual(t, listDir(t, root), []string{"complete"})
+	})
+	t.Run("inexact size hint", func(t *testing.T) {
+		w, err := store.Create("hint", 100)
+		assert.NilError(t, err)
+		_, err = w.Write([]byte("Hello!"))
+		assert.NilError(t, err)
+		assert.NilError(t, w.Sync())
+		assert.NilError(t, w.Close())
+		assert.NilError(t, w.Close())
+		data, err := read(t, "hint")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, data, []byte("Hello!"))
+	})
+}
+
+// failingLiteral returns an error after n bytes are read.
+type failingLiteral struct {
+	r io.Reader
+	n int
+}
+
+func (l *failingLiteral) Len() int {
+	return len(testMsg)
+}
+
+func (l *failingLiteral) Read(b []byte) (int, error) {
+	if l.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(b) > l.n {
+		b = b[:l.n]
+	}
+	n, err := l.r.Read(b)
+	l.n -= n
+	return n, err
+}
+
+func TestFSStoreInterruptedMessage(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	root := b.extStore.(*FSStore).Root
+
+	for _, n := range []int{0, 10, len(testMsg) - 1} {
+		body := &failingLiteral{r: strings.NewReader(testMsg), n: n}
+		assert.Assert(t, usr.CreateMessage("INBOX", []string{}, time.Now(), body, nil) != nil)
+		assert.DeepEqual(t, listDir(t, root), []string{})
+	}
+
+	status, err := usr.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(0))
+
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.Equal(t, len(listDir(t, root)), 1)
+}
+
+func TestFSStoreSharding(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-imap-sql-tests-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(root)
+	flat := &FSStore{Root: root}
+	sharded := &FSStore{Root: root, ShardDepth: 2}
+
+	write := func(t *testing.T, store *FSStore, key string) {
+		t.Helper()
+		w, err := store.Create(key, int64(len(key)))
+		assert.NilError(t, err)
+		_, err = w.Write([]byte(key))
+		assert.NilError(t, err)
+		assert.NilError(t, w.Sync())
+		assert.NilError(t, w.Close())
+	}
+	checkRead := func(t *testing.T, store *FSStore, key string) {
+		t.Helper()
+		r, err := store.Open(key)
+		assert.NilError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		assert.NilError(t, err)
+		assert.Equal(t, string(data), key)
+	}
+
+	t.Run("sharded layout", func(t *testing.T) {
+		write(t, sharded, "0a1b2c3d")
+		_, err := os.Stat(filepath.Join(root, "0a", "1b", "0a1b2c3d"))
+		assert.NilError(t, err)
+		checkRead(t, sharded, "0a1b2c3d")
+
+		// Keys that are too short are stored in Root.
+		write(t, sharded, "0a1")
+		checkRead(t, sharded, "0a1")
+		_, err = os.Stat(filepath.Join(root, "0a1"))
+		assert.NilError(t, err)
+
+		assert.NilError(t, sharded.Delete([]string{"0a1b2c3d", "0a1"}))
+		_, err = sharded.Open("0a1b2c3d")
+		assert.Assert(t, err.(ExternalError).NonExistent)
+	})
+	t.Run("temporary files", func(t *testing.T) {
+		// Not closed, as if the server crashed while writing it.
+		w, err := sharded.Create("3a4b5c6d", 0)
+		assert.NilError(t, err)
+		tempPath := w.(*fsWriter).f.Name()
+		assert.NilError(t, w.(*fsWriter).f.Close())
+
+		var listed []string
+		assert.NilError(t, sharded.listObjects(func(key string, _ time.Time) error {
+			listed = append(listed, key)
+			return nil
+		}))
+		tempKey, err := filepath.Rel(root, tempPath)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, listed, []string{tempKey})
+
+		assert.NilError(t, sharded.Delete(listed))
+		_, err = os.Stat(tempPath)
+		assert.Assert(t, os.IsNotExist(err))
+	})
+	t.Run("legacy layout", func(t *testing.T) {
+		write(t, flat, "1a2b3c4d")
+		checkRead(t, sharded, "1a2b3c4d")
+		assert.NilError(t, sharded.Delete([]string{"1a2b3c4d"}))
+		_, err := os.Stat(filepath.Join(root, "1a2b3c4d"))
+		assert.Assert(t, os.IsNotExist(err))
+	})
+	t.Run("migrate", func(t *testing.T) {
+		var keys []string
+		for i := 0; i < 300; i++ {
+			key := strconv.FormatInt(int64(1000000+i*7919), 16)
+			write(t, flat, key)
+			keys = append(keys, key)
+		}
+		// Incomplete objects should be left as is.
+		w, err := flat.Create("2a3b4c5d", 0)
+		assert.NilError(t, err)
+		defer w.Close()
+
+		// Objects are read while the migration is running.
+		stop := make(chan struct{})
+		readErr := make(chan error, 1)
+		go func() {
+			defer close(readErr)
+			for {
+				for _, key := range keys {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					r, err := sharded.Open(key)
+					if err != nil {
+						readErr <- err
+						return
+					}
+					r.Close()
+				}
+			}
+		}()
+
+		moved, err := sharded.MigrateToShards()
+		close(stop)
+		assert.NilError(t, err)
+		assert.NilError(t, <-readErr)
+		assert.Equal(t, moved, len(keys))
+		for _, key := range keys {
+			checkRead(t, sharded, key)
+			_, err := os.Stat(filepath.Join(root, key[:2], key[2:4], key))
+			assert.NilError(t, err)
+		}
+		for _, name := range listDir(t, root) {
+			assert.Assert(t, len(name) == 2 || strings.HasPrefix(name, "."), name)
+		}
+
+		moved, err = sharded.MigrateToShards()
+		assert.NilError(t, err)
+		assert.Equal(t, moved, 0)
+
+		_, err = flat.MigrateToShards()
+		assert.Assert(t, err != nil)
+	})
+}
+
+func TestWithShardedFSStore(t *testing.T) {
+	backendtests.RunTests(t, func() backendtests.Backend {
+		b := initTestBackend().(*Backend)
+		b.extStore.(*FSStore).ShardDepth = 2
+		return b
+	}, cleanBackend)
+}
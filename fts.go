@@ -0,0 +1,383 @@
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+)
+
+// ftsMaxTextLen is the maximum amount of text indexed for the header and
+// the body of each message.
+//
+// PostgreSQL can't build tsvector for very large texts so the rest is
+// not searchable when full-text index is used.
+const ftsMaxTextLen = 256 * 1024
+
+// extractText returns the text of the message header and its text parts
+// to be added to the full-text index.
+//
+// Header fields are decoded and written as "Key: Value" lines, similar to
+// how TEXT search criteria is matched against the header. Malformed messages
+// are indexed partially.
+func extractText(r io.Reader) (header, body string) {
+	ent, err := message.Read(r)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return "", ""
+	}
+
+	var hdr strings.Builder
+	for fields := ent.Header.Fields(); fields.Next(); {
+		value, err := fields.Text()
+		if err != nil {
+			value = fields.Value()
+		}
+		hdr.WriteString(fields.Key())
+		hdr.WriteString(": ")
+		hdr.WriteString(value)
+		hdr.WriteString("\n")
+	}
+
+	var text strings.Builder
+	ent.Walk(func(_ []int, part *message.Entity, err error) error { // nolint:errcheck
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return nil
+		}
+		mediaType, _, _ := part.Header.ContentType()
+		if mediaType != "" && !strings.HasPrefix(mediaType, "text/") {
+			return nil
+		}
+		if text.Len() >= ftsMaxTextLen {
+			return nil
+		}
+		_, err = io.Copy(&text, io.LimitReader(part.Body, int64(ftsMaxTextLen-text.Len())))
+		text.WriteString("\n")
+		return err
+	})
+
+	return sanitizeText(hdr.String()), sanitizeText(text.String())
+}
+
+// sanitizeText truncates the text to ftsMaxTextLen and removes
+// bytes that can't be stored in TEXT columns.
+func sanitizeText(s string) string {
+	if len(s) > ftsMaxTextLen {
+		s = s[:ftsMaxTextLen]
+	}
+	s = strings.Replace(s, "\x00", "", -1)
+	return strings.ToValidUTF8(s, "")
+}
+
+// ftsIndex adds the message blob to the full-text index.
+//
+// It does nothing if full-text index is disabled or the blob is already
+// indexed.
+func (b *Backend) ftsIndex(tx *sql.Tx, extBodyKey, compressAlgo string) error {
+	if !b.fts {
+		return nil
+	}
+
+	rdr, err := b.openBody(tx, true, compressAlgo, extBodyKey, nil)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	header, body := extractText(rdr)
+
+	if b.ftsAddKey != nil {
+		stats, err := tx.Stmt(b.ftsAddKey).Exec(extBodyKey)
+		if err != nil {
+			return err
+		}
+		affected, err := stats.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return nil
+		}
+	}
+
+	_, err = tx.Stmt(b.ftsAdd).Exec(header, body, extBodyKey)
+	return err
+}
+
+// ftsDelete removes message blobs from the full-text index.
+func (b *Backend) ftsDelete(tx *sql.Tx, keys []string) error {
+	if !b.fts {
+		return nil
+	}
+
+	for _, key := range keys {
+		if _, err := tx.Stmt(b.ftsDelKey).Exec(key); err != nil {
+			return err
+		}
+		if b.ftsDelKeyRow != nil {
+			if _, err := tx.Stmt(b.ftsDelKeyRow).Exec(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ErrFullTextIndexDisabled is returned by Reindex if full-text index is not
+// enabled in Opts or is not supported by the used RDBMS.
+var ErrFullTextIndexDisabled = errors.New("imapsql: full-text index is not available")
+
+// Reindex rebuilds the full-text index from scratch.
+//
+// It should be used after enabling Opts.FullTextIndex for the existing
+// database.
+//
+// Messages are indexed in batches, each in a separate transaction, so
+// searches may miss messages that are not reindexed yet while it is running.
+func (b *Backend) Reindex() error {
+	if !b.fts {
+		return ErrFullTextIndexDisabled
+	}
+
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return wrapErr(err, "Reindex")
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if _, err := tx.Stmt(b.ftsClear).Exec(); err != nil {
+		return wrapErr(err, "Reindex (clear)")
+	}
+	if b.ftsClearKeys != nil {
+		if _, err := tx.Stmt(b.ftsClearKeys).Exec(); err != nil {
+			return wrapErr(err, "Reindex (clear)")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return wrapErr(err, "Reindex (clear)")
+	}
+
+	lastKey := ""
+	for {
+		blobs, err := b.reindexBatch(lastKey)
+		if err != nil {
+			return wrapErr(err, "Reindex")
+		}
+		if len(blobs) < reindexBatchSize {
+			return nil
+		}
+		lastKey = blobs[len(blobs)-1]
+	}
+}
+
+const reindexBatchSize = 100
+
+// reindexBatch indexes up to reindexBatchSize message blobs with keys
+// following lastKey and returns the keys of processed blobs.
+func (b *Backend) reindexBatch(lastKey string) ([]string, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	// Encrypted blobs are skipped unless IndexEncrypted is set.
+	encryptedCond := ""
+	if !b.Opts.IndexEncrypted {
+		encryptedCond = `AND extBodyKey NOT IN (SELECT id FROM extKeys WHERE dataKey IS NOT NULL)`
+	}
+
+	// Rows are read before indexing anything since some drivers
+	// do not allow to execute queries while result set is open.
+	rows, err := tx.Query(b.db.rewriteSQL(`
+		SELECT extBodyKey, MAX(compressAlgo)
+		FROM msgs
+		WHERE extBodyKey > ? `+encryptedCond+`
+		GROUP BY extBodyKey
+		ORDER BY extBodyKey
+		LIMIT `+strconv.Itoa(reindexBatchSize)), lastKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys, compressAlgos []string
+	for rows.Next() {
+		var (
+			key          string
+			compressAlgo sql.NullString
+		)
+		if err := rows.Scan(&key, &compressAlgo); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		compressAlgos = append(compressAlgos, compressAlgo.String)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Blobs of messages delivered after the index was cleared are
+	// already indexed.
+	if err := b.ftsDelete(tx, keys); err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if err := b.ftsIndex(tx, key, compressAlgos[i]); err != nil {
+			b.Opts.Log.Printf("Reindex: failed to index %s, skipping: %v", key, err)
+		}
+	}
+
+	return keys, tx.Commit()
+}
+
+// ftsIndexable reports whether the search string can be matched using the
+// full-text index.
+func (b *Backend) ftsIndexable(value string) bool {
+	if b.db.driver == "sqlite3" {
+		// trigram tokenizer can't match strings shorter than 3 characters.
+		return utf8.RuneCountInString(value) >= 3
+	}
+	return strings.IndexFunc(value, isWordRune) != -1
+}
+
+// ftsPrefilter returns words of the search string that are not parts of
+// longer words in the matching text, i.e. words that are surrounded by
+// whitespace in the search string. Other words are omitted since the string
+// can start and end in the middle of a word, as are words without letters
+// and digits since they are not indexed.
+func ftsPrefilter(value string) string {
+	words := strings.Fields(value)
+	if len(words) == 0 {
+		return ""
+	}
+	if first, _ := utf8.DecodeRuneInString(value); !unicode.IsSpace(first) {
+		words = words[1:]
+	}
+	if last, _ := utf8.DecodeLastRuneInString(value); len(words) != 0 && !unicode.IsSpace(last) {
+		words = words[:len(words)-1]
+	}
+
+	res := words[:0]
+	for _, word := range words {
+		if strings.IndexFunc(word, isWordRune) != -1 {
+			res = append(res, word)
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// ftsSearch returns UIDs of messages in the mailbox that match the search
+// string using the specified statement.
+func (b *Backend) ftsSearch(stmt *sql.Stmt, mboxId uint64, value string) ([]uint32, error) {
+	var matchArgs []interface{}
+	if b.db.driver == "sqlite3" {
+		// Search for the whole string as a phrase.
+		matchArgs = []interface{}{`"` + strings.Replace(value, `"`, `""`, -1) + `"`}
+	} else {
+		prefilter := ftsPrefilter(value)
+		matchArgs = []interface{}{prefilter, prefilter, value}
+	}
+	args := append([]interface{}{mboxId}, matchArgs...)
+	if stmt == b.ftsSearchText {
+		args = append(args, matchArgs...)
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+// ftsResolveCriteria replaces BODY and TEXT criteria with UID sets of matching
+// messages found using the full-text index. HEADER criteria are kept
+// since full-text index does not distinguish header fields, but candidate
+// messages are restricted in the same way.
+//
+// Criteria that can't be matched using the index are left untouched.
+func (m *Mailbox) ftsResolveCriteria(criteria *imap.SearchCriteria) error {
+	restrict := func(stmt *sql.Stmt, value string) error {
+		uids, err := m.parent.ftsSearch(stmt, m.id, value)
+		if err != nil {
+			return err
+		}
+		res := &imap.SeqSet{}
+		for _, uid := range uids {
+			if criteria.Uid == nil || criteria.Uid.Contains(uid) {
+				res.AddNum(uid)
+			}
+		}
+		criteria.Uid = res
+		return nil
+	}
+
+	body := criteria.Body[:0]
+	for _, value := range criteria.Body {
+		if !m.parent.ftsIndexable(value) {
+			body = append(body, value)
+			continue
+		}
+		if err := restrict(m.parent.ftsSearchBody, value); err != nil {
+			return err
+		}
+	}
+	criteria.Body = body
+
+	text := criteria.Text[:0]
+	for _, value := range criteria.Text {
+		if !m.parent.ftsIndexable(value) {
+			text = append(text, value)
+			continue
+		}
+		if err := restrict(m.parent.ftsSearchText, value); err != nil {
+			return err
+		}
+	}
+	criteria.Text = text
+
+	for _, values := range criteria.Header {
+		for _, value := range values {
+			if !m.parent.ftsIndexable(value) {
+				continue
+			}
+			if err := restrict(m.parent.ftsSearchHeader, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, crit := range criteria.Not {
+		if err := m.ftsResolveCriteria(crit); err != nil {
+			return err
+		}
+	}
+	for _, crit := range criteria.Or {
+		if err := m.ftsResolveCriteria(crit[0]); err != nil {
+			return err
+		}
+		if err := m.ftsResolveCriteria(crit[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package imapsql
+
+import (
+	nettextproto "net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+const (
+	ftsMsg1 = "From: <alice@example.org>\r\n" +
+		"Subject: Quarterly report\r\n" +
+		"\r\n" +
+		"The numbers look great this quarter.\r\n"
+	ftsMsg2 = "From: <bob@example.org>\r\n" +
+		"Subject: =?utf-8?q?Caf=C3=A9_meeting?=\r\n" +
+		"Content-Type: multipart/mixed; boundary=BOUNDARY\r\n" +
+		"\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"TGV0J3MgbWVldCBhdCB0aGUgY2FmZXRlcmlhLg==\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"\r\n" +
+		"binary attachment\r\n" +
+		"--BOUNDARY--\r\n"
+	ftsMsg3 = "From: <carol@example.org>\r\n" +
+		"Subject: Lunch\r\n" +
+		"\r\n" +
+		"Quarterly numbers are in the report from Alice.\r\n"
+)
+
+func TestFullTextSearch(t *testing.T) {
+	b := initTestBackendOpts(Opts{FullTextIndex: true}).(*Backend)
+	defer cleanBackend(b)
+	if !b.fts {
+		t.Log("Full-text index is not supported, testing fallback")
+	}
+
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usrI, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	usr := usrI.(*User)
+	dstName := t.Name() + "-dst"
+	assert.NilError(t, usr.CreateMailbox(dstName))
+
+	for _, msg := range []string{ftsMsg1, ftsMsg2} {
+		assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), nil))
+	}
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(ftsMsg3)))
+	assert.NilError(t, delivery.Commit())
+
+	_, mboxI, err := usr.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	search := func(t *testing.T, mbox *Mailbox, criteria *imap.SearchCriteria, expected []uint32) {
+		t.Helper()
+		res, err := mbox.SearchMessages(true, criteria)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, res, expected)
+	}
+
+	t.Run("body", func(t *testing.T) {
+		search(t, mbox, &imap.SearchCriteria{Body: []string{"NUMBERS"}}, []uint32{1, 3})
+		search(t, mbox, &imap.SearchCriteria{Body: []string{"numbers", "alice"}}, []uint32{3})
+		search(t, mbox, &imap.SearchCriteria{Body: []string{"missing"}}, nil)
+		if b.fts {
+			// Only the index contains decoded text of base64-encoded parts.
+			search(t, mbox, &imap.SearchCriteria{Body: []string{"cafeteria"}}, []uint32{2})
+		}
+	})
+	t.Run("text", func(t *testing.T) {
+		search(t, mbox, &imap.SearchCriteria{Text: []string{"Quarterly"}}, []uint32{1, 3})
+		search(t, mbox, &imap.SearchCriteria{Text: []string{"bob@example"}}, []uint32{2})
+	})
+	t.Run("header", func(t *testing.T) {
+		search(t, mbox, &imap.SearchCriteria{
+			Header: nettextproto.MIMEHeader{"Subject": {"report"}},
+		}, []uint32{1})
+		search(t, mbox, &imap.SearchCriteria{
+			Header: nettextproto.MIMEHeader{"Subject": {"café"}},
+		}, []uint32{2})
+		// Matching value in other field.
+		search(t, mbox, &imap.SearchCriteria{
+			Header: nettextproto.MIMEHeader{"From": {"report"}},
+		}, nil)
+	})
+	t.Run("not and or", func(t *testing.T) {
+		search(t, mbox, &imap.SearchCriteria{
+			Not: []*imap.SearchCriteria{{Body: []string{"numbers"}}},
+		}, []uint32{2})
+		search(t, mbox, &imap.SearchCriteria{
+			Or: [][2]*imap.SearchCriteria{{{Body: []string{"great"}}, {Body: []string{"alice"}}}},
+		}, []uint32{1, 3})
+	})
+	t.Run("short string", func(t *testing.T) {
+		search(t, mbox, &imap.SearchCriteria{Body: []string{"in"}}, []uint32{2, 3})
+	})
+
+	t.Run("copy and move", func(t *testing.T) {
+		_, dstI, err := usr.GetMailbox(dstName, false, &noopConn{})
+		assert.NilError(t, err)
+		defer dstI.Close()
+		dst := dstI.(*Mailbox)
+
+		seq, _ := imap.ParseSeqSet("1")
+		assert.NilError(t, mbox.CopyMessages(true, seq, dst.Name()))
+		seq, _ = imap.ParseSeqSet("2")
+		assert.NilError(t, mbox.MoveMessages(true, seq, dst.Name()))
+		assert.NilError(t, dst.Poll(true))
+		assert.NilError(t, mbox.Poll(true))
+
+		search(t, dst, &imap.SearchCriteria{Body: []string{"numbers"}}, []uint32{1})
+		search(t, dst, &imap.SearchCriteria{Text: []string{"bob@example"}}, []uint32{2})
+		search(t, mbox, &imap.SearchCriteria{Text: []string{"bob@example"}}, nil)
+	})
+
+	t.Run("expunge", func(t *testing.T) {
+		seq, _ := imap.ParseSeqSet("1:*")
+		assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+		assert.NilError(t, mbox.Expunge())
+		search(t, mbox, &imap.SearchCriteria{Body: []string{"numbers"}}, nil)
+
+		if b.fts {
+			// Copy of the first message is still in the target mailbox.
+			var count int
+			assert.NilError(t, b.DB.QueryRow(`SELECT COUNT(*) FROM msgs_fts`).Scan(&count))
+			assert.Equal(t, count, 2)
+		}
+	})
+
+	t.Run("reindex", func(t *testing.T) {
+		if !b.fts {
+			assert.Equal(t, b.Reindex(), ErrFullTextIndexDisabled)
+			return
+		}
+
+		_, err := b.DB.Exec(`DELETE FROM msgs_fts`)
+		assert.NilError(t, err)
+		assert.NilError(t, b.Reindex())
+
+		var count int
+		assert.NilError(t, b.DB.QueryRow(`SELECT COUNT(*) FROM msgs_fts`).Scan(&count))
+		assert.Equal(t, count, 2)
+
+		_, dst, err := usr.GetMailbox(dstName, true, &noopConn{})
+		assert.NilError(t, err)
+		defer dst.Close()
+		search(t, dst.(*Mailbox), &imap.SearchCriteria{Body: []string{"cafeteria"}}, []uint32{2})
+	})
+}
+
+func TestFTSPrefilter(t *testing.T) {
+	for _, c := range []struct {
+		value, prefilter string
+	}{
+		{"numbers", ""},
+		{"great this", ""},
+		{"look great this quarter", "great this"},
+		{" numbers ", "numbers"},
+		{"numbers look ", "look"},
+		{"a - b", ""},
+		{"", ""},
+		{"   ", ""},
+	} {
+		assert.Equal(t, ftsPrefilter(c.value), c.prefilter, c.value)
+	}
+}
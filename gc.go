@@ -0,0 +1,216 @@
+package imapsql
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	// gcDefaultInterval is used if Opts.GCInterval is not set.
+	gcDefaultInterval = time.Minute
+
+	// gcDefaultGracePeriod is used if Opts.OrphanGracePeriod is not set.
+	gcDefaultGracePeriod = 24 * time.Hour
+
+	// gcDefaultExpungedRetention is used if Opts.ExpungedRetention is not set.
+	gcDefaultExpungedRetention = 30 * 24 * time.Hour
+
+	// gcPruneInterval is the interval between removals of old entries from
+	// the expunged table.
+	gcPruneInterval = time.Hour
+)
+
+// scheduleExtDelete records keys of objects that should be removed from the
+// external store once tx is committed. flushExtDeletes should be called after
+// the commit, objects it fails to remove are removed by the background
+// worker later.
+//
+// Objects of stores using the database itself are removed in tx directly.
+func (b *Backend) scheduleExtDelete(tx *sql.Tx, keys []string) error {
+	if store, ok := b.extStore.(txExternalStore); ok {
+		return store.deleteTx(tx, keys)
+	}
+	now := time.Now().Unix()
+	for _, key := range keys {
+		if _, err := tx.Stmt(b.queueExtDelete).Exec(key, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushExtDeletes removes objects recorded by scheduleExtDelete. Failures are
+// only logged since the transaction is committed already.
+func (b *Backend) flushExtDeletes(keys []string) {
+	if _, ok := b.extStore.(txExternalStore); ok || len(keys) == 0 {
+		return
+	}
+	if err := b.extStore.Delete(keys); err != nil {
+		b.Opts.Log.Printf("failed to remove objects %v, will retry later: %v", keys, err)
+		return
+	}
+	for _, key := range keys {
+		if _, err := b.dequeueExtDelete.Exec(key); err != nil {
+			// Object is removed again later, that's not a problem.
+			b.Opts.Log.Printf("failed to dequeue removed object %s: %v", key, err)
+		}
+	}
+}
+
+// deleteQueued removes objects recorded by scheduleExtDelete that were not
+// removed by flushExtDeletes. It returns the number of removed objects.
+func (b *Backend) deleteQueued() (int, error) {
+	deleted := 0
+	for {
+		keys, err := scanKeys(b.queuedExtDelete.Query())
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) == 0 {
+			return deleted, nil
+		}
+		if err := b.extStore.Delete(keys); err != nil {
+			return deleted, err
+		}
+		for _, key := range keys {
+			if _, err := b.dequeueExtDelete.Exec(key); err != nil {
+				return deleted, err
+			}
+		}
+		deleted += len(keys)
+	}
+}
+
+// findOrphans returns keys of objects in the external store that are not used
+// by any message and were modified before cutoff. nil is returned if the
+// store does not support listing.
+func (b *Backend) findOrphans(cutoff time.Time) ([]string, error) {
+	store, ok := b.extStore.(listingExternalStore)
+	if !ok {
+		return nil, nil
+	}
+
+	// Objects are listed before keys so objects added in between are
+	// not reported.
+	var candidates []string
+	err := store.listObjects(func(key string, modTime time.Time) error {
+		if modTime.Before(cutoff) {
+			candidates = append(candidates, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	known, err := scanKeys(b.db.Query(`SELECT id FROM extKeys`))
+	if err != nil {
+		return nil, err
+	}
+	knownSet := make(map[string]struct{}, len(known))
+	for _, key := range known {
+		knownSet[key] = struct{}{}
+	}
+
+	var orphans []string
+	for _, key := range candidates {
+		if _, ok := knownSet[key]; !ok {
+			orphans = append(orphans, key)
+		}
+	}
+	return orphans, nil
+}
+
+// sweepOrphans removes objects not used by any message that were modified
+// before cutoff. It returns the number of removed objects.
+func (b *Backend) sweepOrphans(cutoff time.Time) (int, error) {
+	orphans, err := b.findOrphans(cutoff)
+	if err != nil || len(orphans) == 0 {
+		return 0, err
+	}
+	if err := b.deleteExtObjs(nil, orphans); err != nil {
+		return 0, err
+	}
+	return len(orphans), nil
+}
+
+// pruneExpunged removes information about messages expunged before cutoff.
+// It returns the number of removed entries.
+//
+// Modification sequence of the last removed entry is stored for each
+// mailbox so Mailbox.Vanished knows it can't use the table for older
+// states.
+func (b *Backend) pruneExpunged(cutoff time.Time) (int64, error) {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if _, err := tx.Stmt(b.setPrunedModSeq).Exec(cutoff.Unix(), cutoff.Unix()); err != nil {
+		return 0, err
+	}
+	stats, err := tx.Stmt(b.delPrunedExpunged).Exec()
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := stats.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return pruned, tx.Commit()
+}
+
+func (b *Backend) gcLoop() {
+	interval := b.Opts.GCInterval
+	if interval == 0 {
+		interval = gcDefaultInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var lastSweep, lastPrune time.Time
+	for {
+		select {
+		case <-t.C:
+			deleted, err := b.deleteQueued()
+			if err != nil {
+				b.Opts.Log.Printf("failed to remove deleted objects: %v", err)
+			} else if deleted != 0 {
+				b.Opts.Log.Debugln("removed", deleted, "deleted objects")
+			}
+
+			retention := b.Opts.ExpungedRetention
+			if retention == 0 {
+				retention = gcDefaultExpungedRetention
+			}
+			if retention > 0 && time.Since(lastPrune) >= gcPruneInterval {
+				lastPrune = time.Now()
+				pruned, err := b.pruneExpunged(lastPrune.Add(-retention))
+				if err != nil {
+					b.Opts.Log.Printf("failed to prune expunged messages: %v", err)
+				} else if pruned != 0 {
+					b.Opts.Log.Debugln("pruned", pruned, "expunged messages")
+				}
+			}
+
+			// The whole store is scanned once per grace period.
+			gracePeriod := b.Opts.OrphanGracePeriod
+			if gracePeriod == 0 {
+				gracePeriod = gcDefaultGracePeriod
+			}
+			if gracePeriod < 0 || time.Since(lastSweep) < gracePeriod {
+				continue
+			}
+			lastSweep = time.Now()
+			swept, err := b.sweepOrphans(lastSweep.Add(-gracePeriod))
+			if err != nil {
+				b.Opts.Log.Printf("failed to remove orphaned objects: %v", err)
+			} else if swept != 0 {
+				b.Opts.Log.Println("removed", swept, "orphaned objects")
+			}
+		case <-b.gcLoopStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package imapsql
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+)
+
+// flakyStore is the FSStore that fails to delete objects if fail is set.
+type flakyStore struct {
+	*FSStore
+	fail bool
+}
+
+func (s *flakyStore) Delete(keys []string) error {
+	if s.fail {
+		return errors.New("flakyStore: delete failed")
+	}
+	return s.FSStore.Delete(keys)
+}
+
+func storedKeys(t *testing.T, root string) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(root)
+	assert.NilError(t, err)
+	keys := make([]string, 0, len(infos))
+	for _, info := range infos {
+		keys = append(keys, info.Name())
+	}
+	return keys
+}
+
+func queuedDeletes(t *testing.T, b *Backend) int {
+	t.Helper()
+	var count int
+	assert.NilError(t, b.DB.QueryRow(`SELECT COUNT(*) FROM extDeletes`).Scan(&count))
+	return count
+}
+
+func TestDeferredDelete(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	store := &flakyStore{FSStore: b.extStore.(*FSStore)}
+	b.extStore = store
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mbox, err := usr.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{imap.DeletedFlag}, time.Now(), strings.NewReader(testMsg), mbox))
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg+"P.S."), mbox))
+	assert.NilError(t, mbox.Poll(true))
+	assert.Equal(t, len(storedKeys(t, store.Root)), 2)
+
+	// Message is expunged even if its body can't be removed.
+	store.fail = true
+	assert.NilError(t, mbox.Expunge())
+	assert.NilError(t, mbox.Poll(true))
+	assert.Equal(t, len(storedKeys(t, store.Root)), 2)
+	assert.Equal(t, queuedDeletes(t, b), 1)
+
+	deleted, err := b.deleteQueued()
+	assert.Assert(t, err != nil)
+	assert.Equal(t, deleted, 0)
+
+	store.fail = false
+	deleted, err = b.deleteQueued()
+	assert.NilError(t, err)
+	assert.Equal(t, deleted, 1)
+	assert.Equal(t, len(storedKeys(t, store.Root)), 1)
+	assert.Equal(t, queuedDeletes(t, b), 0)
+
+	// Queue is not used if objects are removed right after the commit.
+	assert.NilError(t, b.DeleteUser(t.Name()))
+	assert.Equal(t, len(storedKeys(t, store.Root)), 0)
+	assert.Equal(t, queuedDeletes(t, b), 0)
+}
+
+func TestSweepOrphans(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+
+	root := b.extStore.(*FSStore).Root
+	old := time.Now().Add(-2 * time.Hour)
+	body := storedKeys(t, root)[0]
+	assert.NilError(t, os.Chtimes(filepath.Join(root, body), old, old))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, "orphan"), []byte("orphan"), 0600))
+	assert.NilError(t, os.Chtimes(filepath.Join(root, "orphan"), old, old))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, "fresh"), []byte("fresh"), 0600))
+	// Temporary files left behind by a crash.
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, ".orphan.tmp123"), []byte("orphan"), 0600))
+	assert.NilError(t, os.Chtimes(filepath.Join(root, ".orphan.tmp123"), old, old))
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, ".fresh.tmp123"), []byte("fresh"), 0600))
+
+	swept, err := b.sweepOrphans(time.Now().Add(-time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, swept, 2)
+	assert.DeepEqual(t, storedKeys(t, root), []string{".fresh.tmp123", body, "fresh"})
+}
+
+func TestGCWorker(t *testing.T) {
+	b := initTestBackendOpts(Opts{
+		GCInterval:        10 * time.Millisecond,
+		OrphanGracePeriod: 50 * time.Millisecond,
+	}).(*Backend)
+	defer cleanBackend(b)
+	root := b.extStore.(*FSStore).Root
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	body := storedKeys(t, root)[0]
+
+	// Crash between the commit and removal of the object.
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, "deleted"), []byte("deleted"), 0600))
+	_, err = b.db.Exec(`INSERT INTO extDeletes(id, queued) VALUES (?, ?)`, "deleted", time.Now().Unix())
+	assert.NilError(t, err)
+
+	assert.NilError(t, ioutil.WriteFile(filepath.Join(root, "orphan"), []byte("orphan"), 0600))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(storedKeys(t, root)) != 1 || queuedDeletes(t, b) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Objects are not removed by the worker:", storedKeys(t, root))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.DeepEqual(t, storedKeys(t, root), []string{body})
+}
@@ -0,0 +1,124 @@
+package imapsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	nettextproto "net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+// headerIndexEntries returns values of cached header fields as they should
+// be stored in msgs_headers table.
+//
+// Values are decoded and lower-cased the same way backendutil.Match does
+// it so HEADER criteria can be matched using a simple LIKE expression.
+func headerIndexEntries(cachedHeader map[string][]string) (fields, values []string) {
+	hdr := message.Header{}
+	for key, vals := range cachedHeader {
+		for _, val := range vals {
+			hdr.Add(key, val)
+		}
+	}
+
+	for field := hdr.Fields(); field.Next(); {
+		decoded, _ := field.Text()
+		fields = append(fields, nettextproto.CanonicalMIMEHeaderKey(field.Key()))
+		values = append(values, strings.ToLower(decoded))
+	}
+	return
+}
+
+func (b *Backend) addMsgHeaders(tx *sql.Tx, mboxId uint64, msgId uint32, cachedHeaderBlob []byte) error {
+	var cachedHeader map[string][]string
+	if err := json.Unmarshal(cachedHeaderBlob, &cachedHeader); err != nil {
+		return err
+	}
+
+	fields, values := headerIndexEntries(cachedHeader)
+	for i := range fields {
+		if _, err := tx.Stmt(b.addMsgHeader).Exec(mboxId, msgId, fields[i], values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillHeaderIndex populates msgs_headers table for all existing
+// messages. Only cached header data is used so the external store is not
+// accessed.
+func (b *Backend) backfillHeaderIndex(tx *sql.Tx) error {
+	const batchSize = 1000
+
+	selectBatch, err := tx.Prepare(b.db.rewriteSQL(`
+		SELECT mboxId, msgId, cachedHeader
+		FROM msgs
+		WHERE mboxId > ? OR (mboxId = ? AND msgId > ?)
+		ORDER BY mboxId, msgId
+		LIMIT ` + strconv.Itoa(batchSize)))
+	if err != nil {
+		return err
+	}
+	defer selectBatch.Close()
+	addHeader, err := tx.Prepare(b.db.rewriteSQL(`
+		INSERT INTO msgs_headers(mboxId, msgId, field, value)
+		VALUES (?, ?, ?, ?)`))
+	if err != nil {
+		return err
+	}
+	defer addHeader.Close()
+
+	type msgHeaders struct {
+		mboxId uint64
+		msgId  uint32
+		blob   []byte
+	}
+	var (
+		lastMbox uint64
+		lastMsg  uint32
+	)
+	for {
+		// Rows are read before inserting anything since some drivers
+		// do not allow to execute queries while result set is open.
+		rows, err := selectBatch.Query(lastMbox, lastMbox, lastMsg)
+		if err != nil {
+			return err
+		}
+		msgs := make([]msgHeaders, 0, batchSize)
+		for rows.Next() {
+			var msg msgHeaders
+			if err := rows.Scan(&msg.mboxId, &msg.msgId, &msg.blob); err != nil {
+				rows.Close()
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return err
+		}
+		rows.Close()
+
+		for _, msg := range msgs {
+			var cachedHeader map[string][]string
+			if err := json.Unmarshal(msg.blob, &cachedHeader); err != nil {
+				b.Opts.Log.Printf("backfillHeaderIndex: malformed cached header for %d/%d, skipping: %v", msg.mboxId, msg.msgId, err)
+				continue
+			}
+
+			fields, values := headerIndexEntries(cachedHeader)
+			for i := range fields {
+				if _, err := addHeader.Exec(msg.mboxId, msg.msgId, fields[i], values[i]); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(msgs) < batchSize {
+			return nil
+		}
+		lastMbox, lastMsg = msgs[len(msgs)-1].mboxId, msgs[len(msgs)-1].msgId
+	}
+}
@@ -29,6 +29,14 @@ type Mailbox struct {
 	id       uint64
 	readOnly bool
 
+	// viewer is the user that accesses the mailbox owned by another user
+	// via "Other Users" namespace or the owner logged in using a scoped app
+	// password, nil if the mailbox is accessed by its owner with full
+	// access. rights are the ACL rights of viewer on the mailbox limited by
+	// the scope.
+	viewer *User
+	rights string
+
 	conn   backend.Conn
 	handle *mess.MailboxHandle
 }
@@ -220,6 +228,20 @@ func (m *Mailbox) initSelected(unsetRecent bool) (uids []uint32, recent *imap.Se
 		return nil, nil, nil, wrapErrf(err, "initSelected (uidvalidity) %s", m.name)
 	}
 
+	var highestModSeq uint64
+	if err := tx.Stmt(m.parent.highestModSeq).QueryRow(m.id).Scan(&highestModSeq); err != nil {
+		m.parent.logMboxErr(m, err, "initSelected (highestModSeq)")
+		return nil, nil, nil, wrapErrf(err, "initSelected (highestmodseq) %s", m.name)
+	}
+	status.Items[StatusHighestModSeq] = highestModSeq
+
+	var objectId string
+	if err := tx.Stmt(m.parent.mboxObjectId).QueryRow(m.id).Scan(&objectId); err != nil {
+		m.parent.logMboxErr(m, err, "initSelected (mboxObjectId)")
+		return nil, nil, nil, wrapErrf(err, "initSelected (mailboxid) %s", m.name)
+	}
+	status.Items[StatusMailboxId] = []interface{}{imap.RawString(objectId)}
+
 	if unsetRecent {
 		if err := tx.Commit(); err != nil {
 			m.parent.logMboxErr(m, err, "initSelected (commit)")
@@ -281,6 +303,9 @@ func (m *Mailbox) CreateMessageLimit() *uint32 {
 }
 
 func (m *Mailbox) SetMessageLimit(val *uint32) error {
+	if !m.hasRight(RightAdmin) {
+		return ErrPermissionDenied
+	}
 	_, err := m.parent.setMboxMsgSizeLimit.Exec(val, m.id)
 	return err
 }
@@ -313,10 +338,13 @@ func extractCachedData(hdr textproto.Header, bufferedBody *bufio.Reader) (bodySt
 	return
 }
 
-func (b *Backend) processBody(literal imap.Literal) (bodyStruct, cachedHeader []byte, extBodyKey string, err error) {
-	extBodyKey, err = randomKey()
+// processBody writes the message body to the external store. Parts bigger
+// than Opts.AttachmentThreshold are written as separate objects. Objects are
+// encrypted using dk unless it is nil.
+func (b *Backend) processBody(tx *sql.Tx, dk *dataKey, literal imap.Literal) (bodyStruct, cachedHeader []byte, body storedBody, err error) {
+	extBodyKey, err := randomKey()
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, storedBody{}, err
 	}
 
 	objSize := literal.Len()
@@ -324,45 +352,87 @@ func (b *Backend) processBody(literal imap.Literal) (bodyStruct, cachedHeader []
 		objSize = 0
 	}
 
-	extWriter, err := b.extStore.Create(extBodyKey, int64(objSize))
+	extWriter, err := b.createExtObj(tx, extBodyKey, int64(objSize))
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, storedBody{}, err
 	}
 	defer extWriter.Close()
 
-	compressW, err := b.compressAlgo.WrapCompress(extWriter, b.Opts.CompressAlgoParams)
+	hash := newBodyHash(dk)
+	encW, err := wrapEncrypt(extWriter, dk, extBodyKey)
+	if err != nil {
+		return nil, nil, storedBody{}, err
+	}
+	compressW, err := b.compressAlgo.WrapCompress(io.MultiWriter(encW, hash), b.Opts.CompressAlgoParams)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, storedBody{}, err
 	}
-	defer compressW.Close()
+	defer func() {
+		if compressW != nil {
+			compressW.Close()
+		}
+	}()
+
+	splitter := b.newPartSplitter(tx, dk, compressW)
+	success := false
+	defer func() {
+		if !success {
+			splitter.abort()
+		}
+	}()
 
-	bodyReader := io.TeeReader(literal, compressW)
+	contentHash := newBodyHash(dk)
+	bodyReader := io.TeeReader(literal, io.MultiWriter(splitter, contentHash))
 	bufferedBody := bufio.NewReader(bodyReader)
 	hdr, err := textproto.ReadHeader(bufferedBody)
 	if err != nil {
-		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", wrapErr(err, "CreateMessage (readHeader)")
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, wrapErr(err, "CreateMessage (readHeader)")
 	}
 
 	bodyStruct, cachedHeader, err = extractCachedData(hdr, bufferedBody)
 	if err != nil {
-		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", wrapErr(err, "CreateMessage (extractCachedData)")
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, wrapErr(err, "CreateMessage (extractCachedData)")
 	}
 
 	// Consume all remaining body so io.TeeReader used with external store will
 	// copy everything to extWriter.
 	_, err = io.Copy(ioutil.Discard, bufferedBody)
 	if err != nil {
-		b.extStore.Delete([]string{extBodyKey})
-		return nil, nil, "", wrapErr(err, "CreateMessage (ReadAll consume)")
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, wrapErr(err, "CreateMessage (ReadAll consume)")
+	}
+
+	if err := splitter.Close(); err != nil {
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, wrapErr(err, "CreateMessage (split)")
+	}
+
+	// Compressed stream should be finished before the object is synced,
+	// some ExternalStore implementations do not accept writes after that.
+	err = compressW.Close()
+	compressW = nil
+	if err != nil {
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, wrapErr(err, "CreateMessage (compress)")
+	}
+	if err := encW.Close(); err != nil {
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, wrapErr(err, "CreateMessage (encrypt)")
 	}
 
 	if err := extWriter.Sync(); err != nil {
-		return nil, nil, "", wrapErr(err, "CreateMessage (Sync)")
+		return nil, nil, storedBody{}, wrapErr(err, "CreateMessage (Sync)")
+	}
+	// Object may become visible only after it is closed (e.g. FSStore).
+	if err := extWriter.Close(); err != nil {
+		b.deleteExtObjs(tx, []string{extBodyKey})
+		return nil, nil, storedBody{}, wrapErr(err, "CreateMessage (Close)")
 	}
 
-	return
+	success = true
+	return bodyStruct, cachedHeader, splitter.body(extBodyKey, hash, contentHash), nil
 }
 
 func (m *Mailbox) checkAppendLimit(length int) error {
@@ -382,10 +452,37 @@ func (m *Mailbox) checkAppendLimit(length int) error {
 	return nil
 }
 
+// checkQuota checks both per-mailbox and per-user limits after usage counters
+// are updated.
+func (m *Mailbox) checkQuota(tx *sql.Tx) error {
+	if err := m.parent.checkMboxQuota(tx, m.id); err != nil {
+		if err != ErrQuotaExceeded {
+			m.parent.logMboxErr(m, err, "checkQuota (mbox)")
+		}
+		return err
+	}
+	if err := m.parent.checkUserQuota(tx, m.user.id); err != nil {
+		if err != ErrQuotaExceeded {
+			m.parent.logMboxErr(m, err, "checkQuota (user)")
+		}
+		return err
+	}
+	return nil
+}
+
 func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Literal) error {
+	_, _, err := m.createMessage(flags, date, fullBody)
+	return err
+}
+
+func (m *Mailbox) createMessage(flags []string, date time.Time, fullBody imap.Literal) (uidValidity, uid uint32, err error) {
+	if !m.hasRight(RightInsert) {
+		return 0, 0, ErrPermissionDenied
+	}
+
 	if err := m.checkAppendLimit(fullBody.Len()); err != nil {
 		m.parent.logMboxErr(m, errors.New("appendlimit hit"), "CreateMessage (checkAppendLimit)")
-		return err
+		return 0, 0, err
 	}
 
 	if date.IsZero() {
@@ -394,7 +491,7 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 
 	newFlags := make([]string, 0, len(flags))
 	haveSeen := uint8(0) // it needs to be stored in SQL, hence integer
-	for _, flag := range flags {
+	for _, flag := range m.allowedFlags(flags) {
 		if flag == imap.RecentFlag {
 			continue
 		}
@@ -413,35 +510,88 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 		flagsAddStmt, err = m.parent.getFlagsAddStmt(len(flags))
 		if err != nil {
 			m.parent.logMboxErr(m, err, "CreateMessage (getFlagsAddStmt)")
-			return wrapErr(err, "CreateMessage")
+			return 0, 0, wrapErr(err, "CreateMessage")
 		}
 	}
 
 	tx, err := m.parent.db.BeginLevel(sql.LevelReadCommitted, false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "CreateMessage (tx start)")
-		return wrapErr(err, "CreateMessage (tx begin)")
+		return 0, 0, wrapErr(err, "CreateMessage (tx begin)")
 	}
 	defer tx.Rollback() // nolint:errcheck
 
 	msgId, err := m.incrementMsgCounters(tx)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "CreateMessage (uidNext)")
-		return wrapErr(err, "CreateMessage (uidNext)")
+		return 0, 0, wrapErr(err, "CreateMessage (uidNext)")
+	}
+
+	modSeq, err := m.parent.incrementModSeq(tx, m.id)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "CreateMessage (modseq)")
+		return 0, 0, wrapErr(err, "CreateMessage (modseq)")
+	}
+
+	if err := tx.Stmt(m.parent.uidValidity).QueryRow(m.id).Scan(&uidValidity); err != nil {
+		m.parent.logMboxErr(m, err, "CreateMessage (uidValidity)")
+		return 0, 0, wrapErr(err, "CreateMessage (uidValidity)")
 	}
 
 	bodyLen := fullBody.Len()
-	bodyStruct, cachedHdr, extBodyKey, err := m.parent.processBody(fullBody)
+
+	if err := m.parent.addUsage(tx, m.user.id, m.id, 1, int64(bodyLen)); err != nil {
+		m.parent.logMboxErr(m, err, "CreateMessage (addUsage)")
+		return 0, 0, wrapErr(err, "CreateMessage (addUsage)")
+	}
+	if err := m.checkQuota(tx); err != nil {
+		return 0, 0, err
+	}
+	dk, err := m.parent.userDataKey(tx, m.user.id)
 	if err != nil {
-		return err
+		m.parent.logMboxErr(m, err, "CreateMessage (userDataKey)")
+		return 0, 0, wrapErr(err, "CreateMessage (userDataKey)")
+	}
+	bodyStruct, cachedHdr, body, err := m.parent.processBody(tx, dk, fullBody)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	if _, err = tx.Stmt(m.parent.addExtKey).Exec(extBodyKey, m.user.id, 1); err != nil {
-		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
+	// newKeys are objects that should be deleted if the message is not added.
+	extBodyKey, newKeys, err := m.parent.addBody(tx, m.user.id, body)
+	if err != nil {
+		if err := m.parent.deleteExtObjs(tx, body.keys()); err != nil {
 			m.parent.logMboxErr(m, err, "delete extBodyKey)")
 		}
 		m.parent.logMboxErr(m, err, "CreateMessage (addExtKey)")
-		return wrapErr(err, "CreateMessage (addExtKey)")
+		return 0, 0, wrapErr(err, "CreateMessage (addExtKey)")
+	}
+	if m.parent.indexMessage(dk) {
+		if err := m.parent.ftsIndex(tx, extBodyKey, m.parent.Opts.CompressAlgo); err != nil {
+			if err := m.parent.deleteExtObjs(tx, newKeys); err != nil {
+				m.parent.logMboxErr(m, err, "delete extBodyKey)")
+			}
+			m.parent.logMboxErr(m, err, "CreateMessage (ftsIndex)")
+			return 0, 0, wrapErr(err, "CreateMessage (ftsIndex)")
+		}
+	}
+
+	emailId, threadId, err := m.parent.newMessageIds(tx, m.user.id, cachedHdr)
+	if err != nil {
+		if err := m.parent.deleteExtObjs(tx, newKeys); err != nil {
+			m.parent.logMboxErr(m, err, "delete extBodyKey)")
+		}
+		m.parent.logMboxErr(m, err, "CreateMessage (newMessageIds)")
+		return 0, 0, wrapErr(err, "CreateMessage (newMessageIds)")
+	}
+
+	sealedStruct, sealedHdr, err := m.parent.sealMetadata(dk, bodyStruct, cachedHdr)
+	if err != nil {
+		if err := m.parent.deleteExtObjs(tx, newKeys); err != nil {
+			m.parent.logMboxErr(m, err, "delete extBodyKey)")
+		}
+		m.parent.logMboxErr(m, err, "CreateMessage (sealMetadata)")
+		return 0, 0, wrapErr(err, "CreateMessage (sealMetadata)")
 	}
 
 	recent := m.parent.mngr.NewMessage(m.id, msgId)
@@ -452,60 +602,89 @@ func (m *Mailbox) CreateMessage(flags []string, date time.Time, fullBody imap.Li
 	_, err = tx.Stmt(m.parent.addMsg).Exec(
 		m.id, msgId, date.Unix(),
 		bodyLen,
-		bodyStruct, cachedHdr, extBodyKey,
+		sealedStruct, sealedHdr, extBodyKey,
 		haveSeen, m.parent.Opts.CompressAlgo,
-		recentI,
+		recentI, modSeq,
+		emailId, threadId, body.contentHash,
 	)
 	if err != nil {
-		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
+		if err := m.parent.deleteExtObjs(tx, newKeys); err != nil {
 			m.parent.logMboxErr(m, err, "delete extBodyKey)")
 		}
 		m.parent.logMboxErr(m, err, "CreateMessage (addMsg)")
-		return wrapErr(err, "CreateMessage (addMsg)")
+		return 0, 0, wrapErr(err, "CreateMessage (addMsg)")
+	}
+	if m.parent.indexMessage(dk) {
+		if err := m.parent.addMsgHeaders(tx, m.id, msgId, cachedHdr); err != nil {
+			if err := m.parent.deleteExtObjs(tx, newKeys); err != nil {
+				m.parent.logMboxErr(m, err, "delete extBodyKey)")
+			}
+			m.parent.logMboxErr(m, err, "CreateMessage (addMsgHeaders)")
+			return 0, 0, wrapErr(err, "CreateMessage (addMsgHeaders)")
+		}
 	}
 
 	if len(flags) != 0 {
 		params := m.makeFlagsAddStmtArgs(flags, msgId, msgId)
 		if _, err = tx.Stmt(flagsAddStmt).Exec(params...); err != nil {
-			if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
+			if err := m.parent.deleteExtObjs(tx, newKeys); err != nil {
 				m.parent.logMboxErr(m, err, "delete extBodyKey)")
 			}
 			m.parent.logMboxErr(m, err, "CreateMessage (flags)")
-			return wrapErr(err, "CreateMessage (flags)")
+			return 0, 0, wrapErr(err, "CreateMessage (flags)")
 		}
 	}
 
 	if err = tx.Commit(); err != nil {
-		if err := m.parent.extStore.Delete([]string{extBodyKey}); err != nil {
+		if err := m.parent.deleteExtObjs(nil, newKeys); err != nil {
 			m.parent.logMboxErr(m, err, "delete extBodyKey)")
 		}
 		m.parent.logMboxErr(m, err, "CreateMessage (tx commit)")
-		return wrapErr(err, "CreateMessage (tx commit)")
+		return 0, 0, wrapErr(err, "CreateMessage (tx commit)")
 	}
 
-	return nil
+	return uidValidity, msgId, nil
 }
 
 func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	_, _, _, err := m.moveMessages(uid, seqset, dest)
+	return err
+}
+
+func (m *Mailbox) moveMessages(uid bool, seqset *imap.SeqSet, dest string) (uidValidity uint32, srcUids, destUids *imap.SeqSet, err error) {
 	defer m.handle.Sync(true)
 
+	if !m.hasRight(RightDeleteMsg) || !m.hasRight(RightExpunge) {
+		return 0, nil, nil, ErrPermissionDenied
+	}
+	ownerDest, err := m.resolveDest(dest)
+	if err != nil {
+		if err != backend.ErrNoSuchMailbox && err != ErrPermissionDenied && err != ErrCrossAccount {
+			m.parent.logMboxErr(m, err, "MoveMessages (resolveDest)", uid, seqset, dest)
+			return 0, nil, nil, wrapErr(err, "MoveMessages (resolveDest)")
+		}
+		return 0, nil, nil, err
+	}
+	dest = ownerDest
+
 	tx, err := m.parent.db.Begin(false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (tx start)", uid, seqset, dest)
-		return wrapErr(err, "MoveMessages (tx start)")
+		return 0, nil, nil, wrapErr(err, "MoveMessages (tx start)")
 	}
 	defer tx.Rollback() // nolint:errcheck
 
 	seqset, err = m.handle.ResolveSeq(uid, seqset)
 	if err != nil {
-		return err
+		return 0, nil, nil, err
 	}
+	seqset = sortSeqSet(seqset)
 
 	for _, seq := range seqset.Set {
 		_, err = tx.Stmt(m.parent.markUid).Exec(m.id, seq.Start, seq.Stop)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "MoveMessages (mark)", uid, seqset, dest)
-			return wrapErr(err, "MoveMessages (mark)")
+			return 0, nil, nil, wrapErr(err, "MoveMessages (mark)")
 		}
 	}
 
@@ -516,130 +695,215 @@ func (m *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
 	var destID uint64
 	if err := tx.Stmt(m.parent.mboxId).QueryRow(m.user.id, dest).Scan(&destID); err != nil {
 		if err == sql.ErrNoRows {
-			return backend.ErrNoSuchMailbox
+			return 0, nil, nil, backend.ErrNoSuchMailbox
 		}
 		m.parent.logMboxErr(m, err, "MoveMessages (target lookup)", uid, seqset, dest)
-		return wrapErr(err, "MoveMessages (target lookup)")
+		return 0, nil, nil, wrapErr(err, "MoveMessages (target lookup)")
+	}
+	if err := tx.Stmt(m.parent.uidValidity).QueryRow(destID).Scan(&uidValidity); err != nil {
+		m.parent.logMboxErr(m, err, "MoveMessages (target uidValidity)", uid, seqset, dest)
+		return 0, nil, nil, wrapErr(err, "MoveMessages (target uidValidity)")
+	}
+
+	srcModSeq, err := m.parent.incrementModSeq(tx, m.id)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "MoveMessages (source modseq)", uid, seqset, dest)
+		return 0, nil, nil, wrapErr(err, "MoveMessages (source modseq)")
+	}
+	destModSeq, err := m.parent.incrementModSeq(tx, destID)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "MoveMessages (target modseq)", uid, seqset, dest)
+		return 0, nil, nil, wrapErr(err, "MoveMessages (target modseq)")
 	}
 
 	// Copy messages and flags...
 	copiedCount := uint32(0)
 	for _, seq := range seqset.Set {
-		stats, err := tx.Stmt(m.parent.copyMsgsUid).Exec(destID, destID, copiedCount, m.id, seq.Start, seq.Stop)
+		stats, err := tx.Stmt(m.parent.copyMsgsUid).Exec(destID, destID, copiedCount, destModSeq, m.id, seq.Start, seq.Stop)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "MoveMessages (copy msgs)", uid, seqset, dest)
-			return wrapErr(err, "MoveMessages (copy msgs)")
+			return 0, nil, nil, wrapErr(err, "MoveMessages (copy msgs)")
 		}
 		if _, err := tx.Stmt(m.parent.copyMsgFlagsUid).Exec(destID, destID, copiedCount, m.id, seq.Start, seq.Stop); err != nil {
 			m.parent.logMboxErr(m, err, "MoveMessages (copy msg flags)", uid, seqset, dest)
-			return wrapErr(err, "MoveMessages (copy msg flags)")
+			return 0, nil, nil, wrapErr(err, "MoveMessages (copy msg flags)")
+		}
+		if _, err := tx.Stmt(m.parent.copyMsgHeadersUid).Exec(destID, destID, copiedCount, m.id, seq.Start, seq.Stop); err != nil {
+			m.parent.logMboxErr(m, err, "MoveMessages (copy msg headers)", uid, seqset, dest)
+			return 0, nil, nil, wrapErr(err, "MoveMessages (copy msg headers)")
 		}
 		affected, err := stats.RowsAffected()
 		if err != nil {
 			m.parent.logMboxErr(m, err, "MoveMessages (rows affected)", uid, seqset, dest)
-			return wrapErr(err, "MoveMessages (rows affected)")
+			return 0, nil, nil, wrapErr(err, "MoveMessages (rows affected)")
 		}
 		copiedCount += uint32(affected)
 	}
 	m.parent.Opts.Log.Debugf("copied %v messages to mboxId=%v", copiedCount, destID)
 
+	var movedSize int64
+	if err := tx.Stmt(m.parent.markedSize).QueryRow(m.id).Scan(&movedSize); err != nil {
+		m.parent.logMboxErr(m, err, "MoveMessages (marked size)", uid, seqset, dest)
+		return 0, nil, nil, wrapErr(err, "MoveMessages (marked size)")
+	}
+	if err := m.parent.addUsage(tx, m.user.id, m.id, -int64(copiedCount), -movedSize); err != nil {
+		m.parent.logMboxErr(m, err, "MoveMessages (source usage)", uid, seqset, dest)
+		return 0, nil, nil, wrapErr(err, "MoveMessages (source usage)")
+	}
+	if err := m.parent.addUsage(tx, m.user.id, destID, int64(copiedCount), movedSize); err != nil {
+		m.parent.logMboxErr(m, err, "MoveMessages (target usage)", uid, seqset, dest)
+		return 0, nil, nil, wrapErr(err, "MoveMessages (target usage)")
+	}
+
 	var expunged []uint32
 	rows, err := tx.Stmt(m.parent.markedUids).Query(m.id)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (marked uids)", uid, seqset, dest)
-		return wrapErr(err, "MoveMessages (marked uids)")
+		return 0, nil, nil, wrapErr(err, "MoveMessages (marked uids)")
 	}
 	for rows.Next() {
 		var msgId uint32
 		var extKey sql.NullString
 		if err := rows.Scan(&msgId, &extKey); err != nil {
 			m.parent.logMboxErr(m, err, "MoveMessages (marked uids scan)", uid, seqset, dest)
-			return wrapErr(err, "MoveMessages (marked uids scan)")
+			return 0, nil, nil, wrapErr(err, "MoveMessages (marked uids scan)")
 		}
 
 		expunged = append(expunged, msgId)
 	}
 
+	if _, err := tx.Stmt(m.parent.addExpungedMarked).Exec(srcModSeq, time.Now().Unix(), m.id); err != nil {
+		m.parent.logMboxErr(m, err, "MoveMessages (add expunged)", uid, seqset, dest)
+		return 0, nil, nil, wrapErr(err, "MoveMessages (add expunged)")
+	}
+
 	// Delete marked messages (copies in the source mailbox)
 	if _, err := tx.Stmt(m.parent.delMarked).Exec(); err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (decrease counters)", uid, seqset, dest)
-		return wrapErr(err, "MoveMessages (decrease counters)")
+		return 0, nil, nil, wrapErr(err, "MoveMessages (decrease counters)")
 	}
 
 	// Decrease MESSAGES for the source mailbox.
 	_, err = tx.Stmt(m.parent.decreaseMsgCount).Exec(copiedCount, m.id)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (decrease counters)", uid, seqset, dest)
-		return wrapErr(err, "MoveMessages (decrease counters)")
+		return 0, nil, nil, wrapErr(err, "MoveMessages (decrease counters)")
 	}
 
 	var oldUidNext uint32
 	if err := tx.Stmt(m.parent.uidNext).QueryRow(destID).Scan(&oldUidNext); err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (old uidNext)", uid, seqset, dest)
-		return wrapErr(err, "MoveMessages (old uidNext)")
+		return 0, nil, nil, wrapErr(err, "MoveMessages (old uidNext)")
 	}
 
 	// Increase UIDNEXT and MESSAGES for the target mailbox.
 	if _, err := tx.Stmt(m.parent.increaseMsgCount).Exec(copiedCount, copiedCount, destID); err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (increase counters)", uid, seqset, dest)
-		return wrapErr(err, "MoveMessages (increase counters)")
+		return 0, nil, nil, wrapErr(err, "MoveMessages (increase counters)")
+	}
+
+	// Total usage for the user does not change so only check the per-mailbox
+	// limit of the target mailbox.
+	if err := m.parent.checkMboxQuota(tx, destID); err != nil {
+		if err != ErrQuotaExceeded {
+			m.parent.logMboxErr(m, err, "MoveMessages (target quota)", uid, seqset, dest)
+		}
+		return 0, nil, nil, err
 	}
 
 	if err := tx.Commit(); err != nil {
 		m.parent.logMboxErr(m, err, "MoveMessages (tx commit)", uid, seqset, dest)
-		return wrapErr(err, "MoveMessages (tx commit)")
+		return 0, nil, nil, wrapErr(err, "MoveMessages (tx commit)")
 	}
 
+	srcUids, destUids = &imap.SeqSet{}, &imap.SeqSet{}
 	for _, uid := range expunged {
 		m.handle.Removed(uid)
+		srcUids.AddNum(uid)
+	}
+	if copiedCount != 0 {
+		destUids.AddRange(oldUidNext, oldUidNext+copiedCount-1)
 	}
 	m.parent.mngr.NewMessages(destID, imap.SeqSet{Set: []imap.Seq{{Start: oldUidNext, Stop: oldUidNext + copiedCount - 1}}})
 
-	return nil
+	return uidValidity, srcUids, destUids, nil
 }
 
 func (m *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	_, _, _, err := m.copyMessagesUid(uid, seqset, dest)
+	return err
+}
+
+func (m *Mailbox) copyMessagesUid(uid bool, seqset *imap.SeqSet, dest string) (uidValidity uint32, srcUids, destUids *imap.SeqSet, err error) {
+	if !m.hasRight(RightRead) {
+		return 0, nil, nil, ErrPermissionDenied
+	}
+	ownerDest, err := m.resolveDest(dest)
+	if err != nil {
+		if err != backend.ErrNoSuchMailbox && err != ErrPermissionDenied && err != ErrCrossAccount {
+			m.parent.logMboxErr(m, err, "CopyMessages (resolveDest)", uid, seqset, dest)
+			return 0, nil, nil, wrapErr(err, "CopyMessages (resolveDest)")
+		}
+		return 0, nil, nil, err
+	}
+	dest = ownerDest
+
 	tx, err := m.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "CopyMessages (tx start)", uid, seqset, dest)
-		return wrapErr(err, "CopyMessages")
+		return 0, nil, nil, wrapErr(err, "CopyMessages")
 	}
 	defer tx.Rollback() // nolint:errcheck
 
 	seqset, err = m.handle.ResolveSeq(uid, seqset)
 	if err != nil {
 		if uid {
-			return nil
+			return 0, &imap.SeqSet{}, &imap.SeqSet{}, nil
 		}
-		return err
+		return 0, nil, nil, err
 	}
+	seqset = sortSeqSet(seqset)
 
-	firstCopy, lastCopy, destID, err := m.copyMessages(tx, seqset, dest)
+	srcUids, firstCopy, lastCopy, destID, err := m.copyMessages(tx, seqset, dest)
 	if err != nil {
-		if err == backend.ErrNoSuchMailbox {
-			return err
+		if err == backend.ErrNoSuchMailbox || err == ErrQuotaExceeded {
+			return 0, nil, nil, err
 		}
 		m.parent.logMboxErr(m, err, "CopyMessages", uid, seqset, dest)
-		return wrapErr(err, "CopyMessages")
+		return 0, nil, nil, wrapErr(err, "CopyMessages")
+	}
+
+	if err := tx.Stmt(m.parent.uidValidity).QueryRow(destID).Scan(&uidValidity); err != nil {
+		m.parent.logMboxErr(m, err, "CopyMessages (target uidValidity)", uid, seqset, dest)
+		return 0, nil, nil, wrapErr(err, "CopyMessages")
 	}
 
 	persistRecent := m.parent.mngr.NewMessages(destID, imap.SeqSet{Set: []imap.Seq{{Start: firstCopy, Stop: lastCopy}}})
 	if persistRecent {
 		if _, err := tx.Stmt(m.parent.addRecentToLast).Exec(destID, destID, lastCopy-firstCopy+1); err != nil {
 			m.parent.logMboxErr(m, err, "CopyMessages (persistRecent)", uid, seqset, dest)
-			return wrapErr(err, "CopyMessages")
+			return 0, nil, nil, wrapErr(err, "CopyMessages")
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		m.parent.logMboxErr(m, err, "CopyMessages (tx commit)", uid, seqset, dest)
-		return wrapErr(err, "CopyMessages")
+		return 0, nil, nil, wrapErr(err, "CopyMessages")
 	}
 
-	return nil
+	destUids = &imap.SeqSet{}
+	if lastCopy >= firstCopy {
+		destUids.AddRange(firstCopy, lastCopy)
+	}
+
+	return uidValidity, srcUids, destUids, nil
 }
 
 func (m *Mailbox) DelMessages(uid bool, seqset *imap.SeqSet) error {
+	if !m.hasRight(RightDeleteMsg) || !m.hasRight(RightExpunge) {
+		return ErrPermissionDenied
+	}
+
 	tx, err := m.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "DelMessages (tx start)", uid, seqset)
@@ -652,7 +916,7 @@ func (m *Mailbox) DelMessages(uid bool, seqset *imap.SeqSet) error {
 		return err
 	}
 
-	deleted, err := m.delMessages(tx, seqset)
+	deleted, keys, err := m.delMessages(tx, seqset)
 	if err != nil {
 		if err == backend.ErrNoSuchMailbox {
 			return err
@@ -666,108 +930,170 @@ func (m *Mailbox) DelMessages(uid bool, seqset *imap.SeqSet) error {
 		return wrapErr(err, "DelMessages")
 	}
 
+	m.parent.flushExtDeletes(keys)
+
 	m.handle.RemovedSet(deleted)
 
 	return nil
 }
 
-func (m *Mailbox) delMessages(tx *sql.Tx, seqset *imap.SeqSet) (imap.SeqSet, error) {
+// delMessages removes messages from the mailbox. It returns UIDs of removed
+// messages and external store keys that are no longer referenced, they
+// should be deleted after the transaction is committed.
+func (m *Mailbox) delMessages(tx *sql.Tx, seqset *imap.SeqSet) (imap.SeqSet, []string, error) {
 	for _, seq := range seqset.Set {
 		m.parent.Opts.Log.Println("delMessages: marking SQL window range", seq.Start, seq.Stop, "for deletion")
 		_, err := tx.Stmt(m.parent.markUid).Exec(m.id, seq.Start, seq.Stop)
 		if err != nil {
-			return imap.SeqSet{}, err
+			return imap.SeqSet{}, nil, err
 		}
 	}
 
 	var (
-		deletedExtKeys []string
-		deletedUids    imap.SeqSet
-		deletedCount   uint32
+		deletedUids  imap.SeqSet
+		deletedCount uint32
 	)
 
 	rows, err := tx.Stmt(m.parent.markedUids).Query(m.id)
 	if err != nil {
-		return imap.SeqSet{}, err
+		return imap.SeqSet{}, nil, err
 	}
 	for rows.Next() {
 		var uid uint32
 		var extKey sql.NullString
 		if err := rows.Scan(&uid, &extKey); err != nil {
-			return imap.SeqSet{}, err
+			return imap.SeqSet{}, nil, err
 		}
 		m.parent.Opts.Log.Println("delMessages:", uid, extKey, "is marked")
 
-		deletedExtKeys = append(deletedExtKeys, extKey.String)
 		deletedUids.AddNum(uid)
 		deletedCount++
 	}
 	if err := rows.Err(); err != nil {
-		return imap.SeqSet{}, err
+		return imap.SeqSet{}, nil, err
 	}
 
-	m.parent.Opts.Log.Println("delMessages: deleting storage keys: ", deletedExtKeys)
-	if err := m.parent.extStore.Delete(deletedExtKeys); err != nil {
-		return imap.SeqSet{}, err
+	if deletedCount != 0 {
+		modSeq, err := m.parent.incrementModSeq(tx, m.id)
+		if err != nil {
+			return imap.SeqSet{}, nil, err
+		}
+		if _, err := tx.Stmt(m.parent.addExpungedMarked).Exec(modSeq, time.Now().Unix(), m.id); err != nil {
+			return imap.SeqSet{}, nil, err
+		}
+
+		var deletedSize int64
+		if err := tx.Stmt(m.parent.markedSize).QueryRow(m.id).Scan(&deletedSize); err != nil {
+			return imap.SeqSet{}, nil, err
+		}
+		if err := m.parent.addUsage(tx, m.user.id, m.id, -int64(deletedCount), -deletedSize); err != nil {
+			return imap.SeqSet{}, nil, err
+		}
 	}
 
+	keys, err := m.expungeExternal(tx, m.parent.decreaseRefForMarked)
+	if err != nil {
+		return imap.SeqSet{}, nil, err
+	}
+	m.parent.Opts.Log.Println("delMessages: unreferenced storage keys: ", keys)
+
 	if _, err := tx.Stmt(m.parent.delMarked).Exec(); err != nil {
-		return imap.SeqSet{}, err
+		return imap.SeqSet{}, nil, err
+	}
+	keys, err = m.parent.deleteZeroRefKeys(tx, keys)
+	if err != nil {
+		return imap.SeqSet{}, nil, err
 	}
 
 	m.parent.Opts.Log.Println("delMessages: deleted", deletedCount, "messages")
 	_, err = tx.Stmt(m.parent.decreaseMsgCount).Exec(deletedCount, m.id)
-	return deletedUids, err
+	return deletedUids, keys, err
 }
 
-func (m *Mailbox) copyMessages(tx *sql.Tx, seqset *imap.SeqSet, dest string) (firstCopy, lastCopy uint32, destID uint64, err error) {
+func (m *Mailbox) copyMessages(tx *sql.Tx, seqset *imap.SeqSet, dest string) (srcUids *imap.SeqSet, firstCopy, lastCopy uint32, destID uint64, err error) {
 	row := tx.Stmt(m.parent.mboxId).QueryRow(m.user.id, dest)
 	if err := row.Scan(&destID); err != nil {
 		if err == sql.ErrNoRows {
-			return 0, 0, 0, backend.ErrNoSuchMailbox
+			return nil, 0, 0, 0, backend.ErrNoSuchMailbox
 		}
 	}
 
 	m.parent.Opts.Log.Debugln("copyMessages: resolved target mailbox name to", destID)
 
+	modSeq, err := m.parent.incrementModSeq(tx, destID)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+
 	srcId := m.id
-	var totalCopied uint32
+	srcUids = &imap.SeqSet{}
+	var (
+		totalCopied uint32
+		totalSize   int64
+	)
 	for _, seq := range seqset.Set {
-		stats, err := tx.Stmt(m.parent.copyMsgsUid).Exec(destID, destID, totalCopied, srcId, seq.Start, seq.Stop)
+		if err := m.collectUids(tx, srcUids, seq); err != nil {
+			return nil, 0, 0, 0, err
+		}
+
+		var size int64
+		if err := tx.Stmt(m.parent.msgsSizeUid).QueryRow(srcId, seq.Start, seq.Stop).Scan(&size); err != nil {
+			return nil, 0, 0, 0, err
+		}
+		totalSize += size
+
+		stats, err := tx.Stmt(m.parent.copyMsgsUid).Exec(destID, destID, totalCopied, modSeq, srcId, seq.Start, seq.Stop)
 		if err != nil {
-			return 0, 0, 0, err
+			return nil, 0, 0, 0, err
 		}
 		if _, err := tx.Stmt(m.parent.copyMsgFlagsUid).Exec(destID, destID, totalCopied, srcId, seq.Start, seq.Stop); err != nil {
-			return 0, 0, 0, err
+			return nil, 0, 0, 0, err
+		}
+		if _, err := tx.Stmt(m.parent.copyMsgHeadersUid).Exec(destID, destID, totalCopied, srcId, seq.Start, seq.Stop); err != nil {
+			return nil, 0, 0, 0, err
 		}
 
 		affected, err := stats.RowsAffected()
 		if err != nil {
-			return 0, 0, 0, err
+			return nil, 0, 0, 0, err
 		}
 		totalCopied += uint32(affected)
 		m.parent.Opts.Log.Debugln("copyMessages: copied", affected, "messages for range", seq, "SQL:", seq.Start, seq.Stop)
 
-		if _, err := tx.Stmt(m.parent.incrementRefUid).Exec(m.user.id, srcId, seq.Start, seq.Stop); err != nil {
-			return 0, 0, 0, err
+		if _, err := tx.Stmt(m.parent.incrementRefUid).Exec(srcId, seq.Start, seq.Stop, srcId, seq.Start, seq.Stop); err != nil {
+			return nil, 0, 0, 0, err
 		}
 	}
 
 	var oldUidNext uint32
 	if err := tx.Stmt(m.parent.uidNext).QueryRow(destID).Scan(&oldUidNext); err != nil {
-		return 0, 0, 0, err
+		return nil, 0, 0, 0, err
 	}
 
 	if _, err := tx.Stmt(m.parent.increaseMsgCount).Exec(totalCopied, totalCopied, destID); err != nil {
-		return 0, 0, 0, err
+		return nil, 0, 0, 0, err
+	}
+
+	if err := m.parent.addUsage(tx, m.user.id, destID, int64(totalCopied), totalSize); err != nil {
+		return nil, 0, 0, 0, err
+	}
+	if err := m.parent.checkMboxQuota(tx, destID); err != nil {
+		return nil, 0, 0, 0, err
+	}
+	if err := m.parent.checkUserQuota(tx, m.user.id); err != nil {
+		return nil, 0, 0, 0, err
 	}
 
-	return oldUidNext, oldUidNext + totalCopied - 1, destID, nil
+	return srcUids, oldUidNext, oldUidNext + totalCopied - 1, destID, nil
 }
 
 func (m *Mailbox) Expunge() error {
 	defer m.handle.Sync(true)
 
+	if !m.hasRight(RightExpunge) {
+		return ErrPermissionDenied
+	}
+
 	tx, err := m.parent.db.Begin(false)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (tx start)")
@@ -802,12 +1128,34 @@ func (m *Mailbox) Expunge() error {
 
 	rows.Close()
 
-	keys, err := m.expungeExternal(tx)
+	keys, err := m.expungeExternal(tx, m.parent.decreaseRefForDeleted)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (external prepare)")
 		return err
 	}
 
+	if expungedCount != 0 {
+		modSeq, err := m.parent.incrementModSeq(tx, m.id)
+		if err != nil {
+			m.parent.logMboxErr(m, err, "Expunge (modseq)")
+			return wrapErr(err, "Expunge (modseq)")
+		}
+		if _, err := tx.Stmt(m.parent.addExpungedDeleted).Exec(modSeq, time.Now().Unix(), m.id); err != nil {
+			m.parent.logMboxErr(m, err, "Expunge (add expunged)")
+			return wrapErr(err, "Expunge (add expunged)")
+		}
+
+		var expungedSize int64
+		if err := tx.Stmt(m.parent.deletedSize).QueryRow(m.id).Scan(&expungedSize); err != nil {
+			m.parent.logMboxErr(m, err, "Expunge (deleted size)")
+			return wrapErr(err, "Expunge (deleted size)")
+		}
+		if err := m.parent.addUsage(tx, m.user.id, m.id, -int64(expungedCount), -expungedSize); err != nil {
+			m.parent.logMboxErr(m, err, "Expunge (usage)")
+			return wrapErr(err, "Expunge (usage)")
+		}
+	}
+
 	_, err = tx.Stmt(m.parent.expungeMbox).Exec(m.id, m.id)
 	if err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (expunge)")
@@ -820,7 +1168,8 @@ func (m *Mailbox) Expunge() error {
 		return wrapErr(err, "Expunge (decrease counters)")
 	}
 
-	if _, err := tx.Stmt(m.parent.deleteZeroRef).Exec(m.user.id); err != nil {
+	keys, err = m.parent.deleteZeroRefKeys(tx, keys)
+	if err != nil {
 		m.parent.logMboxErr(m, err, "Expunge (deleteZeroRef)")
 		return wrapErr(err, "Expunge")
 	}
@@ -830,36 +1179,22 @@ func (m *Mailbox) Expunge() error {
 		return wrapErr(err, "Expunge")
 	}
 
-	if err := m.parent.extStore.Delete(keys); err != nil {
-		return wrapErr(err, "Expunge (external)")
-	}
+	m.parent.flushExtDeletes(keys)
 
 	m.handle.RemovedSet(uids)
 
 	return nil
 }
 
-func (m *Mailbox) expungeExternal(tx *sql.Tx) ([]string, error) {
-	if _, err := tx.Stmt(m.parent.decreaseRefForDeleted).Exec(m.user.id, m.id); err != nil {
+func (m *Mailbox) expungeExternal(tx *sql.Tx, decreaseRefStmt *sql.Stmt) ([]string, error) {
+	if _, err := tx.Stmt(decreaseRefStmt).Exec(m.id, m.id); err != nil {
 		return nil, wrapErr(err, "Expunge (external decrease for deleted)")
 	}
 
-	rows, err := tx.Stmt(m.parent.zeroRef).Query(m.user.id, m.id)
+	keys, err := scanKeys(tx.Stmt(m.parent.zeroRef).Query(m.id))
 	if err != nil {
 		return nil, wrapErr(err, "Expunge (external zeroRef collect)")
 	}
-	defer rows.Close()
-
-	keys := make([]string, 0, 16)
-	for rows.Next() {
-		var extKey string
-		if err := rows.Scan(&extKey); err != nil {
-			return nil, wrapErr(err, "Expunge (external scan)")
-		}
-		keys = append(keys, extKey)
-
-	}
-
 	return keys, nil
 }
 
@@ -0,0 +1,282 @@
+package imapsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// FetchEmailId is the FETCH item that requests the EMAILID of the message as
+// defined by RFC 8474.
+//
+// Copies of the same message share the EMAILID. The value is returned in
+// imap.Message.Items in the form suitable for direct serialization.
+const FetchEmailId imap.FetchItem = "EMAILID"
+
+// FetchThreadId is the FETCH item that requests the THREADID of the message
+// as defined by RFC 8474.
+//
+// Messages of the same user that refer to each other using References or
+// In-Reply-To share the THREADID.
+const FetchThreadId imap.FetchItem = "THREADID"
+
+// StatusMailboxId is the STATUS item (and SELECT response code) that contains
+// the MAILBOXID of the mailbox as defined by RFC 8474.
+const StatusMailboxId imap.StatusItem = "MAILBOXID"
+
+// Object ID prefixes, they make IDs of different kinds distinguishable and
+// guarantee that the ID starts with a letter.
+const (
+	mailboxIdPrefix = "F"
+	emailIdPrefix   = "M"
+	threadIdPrefix  = "T"
+)
+
+// maxMsgIdLen is the maximum length of Message-Id stored in msgThreads.
+// Longer values are not used for thread matching.
+const maxMsgIdLen = 255
+
+// newObjectId generates a new random object ID with the specified prefix.
+func newObjectId(prefix string) (string, error) {
+	key, err := randomKey()
+	if err != nil {
+		return "", err
+	}
+	return prefix + key, nil
+}
+
+// MailboxId returns the MAILBOXID of the mailbox. It does not change when
+// the mailbox is renamed.
+func (m *Mailbox) MailboxId() (string, error) {
+	var id string
+	if err := m.parent.mboxObjectId.QueryRow(m.id).Scan(&id); err != nil {
+		m.parent.logMboxErr(m, err, "MailboxId")
+		return "", wrapErr(err, "MailboxId")
+	}
+	return id, nil
+}
+
+// threadRefs returns the Message-Id of the message and identifiers of
+// messages it refers to, closest ancestor first.
+func threadRefs(cachedHeader map[string][]string) (msgId string, refs []string) {
+	if ids := parseMsgIds(firstHeaderField(cachedHeader["Message-Id"])); len(ids) != 0 {
+		msgId = ids[0]
+	}
+
+	refs = parseMsgIds(firstHeaderField(cachedHeader["In-Reply-To"]))
+	references := parseMsgIds(strings.Join(cachedHeader["References"], " "))
+	for i := len(references) - 1; i >= 0; i-- {
+		refs = append(refs, references[i])
+	}
+	return
+}
+
+// assignThreadId returns the THREADID for a new message of the user.
+//
+// If the message or any of the messages it refers to is already known, the
+// existing thread ID is used, otherwise a new one is generated. All
+// identifiers are then recorded so messages that arrive later join the same
+// thread, even if they refer only to the messages not present in the
+// mailbox.
+//
+// get and add should be threadIdByMsgId and addMsgThread statements bound to
+// the current transaction.
+func assignThreadId(get, add *sql.Stmt, uid uint64, msgId string, refs []string) (string, error) {
+	ids := make([]string, 0, len(refs)+1)
+	for _, id := range append([]string{msgId}, refs...) {
+		if id != "" && len(id) <= maxMsgIdLen {
+			ids = append(ids, id)
+		}
+	}
+
+	var threadId string
+	for _, id := range ids {
+		err := get.QueryRow(uid, id).Scan(&threadId)
+		if err == nil {
+			break
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+	if threadId == "" {
+		var err error
+		threadId, err = newObjectId(threadIdPrefix)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, id := range ids {
+		if _, err := add.Exec(uid, id, threadId); err != nil {
+			return "", err
+		}
+	}
+	return threadId, nil
+}
+
+// newMessageIds generates EMAILID and THREADID for a new message of the user.
+func (b *Backend) newMessageIds(tx *sql.Tx, uid uint64, cachedHeaderBlob []byte) (emailId, threadId string, err error) {
+	var cachedHeader map[string][]string
+	if err := json.Unmarshal(cachedHeaderBlob, &cachedHeader); err != nil {
+		return "", "", err
+	}
+
+	emailId, err = newObjectId(emailIdPrefix)
+	if err != nil {
+		return "", "", err
+	}
+	msgId, refs := threadRefs(cachedHeader)
+	threadId, err = assignThreadId(tx.Stmt(b.threadIdByMsgId), tx.Stmt(b.addMsgThread), uid, msgId, refs)
+	return emailId, threadId, err
+}
+
+// backfillObjectIds assigns MAILBOXID to all existing mailboxes and EMAILID
+// and THREADID to all existing messages.
+//
+// Messages sharing the body blob are copies of each other and get the same
+// EMAILID. Messages are processed in the order of their INTERNALDATE so
+// thread IDs are assigned the same way as it would happen on delivery.
+func (b *Backend) backfillObjectIds(tx *sql.Tx) error {
+	scanIds := func(query string) ([]uint64, error) {
+		rows, err := tx.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var ids []uint64
+		for rows.Next() {
+			var id uint64
+			if err := rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return ids, rows.Err()
+	}
+
+	mboxIds, err := scanIds(`SELECT id FROM mboxes`)
+	if err != nil {
+		return err
+	}
+	setMboxId, err := tx.Prepare(b.db.rewriteSQL(`
+		UPDATE mboxes SET objectId = ?
+		WHERE id = ?`))
+	if err != nil {
+		return err
+	}
+	defer setMboxId.Close()
+	for _, id := range mboxIds {
+		objectId, err := newObjectId(mailboxIdPrefix)
+		if err != nil {
+			return err
+		}
+		if _, err := setMboxId.Exec(objectId, id); err != nil {
+			return err
+		}
+	}
+
+	userIds, err := scanIds(`SELECT id FROM users`)
+	if err != nil {
+		return err
+	}
+	listMsgs, err := tx.Prepare(b.db.rewriteSQL(`
+		SELECT msgs.mboxId, msgs.msgId, msgs.extBodyKey, msgs.cachedHeader
+		FROM msgs
+		INNER JOIN mboxes
+		ON mboxes.id = msgs.mboxId
+		WHERE mboxes.uid = ?
+		ORDER BY msgs.date, msgs.mboxId, msgs.msgId`))
+	if err != nil {
+		return err
+	}
+	defer listMsgs.Close()
+	setMsgIds, err := tx.Prepare(b.db.rewriteSQL(`
+		UPDATE msgs SET emailId = ?, threadId = ?
+		WHERE mboxId = ? AND msgId = ?`))
+	if err != nil {
+		return err
+	}
+	defer setMsgIds.Close()
+	getThread, err := tx.Prepare(b.db.rewriteSQL(`
+		SELECT threadId
+		FROM msgThreads
+		WHERE uid = ? AND messageId = ?`))
+	if err != nil {
+		return err
+	}
+	defer getThread.Close()
+	addThread, err := tx.Prepare(b.db.rewriteSQL(`
+		INSERT INTO msgThreads(uid, messageId, threadId)
+		VALUES (?, ?, ?) ON CONFLICT DO NOTHING`))
+	if err != nil {
+		return err
+	}
+	defer addThread.Close()
+
+	type msgInfo struct {
+		mboxId     uint64
+		msgId      uint32
+		extBodyKey sql.NullString
+		headerId   string
+		refs       []string
+	}
+	for _, uid := range userIds {
+		// Rows are read before updating anything since some drivers
+		// do not allow to execute queries while result set is open.
+		rows, err := listMsgs.Query(uid)
+		if err != nil {
+			return err
+		}
+		var msgs []msgInfo
+		for rows.Next() {
+			var (
+				msg  msgInfo
+				blob []byte
+			)
+			if err := rows.Scan(&msg.mboxId, &msg.msgId, &msg.extBodyKey, &blob); err != nil {
+				rows.Close()
+				return err
+			}
+			var cachedHeader map[string][]string
+			if err := json.Unmarshal(blob, &cachedHeader); err != nil {
+				b.Opts.Log.Printf("backfillObjectIds: malformed cached header for %d/%d, ignoring: %v", msg.mboxId, msg.msgId, err)
+			}
+			msg.headerId, msg.refs = threadRefs(cachedHeader)
+			msgs = append(msgs, msg)
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return err
+		}
+		rows.Close()
+
+		type objectIds struct {
+			emailId, threadId string
+		}
+		copies := make(map[string]objectIds)
+		for _, msg := range msgs {
+			ids, ok := copies[msg.extBodyKey.String]
+			if !ok || !msg.extBodyKey.Valid {
+				ids.emailId, err = newObjectId(emailIdPrefix)
+				if err != nil {
+					return err
+				}
+				ids.threadId, err = assignThreadId(getThread, addThread, uid, msg.headerId, msg.refs)
+				if err != nil {
+					return err
+				}
+				if msg.extBodyKey.Valid {
+					copies[msg.extBodyKey.String] = ids
+				}
+			}
+
+			if _, err := setMsgIds.Exec(ids.emailId, ids.threadId, msg.mboxId, msg.msgId); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func objectIdTestMsg(msgId, references string) string {
+	hdr := "Message-Id: <" + msgId + ">\r\n"
+	if references != "" {
+		hdr += "References: " + references + "\r\n"
+	}
+	return hdr + "Subject: Hello!\r\n\r\nHello!\r\n"
+}
+
+// listObjectIds returns EMAILID and THREADID of all messages in the mailbox
+// in UID order.
+func listObjectIds(t *testing.T, m *Mailbox) (emailIds, threadIds []string) {
+	t.Helper()
+	assert.NilError(t, m.Poll(true))
+
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 20)
+	assert.NilError(t, m.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, FetchEmailId, FetchThreadId}, ch))
+	for msg := range ch {
+		emailId := string(msg.Items[FetchEmailId].([]interface{})[0].(imap.RawString))
+		threadId := string(msg.Items[FetchThreadId].([]interface{})[0].(imap.RawString))
+		assert.Assert(t, emailId != "")
+		assert.Assert(t, threadId != "")
+		emailIds = append(emailIds, emailId)
+		threadIds = append(threadIds, threadId)
+	}
+	return
+}
+
+func TestMailboxId(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()+".child"))
+
+	mailboxId := func(name string) string {
+		t.Helper()
+		// User caches INBOX ID so get a fresh one after renames.
+		usr, err := b.GetUser(t.Name())
+		assert.NilError(t, err)
+		status, err := usr.Status(name, []imap.StatusItem{StatusMailboxId})
+		assert.NilError(t, err)
+		return string(status.Items[StatusMailboxId].([]interface{})[0].(imap.RawString))
+	}
+
+	parentId := mailboxId(t.Name())
+	childId := mailboxId(t.Name() + ".child")
+	inboxId := mailboxId("INBOX")
+	assert.Assert(t, parentId != "")
+	assert.Assert(t, childId != parentId)
+	assert.Assert(t, inboxId != parentId)
+
+	assert.NilError(t, usr.RenameMailbox(t.Name(), "Renamed"))
+	assert.Equal(t, mailboxId("Renamed"), parentId)
+	assert.Equal(t, mailboxId("Renamed.child"), childId)
+
+	// INBOX is moved and the new INBOX is created instead.
+	assert.NilError(t, usr.RenameMailbox("INBOX", "Old"))
+	assert.Equal(t, mailboxId("Old"), inboxId)
+	assert.Assert(t, mailboxId("INBOX") != inboxId)
+
+	_, mbox, err := usr.GetMailbox("Renamed", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+	id, err := mbox.(*Mailbox).MailboxId()
+	assert.NilError(t, err)
+	assert.Equal(t, id, parentId)
+}
+
+func TestEmailThreadIds(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	dstName := t.Name() + "-dst"
+	assert.NilError(t, usr.CreateMailbox(dstName))
+
+	for _, msg := range []string{
+		objectIdTestMsg("1@example.org", ""),
+		objectIdTestMsg("2@example.org", "<1@example.org>"),
+		// Reply to the message that is not delivered yet.
+		objectIdTestMsg("4@example.org", "<1@example.org> <3@example.org>"),
+		objectIdTestMsg("5@example.org", ""),
+	} {
+		assert.NilError(t, usr.CreateMessage(t.Name(), []string{}, time.Now(), strings.NewReader(msg), nil))
+	}
+
+	// Parent of the third message arrives later and has no references.
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), textproto.Header{}))
+	assert.NilError(t, delivery.Mailbox(t.Name()))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(objectIdTestMsg("3@example.org", ""))))
+	assert.NilError(t, delivery.Commit())
+
+	// Same Message-Id in the mailbox of other user should not be related.
+	assert.NilError(t, b.CreateUser(t.Name()+"-other"))
+	other, err := b.GetUser(t.Name() + "-other")
+	assert.NilError(t, err)
+	assert.NilError(t, other.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(objectIdTestMsg("1@example.org", "")), nil))
+
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	checkThreads := func(t *testing.T, emailIds, threadIds []string) {
+		t.Helper()
+		assert.Assert(t, is.Len(threadIds, 5))
+		for i := range emailIds {
+			for j := range emailIds {
+				if i != j {
+					assert.Assert(t, emailIds[i] != emailIds[j], "messages %d and %d share EMAILID", i+1, j+1)
+				}
+			}
+		}
+		assert.Equal(t, threadIds[1], threadIds[0])
+		assert.Equal(t, threadIds[2], threadIds[0])
+		assert.Equal(t, threadIds[4], threadIds[0])
+		assert.Assert(t, threadIds[3] != threadIds[0])
+	}
+
+	emailIds, threadIds := listObjectIds(t, mbox)
+	checkThreads(t, emailIds, threadIds)
+
+	_, otherInbox, err := other.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer otherInbox.Close()
+	_, otherThreadIds := listObjectIds(t, otherInbox.(*Mailbox))
+	assert.Assert(t, otherThreadIds[0] != threadIds[0])
+
+	t.Run("copy and move", func(t *testing.T) {
+		_, dstI, err := usr.GetMailbox(dstName, false, &noopConn{})
+		assert.NilError(t, err)
+		defer dstI.Close()
+		dst := dstI.(*Mailbox)
+
+		seq, _ := imap.ParseSeqSet("1:2")
+		assert.NilError(t, mbox.CopyMessages(true, seq, dst.Name()))
+		seq, _ = imap.ParseSeqSet("4")
+		assert.NilError(t, mbox.MoveMessages(true, seq, dst.Name()))
+
+		dstEmailIds, dstThreadIds := listObjectIds(t, dst)
+		assert.DeepEqual(t, dstEmailIds, []string{emailIds[0], emailIds[1], emailIds[3]})
+		assert.DeepEqual(t, dstThreadIds, []string{threadIds[0], threadIds[1], threadIds[3]})
+	})
+
+	t.Run("backfill", func(t *testing.T) {
+		// Simulate the database upgraded from older version.
+		_, err := b.DB.Exec(`UPDATE msgs SET emailId = '', threadId = ''`)
+		assert.NilError(t, err)
+		_, err = b.DB.Exec(`UPDATE mboxes SET objectId = ''`)
+		assert.NilError(t, err)
+		_, err = b.DB.Exec(`DELETE FROM msgThreads`)
+		assert.NilError(t, err)
+		tx, err := b.DB.Begin()
+		assert.NilError(t, err)
+		assert.NilError(t, b.backfillObjectIds(tx))
+		assert.NilError(t, tx.Commit())
+
+		mboxId, err := mbox.MailboxId()
+		assert.NilError(t, err)
+		assert.Assert(t, mboxId != "")
+
+		emailIds, threadIds := listObjectIds(t, mbox)
+		assert.Assert(t, is.Len(threadIds, 4))
+		assert.Equal(t, threadIds[1], threadIds[0])
+		assert.Equal(t, threadIds[2], threadIds[0])
+		assert.Equal(t, threadIds[3], threadIds[0])
+
+		_, dst, err := usr.GetMailbox(dstName, true, &noopConn{})
+		assert.NilError(t, err)
+		defer dst.Close()
+		dstEmailIds, dstThreadIds := listObjectIds(t, dst.(*Mailbox))
+		// Copies share the message body.
+		assert.DeepEqual(t, dstEmailIds[:2], emailIds[:2])
+		assert.Equal(t, dstThreadIds[0], threadIds[0])
+		assert.Assert(t, dstThreadIds[2] != threadIds[0])
+	})
+}
@@ -0,0 +1,488 @@
+package imapsql
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/backend"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type PassHashAlgo interface {
+	// Hash returns the hash of the password encoded as a string that
+	// includes everything needed to check it later (salt, parameters).
+	//
+	// Algorithm settings can be customized by passing
+	// implementation-defined params argument, see Opts.PassHashParams.
+	// Empty string means that the default parameters should be used.
+	Hash(pass, params string) (string, error)
+
+	// Check reports whether the password matches the hash returned by
+	// Hash.
+	Check(pass, hash string) (bool, error)
+
+	// NeedsRehash reports whether the hash was created using parameters
+	// different from params. Such hashes are replaced on successful login.
+	NeedsRehash(hash, params string) bool
+}
+
+var passHashAlgos = map[string]PassHashAlgo{
+	"bcrypt":   bcryptHash{},
+	"argon2id": argon2idHash{},
+	// Can be used only to check passwords of accounts migrated from other
+	// servers (crypt(3) hashes starting with $6$).
+	"sha512-crypt": sha512CryptHash{},
+}
+
+// RegisterPassHashAlgo adds a new password hashing algorithm to the registry
+// so it can be used in Opts.PassHashAlgo and SetUserPasswordHash.
+func RegisterPassHashAlgo(name string, algo PassHashAlgo) {
+	passHashAlgos[name] = algo
+}
+
+func (b *Backend) passHashAlgo() string {
+	if b.Opts.PassHashAlgo == "" {
+		return defaultPassHashAlgo
+	}
+	return b.Opts.PassHashAlgo
+}
+
+// SetUserPassword changes the password of the user. It is hashed using
+// Opts.PassHashAlgo.
+//
+// The password is checked by Login only if Opts.Authenticate is set.
+func (b *Backend) SetUserPassword(username, password string) error {
+	algoName := b.passHashAlgo()
+	algo, ok := passHashAlgos[algoName]
+	if !ok {
+		return fmt.Errorf("SetUserPassword: unknown password hash algorithm: %s", algoName)
+	}
+	hash, err := algo.Hash(password, b.Opts.PassHashParams)
+	if err != nil {
+		return wrapErr(err, "SetUserPassword")
+	}
+	return b.setPasswordColumn(username, algoName+":"+hash, "SetUserPassword")
+}
+
+// SetUserPasswordHash sets the already hashed password of the user, e.g. one
+// exported from another server. algo should be a registered algorithm that
+// accepts the hash, "sha512-crypt" can be used for crypt(3) hashes starting
+// with $6$.
+//
+// The password is rehashed using Opts.PassHashAlgo on the next successful
+// login.
+func (b *Backend) SetUserPasswordHash(username, algo, hash string) error {
+	if _, ok := passHashAlgos[algo]; !ok {
+		return fmt.Errorf("SetUserPasswordHash: unknown password hash algorithm: %s", algo)
+	}
+	return b.setPasswordColumn(username, algo+":"+hash, "SetUserPasswordHash")
+}
+
+// ResetUserPassword removes the password of the user. Such users can't log
+// in if Opts.Authenticate is set.
+func (b *Backend) ResetUserPassword(username string) error {
+	return b.setPasswordColumn(username, nil, "ResetUserPassword")
+}
+
+func (b *Backend) setPasswordColumn(username string, value interface{}, when string) error {
+	stats, err := b.setUserPassword.Exec(value, normalizeUsername(username))
+	if err != nil {
+		return wrapErr(err, when)
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		return wrapErr(err, when)
+	}
+	if affected == 0 {
+		return ErrUserDoesntExists
+	}
+	return nil
+}
+
+// checkPassword checks the password of the user and rehashes it if
+// necessary. It returns backend.ErrInvalidCredentials if the user does not
+// exist, has no password or the password does not match.
+func (b *Backend) checkPassword(username, password string) error {
+	var (
+		uid    uint64
+		stored sql.NullString
+	)
+	if err := b.userPassword.QueryRow(username).Scan(&uid, &stored); err != nil {
+		if err == sql.ErrNoRows {
+			b.checkDummyPassword(password)
+			return backend.ErrInvalidCredentials
+		}
+		return err
+	}
+	if !stored.Valid {
+		b.checkDummyPassword(password)
+		return backend.ErrInvalidCredentials
+	}
+
+	parts := strings.SplitN(stored.String, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed password hash for %s", username)
+	}
+	algo, ok := passHashAlgos[parts[0]]
+	if !ok {
+		return fmt.Errorf("unknown password hash algorithm for %s: %s", username, parts[0])
+	}
+	ok, err := algo.Check(password, parts[1])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return backend.ErrInvalidCredentials
+	}
+
+	if parts[0] == b.passHashAlgo() && !algo.NeedsRehash(parts[1], b.Opts.PassHashParams) {
+		return nil
+	}
+	newAlgo, ok := passHashAlgos[b.passHashAlgo()]
+	if !ok {
+		b.Opts.Log.Printf("unknown password hash algorithm: %s", b.passHashAlgo())
+		return nil
+	}
+	hash, err := newAlgo.Hash(password, b.Opts.PassHashParams)
+	if err != nil {
+		b.Opts.Log.Printf("failed to rehash password of %s: %v", username, err)
+		return nil
+	}
+	// The stored hash is compared to not overwrite the password changed
+	// concurrently.
+	if _, err := b.rehashUserPassword.Exec(b.passHashAlgo()+":"+hash, uid, stored.String); err != nil {
+		b.Opts.Log.Printf("failed to rehash password of %s: %v", username, err)
+		return nil
+	}
+	b.Opts.Log.Debugln("rehashed password of", username, "using", b.passHashAlgo())
+	return nil
+}
+
+// checkDummyPassword checks the password against a hash created using the
+// configured algorithm and parameters so failed logins of users without a
+// password take the same time as for users with one. Otherwise, response
+// time would disclose which accounts exist.
+func (b *Backend) checkDummyPassword(password string) {
+	algoName := b.passHashAlgo()
+	algo, ok := passHashAlgos[algoName]
+	if !ok {
+		return
+	}
+
+	params := algoName + ":" + b.Opts.PassHashParams
+	b.dummyHashLck.Lock()
+	if b.dummyHashParams != params {
+		hash, err := algo.Hash("", b.Opts.PassHashParams)
+		if err != nil {
+			b.dummyHashLck.Unlock()
+			b.Opts.Log.Printf("failed to create dummy password hash: %v", err)
+			return
+		}
+		b.dummyHashParams, b.dummyHash = params, hash
+	}
+	hash := b.dummyHash
+	b.dummyHashLck.Unlock()
+
+	algo.Check(password, hash) // nolint:errcheck
+}
+
+type bcryptHash struct{}
+
+func (bcryptHash) cost(params string) (int, error) {
+	if params == "" {
+		return bcrypt.DefaultCost, nil
+	}
+	return strconv.Atoi(params)
+}
+
+func (h bcryptHash) Hash(pass, params string) (string, error) {
+	cost, err := h.cost(params)
+	if err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), cost)
+	return string(hash), err
+}
+
+func (bcryptHash) Check(pass, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h bcryptHash) NeedsRehash(hash, params string) bool {
+	cost, err := h.cost(params)
+	if err != nil {
+		return false
+	}
+	hashCost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || hashCost != cost
+}
+
+// argon2idHash stores hashes in the PHC string format:
+// $argon2id$v=19$m=65536,t=1,p=4$SALT$HASH
+//
+// params use the same syntax as the parameters part: m=65536,t=1,p=4.
+type argon2idHash struct{}
+
+type argon2idParams struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func parseArgon2idParams(s string) (argon2idParams, error) {
+	p := argon2idParams{memory: 64 * 1024, time: 1, threads: 4}
+	if s == "" {
+		return p, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return p, fmt.Errorf("argon2id: malformed parameter: %s", field)
+		}
+		val, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("argon2id: malformed parameter: %s", field)
+		}
+		switch kv[0] {
+		case "m":
+			p.memory = uint32(val)
+		case "t":
+			p.time = uint32(val)
+		case "p":
+			if val > 255 {
+				return p, fmt.Errorf("argon2id: malformed parameter: %s", field)
+			}
+			p.threads = uint8(val)
+		default:
+			return p, fmt.Errorf("argon2id: unknown parameter: %s", kv[0])
+		}
+	}
+	return p, nil
+}
+
+func (p argon2idParams) String() string {
+	return fmt.Sprintf("m=%d,t=%d,p=%d", p.memory, p.time, p.threads)
+}
+
+// parse returns parameters, salt and the key from the encoded hash.
+func (argon2idHash) parse(hash string) (argon2idParams, []byte, []byte, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[1] != "argon2id" || fields[2] != "v=19" {
+		return argon2idParams{}, nil, nil, errors.New("argon2id: malformed hash")
+	}
+	p, err := parseArgon2idParams(fields[3])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return p, nil, nil, errors.New("argon2id: malformed hash")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil {
+		return p, nil, nil, errors.New("argon2id: malformed hash")
+	}
+	return p, salt, key, nil
+}
+
+func (argon2idHash) Hash(pass, params string) (string, error) {
+	p, err := parseArgon2idParams(params)
+	if err != nil {
+		return "", err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pass), salt, p.time, p.memory, p.threads, 32)
+	return fmt.Sprintf("$argon2id$v=%d$%s$%s$%s", argon2.Version, p,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h argon2idHash) Check(pass, hash string) (bool, error) {
+	p, salt, key, err := h.parse(hash)
+	if err != nil {
+		return false, err
+	}
+	actual := argon2.IDKey([]byte(pass), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+func (h argon2idHash) NeedsRehash(hash, params string) bool {
+	p, err := parseArgon2idParams(params)
+	if err != nil {
+		return false
+	}
+	hashParams, _, _, err := h.parse(hash)
+	return err != nil || hashParams != p
+}
+
+// sha512CryptHash checks SHA-512 based crypt(3) hashes as specified in
+// https://www.akkadia.org/drepper/SHA-crypt.txt.
+type sha512CryptHash struct{}
+
+const (
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+	sha512CryptMaxSalt       = 16
+)
+
+func (sha512CryptHash) Hash(pass, params string) (string, error) {
+	return "", errors.New("sha512-crypt: can be used only to check existing hashes")
+}
+
+func (sha512CryptHash) Check(pass, hash string) (bool, error) {
+	if !strings.HasPrefix(hash, "$6$") {
+		return false, errors.New("sha512-crypt: malformed hash")
+	}
+	rest := hash[3:]
+
+	rounds := sha512CryptDefaultRounds
+	customRounds := false
+	if strings.HasPrefix(rest, "rounds=") {
+		end := strings.IndexByte(rest, '$')
+		if end == -1 {
+			return false, errors.New("sha512-crypt: malformed hash")
+		}
+		val, err := strconv.Atoi(rest[len("rounds="):end])
+		if err != nil {
+			return false, errors.New("sha512-crypt: malformed hash")
+		}
+		rounds = val
+		if rounds < sha512CryptMinRounds {
+			rounds = sha512CryptMinRounds
+		}
+		if rounds > sha512CryptMaxRounds {
+			rounds = sha512CryptMaxRounds
+		}
+		customRounds = true
+		rest = rest[end+1:]
+	}
+
+	end := strings.IndexByte(rest, '$')
+	if end == -1 {
+		return false, errors.New("sha512-crypt: malformed hash")
+	}
+	salt := rest[:end]
+	if len(salt) > sha512CryptMaxSalt {
+		salt = salt[:sha512CryptMaxSalt]
+	}
+
+	actual := sha512Crypt([]byte(pass), []byte(salt), rounds, customRounds)
+	return subtle.ConstantTimeCompare([]byte(actual), []byte(hash)) == 1, nil
+}
+
+func (sha512CryptHash) NeedsRehash(hash, params string) bool {
+	return true
+}
+
+func sha512Crypt(pass, salt []byte, rounds int, customRounds bool) string {
+	alt := sha512.New()
+	alt.Write(pass)
+	alt.Write(salt)
+	alt.Write(pass)
+	altSum := alt.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pass)
+	a.Write(salt)
+	cnt := len(pass)
+	for ; cnt > 64; cnt -= 64 {
+		a.Write(altSum)
+	}
+	a.Write(altSum[:cnt])
+	for cnt = len(pass); cnt > 0; cnt >>= 1 {
+		if cnt&1 != 0 {
+			a.Write(altSum)
+		} else {
+			a.Write(pass)
+		}
+	}
+	sum := a.Sum(nil)
+
+	dp := sha512.New()
+	for i := 0; i < len(pass); i++ {
+		dp.Write(pass)
+	}
+	pSeq := repeatBytes(dp.Sum(nil), len(pass))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		ds.Write(salt)
+	}
+	sSeq := repeatBytes(ds.Sum(nil), len(salt))
+
+	for i := 0; i < rounds; i++ {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(pSeq)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write(sSeq)
+		}
+		if i%7 != 0 {
+			c.Write(pSeq)
+		}
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(pSeq)
+		}
+		sum = c.Sum(sum[:0])
+	}
+
+	res := strings.Builder{}
+	res.WriteString("$6$")
+	if customRounds {
+		res.WriteString("rounds=")
+		res.WriteString(strconv.Itoa(rounds))
+		res.WriteString("$")
+	}
+	res.Write(salt)
+	res.WriteString("$")
+	for _, group := range [...][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	} {
+		cryptB64(&res, sum[group[0]], sum[group[1]], sum[group[2]], 4)
+	}
+	cryptB64(&res, 0, 0, sum[63], 2)
+	return res.String()
+}
+
+func repeatBytes(b []byte, n int) []byte {
+	res := make([]byte, 0, n)
+	for len(res)+len(b) < n {
+		res = append(res, b...)
+	}
+	return append(res, b[:n-len(res)]...)
+}
+
+const cryptB64Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func cryptB64(w *strings.Builder, b2, b1, b0 byte, n int) {
+	v := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		w.WriteByte(cryptB64Alphabet[v&0x3f])
+		v >>= 6
+	}
+}
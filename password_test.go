@@ -0,0 +1,130 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/backend"
+	"gotest.tools/assert"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	// Test vectors from https://www.akkadia.org/drepper/SHA-crypt.txt.
+	for _, hash := range []string{
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+	} {
+		ok, err := sha512CryptHash{}.Check("Hello world!", hash)
+		assert.NilError(t, err)
+		assert.Assert(t, ok, "Hash does not match: %s", hash)
+
+		ok, err = sha512CryptHash{}.Check("Hello world", hash)
+		assert.NilError(t, err)
+		assert.Assert(t, !ok, "Wrong password accepted: %s", hash)
+	}
+
+	_, err := sha512CryptHash{}.Check("Hello world!", "$1$saltstring$hash")
+	assert.ErrorContains(t, err, "malformed")
+}
+
+func TestPassHashAlgos(t *testing.T) {
+	for _, algo := range []struct {
+		name          string
+		params, other string
+	}{
+		{"bcrypt", "4", "5"},
+		{"argon2id", "m=1024,t=1,p=1", "m=1024,t=2,p=1"},
+	} {
+		impl := passHashAlgos[algo.name]
+		hash, err := impl.Hash("password", algo.params)
+		assert.NilError(t, err)
+
+		ok, err := impl.Check("password", hash)
+		assert.NilError(t, err)
+		assert.Assert(t, ok, "Password does not match for %s", algo.name)
+		ok, err = impl.Check("Password", hash)
+		assert.NilError(t, err)
+		assert.Assert(t, !ok, "Wrong password accepted for %s", algo.name)
+
+		assert.Assert(t, !impl.NeedsRehash(hash, algo.params), "Rehash requested for %s", algo.name)
+		assert.Assert(t, impl.NeedsRehash(hash, algo.other), "Rehash not requested for %s", algo.name)
+	}
+}
+
+func storedPassword(t *testing.T, b *Backend, username string) string {
+	t.Helper()
+	var password string
+	assert.NilError(t, b.db.QueryRow(`SELECT password FROM users WHERE username = ?`, username).Scan(&password))
+	return password
+}
+
+func TestLoginAuthenticate(t *testing.T) {
+	b := initTestBackendOpts(Opts{
+		Authenticate:   true,
+		PassHashAlgo:   "argon2id",
+		PassHashParams: "m=1024,t=1,p=1",
+	}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user"))
+
+	_, err := b.Login(nil, "user", "")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	assert.NilError(t, b.SetUserPassword("user", "password"))
+	assert.Assert(t, strings.HasPrefix(storedPassword(t, b, "user"), "argon2id:$argon2id$"))
+	u, err := b.Login(nil, "USER", "password")
+	assert.NilError(t, err)
+	assert.Equal(t, u.Username(), "user")
+	_, err = b.Login(nil, "user", "Password")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	// Accounts are not created.
+	_, err = b.Login(nil, "nobody", "password")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.GetUser("nobody")
+	assert.Equal(t, err, ErrUserDoesntExists)
+	assert.Equal(t, b.SetUserPassword("nobody", "password"), ErrUserDoesntExists)
+	// Password is still hashed to not disclose that.
+	assert.Assert(t, strings.HasPrefix(b.dummyHash, "$argon2id$"))
+	assert.Assert(t, strings.Contains(b.dummyHash, "$m=1024,t=1,p=1$"))
+
+	// Legacy hash is replaced on login.
+	legacy := "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+	assert.NilError(t, b.SetUserPasswordHash("user", "sha512-crypt", legacy))
+	assert.Equal(t, storedPassword(t, b, "user"), "sha512-crypt:"+legacy)
+	_, err = b.Login(nil, "user", "password")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.Login(nil, "user", "Hello world!")
+	assert.NilError(t, err)
+	rehashed := storedPassword(t, b, "user")
+	assert.Assert(t, strings.HasPrefix(rehashed, "argon2id:"))
+	_, err = b.Login(nil, "user", "Hello world!")
+	assert.NilError(t, err)
+	assert.Equal(t, storedPassword(t, b, "user"), rehashed)
+
+	// So are hashes using old parameters.
+	b.Opts.PassHashParams = "m=1024,t=2,p=1"
+	_, err = b.Login(nil, "user", "Hello world!")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(storedPassword(t, b, "user"), "$m=1024,t=2,p=1$"))
+
+	assert.ErrorContains(t, b.SetUserPasswordHash("user", "md5", "hash"), "unknown")
+
+	assert.NilError(t, b.ResetUserPassword("user"))
+	_, err = b.Login(nil, "user", "Hello world!")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+}
+
+func TestLoginNoAutoCreate(t *testing.T) {
+	b := initTestBackendOpts(Opts{NoAutoCreate: true}).(*Backend)
+	defer cleanBackend(b)
+
+	_, err := b.Login(nil, "user", "")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.GetUser("user")
+	assert.Equal(t, err, ErrUserDoesntExists)
+
+	assert.NilError(t, b.CreateUser("user"))
+	_, err = b.Login(nil, "user", "anything")
+	assert.NilError(t, err)
+}
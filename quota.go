@@ -0,0 +1,198 @@
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+// Resource names used in QUOTA extension as defined by RFC 2087.
+const (
+	// QuotaStorage is the sum of messages sizes, in units of 1024 octets.
+	QuotaStorage = "STORAGE"
+	// QuotaMessage is the number of messages.
+	QuotaMessage = "MESSAGE"
+)
+
+var (
+	ErrQuotaExceeded            = errors.New("imap: quota exceeded")
+	ErrUnsupportedQuotaResource = errors.New("imap: unsupported quota resource")
+)
+
+// QuotaStatus is the state of a quota root.
+//
+// Empty Name refers to the per-user quota root that covers all mailboxes
+// of the user. Other names refer to the per-mailbox quota roots and are equal
+// to the mailbox name.
+type QuotaStatus struct {
+	Name string
+
+	// Resources contains the current usage and the limit for each resource
+	// the limit is set for.
+	Resources map[string][2]uint64
+}
+
+// GetQuota returns the state of the quota root.
+func (u *User) GetQuota(root string) (*QuotaStatus, error) {
+	var row *sql.Row
+	if root == "" {
+		row = u.parent.userQuota.QueryRow(u.id)
+	} else {
+		var mboxId uint64
+		if err := u.parent.mboxId.QueryRow(u.id, root).Scan(&mboxId); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, backend.ErrNoSuchMailbox
+			}
+			u.parent.logUserErr(u, err, "GetQuota (mboxId)", root)
+			return nil, wrapErrf(err, "GetQuota %s", root)
+		}
+		row = u.parent.mboxQuota.QueryRow(mboxId)
+	}
+
+	count, size, msgsLimit, storageLimit, err := scanQuota(row)
+	if err != nil {
+		u.parent.logUserErr(u, err, "GetQuota", root)
+		return nil, wrapErrf(err, "GetQuota %s", root)
+	}
+
+	status := &QuotaStatus{Name: root, Resources: make(map[string][2]uint64)}
+	if msgsLimit.Valid {
+		status.Resources[QuotaMessage] = [2]uint64{uint64(count), uint64(msgsLimit.Int64)}
+	}
+	if storageLimit.Valid {
+		status.Resources[QuotaStorage] = [2]uint64{(uint64(size) + 1023) / 1024, uint64(storageLimit.Int64) / 1024}
+	}
+	return status, nil
+}
+
+// SetQuota implements the SETQUOTA command. Users can't change their own
+// limits so ErrPermissionDenied is always returned, use Backend.SetQuota
+// instead.
+func (u *User) SetQuota(root string, resources map[string]uint64) error {
+	return ErrPermissionDenied
+}
+
+// SetQuota changes limits for the quota root of the user.
+//
+// Limits for resources not present in the map are removed, the per-user
+// quota root then uses defaults of the user's domain, see DomainSettings.
+// Use NoLimit to remove the limit without using the default.
+// Values for QuotaStorage are in units of 1024 octets.
+func (b *Backend) SetQuota(username, root string, resources map[string]uint64) error {
+	u, err := b.GetUser(username)
+	if err != nil {
+		return err
+	}
+	return u.(*User).setQuota(root, resources)
+}
+
+func (u *User) setQuota(root string, resources map[string]uint64) error {
+	var msgsLimit, storageLimit sql.NullInt64
+	for name, val := range resources {
+		switch name {
+		case QuotaMessage:
+			msgsLimit = limitValue(val, 1, root == "")
+		case QuotaStorage:
+			storageLimit = limitValue(val, 1024, root == "")
+		default:
+			return ErrUnsupportedQuotaResource
+		}
+	}
+
+	if root == "" {
+		if _, err := u.parent.setUserQuota.Exec(msgsLimit, storageLimit, u.id); err != nil {
+			u.parent.logUserErr(u, err, "SetQuota", root)
+			return wrapErrf(err, "SetQuota %s", root)
+		}
+		return nil
+	}
+
+	stats, err := u.parent.setMboxQuota.Exec(msgsLimit, storageLimit, u.id, root)
+	if err != nil {
+		u.parent.logUserErr(u, err, "SetQuota", root)
+		return wrapErrf(err, "SetQuota %s", root)
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		u.parent.logUserErr(u, err, "SetQuota (stats)", root)
+		return wrapErrf(err, "SetQuota %s", root)
+	}
+	if affected == 0 {
+		return backend.ErrNoSuchMailbox
+	}
+	return nil
+}
+
+// GetQuotaRoot returns the list of quota roots for the mailbox.
+//
+// Per-user quota root is always included, per-mailbox one is included only
+// if mailbox has any limits set.
+func (u *User) GetQuotaRoot(mboxName string) ([]string, error) {
+	var mboxId uint64
+	if err := u.parent.mboxId.QueryRow(u.id, mboxName).Scan(&mboxId); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, backend.ErrNoSuchMailbox
+		}
+		u.parent.logUserErr(u, err, "GetQuotaRoot (mboxId)", mboxName)
+		return nil, wrapErrf(err, "GetQuotaRoot %s", mboxName)
+	}
+
+	_, _, msgsLimit, storageLimit, err := scanQuota(u.parent.mboxQuota.QueryRow(mboxId))
+	if err != nil {
+		u.parent.logUserErr(u, err, "GetQuotaRoot", mboxName)
+		return nil, wrapErrf(err, "GetQuotaRoot %s", mboxName)
+	}
+
+	roots := []string{""}
+	if msgsLimit.Valid || storageLimit.Valid {
+		roots = append(roots, mboxName)
+	}
+	return roots, nil
+}
+
+func scanQuota(row *sql.Row) (count, size int64, msgsLimit, storageLimit sql.NullInt64, err error) {
+	err = row.Scan(&count, &size, &msgsLimit, &storageLimit)
+	return
+}
+
+// addUsage adjusts storage usage counters of the mailbox and its owner.
+//
+// Message count for the mailbox itself is maintained separately
+// by increaseMsgCount and decreaseMsgCount.
+func (b *Backend) addUsage(tx *sql.Tx, userId, mboxId uint64, count, size int64) error {
+	if _, err := tx.Stmt(b.addMboxSize).Exec(size, mboxId); err != nil {
+		return err
+	}
+	_, err := tx.Stmt(b.addUserUsage).Exec(count, size, userId)
+	return err
+}
+
+// checkUserQuota returns ErrQuotaExceeded if the current usage of the user
+// exceeds per-user limits.
+//
+// It should be called in the same transaction after usage counters are
+// updated so transaction can be rolled back.
+func (b *Backend) checkUserQuota(tx *sql.Tx, userId uint64) error {
+	return checkQuota(tx.Stmt(b.userQuota).QueryRow(userId))
+}
+
+// checkMboxQuota returns ErrQuotaExceeded if the current usage of the mailbox
+// exceeds per-mailbox limits.
+func (b *Backend) checkMboxQuota(tx *sql.Tx, mboxId uint64) error {
+	return checkQuota(tx.Stmt(b.mboxQuota).QueryRow(mboxId))
+}
+
+func checkQuota(row *sql.Row) error {
+	count, size, msgsLimit, storageLimit, err := scanQuota(row)
+	if err != nil {
+		return err
+	}
+	if msgsLimit.Valid && count > msgsLimit.Int64 {
+		return ErrQuotaExceeded
+	}
+	if storageLimit.Valid && size > storageLimit.Int64 {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
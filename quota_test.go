@@ -0,0 +1,144 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func TestQuotaUsage(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usrI, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	usr := usrI.(*User)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	assert.NilError(t, usr.CreateMailbox(t.Name()+"-dst"))
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	// Set limits high enough to not interfere so we can see usage.
+	assert.NilError(t, b.SetQuota(t.Name(), "", map[string]uint64{QuotaMessage: 1000, QuotaStorage: 1000}))
+	assert.NilError(t, b.SetQuota(t.Name(), t.Name()+"-dst", map[string]uint64{QuotaMessage: 1000}))
+
+	checkUsage := func(t *testing.T, root string, msgs uint64) {
+		t.Helper()
+		status, err := usr.GetQuota(root)
+		assert.NilError(t, err)
+		assert.Equal(t, status.Resources[QuotaMessage][0], msgs)
+		if root == "" {
+			assert.Equal(t, status.Resources[QuotaStorage][0], (msgs*uint64(len(testMsg))+1023)/1024)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+	checkUsage(t, "", 4)
+
+	seq, _ := imap.ParseSeqSet("1:2")
+	assert.NilError(t, mbox.CopyMessages(true, seq, t.Name()+"-dst"))
+	checkUsage(t, "", 6)
+	checkUsage(t, t.Name()+"-dst", 2)
+
+	seq, _ = imap.ParseSeqSet("3")
+	assert.NilError(t, mbox.MoveMessages(true, seq, t.Name()+"-dst"))
+	checkUsage(t, "", 6)
+	checkUsage(t, t.Name()+"-dst", 3)
+
+	seq, _ = imap.ParseSeqSet("1")
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+	assert.NilError(t, mbox.Expunge())
+	checkUsage(t, "", 5)
+
+	assert.NilError(t, usr.DeleteMailbox(t.Name()+"-dst"))
+	checkUsage(t, "", 2)
+}
+
+func TestQuotaEnforcement(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usrI, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	usr := usrI.(*User)
+	dstName := t.Name() + "-dst"
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	assert.NilError(t, usr.CreateMailbox(dstName))
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	assert.NilError(t, b.SetQuota(t.Name(), "", map[string]uint64{QuotaMessage: 3}))
+	assert.NilError(t, b.SetQuota(t.Name(), dstName, map[string]uint64{QuotaMessage: 1}))
+
+	roots, err := usr.GetQuotaRoot(t.Name())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, roots, []string{""})
+	roots, err = usr.GetQuotaRoot(dstName)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, roots, []string{"", dstName})
+
+	for i := 0; i < 2; i++ {
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	t.Run("copy", func(t *testing.T) {
+		seq, _ := imap.ParseSeqSet("1:2")
+		assert.Equal(t, mbox.CopyMessages(true, seq, dstName), ErrQuotaExceeded)
+	})
+	t.Run("move", func(t *testing.T) {
+		// Per-user usage does not change on move so only mailbox limit applies.
+		seq, _ := imap.ParseSeqSet("1:2")
+		assert.Equal(t, mbox.MoveMessages(true, seq, dstName), ErrQuotaExceeded)
+	})
+
+	assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	assert.Equal(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox), ErrQuotaExceeded)
+
+	t.Run("delivery", func(t *testing.T) {
+		delivery := b.NewDelivery()
+		assert.NilError(t, delivery.AddRcpt(usr.Username(), textproto.Header{}))
+		assert.Equal(t, delivery.BodyRaw(strings.NewReader(testMsg)), ErrQuotaExceeded)
+		assert.NilError(t, delivery.Abort())
+	})
+
+	status, err := usr.GetQuota("")
+	assert.NilError(t, err)
+	assert.Equal(t, status.Resources[QuotaMessage], [2]uint64{3, 3})
+
+	// Removing the limit should allow new messages.
+	assert.NilError(t, b.SetQuota(t.Name(), "", nil))
+	assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+}
+
+func TestSetQuotaPermission(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	assert.NilError(t, b.SetQuota(t.Name(), "", map[string]uint64{QuotaMessage: 1}))
+	assert.Equal(t, b.SetQuota("nobody", "", nil), ErrUserDoesntExists)
+
+	// Users can't change their own limits.
+	u, err := b.Login(nil, t.Name(), "")
+	assert.NilError(t, err)
+	assert.Equal(t, u.(*User).SetQuota("", nil), ErrPermissionDenied)
+	assert.Equal(t, u.(*User).SetQuota("INBOX", map[string]uint64{QuotaMessage: 10}), ErrPermissionDenied)
+
+	status, err := u.(*User).GetQuota("")
+	assert.NilError(t, err)
+	assert.Equal(t, status.Resources[QuotaMessage], [2]uint64{0, 1})
+	roots, err := u.(*User).GetQuotaRoot("INBOX")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, roots, []string{""})
+}
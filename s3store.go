@@ -0,0 +1,497 @@
+package imapsql
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3DefaultPartSize is the part size used for multipart uploads if
+	// S3Store.PartSize is not set.
+	s3DefaultPartSize = 16 * 1024 * 1024
+
+	// s3MaxDeleteKeys is the maximum amount of keys that can be removed
+	// using one DeleteObjects request.
+	s3MaxDeleteKeys = 1000
+
+	s3TimeFormat  = "20060102T150405Z"
+	s3EmptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Store struct represents a bucket in S3-compatible object storage used to
+// store message bodies.
+//
+// Path-style requests signed using AWS Signature Version 4 are used so it
+// should work with any S3-compatible server.
+//
+// Always use field names on initialization because new fields may be added
+// without a major version change.
+type S3Store struct {
+	// Base URL of the storage, for example https://s3.us-east-1.amazonaws.com.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Prefix is prepended to all object keys.
+	Prefix string
+
+	// Bodies larger than PartSize are uploaded using multipart upload in
+	// PartSize chunks. If zero, 16 MiB is used. AWS requires it to be at
+	// least 5 MiB.
+	PartSize int64
+
+	// HTTP client used to make requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// S3Error is the error response returned by the storage.
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (err S3Error) Error() string {
+	if err.Code == "" {
+		return fmt.Sprintf("s3: HTTP %d", err.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s", err.Code, err.Message)
+}
+
+// s3Escape encodes the string as required by AWS Signature Version 4.
+func s3Escape(s string, encodeSlash bool) string {
+	var res strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			res.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			res.WriteByte(c)
+		default:
+			fmt.Fprintf(&res, "%%%02X", c)
+		}
+	}
+	return res.String()
+}
+
+// s3CanonicalQuery returns the query string in the canonical form used for
+// request signing.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Authorization computes the value of Authorization header for the
+// request using AWS Signature Version 4.
+//
+// path and query should be in the form they are sent to the server. Host,
+// Content-MD5, Content-Type, Range and all X-Amz-* header fields are
+// signed. X-Amz-Date and X-Amz-Content-Sha256 should be already set.
+func s3Authorization(method, host, path, query string, header http.Header, accessKey, secretKey, region string) string {
+	signedHdrs := map[string]string{"host": host}
+	for k, v := range header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "content-md5" || k == "content-type" || k == "range" {
+			values := make([]string, 0, len(v))
+			for _, value := range v {
+				values = append(values, strings.Join(strings.Fields(value), " "))
+			}
+			signedHdrs[k] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(signedHdrs))
+	for k := range signedHdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHdrs strings.Builder
+	for _, k := range names {
+		canonicalHdrs.WriteString(k)
+		canonicalHdrs.WriteByte(':')
+		canonicalHdrs.WriteString(signedHdrs[k])
+		canonicalHdrs.WriteByte('\n')
+	}
+	signedNames := strings.Join(names, ";")
+
+	canonicalReq := strings.Join([]string{
+		method,
+		path,
+		query,
+		canonicalHdrs.String(),
+		signedNames,
+		header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	reqHash := sha256.Sum256([]byte(canonicalReq))
+
+	amzDate := header.Get("X-Amz-Date")
+	date := amzDate
+	if len(date) > 8 {
+		date = date[:8]
+	}
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return "AWS4-HMAC-SHA256 Credential=" + accessKey + "/" + scope +
+		",SignedHeaders=" + signedNames + ",Signature=" + signature
+}
+
+func (s *S3Store) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+func (s *S3Store) partSize() int64 {
+	if s.PartSize > 0 {
+		return s.PartSize
+	}
+	return s3DefaultPartSize
+}
+
+// do sends the signed request for the object with the specified key. Empty
+// key addresses the bucket itself.
+//
+// Responses with non-2xx status are converted into S3Error.
+func (s *S3Store) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/" + s.Bucket
+	if key != "" {
+		path += "/" + s.Prefix + key
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + path
+	endpoint.RawPath = s3Escape(endpoint.Path, false)
+	endpoint.RawQuery = s3CanonicalQuery(query)
+
+	var bodyRdr io.Reader
+	if body != nil {
+		bodyRdr = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, endpoint.String(), bodyRdr)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	payloadHash := s3EmptySHA256
+	if len(body) != 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", time.Now().UTC().Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("Authorization", s3Authorization(method, req.URL.Host, endpoint.RawPath,
+		endpoint.RawQuery, req.Header, s.AccessKeyID, s.SecretAccessKey, s.Region))
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		s3Err := S3Error{StatusCode: resp.StatusCode}
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(respBody, &s3Err) // nolint:errcheck
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+// doXML sends the request and decodes XML response into v.
+//
+// Some requests (e.g. CompleteMultipartUpload) can fail after 200 OK status
+// is sent so the Error element is recognized too.
+func (s *S3Store) doXML(method, key string, query url.Values, header http.Header, body []byte, v interface{}) error {
+	resp, err := s.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(respBody, &root); err != nil {
+		return err
+	}
+	if root.XMLName.Local == "Error" {
+		s3Err := S3Error{StatusCode: resp.StatusCode}
+		if err := xml.Unmarshal(respBody, &s3Err); err != nil {
+			return err
+		}
+		return s3Err
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(respBody, v)
+}
+
+func (s *S3Store) Open(key string) (ExtStoreObj, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		s3Err, ok := err.(S3Error)
+		return nil, ExternalError{
+			Key:         key,
+			Err:         err,
+			NonExistent: ok && (s3Err.Code == "NoSuchKey" || s3Err.StatusCode == http.StatusNotFound),
+		}
+	}
+	return s3Reader{resp.Body}, nil
+}
+
+func (s *S3Store) Create(key string, blobSize int64) (ExtStoreObj, error) {
+	w := &s3Writer{store: s, key: key}
+	if blobSize > 0 && blobSize < s.partSize() {
+		w.buf.Grow(int(blobSize))
+	}
+	return w, nil
+}
+
+func (s *S3Store) Delete(keys []string) error {
+	type object struct {
+		Key string `xml:"Key"`
+	}
+	type deleteReq struct {
+		XMLName xml.Name `xml:"Delete"`
+		Quiet   bool     `xml:"Quiet"`
+		Objects []object `xml:"Object"`
+	}
+	type deleteResult struct {
+		Errors []struct {
+			Key     string `xml:"Key"`
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Error"`
+	}
+
+	for len(keys) != 0 {
+		batch := keys
+		if len(batch) > s3MaxDeleteKeys {
+			batch = batch[:s3MaxDeleteKeys]
+		}
+		keys = keys[len(batch):]
+
+		req := deleteReq{Quiet: true, Objects: make([]object, 0, len(batch))}
+		for _, key := range batch {
+			req.Objects = append(req.Objects, object{Key: s.Prefix + key})
+		}
+		body, err := xml.Marshal(req)
+		if err != nil {
+			return err
+		}
+		sum := md5.Sum(body)
+		header := http.Header{}
+		header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		header.Set("Content-Type", "application/xml")
+
+		var res deleteResult
+		if err := s.doXML(http.MethodPost, "", url.Values{"delete": {""}}, header, body, &res); err != nil {
+			return ExternalError{Key: batch[0], Err: err}
+		}
+		for _, objErr := range res.Errors {
+			if objErr.Code == "NoSuchKey" {
+				continue
+			}
+			return ExternalError{
+				Key: strings.TrimPrefix(objErr.Key, s.Prefix),
+				Err: S3Error{StatusCode: http.StatusOK, Code: objErr.Code, Message: objErr.Message},
+			}
+		}
+	}
+	return nil
+}
+
+type s3Reader struct {
+	io.ReadCloser
+}
+
+func (r s3Reader) Write([]byte) (int, error) {
+	return 0, errors.New("s3: object is opened for reading")
+}
+
+func (r s3Reader) Sync() error {
+	return nil
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// s3Writer buffers the object body in memory. Small objects are uploaded
+// using a single request when Sync is called, larger ones are uploaded
+// using multipart upload as the data is written.
+type s3Writer struct {
+	store *S3Store
+	key   string
+	buf   bytes.Buffer
+
+	uploadId string
+	parts    []s3Part
+	done     bool
+	err      error
+}
+
+func (w *s3Writer) Read([]byte) (int, error) {
+	return 0, errors.New("s3: object is opened for writing")
+}
+
+func (w *s3Writer) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.done {
+		return 0, errors.New("s3: write after sync")
+	}
+
+	w.buf.Write(b)
+	for int64(w.buf.Len()) >= w.store.partSize() {
+		if err := w.uploadPart(w.buf.Next(int(w.store.partSize()))); err != nil {
+			w.err = ExternalError{Key: w.key, Err: err}
+			return 0, w.err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *s3Writer) uploadPart(part []byte) error {
+	if w.uploadId == "" {
+		var res struct {
+			UploadId string `xml:"UploadId"`
+		}
+		if err := w.store.doXML(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, nil, &res); err != nil {
+			return err
+		}
+		w.uploadId = res.UploadId
+	}
+
+	number := len(w.parts) + 1
+	resp, err := w.store.do(http.MethodPut, w.key, url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {w.uploadId},
+	}, nil, part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{Number: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+// Sync uploads the object. The object is not visible in the storage before
+// it is called.
+func (w *s3Writer) Sync() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.done {
+		return nil
+	}
+
+	if err := w.finish(); err != nil {
+		w.err = ExternalError{Key: w.key, Err: err}
+		return w.err
+	}
+	w.done = true
+	w.buf = bytes.Buffer{}
+	return nil
+}
+
+func (w *s3Writer) finish() error {
+	if w.uploadId == "" {
+		resp, err := w.store.do(http.MethodPut, w.key, nil, nil, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if w.buf.Len() != 0 {
+		if err := w.uploadPart(w.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	return w.store.doXML(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadId}}, nil, body, nil)
+}
+
+// Close releases the buffer. Multipart upload is aborted if Sync was not
+// called or failed.
+func (w *s3Writer) Close() error {
+	w.buf = bytes.Buffer{}
+	if w.done || w.uploadId == "" {
+		return nil
+	}
+	w.done = true
+
+	resp, err := w.store.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadId}}, nil, nil)
+	if err != nil {
+		return ExternalError{Key: w.key, Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
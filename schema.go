@@ -3,6 +3,8 @@ package imapsql
 import (
 	"database/sql"
 	"errors"
+	"strconv"
+	"time"
 )
 
 func (b *Backend) schemaVersion() (int, error) {
@@ -47,27 +49,240 @@ func (b *Backend) setSchemaVersion(newVer int) error {
 	return nil
 }
 
+// upgradeSchema upgrades the database schema to SchemaVersion.
+//
+// Each step is committed together with the new schema version so an
+// interrupted upgrade continues from the last completed step. All statements
+// of a step are executed in its transaction, DDL included (note that MySQL
+// commits it implicitly anyway).
+//
+// Tables added in a version are created by initSchema after the upgrade.
+// A step should create such table itself if a later step changes it.
 func (b *Backend) upgradeSchema(currentVer int) error {
 	tx, err := b.db.Begin(false)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	defer func() {
+		tx.Rollback()
+	}()
 
-	// Functions for schema upgrade go here. Example:
-	//if currentVer == 1 {
-	//	if err := b.schemaUpgrade1To2(tx); err != nil {
-	//		return wrapErr(err, "1->2 upgrade")
-	//	}
-	//	currentVer = 2
-	//}
+	exec := func(stmts ...string) error {
+		for _, stmt := range stmts {
+			if _, err := (dbTx{b.db, tx}).Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	commit := func(newVer int) error {
+		if _, err := (dbTx{b.db, tx}).Exec(`UPDATE schema_version SET version = ?`, newVer); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		b.Opts.Log.Debugln("upgraded database schema to", newVer)
+		currentVer = newVer
+		tx, err = b.db.Begin(false)
+		return err
+	}
 
 	if currentVer == 5 {
-		_, err = b.DB.Exec(`ALTER TABLE msgs ADD COLUMN recent INTEGER NOT NULL DEFAULT 1`)
-		if err != nil {
+		if err := exec(`ALTER TABLE msgs ADD COLUMN recent INTEGER NOT NULL DEFAULT 1`); err != nil {
 			return wrapErr(err, "5->6 upgrade")
 		}
-		currentVer = 6
+		if err := commit(6); err != nil {
+			return wrapErr(err, "5->6 upgrade")
+		}
+	}
+	if currentVer == 6 {
+		// expunged table is changed by 21->22 upgrade.
+		err := exec(
+			`ALTER TABLE msgs ADD COLUMN modseq BIGINT NOT NULL DEFAULT 1`,
+			`ALTER TABLE mboxes ADD COLUMN highestmodseq BIGINT NOT NULL DEFAULT 1`,
+			`CREATE TABLE IF NOT EXISTS expunged (
+				mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
+				msgId BIGINT NOT NULL,
+				modseq BIGINT NOT NULL,
+
+				PRIMARY KEY(mboxId, msgId)
+			)`,
+		)
+		if err != nil {
+			return wrapErr(err, "6->7 upgrade")
+		}
+		if err := commit(7); err != nil {
+			return wrapErr(err, "6->7 upgrade")
+		}
+	}
+	if currentVer == 7 {
+		err := exec(
+			`ALTER TABLE users ADD COLUMN msgsCount INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE users ADD COLUMN msgsSize BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE users ADD COLUMN msgslimit INTEGER DEFAULT NULL`,
+			`ALTER TABLE users ADD COLUMN storagelimit BIGINT DEFAULT NULL`,
+			`ALTER TABLE mboxes ADD COLUMN msgsSize BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE mboxes ADD COLUMN msgslimit INTEGER DEFAULT NULL`,
+			`ALTER TABLE mboxes ADD COLUMN storagelimit BIGINT DEFAULT NULL`,
+			`UPDATE mboxes SET msgsSize = (
+				SELECT COALESCE(SUM(bodyLen), 0)
+				FROM msgs
+				WHERE msgs.mboxId = mboxes.id
+			)`,
+			`UPDATE users SET msgsCount = (
+				SELECT COALESCE(SUM(msgsCount), 0)
+				FROM mboxes
+				WHERE mboxes.uid = users.id
+			), msgsSize = (
+				SELECT COALESCE(SUM(msgsSize), 0)
+				FROM mboxes
+				WHERE mboxes.uid = users.id
+			)`,
+		)
+		if err != nil {
+			return wrapErr(err, "7->8 upgrade")
+		}
+		if err := commit(8); err != nil {
+			return wrapErr(err, "7->8 upgrade")
+		}
+	}
+	if currentVer == 8 {
+		if err := b.initHeaderIndexSchema(dbTx{b.db, tx}); err != nil {
+			return wrapErr(err, "8->9 upgrade")
+		}
+		if err := b.backfillHeaderIndex(tx); err != nil {
+			return wrapErr(err, "8->9 upgrade")
+		}
+		if err := commit(9); err != nil {
+			return wrapErr(err, "8->9 upgrade")
+		}
+	}
+	if currentVer == 9 {
+		err := exec(
+			`ALTER TABLE mboxes ADD COLUMN objectId VARCHAR(255) NOT NULL DEFAULT ''`,
+			`ALTER TABLE msgs ADD COLUMN emailId VARCHAR(255) NOT NULL DEFAULT ''`,
+			`ALTER TABLE msgs ADD COLUMN threadId VARCHAR(255) NOT NULL DEFAULT ''`,
+		)
+		if err != nil {
+			return wrapErr(err, "9->10 upgrade")
+		}
+		if err := b.initThreadIdSchema(dbTx{b.db, tx}); err != nil {
+			return wrapErr(err, "9->10 upgrade")
+		}
+		if err := b.backfillObjectIds(tx); err != nil {
+			return wrapErr(err, "9->10 upgrade")
+		}
+		if err := commit(10); err != nil {
+			return wrapErr(err, "9->10 upgrade")
+		}
+	}
+	if currentVer == 10 {
+		// Hashes of existing bodies are not known, these are never
+		// deduplicated. Counters were per-user before and are recalculated.
+		err := exec(
+			`ALTER TABLE extKeys ADD COLUMN hash VARCHAR(255) DEFAULT NULL`,
+			`UPDATE extKeys SET refs = (SELECT COUNT(*) FROM msgs WHERE msgs.extBodyKey = extKeys.id)`,
+		)
+		if err != nil {
+			return wrapErr(err, "10->11 upgrade")
+		}
+		if err := commit(11); err != nil {
+			return wrapErr(err, "10->11 upgrade")
+		}
+	}
+	if currentVer == 11 {
+		// extParts table is created by initSchema.
+		if err := commit(12); err != nil {
+			return wrapErr(err, "11->12 upgrade")
+		}
+	}
+	if currentVer == 12 {
+		// dataKeys table is created by initSchema.
+		if err := exec(`ALTER TABLE extKeys ADD COLUMN dataKey VARCHAR(255) DEFAULT NULL`); err != nil {
+			return wrapErr(err, "12->13 upgrade")
+		}
+		if err := commit(13); err != nil {
+			return wrapErr(err, "12->13 upgrade")
+		}
+	}
+	if currentVer == 13 {
+		if err := exec(`ALTER TABLE msgs ADD COLUMN bodyHash VARCHAR(255) NOT NULL DEFAULT ''`); err != nil {
+			return wrapErr(err, "13->14 upgrade")
+		}
+		if err := commit(14); err != nil {
+			return wrapErr(err, "13->14 upgrade")
+		}
+	}
+	if currentVer == 14 {
+		// extDeletes table is created by initSchema.
+		if err := commit(15); err != nil {
+			return wrapErr(err, "14->15 upgrade")
+		}
+	}
+	if currentVer == 15 {
+		if err := exec(`ALTER TABLE users ADD COLUMN password VARCHAR(255) DEFAULT NULL`); err != nil {
+			return wrapErr(err, "15->16 upgrade")
+		}
+		if err := commit(16); err != nil {
+			return wrapErr(err, "15->16 upgrade")
+		}
+	}
+	if currentVer == 16 {
+		// appPasswords table is created by initSchema.
+		if err := commit(17); err != nil {
+			return wrapErr(err, "16->17 upgrade")
+		}
+	}
+	if currentVer == 17 {
+		if err := exec(`ALTER TABLE users ADD COLUMN state INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return wrapErr(err, "17->18 upgrade")
+		}
+		if err := commit(18); err != nil {
+			return wrapErr(err, "17->18 upgrade")
+		}
+	}
+	if currentVer == 18 {
+		// aliases table is created by initSchema.
+		if err := commit(19); err != nil {
+			return wrapErr(err, "18->19 upgrade")
+		}
+	}
+	if currentVer == 19 {
+		// domains table and users_domain index are created by initSchema.
+		if err := exec(`ALTER TABLE users ADD COLUMN domain VARCHAR(255) NOT NULL DEFAULT ''`); err != nil {
+			return wrapErr(err, "19->20 upgrade")
+		}
+		if err := b.backfillUserDomains(tx); err != nil {
+			return wrapErr(err, "19->20 upgrade")
+		}
+		if err := commit(20); err != nil {
+			return wrapErr(err, "19->20 upgrade")
+		}
+	}
+	if currentVer == 20 {
+		// Personal mailboxes created before namespaces were added can't be
+		// accessed otherwise.
+		if err := b.renameShadowedMboxes(tx, []string{OtherUsersPrefix, SharedPrefix}); err != nil {
+			return wrapErr(err, "20->21 upgrade")
+		}
+		if err := commit(21); err != nil {
+			return wrapErr(err, "20->21 upgrade")
+		}
+	}
+	if currentVer == 21 {
+		// Retention of existing entries starts now.
+		err := exec(
+			`ALTER TABLE mboxes ADD COLUMN prunedmodseq BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE expunged ADD COLUMN expungedAt BIGINT NOT NULL DEFAULT 0`,
+			`UPDATE expunged SET expungedAt = `+strconv.FormatInt(time.Now().Unix(), 10),
+		)
+		if err != nil {
+			return wrapErr(err, "21->22 upgrade")
+		}
+		if err := commit(22); err != nil {
+			return wrapErr(err, "21->22 upgrade")
+		}
 	}
 
 	if currentVer != SchemaVersion {
@@ -0,0 +1,110 @@
+package imapsql
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// TestUpgradeSchema6 upgrades the database created by go-imap-sql with schema
+// version 6 (testdata/schema6.sql, bodies are in testdata/schema6-store).
+func TestUpgradeSchema6(t *testing.T) {
+	if TestDB != "" && TestDB != "sqlite3" {
+		t.Skip("Fixture is available only for SQLite3")
+	}
+
+	tempDir, err := ioutil.TempDir("", "go-imap-sql-tests-")
+	assert.NilError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	// Bodies are copied since they are removed on expunge.
+	storeDir := filepath.Join(tempDir, "store")
+	assert.NilError(t, os.Mkdir(storeDir, 0700))
+	objs, err := ioutil.ReadDir("testdata/schema6-store")
+	assert.NilError(t, err)
+	for _, obj := range objs {
+		blob, err := ioutil.ReadFile(filepath.Join("testdata/schema6-store", obj.Name()))
+		assert.NilError(t, err)
+		assert.NilError(t, ioutil.WriteFile(filepath.Join(storeDir, obj.Name()), blob, 0600))
+	}
+
+	dsn := filepath.Join(tempDir, "test.db")
+	dump, err := ioutil.ReadFile("testdata/schema6.sql")
+	assert.NilError(t, err)
+	db, err := sql.Open("sqlite3", dsn)
+	assert.NilError(t, err)
+	_, err = db.Exec(string(dump))
+	assert.NilError(t, err)
+	assert.NilError(t, db.Close())
+
+	b, err := New("sqlite3", dsn, &FSStore{Root: storeDir}, Opts{
+		Log:        DummyLogger{},
+		GCInterval: -1,
+	})
+	assert.NilError(t, err)
+	defer b.Close()
+
+	ver, err := b.schemaVersion()
+	assert.NilError(t, err)
+	assert.Equal(t, ver, SchemaVersion)
+
+	users, err := b.ListDomainUsers("example.org")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, users, []string{"alice@example.org"})
+
+	u, err := b.GetUser("alice@example.org")
+	assert.NilError(t, err)
+	var msgsCount int
+	assert.NilError(t, b.db.QueryRow(`SELECT msgsCount FROM users WHERE username = ?`, "alice@example.org").Scan(&msgsCount))
+	assert.Equal(t, msgsCount, 2)
+
+	_, inboxI, err := u.GetMailbox("INBOX", false, &noopConn{})
+	assert.NilError(t, err)
+	defer inboxI.Close()
+	inbox := inboxI.(*Mailbox)
+	_, archiveI, err := u.GetMailbox("Archive", false, &noopConn{})
+	assert.NilError(t, err)
+	defer archiveI.Close()
+	archive := archiveI.(*Mailbox)
+
+	// Header index, bodies and flags.
+	res, err := inbox.SearchMessages(true, &imap.SearchCriteria{
+		Header:    map[string][]string{"Subject": {"quarterly"}},
+		Body:      []string{"look great"},
+		WithFlags: []string{imap.SeenFlag},
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []uint32{1})
+
+	// The reply is in the same thread.
+	_, inboxThreads := listObjectIds(t, inbox)
+	_, archiveThreads := listObjectIds(t, archive)
+	assert.DeepEqual(t, archiveThreads, inboxThreads)
+
+	// Expunged messages are recorded.
+	base, err := archive.HighestModSeq()
+	assert.NilError(t, err)
+	seq, _ := imap.ParseSeqSet("1")
+	assert.NilError(t, archive.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+	assert.NilError(t, archive.Expunge())
+	vanished, err := archive.Vanished(nil, base)
+	assert.NilError(t, err)
+	assert.Equal(t, vanished.String(), "1")
+
+	// Mailboxes shadowed by the namespace are renamed.
+	bob, err := b.GetUser("bob")
+	assert.NilError(t, err)
+	mboxes, err := bob.ListMailboxes(false)
+	assert.NilError(t, err)
+	names := make([]string, 0, len(mboxes))
+	for _, info := range mboxes {
+		names = append(names, info.Name)
+	}
+	assert.Assert(t, is.Contains(names, "Shared (personal).Team"))
+}
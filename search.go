@@ -12,6 +12,10 @@ import (
 )
 
 func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	if !m.hasRight(RightRead) {
+		return nil, ErrPermissionDenied
+	}
+
 	if searchOnlyWithFlags(criteria) {
 		if criteria.Not == nil && criteria.Or == nil && criteria.WithFlags == nil && criteria.WithoutFlags == nil {
 			return m.allSearch(uid)
@@ -22,8 +26,44 @@ func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uin
 
 	m.handle.ResolveCriteria(criteria)
 
-	needBody := searchNeedsBody(criteria)
-	rows, err := m.parent.searchFetchNoSeq.Query(m.id)
+	if m.parent.fts && m.parent.useIndexes() {
+		if err := m.ftsResolveCriteria(criteria); err != nil {
+			return nil, err
+		}
+	}
+
+	cond, args, residual := compileSearch(criteria, m.parent.useIndexes())
+	if residual == nil {
+		return m.condSearch(uid, cond, args)
+	}
+
+	needBody := searchNeedsBody(residual)
+
+	// openBody queries the database while the result set is open, SQLite3
+	// needs to use the same transaction for that (see ListMessages).
+	var bodyTx *sql.Tx
+	if needBody && m.parent.db.driver == "sqlite3" {
+		tx, err := m.parent.db.BeginLevel(sql.LevelReadCommitted, true)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		bodyTx = tx
+	}
+
+	var rows *sql.Rows
+	var err error
+	if len(args) == 0 && cond == `1 = 1` {
+		stmt := m.parent.searchFetchNoSeq
+		if bodyTx != nil {
+			stmt = bodyTx.Stmt(stmt)
+		}
+		rows, err = stmt.Query(m.id)
+	} else if bodyTx != nil {
+		rows, err = bodyTx.Query(m.parent.db.rewriteSQL(m.parent.buildSearchFetchStmt(cond)), append([]interface{}{m.id}, args...)...)
+	} else {
+		rows, err = m.parent.db.Query(m.parent.buildSearchFetchStmt(cond), append([]interface{}{m.id}, args...)...)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -31,7 +71,7 @@ func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uin
 
 	var res []uint32
 	for rows.Next() {
-		id, err := m.searchMatches(uid, needBody, rows, criteria)
+		id, err := m.searchMatches(bodyTx, uid, needBody, rows, residual)
 		if err != nil {
 			return nil, err
 		}
@@ -46,7 +86,7 @@ func (m *Mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uin
 	return res, nil
 }
 
-func (m *Mailbox) searchMatches(uid, needBody bool, rows *sql.Rows, criteria *imap.SearchCriteria) (uint32, error) {
+func (m *Mailbox) searchMatches(bodyTx *sql.Tx, uid, needBody bool, rows *sql.Rows, criteria *imap.SearchCriteria) (uint32, error) {
 	var (
 		msgId        uint32
 		dateUnix     int64
@@ -64,11 +104,20 @@ func (m *Mailbox) searchMatches(uid, needBody bool, rows *sql.Rows, criteria *im
 	if len(flags) == 1 && flags[0] == "" {
 		flags = nil
 	}
+	if m.handle.IsRecent(msgId) {
+		flags = append(flags, imap.RecentFlag)
+	}
+
+	// Skip messages not matching UID criteria (e.g. restricted using
+	// full-text index) without reading the body.
+	if criteria.Uid != nil && !criteria.Uid.Contains(msgId) {
+		return 0, nil
+	}
 
 	var ent *message.Entity
 	var err error
 	if needBody {
-		bufferedBody, err := m.openBody(true, compressAlgo, extBodyKey)
+		bufferedBody, err := m.openBody(bodyTx, true, compressAlgo, extBodyKey, nil)
 		if err != nil {
 			m.parent.logMboxErr(m, err, "failed to read body, skipping", extBodyKey)
 			return 0, nil
@@ -209,6 +258,41 @@ func (m *Mailbox) allSearch(uid bool) ([]uint32, error) {
 	return uids, nil
 }
 
+// condSearch returns messages matching the SQL condition built by
+// compileSearch.
+func (m *Mailbox) condSearch(uid bool, cond string, args []interface{}) ([]uint32, error) {
+	rows, err := m.parent.db.Query(`
+		SELECT msgs.msgId
+		FROM msgs
+		WHERE msgs.mboxId = ? AND `+cond+`
+		ORDER BY msgs.msgId`, append([]interface{}{m.id}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []uint32
+	for rows.Next() {
+		var id uint32
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		if !uid {
+			var ok bool
+			id, ok = m.handle.UidAsSeq(id)
+			if !ok {
+				continue
+			}
+		}
+		res = append(res, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 func (m *Mailbox) flagSearch(uid bool, withFlags, withoutFlags []string) ([]uint32, error) {
 	recentRequired := false
 	recentExcluded := false
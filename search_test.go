@@ -0,0 +1,269 @@
+package imapsql
+
+import (
+	"database/sql"
+	"math/rand"
+	nettextproto "net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+const searchTestMsgHeader = "From: <foxcpp@foxcpp.dev>\r\n" +
+	"Subject: Hello!\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n"
+
+var searchTestHeaders = [][2]string{
+	{"Subject", "hello"},
+	{"Subject", "HELLO!"},
+	{"Subject", "café"},
+	{"Subject", "1%"},
+	{"From", "foxcpp"},
+	{"From", ""},
+	{"Cc", ""},
+	{"X-Custom", "value"},
+}
+
+var searchTestFlags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.RecentFlag, "$Label"}
+
+// searchTestDate returns the date of i-th message in the search test
+// mailbox. Messages are spread across several days, some of them are close
+// to midnight.
+func searchTestDate(i int) time.Time {
+	return time.Date(2020, time.March, 10, 21, 30, 0, 0, time.UTC).Add(time.Duration(i) * 5 * time.Hour)
+}
+
+func genSearchDate(r *rand.Rand) time.Time {
+	date := time.Date(2020, time.March, 9+r.Intn(6), 0, 0, 0, 0, time.UTC)
+	if r.Intn(4) == 0 {
+		date = date.Add(time.Duration(r.Intn(24)) * time.Hour)
+	}
+	return date
+}
+
+func genSearchSeqSet(r *rand.Rand) *imap.SeqSet {
+	set := &imap.SeqSet{}
+	for i := r.Intn(3) + 1; i > 0; i-- {
+		start := uint32(r.Intn(14) + 1)
+		if r.Intn(5) == 0 {
+			set.AddRange(start, 0)
+		} else {
+			set.AddRange(start, start+uint32(r.Intn(4)))
+		}
+	}
+	return set
+}
+
+func genSearchCriteria(r *rand.Rand, depth int) *imap.SearchCriteria {
+	c := &imap.SearchCriteria{}
+	for i := r.Intn(3) + 1; i > 0; i-- {
+		switch r.Intn(12) {
+		case 0:
+			c.Since = genSearchDate(r)
+		case 1:
+			c.Before = genSearchDate(r)
+		case 2:
+			c.Larger = uint32(100 + r.Intn(600))
+		case 3:
+			c.Smaller = uint32(100 + r.Intn(600))
+		case 4:
+			c.WithFlags = append(c.WithFlags, searchTestFlags[r.Intn(len(searchTestFlags))])
+		case 5:
+			c.WithoutFlags = append(c.WithoutFlags, searchTestFlags[r.Intn(len(searchTestFlags))])
+		case 6:
+			c.Uid = genSearchSeqSet(r)
+		case 7:
+			c.SeqNum = genSearchSeqSet(r)
+		case 8:
+			c.Body = append(c.Body, strings.Repeat("x", r.Intn(3)*100+1))
+		case 9:
+			c.Header = nettextproto.MIMEHeader{}
+			for j := r.Intn(2) + 1; j > 0; j-- {
+				field := searchTestHeaders[r.Intn(len(searchTestHeaders))]
+				c.Header.Add(field[0], field[1])
+			}
+		case 10:
+			if depth > 0 {
+				c.Not = append(c.Not, genSearchCriteria(r, depth-1))
+			}
+		case 11:
+			if depth > 0 {
+				c.Or = append(c.Or, [2]*imap.SearchCriteria{
+					genSearchCriteria(r, depth-1),
+					genSearchCriteria(r, depth-1),
+				})
+			}
+		}
+	}
+	return c
+}
+
+// matchSearch returns messages matching criteria using backendutil.Match
+// for all messages in the mailbox.
+func matchSearch(t *testing.T, m *Mailbox, uid bool, criteria *imap.SearchCriteria) []uint32 {
+	t.Helper()
+	m.handle.ResolveCriteria(criteria)
+
+	tx, err := m.parent.db.BeginLevel(sql.LevelReadCommitted, true)
+	assert.NilError(t, err)
+	defer tx.Rollback()
+
+	rows, err := tx.Stmt(m.parent.searchFetchNoSeq).Query(m.id)
+	assert.NilError(t, err)
+	defer rows.Close()
+
+	var bodyTx *sql.Tx
+	if m.parent.db.driver == "sqlite3" {
+		bodyTx = tx
+	}
+
+	var res []uint32
+	for rows.Next() {
+		id, err := m.searchMatches(bodyTx, uid, true, rows, criteria)
+		assert.NilError(t, err)
+		if id != 0 {
+			res = append(res, id)
+		}
+	}
+	assert.NilError(t, rows.Err())
+	return res
+}
+
+func TestSearchCompiled(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+
+	add := func(i int) {
+		var flags []string
+		if i%2 == 0 {
+			flags = append(flags, imap.SeenFlag)
+		}
+		if i%3 == 0 {
+			flags = append(flags, imap.FlaggedFlag)
+		}
+		if i%4 == 0 {
+			flags = append(flags, "$Label")
+		}
+		hdr := searchTestMsgHeader
+		if i%5 == 0 {
+			hdr = "Subject: =?utf-8?q?Caf=C3=A9_100%?=\r\n" + hdr
+		}
+		if i%3 == 0 {
+			hdr = "X-Custom: Value\r\n" + hdr
+		}
+		msg := hdr + testMsgBody + strings.Repeat(strings.Repeat("x", 98)+"\r\n", i)
+		assert.NilError(t, usr.CreateMessage(t.Name(), flags, searchTestDate(i), strings.NewReader(msg), nil))
+	}
+
+	for i := 0; i < 6; i++ {
+		add(i)
+	}
+	// Take \Recent flag for existing messages.
+	_, mbox, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	assert.NilError(t, mbox.Close())
+	for i := 6; i < 12; i++ {
+		add(i)
+	}
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	m := mboxI.(*Mailbox)
+
+	// Gaps in UIDs to make sequence numbers differ.
+	seq, _ := imap.ParseSeqSet("2,5")
+	assert.NilError(t, m.UpdateMessagesFlags(false, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+	assert.NilError(t, m.Expunge())
+	assert.NilError(t, m.Poll(true))
+
+	t.Run("exact", func(t *testing.T) {
+		cond, _, residual := compileSearch(&imap.SearchCriteria{
+			Since:     time.Now(),
+			Larger:    10,
+			WithFlags: []string{imap.SeenFlag},
+			Not:       []*imap.SearchCriteria{{Uid: &imap.SeqSet{Set: []imap.Seq{{Start: 1, Stop: 3}}}}},
+		}, true)
+		assert.Assert(t, residual == nil, "criteria should be compiled fully")
+		assert.Assert(t, strings.Contains(cond, "NOT (("), cond)
+	})
+	t.Run("residual", func(t *testing.T) {
+		_, _, residual := compileSearch(&imap.SearchCriteria{
+			Larger: 10,
+			Body:   []string{"a"},
+			Or: [][2]*imap.SearchCriteria{
+				{{WithFlags: []string{imap.RecentFlag}}, {Larger: 5}},
+				{{WithFlags: []string{imap.SeenFlag}}, {Larger: 5}},
+			},
+		}, true)
+		assert.Assert(t, residual != nil)
+		assert.Equal(t, residual.Larger, uint32(0))
+		assert.DeepEqual(t, residual.Body, []string{"a"})
+		assert.Equal(t, len(residual.Or), 1)
+	})
+
+	for i := 0; i < 500; i++ {
+		for _, uid := range []bool{true, false} {
+			expected := matchSearch(t, m, uid, genSearchCriteria(rand.New(rand.NewSource(int64(i))), 2))
+			criteria := genSearchCriteria(rand.New(rand.NewSource(int64(i))), 2)
+			res, err := m.SearchMessages(uid, criteria)
+			assert.NilError(t, err)
+			assert.Assert(t, is.DeepEqual(res, expected), "case %d", i)
+		}
+	}
+}
+
+func TestSearchHeaderIndex(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+
+	assert.NilError(t, usr.CreateMessage(t.Name(), []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, usr.CreateMessage(t.Name(), []string{}, time.Now(),
+		strings.NewReader("Subject: =?utf-8?q?Caf=C3=A9?=\r\n\r\nHello!\r\n"), nil))
+
+	_, mboxI, err := usr.GetMailbox(t.Name(), true, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	m := mboxI.(*Mailbox)
+
+	// Message bodies are not needed for cached header fields.
+	assert.NilError(t, os.RemoveAll(b.extStore.(*FSStore).Root))
+	assert.NilError(t, os.MkdirAll(b.extStore.(*FSStore).Root, 0700))
+
+	check := func() {
+		t.Helper()
+		res, err := m.SearchMessages(true, &imap.SearchCriteria{
+			Header: nettextproto.MIMEHeader{"Subject": {"CAFÉ"}},
+		})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, res, []uint32{2})
+		res, err = m.SearchMessages(true, &imap.SearchCriteria{
+			Header: nettextproto.MIMEHeader{"From": {""}},
+		})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, res, []uint32{1})
+	}
+	check()
+
+	// Simulate the database upgraded from older version.
+	_, err = b.DB.Exec(`DELETE FROM msgs_headers`)
+	assert.NilError(t, err)
+	tx, err := b.DB.Begin()
+	assert.NilError(t, err)
+	assert.NilError(t, b.backfillHeaderIndex(tx))
+	assert.NilError(t, tx.Commit())
+	check()
+}
@@ -0,0 +1,74 @@
+package imapsql
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// SharedPrefix is the prefix of "Shared" namespace (RFC 2342).
+//
+// Mailboxes in this namespace are not owned by any real account. They belong
+// to the pseudo-user SharedUsername and access to them is controlled using ACL.
+// Mailbox "Announcements" of the pseudo-user is visible for users as
+// "Shared.Announcements".
+const SharedPrefix = "Shared" + MailboxPathSep
+
+// SharedUsername is the name of the pseudo-user owning mailboxes in the
+// "Shared" namespace.
+//
+// Use Backend.SharedUser to get the User object for it to manage mailboxes
+// and their ACLs. The pseudo-user can't log in and is not included in
+// Backend.ListUsers output.
+const SharedUsername = "#shared"
+
+// SharedUser returns the pseudo-user owning mailboxes in the "Shared"
+// namespace. It is created along with the database schema.
+func (b *Backend) SharedUser() (*User, error) {
+	u, err := b.sharedUser(nil)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserDoesntExists
+		}
+		return nil, wrapErr(err, "SharedUser")
+	}
+	return u, nil
+}
+
+// initSharedUser creates the pseudo-user owning mailboxes in the "Shared"
+// namespace if it does not exist yet.
+func (b *Backend) initSharedUser() error {
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if _, err := b.sharedUser(tx); err != sql.ErrNoRows {
+		return err
+	}
+
+	b.Opts.Log.Debugln("creating shared namespace pseudo-user")
+	if _, _, err := b.createUser(tx, SharedUsername); err != nil {
+		if err == ErrUserAlreadyExists {
+			return nil
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// sharedUser returns the pseudo-user owning mailboxes in the "Shared"
+// namespace or sql.ErrNoRows if it does not exist yet.
+func (b *Backend) sharedUser(tx *sql.Tx) (*User, error) {
+	uid, inboxId, err := b.getUserMeta(tx, SharedUsername)
+	if err != nil {
+		return nil, err
+	}
+	return &User{id: uid, username: SharedUsername, parent: b, inboxId: inboxId}, nil
+}
+
+// isForeignMailbox reports whether the mailbox name refers to a mailbox
+// not owned by the user accessing it.
+func isForeignMailbox(name string) bool {
+	return strings.HasPrefix(name, OtherUsersPrefix) || strings.HasPrefix(name, SharedPrefix)
+}
@@ -0,0 +1,163 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type recordingConn struct {
+	updates []backend.Update
+}
+
+func (c *recordingConn) SendUpdate(upd backend.Update) error {
+	c.updates = append(c.updates, upd)
+	return nil
+}
+
+func TestSharedNamespace(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()+"-1"))
+	assert.NilError(t, b.CreateUser(t.Name()+"-2"))
+	u1I, err := b.GetUser(t.Name() + "-1")
+	assert.NilError(t, err)
+	u2I, err := b.GetUser(t.Name() + "-2")
+	assert.NilError(t, err)
+	u1, u2 := u1I.(*User), u2I.(*User)
+
+	_, _, shared, err := u1.Namespaces()
+	assert.NilError(t, err)
+	assert.Equal(t, len(shared), 1)
+	assert.Equal(t, shared[0].Prefix, SharedPrefix)
+
+	_, _, err = u1.GetMailbox(SharedPrefix+"News", false, &noopConn{})
+	assert.Equal(t, err, backend.ErrNoSuchMailbox)
+
+	sharedUsr, err := b.SharedUser()
+	assert.NilError(t, err)
+	assert.NilError(t, sharedUsr.CreateMailbox("News"))
+	assert.NilError(t, sharedUsr.SetACL("News", AnyoneIdentifier, "p"))
+	assert.NilError(t, sharedUsr.SetACL("News", u1.Username(), "lrsi"))
+	assert.NilError(t, sharedUsr.SetACL("News", u2.Username(), "lr"))
+
+	users, err := b.ListUsers()
+	assert.NilError(t, err)
+	for _, name := range users {
+		assert.Assert(t, name != SharedUsername)
+	}
+	_, err = b.Login(nil, SharedUsername, "")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+
+	list, err := u2.ListMailboxes(false)
+	assert.NilError(t, err)
+	found := false
+	for _, info := range list {
+		if info.Name == SharedPrefix+"News" {
+			found = true
+		}
+	}
+	assert.Assert(t, found, "shared mailbox is not listed")
+
+	conn1, conn2 := &recordingConn{}, &recordingConn{}
+	_, mbox1, err := u1.GetMailbox(SharedPrefix+"News", false, conn1)
+	assert.NilError(t, err)
+	defer mbox1.Close()
+	_, mbox2, err := u2.GetMailbox(SharedPrefix+"News", true, conn2)
+	assert.NilError(t, err)
+	defer mbox2.Close()
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt("SHARED.News", textproto.Header{}))
+	assert.Equal(t, delivery.AddRcpt(SharedPrefix+"Missing", textproto.Header{}), backend.ErrNoSuchMailbox)
+	delivery.UserMailbox("shared.News", "", []string{imap.FlaggedFlag})
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	// Both viewers should see the new message.
+	assert.NilError(t, mbox1.Poll(true))
+	assert.NilError(t, mbox2.Poll(true))
+	assert.Assert(t, len(conn1.updates) != 0, "no updates sent for the first viewer")
+	assert.Assert(t, len(conn2.updates) != 0, "no updates sent for the second viewer")
+
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox2.ListMessages(false, seq, []imap.FetchItem{imap.FetchFlags}, ch))
+	assert.Equal(t, len(ch), 1)
+	// \Recent depends on which session gets the message first.
+	assert.Assert(t, is.Contains((<-ch).Flags, imap.FlaggedFlag))
+
+	// Only the first user has 'i' right.
+	assert.NilError(t, u1.CreateMessage(SharedPrefix+"News", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.Equal(t, u2.CreateMessage(SharedPrefix+"News", []string{}, time.Now(), strings.NewReader(testMsg), nil), ErrPermissionDenied)
+
+	status, err := u2.Status(SharedPrefix+"News", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(2))
+
+	assert.Equal(t, u1.CreateMailbox(SharedPrefix+"Other"), ErrPermissionDenied)
+}
+
+func TestSharedDeliveryPost(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+
+	sharedUsr, err := b.SharedUser()
+	assert.NilError(t, err)
+	assert.NilError(t, sharedUsr.CreateMailbox("Team"))
+	// Rights of users do not apply to unauthenticated senders.
+	assert.NilError(t, sharedUsr.SetACL("Team", t.Name(), "lrip"))
+
+	delivery := b.NewDelivery()
+	assert.Equal(t, delivery.AddRcpt(SharedPrefix+"Team", textproto.Header{}), ErrPermissionDenied)
+	assert.NilError(t, delivery.Abort())
+
+	assert.NilError(t, sharedUsr.SetACL("Team", AnyoneIdentifier, "p"))
+	delivery = b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(SharedPrefix+"Team", textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	status, err := sharedUsr.Status("Team", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(1))
+
+	// ACL can't be bypassed by delivering to the pseudo-user directly.
+	delivery = b.NewDelivery()
+	assert.Equal(t, delivery.AddRcpt(SharedUsername, textproto.Header{}), ErrUserDoesntExists)
+	assert.Equal(t, delivery.AddRcpt(strings.ToUpper(SharedUsername), textproto.Header{}), ErrUserDoesntExists)
+	assert.NilError(t, delivery.Abort())
+	status, err = sharedUsr.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(0))
+}
+
+func TestSharedShadowedMboxes(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	uI, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	u := uI.(*User)
+	assert.NilError(t, u.CreateMailbox("A.News"))
+
+	// Mailbox created before the namespace was added.
+	_, err = b.db.Exec(`UPDATE mboxes SET name = ? WHERE uid = ? AND name = ?`, "Shared.News", u.id, "A.News")
+	assert.NilError(t, err)
+
+	tx, err := b.db.Begin(false)
+	assert.NilError(t, err)
+	assert.NilError(t, b.renameShadowedMboxes(tx, []string{OtherUsersPrefix, SharedPrefix}))
+	assert.NilError(t, tx.Commit())
+
+	_, mbox, err := u.GetMailbox("Shared (personal).News", true, &noopConn{})
+	assert.NilError(t, err)
+	assert.NilError(t, mbox.Close())
+}
@@ -185,12 +185,12 @@ func messageCompare(buf []*msgKey, sortCrit []sortthread.SortCriterion) func(i,
 }
 
 func (b *Backend) SupportedThreadAlgorithms() []sortthread.ThreadAlgorithm {
-	return []sortthread.ThreadAlgorithm{sortthread.OrderedSubject}
+	return []sortthread.ThreadAlgorithm{sortthread.OrderedSubject, sortthread.References}
 }
 
 func (m *Mailbox) Thread(uid bool, threading sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
 	m.parent.Opts.Log.Debugln("Sort: THREAD", uid, threading, searchCrit)
-	msgs, err := m.SearchMessages(uid, searchCrit)
+	msgs, err := m.SearchMessages(true, searchCrit)
 	if err != nil {
 		return nil, err
 	}
@@ -206,11 +206,14 @@ func (m *Mailbox) Thread(uid bool, threading sortthread.ThreadAlgorithm, searchC
 
 	// TODO: Split SearchMessages to allow it running in the same transaction.
 
-	if threading != sortthread.OrderedSubject {
+	switch threading {
+	case sortthread.OrderedSubject:
+		return m.orderedSubjThread(nil, uid, &seqSet, len(msgs))
+	case sortthread.References:
+		return m.referencesThread(nil, uid, &seqSet, len(msgs))
+	default:
 		return nil, errors.New("Unsupported threading algorithm")
 	}
-
-	return m.orderedSubjThread(nil, uid, &seqSet, len(msgs))
 }
 
 func (m *Mailbox) orderedSubjThread(tx *sql.Tx, uid bool, seqSet *imap.SeqSet, msgCount int) ([]*sortthread.Thread, error) {
@@ -273,6 +276,9 @@ func (m *Mailbox) orderedSubjThread(tx *sql.Tx, uid bool, seqSet *imap.SeqSet, m
 		// Assertion: No empty threads (threads are only created by callback
 		// above and have at least one message).
 		current.Id = thread[0].id
+		if !uid {
+			current.Id, _ = m.handle.UidAsSeq(current.Id)
+		}
 		for _, msg := range thread[1:] {
 			next := &threadsTree[nodeOffset]
 			nodeOffset++
@@ -307,6 +313,13 @@ func (m *Mailbox) headerMetaScan(tx *sql.Tx, seqSet *imap.SeqSet, callback func(
 		defer tx.Rollback()
 	}
 
+	// Data keys for encrypted headers are queried while the result set is
+	// open (see ListMessages).
+	var keyTx *sql.Tx
+	if m.parent.db.driver == "sqlite3" {
+		keyTx = tx
+	}
+
 outerLoop:
 	for _, seq := range seqSet.Set {
 		rows, err := tx.Stmt(m.parent.cachedHeaderUid).Query(m.id, seq.Start, seq.Stop)
@@ -323,6 +336,12 @@ outerLoop:
 				rows.Close()
 				continue
 			}
+			cachedHeaderBlob, err = m.parent.openMetadata(keyTx, cachedHeaderBlob)
+			if err != nil {
+				m.parent.logMboxErr(m, err, "headerMetaScan: cachedHeader decrypt", seqSet)
+				rows.Close()
+				continue
+			}
 			if err := json.Unmarshal(cachedHeaderBlob, &key.CachedHeader); err != nil {
 				m.parent.logMboxErr(m, err, "headerMetaScan: cachedHeader unmarshal", seqSet)
 				rows.Close()
@@ -43,7 +43,8 @@ func (b *Backend) configureEngine() error {
 			b.db.DB.SetMaxOpenConns(1)
 		}
 
-		if b.extStore == nil {
+		// Bodies stored in the database benefit from bigger pages too.
+		if _, sqlStore := b.extStore.(*SQLBlobStore); b.extStore == nil || sqlStore {
 			if _, err := b.db.Exec(`PRAGMA page_size=16384`); err != nil {
 				return err
 			}
@@ -82,13 +83,58 @@ func (b *Backend) initSchema() error {
 			username VARCHAR(255) NOT NULL UNIQUE,
 			msgsizelimit INTEGER DEFAULT NULL,
 
+            msgsCount INTEGER NOT NULL DEFAULT 0,
+            msgsSize BIGINT NOT NULL DEFAULT 0,
+            msgslimit INTEGER DEFAULT NULL,
+            storagelimit BIGINT DEFAULT NULL,
+
             -- It does not reference mboxes, since otherwise there will
             -- be recursive foreign key constraint.
-            inboxId BIGINT DEFAULT 0
+            inboxId BIGINT DEFAULT 0,
+
+            -- Algorithm name and the hash separated by colon,
+            -- NULL if the password is not set.
+            password VARCHAR(255) DEFAULT NULL,
+
+            -- See UserState.
+            state INTEGER NOT NULL DEFAULT 0,
+
+            -- Part of username after the last @, empty if there is none.
+            domain VARCHAR(255) NOT NULL DEFAULT ''
 		)`)
 	if err != nil {
 		return wrapErr(err, "create table users")
 	}
+	_, err = b.db.Exec(`
+        CREATE INDEX IF NOT EXISTS users_domain
+        ON users(domain)`)
+	if err != nil && b.db.driver == "mysql" {
+		_, err = b.db.Exec(`
+			CREATE INDEX users_domain
+			ON users(domain)`)
+		if err != nil && strings.HasPrefix(err.Error(), "Error 1061: Duplicate key name") {
+			err = nil
+		}
+	}
+	if err != nil {
+		return wrapErr(err, "create index users_domain")
+	}
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS domains (
+			name VARCHAR(255) PRIMARY KEY NOT NULL,
+
+			-- Defaults for users of the domain without own limits.
+			msgsizelimit INTEGER DEFAULT NULL,
+			msgslimit INTEGER DEFAULT NULL,
+			storagelimit BIGINT DEFAULT NULL,
+
+			-- JSON-encoded list of mailboxes created for new users.
+			defaultMboxes TEXT NOT NULL,
+			disabled INTEGER NOT NULL DEFAULT 0
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table domains")
+	}
 	_, err = b.db.Exec(`
 		CREATE TABLE IF NOT EXISTS mboxes (
 			id BIGSERIAL NOT NULL PRIMARY KEY AUTOINCREMENT,
@@ -103,6 +149,15 @@ func (b *Backend) initSchema() error {
 
             msgsCount INTEGER NOT NULL DEFAULT 0,
 
+            highestmodseq BIGINT NOT NULL DEFAULT 1,
+            prunedmodseq BIGINT NOT NULL DEFAULT 0,
+
+            msgsSize BIGINT NOT NULL DEFAULT 0,
+            msgslimit INTEGER DEFAULT NULL,
+            storagelimit BIGINT DEFAULT NULL,
+
+            objectId VARCHAR(255) NOT NULL DEFAULT '',
+
 			UNIQUE(uid, name)
 		)`)
 	if err != nil {
@@ -117,7 +172,14 @@ func (b *Backend) initSchema() error {
 			-- doing multiple queries to delete mboxes and stuff
 			-- or using deferred constraint checking (not supported by MySQL/MariaDB)
 			uid BIGINT NOT NULL, -- REFERENCES users(id) ON DELETE RESTRICT
-			refs INTEGER NOT NULL DEFAULT 1
+			-- Counts messages of all users that refer to the key, or
+			-- bodies for keys of attachment parts (see extParts).
+			refs INTEGER NOT NULL DEFAULT 1,
+			-- Hash of the stored object, used to find duplicates.
+			hash VARCHAR(255) DEFAULT NULL,
+			-- Data key used to encrypt the object, NULL if it is not
+			-- encrypted.
+			dataKey VARCHAR(255) DEFAULT NULL
 		)`)
 	if err != nil {
 		return wrapErr(err, "create table extkeys")
@@ -139,6 +201,88 @@ func (b *Backend) initSchema() error {
 		return wrapErr(err, "create index extKeys_uid_id")
 	}
 
+	_, err = b.db.Exec(`
+        CREATE INDEX IF NOT EXISTS extKeys_hash
+        ON extKeys(hash)`)
+	if err != nil && b.db.driver == "mysql" {
+		_, err = b.db.Exec(`
+			CREATE INDEX extKeys_hash
+			ON extKeys(hash)`)
+		if err != nil && strings.HasPrefix(err.Error(), "Error 1061: Duplicate key name") {
+			err = nil
+		}
+	}
+	if err != nil {
+		return wrapErr(err, "create index extKeys_hash")
+	}
+
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS dataKeys (
+			id VARCHAR(255) PRIMARY KEY NOT NULL,
+			uid BIGINT NOT NULL,
+			-- Identifier of the master key used to wrap the data key.
+			masterKey VARCHAR(255) NOT NULL,
+			wrappedKey BLOB NOT NULL,
+			created BIGINT NOT NULL
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table dataKeys")
+	}
+
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS extDeletes (
+			-- Key of the object that should be removed from the external
+			-- store once the transaction that deleted it is committed.
+			id VARCHAR(255) PRIMARY KEY NOT NULL,
+			queued BIGINT NOT NULL
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table extDeletes")
+	}
+
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS aliases (
+			-- Alternate address or "@domain" for catch-all.
+			alias VARCHAR(255) PRIMARY KEY NOT NULL,
+			-- Username or another alias.
+			target VARCHAR(255) NOT NULL
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table aliases")
+	}
+
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS appPasswords (
+			id BIGSERIAL NOT NULL PRIMARY KEY AUTOINCREMENT,
+			uid BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name VARCHAR(255) NOT NULL,
+			-- Hex-encoded SHA-256 of the password, see appPasswordHash.
+			hash VARCHAR(255) NOT NULL,
+			scope VARCHAR(255) NOT NULL DEFAULT '',
+			created BIGINT NOT NULL,
+			lastUsed BIGINT DEFAULT NULL,
+
+			UNIQUE(uid, name)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table appPasswords")
+	}
+
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS extParts (
+			bodyKey VARCHAR(255) NOT NULL,
+			-- Offset in the decompressed body object where the part
+			-- is inserted.
+			pos BIGINT NOT NULL,
+			partKey VARCHAR(255) NOT NULL,
+			compressAlgo VARCHAR(255) DEFAULT NULL,
+
+			PRIMARY KEY (bodyKey, pos)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table extParts")
+	}
+
 	_, err = b.db.Exec(`
 		CREATE TABLE IF NOT EXISTS msgs (
 			mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
@@ -157,6 +301,15 @@ func (b *Backend) initSchema() error {
 
 			recent INTEGER NOT NULL DEFAULT 1,
 
+			modseq BIGINT NOT NULL DEFAULT 1,
+
+			emailId VARCHAR(255) NOT NULL DEFAULT '',
+			threadId VARCHAR(255) NOT NULL DEFAULT '',
+
+			-- Hash of the message body, empty for messages added before
+			-- schema version 14.
+			bodyHash VARCHAR(255) NOT NULL DEFAULT '',
+
 			PRIMARY KEY(mboxId, msgId)
 		)`)
 	if err != nil {
@@ -175,6 +328,38 @@ func (b *Backend) initSchema() error {
 		return wrapErr(err, "create table flags")
 	}
 
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS expunged (
+			mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
+			msgId BIGINT NOT NULL,
+			modseq BIGINT NOT NULL,
+			expungedAt BIGINT NOT NULL DEFAULT 0,
+
+			PRIMARY KEY(mboxId, msgId)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table expunged")
+	}
+
+	_, err = b.db.Exec(`
+		CREATE TABLE IF NOT EXISTS acl (
+			mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
+			identifier VARCHAR(255) NOT NULL,
+			rights VARCHAR(32) NOT NULL,
+
+			PRIMARY KEY(mboxId, identifier)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table acl")
+	}
+
+	if err := b.initHeaderIndexSchema(b.db); err != nil {
+		return err
+	}
+	if err := b.initThreadIdSchema(b.db); err != nil {
+		return err
+	}
+
 	_, err = b.db.Exec(`
         CREATE INDEX IF NOT EXISTS seen_msgs
         ON msgs(mboxId, seen)`)
@@ -194,6 +379,66 @@ func (b *Backend) initSchema() error {
 	return nil
 }
 
+// initHeaderIndexSchema creates the table used to match SEARCH criteria
+// against cached header fields.
+//
+// It is used both by initSchema and by the schema upgrade code that
+// populates the table for existing messages.
+func (b *Backend) initHeaderIndexSchema(e execer) error {
+	_, err := e.Exec(`
+		CREATE TABLE IF NOT EXISTS msgs_headers (
+			mboxId BIGINT NOT NULL,
+			msgId BIGINT NOT NULL,
+			field VARCHAR(255) NOT NULL,
+			value TEXT NOT NULL,
+
+			FOREIGN KEY (mboxId, msgId) REFERENCES msgs(mboxId, msgId) ON DELETE CASCADE
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table msgs_headers")
+	}
+
+	_, err = e.Exec(`
+        CREATE INDEX IF NOT EXISTS msgs_headers_msg
+        ON msgs_headers(mboxId, msgId, field)`)
+	// MySQL does not support "IF NOT EXISTS", but MariaDB does.
+	if err != nil && b.db.driver == "mysql" {
+		_, err = e.Exec(`
+			CREATE INDEX msgs_headers_msg
+			ON msgs_headers(mboxId, msgId, field)`)
+		if err != nil && strings.HasPrefix(err.Error(), "Error 1061: Duplicate key name") {
+			err = nil
+		}
+	}
+	if err != nil {
+		return wrapErr(err, "create index msgs_headers_msg")
+	}
+
+	return nil
+}
+
+// initThreadIdSchema creates the table used to assign THREADID to new
+// messages.
+//
+// It maps Message-Id values seen by the user (including ones mentioned in
+// References and In-Reply-To) to thread IDs. Entries are not removed when
+// messages are expunged so replies to deleted messages still end up in the
+// same thread.
+func (b *Backend) initThreadIdSchema(e execer) error {
+	_, err := e.Exec(`
+		CREATE TABLE IF NOT EXISTS msgThreads (
+			uid BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			messageId VARCHAR(255) NOT NULL,
+			threadId VARCHAR(255) NOT NULL,
+
+			PRIMARY KEY(uid, messageId)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table msgThreads")
+	}
+	return nil
+}
+
 func (b *Backend) prepareStmts() error {
 	var err error
 
@@ -212,8 +457,8 @@ func (b *Backend) prepareStmts() error {
 		return wrapErr(err, "listUsers prep")
 	}
 	b.addUser, err = b.db.Prepare(`
-		INSERT INTO users(username)
-		VALUES (?)`)
+		INSERT INTO users(username, domain)
+		VALUES (?, ?)`)
 	if err != nil {
 		return wrapErr(err, "addUser prep")
 	}
@@ -223,6 +468,27 @@ func (b *Backend) prepareStmts() error {
 	if err != nil {
 		return wrapErr(err, "addUser prep")
 	}
+	b.userState, err = b.db.Prepare(`
+		SELECT state
+		FROM users
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "userState prep")
+	}
+	b.setUserState, err = b.db.Prepare(`
+		UPDATE users
+		SET state = ?
+		WHERE username = ?`)
+	if err != nil {
+		return wrapErr(err, "setUserState prep")
+	}
+	b.renameUser, err = b.db.Prepare(`
+		UPDATE users
+		SET username = ?, domain = ?
+		WHERE username = ?`)
+	if err != nil {
+		return wrapErr(err, "renameUser prep")
+	}
 	b.listMboxes, err = b.db.Prepare(`
 		SELECT id, name
 		FROM mboxes
@@ -240,14 +506,14 @@ func (b *Backend) prepareStmts() error {
 		return wrapErr(err, "listSubbedMboxes prep")
 	}
 	b.createMbox, err = b.db.Prepare(`
-		INSERT INTO mboxes(uid, name, uidvalidity, specialuse)
-		VALUES (?, ?, ?, ?)`)
+		INSERT INTO mboxes(uid, name, uidvalidity, specialuse, objectId)
+		VALUES (?, ?, ?, ?, ?)`)
 	if err != nil {
 		return wrapErr(err, "createMbox prep")
 	}
 	b.createMboxExistsOk, err = b.db.Prepare(`
-		INSERT INTO mboxes(uid, name, uidvalidity)
-		VALUES (?, ?, ?) ON CONFLICT DO NOTHING`)
+		INSERT INTO mboxes(uid, name, uidvalidity, objectId)
+		VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`)
 	if err != nil {
 		return wrapErr(err, "createMboxExistsOk prep")
 	}
@@ -411,8 +677,8 @@ func (b *Backend) prepareStmts() error {
 		return wrapErr(err, "mboxId prep")
 	}
 	b.addMsg, err = b.db.Prepare(`
-		INSERT INTO msgs(mboxId, msgId, date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, recent)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		INSERT INTO msgs(mboxId, msgId, date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, recent, modseq, emailId, threadId, bodyHash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return wrapErr(err, "addMsg prep")
 	}
@@ -422,12 +688,37 @@ func (b *Backend) prepareStmts() error {
 			SELECT uidnext - 1
 			FROM mboxes
 			WHERE id = ?
-		) + row_number() OVER (ORDER BY msgId) + ?, date, bodyLen, 0 AS mark, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, 0
+		) + row_number() OVER (ORDER BY msgId) + ?, date, bodyLen, 0 AS mark, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, 0, ? AS modseq, emailId, threadId, bodyHash
 		FROM msgs
 		WHERE mboxId = ? AND msgId BETWEEN ? AND ? ORDER BY msgId`)
 	if err != nil {
 		return wrapErr(err, "copyMsgsUid prep")
 	}
+	b.addMsgHeader, err = b.db.Prepare(`
+		INSERT INTO msgs_headers(mboxId, msgId, field, value)
+		VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addMsgHeader prep")
+	}
+	b.copyMsgHeadersUid, err = b.db.Prepare(`
+		INSERT INTO msgs_headers
+		SELECT ?, new_msgId AS msgId, field, value
+		FROM msgs_headers
+		INNER JOIN (
+			SELECT (
+				SELECT uidnext - 1
+				FROM mboxes
+				WHERE id = ?
+			) + row_number() OVER (ORDER BY msgId) + ? AS new_msgId, msgId, mboxId
+			FROM msgs
+			WHERE mboxId = ?
+			AND msgId BETWEEN ? AND ?
+			ORDER BY msgId
+		) map ON map.msgId = msgs_headers.msgId
+		AND map.mboxId = msgs_headers.mboxId`)
+	if err != nil {
+		return wrapErr(err, "copyMsgHeadersUid prep")
+	}
 	b.copyMsgFlagsUid, err = b.db.Prepare(`
 		INSERT INTO flags
 		SELECT ?, new_msgId AS msgId, flag
@@ -500,9 +791,11 @@ func (b *Backend) prepareStmts() error {
 		return wrapErr(err, "setUserMsgSizeLimit prep")
 	}
 	b.userMsgSizeLimit, err = b.db.Prepare(`
-		SELECT msgsizelimit
+		SELECT NULLIF(COALESCE(users.msgsizelimit, domains.msgsizelimit), -1)
 		FROM users
-		WHERE id = ?`)
+		LEFT JOIN domains
+		ON domains.name = users.domain
+		WHERE users.id = ?`)
 	if err != nil {
 		return wrapErr(err, "userMsgSizeLimit prep")
 	}
@@ -572,16 +865,36 @@ func (b *Backend) prepareStmts() error {
 	}
 
 	b.addExtKey, err = b.db.Prepare(`
-		INSERT INTO extKeys(id, uid, refs)
-		VALUES (?, ?, ?)`)
+		INSERT INTO extKeys(id, uid, refs, hash, dataKey)
+		VALUES (?, ?, ?, ?, ?)`)
 	if err != nil {
 		return wrapErr(err, "addExtKey prep")
 	}
+	b.extKeyByHash, err = b.db.Prepare(`
+		SELECT id
+		FROM extKeys
+		WHERE hash = ? AND refs > 0
+		LIMIT 1`)
+	if err != nil {
+		return wrapErr(err, "extKeyByHash prep")
+	}
+	b.incrementRef, err = b.db.Prepare(`
+		UPDATE extKeys
+		SET refs = refs + 1
+		WHERE id = ? AND refs > 0`)
+	if err != nil {
+		return wrapErr(err, "incrementRef prep")
+	}
+	// Keys are shared between messages and users so reference counts are
+	// changed by the number of messages that refer to them.
 	b.decreaseRefForMarked, err = b.db.Prepare(`
 		UPDATE extKeys
-		SET refs = refs - 1
-		WHERE uid = ?
-		AND id IN (
+		SET refs = refs - (
+			SELECT COUNT(*)
+			FROM msgs
+			WHERE mboxId = ? AND mark = 1 AND extBodyKey = extKeys.id
+		)
+		WHERE id IN (
 			SELECT extBodyKey
 			FROM msgs
 			WHERE mboxId = ? AND mark = 1 AND extBodyKey IS NOT NULL
@@ -591,9 +904,16 @@ func (b *Backend) prepareStmts() error {
 	}
 	b.decreaseRefForDeleted, err = b.db.Prepare(`
 		UPDATE extKeys
-		SET refs = refs - 1
-		WHERE uid = ?
-		AND id IN (
+		SET refs = refs - (
+			SELECT COUNT(*)
+			FROM msgs
+			INNER JOIN flags
+			ON msgs.mboxId = flags.mboxId
+			AND msgs.msgId = flags.msgId
+			AND flag = '\Deleted'
+			WHERE msgs.mboxId = ? AND extBodyKey = extKeys.id
+		)
+		WHERE id IN (
 			SELECT extBodyKey
 			FROM msgs
 			INNER JOIN flags
@@ -607,60 +927,343 @@ func (b *Backend) prepareStmts() error {
 	}
 	b.incrementRefUid, err = b.db.Prepare(`
 		UPDATE extKeys
-		SET refs = refs + 1
-		WHERE uid = ?
-		AND id IN (
+		SET refs = refs + (
+			SELECT COUNT(*)
+			FROM msgs
+			WHERE mboxId = ? AND msgId BETWEEN ? AND ? AND extBodyKey = extKeys.id
+		)
+		WHERE id IN (
 			SELECT extBodyKey
 			FROM msgs
 			WHERE mboxId = ? AND msgId BETWEEN ? AND ?
-			ORDER BY msgId DESC
 		)`)
 	if err != nil {
 		return wrapErr(err, "incrementRefUid prep")
 	}
 	b.zeroRef, err = b.db.Prepare(`
-		SELECT extBodyKey
+		SELECT DISTINCT extBodyKey
 		FROM msgs
 		INNER JOIN extKeys
 		ON msgs.extBodyKey = extKeys.id
 		WHERE extBodyKey IS NOT NULL
-		AND uid = ?
 		AND mboxId = ?
 		AND refs = 0`)
 	if err != nil {
 		return wrapErr(err, "zeroRef prep")
 	}
+	b.zeroRefMbox, err = b.db.Prepare(`
+		SELECT DISTINCT extBodyKey
+		FROM msgs
+		INNER JOIN extKeys
+		ON msgs.extBodyKey = extKeys.id
+		WHERE mboxId = (SELECT id FROM mboxes WHERE uid = ? AND name = ?)
+		AND refs = 0`)
+	if err != nil {
+		return wrapErr(err, "zeroRefMbox prep")
+	}
 	b.zeroRefUser, err = b.db.Prepare(`
-		SELECT id
-		FROM extKeys
-		WHERE uid = ?
+		SELECT DISTINCT extBodyKey
+		FROM msgs
+		INNER JOIN mboxes
+		ON mboxes.id = msgs.mboxId
+		INNER JOIN extKeys
+		ON msgs.extBodyKey = extKeys.id
+		WHERE mboxes.uid = (SELECT id FROM users WHERE username = ?)
 		AND refs = 0`)
 	if err != nil {
 		return wrapErr(err, "zeroRefUser prep")
 	}
-	b.refUser, err = b.db.Prepare(`
+	b.deleteZeroRef, err = b.db.Prepare(`
+		DELETE FROM extKeys
+		WHERE id = ? AND refs = 0`)
+	if err != nil {
+		return wrapErr(err, "deleteZeroRef prep")
+	}
+	b.userBodies, err = b.db.Prepare(`
+		SELECT mboxes.name, msgs.msgId, msgs.extBodyKey, msgs.compressAlgo, msgs.bodyLen, msgs.bodyHash
+		FROM msgs
+		INNER JOIN mboxes
+		ON msgs.mboxId = mboxes.id
+		WHERE mboxes.uid = ?
+		ORDER BY mboxes.name, msgs.msgId`)
+	if err != nil {
+		return wrapErr(err, "userBodies prep")
+	}
+	b.addDataKey, err = b.db.Prepare(`
+		INSERT INTO dataKeys(id, uid, masterKey, wrappedKey, created)
+		VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addDataKey prep")
+	}
+	b.dataKeyById, err = b.db.Prepare(`
+		SELECT masterKey, wrappedKey
+		FROM dataKeys
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "dataKeyById prep")
+	}
+	b.userDataKeyId, err = b.db.Prepare(`
 		SELECT id
-		FROM extKeys
-		WHERE uid = (SELECT id FROM users WHERE username = ?)`)
+		FROM dataKeys
+		WHERE uid = ?
+		ORDER BY created DESC
+		LIMIT 1`)
 	if err != nil {
-		return wrapErr(err, "refUser prep")
+		return wrapErr(err, "userDataKeyId prep")
 	}
-	b.deleteZeroRef, err = b.db.Prepare(`
-		DELETE FROM extKeys
-		-- This is the hint to accelerate operation
-		-- when we have many users.
+	b.oldDataKeys, err = b.db.Prepare(`
+		SELECT id, masterKey, wrappedKey
+		FROM dataKeys
+		WHERE masterKey != ?`)
+	if err != nil {
+		return wrapErr(err, "oldDataKeys prep")
+	}
+	b.rewrapDataKey, err = b.db.Prepare(`
+		UPDATE dataKeys
+		SET masterKey = ?, wrappedKey = ?
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "rewrapDataKey prep")
+	}
+	b.userPassword, err = b.db.Prepare(`
+		SELECT id, password
+		FROM users
+		WHERE username = ?`)
+	if err != nil {
+		return wrapErr(err, "userPassword prep")
+	}
+	b.setUserPassword, err = b.db.Prepare(`
+		UPDATE users
+		SET password = ?
+		WHERE username = ?`)
+	if err != nil {
+		return wrapErr(err, "setUserPassword prep")
+	}
+	b.rehashUserPassword, err = b.db.Prepare(`
+		UPDATE users
+		SET password = ?
+		WHERE id = ? AND password = ?`)
+	if err != nil {
+		return wrapErr(err, "rehashUserPassword prep")
+	}
+	b.addDomain, err = b.db.Prepare(`
+		INSERT INTO domains(name, defaultMboxes)
+		VALUES (?, '')`)
+	if err != nil {
+		return wrapErr(err, "addDomain prep")
+	}
+	b.delDomain, err = b.db.Prepare(`
+		DELETE FROM domains
+		WHERE name = ?`)
+	if err != nil {
+		return wrapErr(err, "delDomain prep")
+	}
+	b.listDomains, err = b.db.Prepare(`
+		SELECT name
+		FROM domains
+		ORDER BY name`)
+	if err != nil {
+		return wrapErr(err, "listDomains prep")
+	}
+	b.domainSettings, err = b.db.Prepare(`
+		SELECT msgsizelimit, msgslimit, storagelimit, defaultMboxes, disabled
+		FROM domains
+		WHERE name = ?`)
+	if err != nil {
+		return wrapErr(err, "domainSettings prep")
+	}
+	b.setDomainSettings, err = b.db.Prepare(`
+		UPDATE domains
+		SET msgsizelimit = ?, msgslimit = ?, storagelimit = ?, defaultMboxes = ?, disabled = ?
+		WHERE name = ?`)
+	if err != nil {
+		return wrapErr(err, "setDomainSettings prep")
+	}
+	b.domainDisabled, err = b.db.Prepare(`
+		SELECT disabled
+		FROM domains
+		WHERE name = ?`)
+	if err != nil {
+		return wrapErr(err, "domainDisabled prep")
+	}
+	b.domainMboxes, err = b.db.Prepare(`
+		SELECT defaultMboxes
+		FROM domains
+		WHERE name = ?`)
+	if err != nil {
+		return wrapErr(err, "domainMboxes prep")
+	}
+	b.listDomainUsers, err = b.db.Prepare(`
+		SELECT username
+		FROM users
+		WHERE domain = ?
+		ORDER BY id`)
+	if err != nil {
+		return wrapErr(err, "listDomainUsers prep")
+	}
+	b.aliasTarget, err = b.db.Prepare(`
+		SELECT target
+		FROM aliases
+		WHERE alias = ?`)
+	if err != nil {
+		return wrapErr(err, "aliasTarget prep")
+	}
+	b.addAlias, err = b.db.Prepare(`
+		INSERT INTO aliases(alias, target)
+		VALUES (?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addAlias prep")
+	}
+	b.delAlias, err = b.db.Prepare(`
+		DELETE FROM aliases
+		WHERE alias = ?`)
+	if err != nil {
+		return wrapErr(err, "delAlias prep")
+	}
+	b.listAliases, err = b.db.Prepare(`
+		SELECT alias, target
+		FROM aliases
+		ORDER BY alias`)
+	if err != nil {
+		return wrapErr(err, "listAliases prep")
+	}
+	b.delAliasesTo, err = b.db.Prepare(`
+		DELETE FROM aliases
+		WHERE target = ?`)
+	if err != nil {
+		return wrapErr(err, "delAliasesTo prep")
+	}
+	b.renameAliasTarget, err = b.db.Prepare(`
+		UPDATE aliases
+		SET target = ?
+		WHERE target = ?`)
+	if err != nil {
+		return wrapErr(err, "renameAliasTarget prep")
+	}
+	b.addAppPassword, err = b.db.Prepare(`
+		INSERT INTO appPasswords(uid, name, hash, scope, created)
+		VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addAppPassword prep")
+	}
+	b.listAppPasswords, err = b.db.Prepare(`
+		SELECT name, scope, created, lastUsed
+		FROM appPasswords
 		WHERE uid = ?
+		ORDER BY name`)
+	if err != nil {
+		return wrapErr(err, "listAppPasswords prep")
+	}
+	b.delAppPassword, err = b.db.Prepare(`
+		DELETE FROM appPasswords
+		WHERE uid = ? AND name = ?`)
+	if err != nil {
+		return wrapErr(err, "delAppPassword prep")
+	}
+	b.appPasswordByHash, err = b.db.Prepare(`
+		SELECT appPasswords.id, appPasswords.scope
+		FROM appPasswords
+		INNER JOIN users
+		ON appPasswords.uid = users.id
+		WHERE users.username = ? AND appPasswords.hash = ?`)
+	if err != nil {
+		return wrapErr(err, "appPasswordByHash prep")
+	}
+	b.touchAppPassword, err = b.db.Prepare(`
+		UPDATE appPasswords
+		SET lastUsed = ?
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "touchAppPassword prep")
+	}
+	b.queueExtDelete, err = b.db.Prepare(`
+		INSERT INTO extDeletes(id, queued)
+		VALUES (?, ?)`)
+	if err != nil {
+		return wrapErr(err, "queueExtDelete prep")
+	}
+	b.queuedExtDelete, err = b.db.Prepare(`
+		SELECT id
+		FROM extDeletes
+		ORDER BY queued
+		LIMIT 1000`)
+	if err != nil {
+		return wrapErr(err, "queuedExtDelete prep")
+	}
+	b.dequeueExtDelete, err = b.db.Prepare(`
+		DELETE FROM extDeletes
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "dequeueExtDelete prep")
+	}
+	b.addBodyPart, err = b.db.Prepare(`
+		INSERT INTO extParts(bodyKey, pos, partKey, compressAlgo)
+		VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addBodyPart prep")
+	}
+	b.bodyParts, err = b.db.Prepare(`
+		SELECT extKeys.dataKey, extParts.pos, extParts.partKey, extParts.compressAlgo, partKeys.dataKey
+		FROM extKeys
+		LEFT JOIN extParts
+		ON extParts.bodyKey = extKeys.id
+		LEFT JOIN extKeys partKeys
+		ON extParts.partKey = partKeys.id
+		WHERE extKeys.id = ?
+		ORDER BY extParts.pos`)
+	if err != nil {
+		return wrapErr(err, "bodyParts prep")
+	}
+	b.decreaseRefForParts, err = b.db.Prepare(`
+		UPDATE extKeys
+		SET refs = refs - (
+			SELECT COUNT(*)
+			FROM extParts
+			WHERE bodyKey = ? AND partKey = extKeys.id
+		)
+		WHERE id IN (
+			SELECT partKey
+			FROM extParts
+			WHERE bodyKey = ?
+		)`)
+	if err != nil {
+		return wrapErr(err, "decreaseRefForParts prep")
+	}
+	b.zeroRefParts, err = b.db.Prepare(`
+		SELECT DISTINCT partKey
+		FROM extParts
+		INNER JOIN extKeys
+		ON extParts.partKey = extKeys.id
+		WHERE bodyKey = ?
 		AND refs = 0`)
 	if err != nil {
-		return wrapErr(err, "deleteZeroRef prep")
+		return wrapErr(err, "zeroRefParts prep")
 	}
-	b.deleteUserRef, err = b.db.Prepare(`
-		DELETE FROM extKeys
-		-- This is the hint to accelerate operation
-		-- when we have many users.
-		WHERE uid = (SELECT id FROM users WHERE username = ?)`)
+	b.delBodyParts, err = b.db.Prepare(`
+		DELETE FROM extParts
+		WHERE bodyKey = ?`)
 	if err != nil {
-		return wrapErr(err, "deleteUserRef prep")
+		return wrapErr(err, "delBodyParts prep")
+	}
+	b.decreaseRefForUser, err = b.db.Prepare(`
+		UPDATE extKeys
+		SET refs = refs - (
+			SELECT COUNT(*)
+			FROM msgs
+			INNER JOIN mboxes
+			ON mboxes.id = msgs.mboxId
+			WHERE mboxes.uid = (SELECT id FROM users WHERE username = ?)
+			AND extBodyKey = extKeys.id
+		)
+		WHERE id IN (
+			SELECT extBodyKey
+			FROM msgs
+			INNER JOIN mboxes
+			ON mboxes.id = msgs.mboxId
+			WHERE mboxes.uid = (SELECT id FROM users WHERE username = ?)
+		)`)
+	if err != nil {
+		return wrapErr(err, "decreaseRefForUser prep")
 	}
 
 	b.specialUseMbox, err = b.db.Prepare(`
@@ -692,17 +1295,319 @@ func (b *Backend) prepareStmts() error {
 
 	b.decreaseRefForMbox, err = b.db.Prepare(`
 		UPDATE extKeys
-		SET refs = refs - 1
-		WHERE uid = ?
-		AND id IN (
+		SET refs = refs - (
+			SELECT COUNT(*)
+			FROM msgs
+			WHERE mboxId = (SELECT id FROM mboxes WHERE uid = ? AND name = ?)
+			AND extBodyKey = extKeys.id
+		)
+		WHERE id IN (
 			SELECT extBodyKey
 			FROM msgs
-			WHERE mboxId = (SELECT id FROM mboxes WHERE name = ?)
+			WHERE mboxId = (SELECT id FROM mboxes WHERE uid = ? AND name = ?)
 		)`)
 	if err != nil {
 		return wrapErr(err, "decreaseRefForMbox prep")
 	}
 
+	if b.db.driver == "postgres" {
+		b.bumpModSeq, err = b.db.Prepare(`
+			UPDATE mboxes
+			SET highestmodseq = highestmodseq + 1
+			WHERE id = ?
+			RETURNING highestmodseq`)
+	} else {
+		b.bumpModSeq, err = b.db.Prepare(`
+			UPDATE mboxes
+			SET highestmodseq = highestmodseq + 1
+			WHERE id = ?`)
+	}
+	if err != nil {
+		return wrapErr(err, "bumpModSeq prep")
+	}
+	b.mboxObjectId, err = b.db.Prepare(`
+		SELECT objectId
+		FROM mboxes
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "mboxObjectId prep")
+	}
+	b.threadIdByMsgId, err = b.db.Prepare(`
+		SELECT threadId
+		FROM msgThreads
+		WHERE uid = ? AND messageId = ?`)
+	if err != nil {
+		return wrapErr(err, "threadIdByMsgId prep")
+	}
+	b.addMsgThread, err = b.db.Prepare(`
+		INSERT INTO msgThreads(uid, messageId, threadId)
+		VALUES (?, ?, ?) ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return wrapErr(err, "addMsgThread prep")
+	}
+	b.highestModSeq, err = b.db.Prepare(`
+		SELECT highestmodseq
+		FROM mboxes
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "highestModSeq prep")
+	}
+	b.setModSeqUid, err = b.db.Prepare(`
+		UPDATE msgs
+		SET modseq = ?
+		WHERE mboxId = ?
+		AND msgId BETWEEN ? AND ?`)
+	if err != nil {
+		return wrapErr(err, "setModSeqUid prep")
+	}
+	b.msgModSeqUid, err = b.db.Prepare(`
+		SELECT msgId, modseq
+		FROM msgs
+		WHERE mboxId = ?
+		AND msgId BETWEEN ? AND ?
+		ORDER BY msgId`)
+	if err != nil {
+		return wrapErr(err, "msgModSeqUid prep")
+	}
+	b.addExpungedDeleted, err = b.db.Prepare(`
+		INSERT INTO expunged(mboxId, msgId, modseq, expungedAt)
+		SELECT mboxId, msgId, ?, ?
+		FROM flags
+		WHERE mboxId = ?
+		AND flag = '\Deleted'`)
+	if err != nil {
+		return wrapErr(err, "addExpungedDeleted prep")
+	}
+	b.addExpungedMarked, err = b.db.Prepare(`
+		INSERT INTO expunged(mboxId, msgId, modseq, expungedAt)
+		SELECT mboxId, msgId, ?, ?
+		FROM msgs
+		WHERE mboxId = ?
+		AND mark = 1`)
+	if err != nil {
+		return wrapErr(err, "addExpungedMarked prep")
+	}
+	b.vanishedUids, err = b.db.Prepare(`
+		SELECT msgId
+		FROM expunged
+		WHERE mboxId = ?
+		AND modseq > ?
+		ORDER BY msgId`)
+	if err != nil {
+		return wrapErr(err, "vanishedUids prep")
+	}
+	b.prunedModSeq, err = b.db.Prepare(`
+		SELECT prunedmodseq
+		FROM mboxes
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "prunedModSeq prep")
+	}
+	b.setPrunedModSeq, err = b.db.Prepare(`
+		UPDATE mboxes
+		SET prunedmodseq = (
+			SELECT MAX(modseq)
+			FROM expunged
+			WHERE expunged.mboxId = mboxes.id
+			AND expungedAt < ?
+		)
+		WHERE id IN (
+			SELECT mboxId
+			FROM expunged
+			WHERE expungedAt < ?
+		)`)
+	if err != nil {
+		return wrapErr(err, "setPrunedModSeq prep")
+	}
+	b.delPrunedExpunged, err = b.db.Prepare(`
+		DELETE FROM expunged
+		WHERE modseq <= (
+			SELECT prunedmodseq
+			FROM mboxes
+			WHERE mboxes.id = expunged.mboxId
+		)`)
+	if err != nil {
+		return wrapErr(err, "delPrunedExpunged prep")
+	}
+
+	b.msgIdsUid, err = b.db.Prepare(`
+		SELECT msgId
+		FROM msgs
+		WHERE mboxId = ?
+		AND msgId BETWEEN ? AND ?
+		ORDER BY msgId`)
+	if err != nil {
+		return wrapErr(err, "msgIdsUid prep")
+	}
+	b.markDeletedUid, err = b.db.Prepare(`
+		UPDATE msgs
+		SET mark = 1
+		WHERE mboxId = ?
+		AND msgId BETWEEN ? AND ?
+		AND msgId IN (
+			SELECT msgId
+			FROM flags
+			WHERE mboxId = ?
+			AND flag = '\Deleted'
+		)`)
+	if err != nil {
+		return wrapErr(err, "markDeletedUid prep")
+	}
+
+	b.addMboxSize, err = b.db.Prepare(`
+		UPDATE mboxes
+		SET msgsSize = msgsSize + ?
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "addMboxSize prep")
+	}
+	b.addUserUsage, err = b.db.Prepare(`
+		UPDATE users
+		SET msgsCount = msgsCount + ?,
+		msgsSize = msgsSize + ?
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "addUserUsage prep")
+	}
+	b.delMboxUsage, err = b.db.Prepare(`
+		UPDATE users
+		SET msgsCount = msgsCount - COALESCE((
+			SELECT msgsCount
+			FROM mboxes
+			WHERE uid = ? AND name = ?
+		), 0), msgsSize = msgsSize - COALESCE((
+			SELECT msgsSize
+			FROM mboxes
+			WHERE uid = ? AND name = ?
+		), 0)
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "delMboxUsage prep")
+	}
+	b.mboxQuota, err = b.db.Prepare(`
+		SELECT msgsCount, msgsSize, msgslimit, storagelimit
+		FROM mboxes
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "mboxQuota prep")
+	}
+	b.userQuota, err = b.db.Prepare(`
+		SELECT users.msgsCount, users.msgsSize,
+			NULLIF(COALESCE(users.msgslimit, domains.msgslimit), -1),
+			NULLIF(COALESCE(users.storagelimit, domains.storagelimit), -1)
+		FROM users
+		LEFT JOIN domains
+		ON domains.name = users.domain
+		WHERE users.id = ?`)
+	if err != nil {
+		return wrapErr(err, "userQuota prep")
+	}
+	b.setMboxQuota, err = b.db.Prepare(`
+		UPDATE mboxes
+		SET msgslimit = ?, storagelimit = ?
+		WHERE uid = ? AND name = ?`)
+	if err != nil {
+		return wrapErr(err, "setMboxQuota prep")
+	}
+	b.setUserQuota, err = b.db.Prepare(`
+		UPDATE users
+		SET msgslimit = ?, storagelimit = ?
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "setUserQuota prep")
+	}
+	b.markedSize, err = b.db.Prepare(`
+		SELECT COALESCE(SUM(bodyLen), 0)
+		FROM msgs
+		WHERE mboxId = ?
+		AND mark = 1`)
+	if err != nil {
+		return wrapErr(err, "markedSize prep")
+	}
+	b.deletedSize, err = b.db.Prepare(`
+		SELECT COALESCE(SUM(bodyLen), 0)
+		FROM msgs
+		INNER JOIN flags
+		ON msgs.mboxId = flags.mboxId
+		AND msgs.msgId = flags.msgId
+		AND flag = '\Deleted'
+		WHERE msgs.mboxId = ?`)
+	if err != nil {
+		return wrapErr(err, "deletedSize prep")
+	}
+	b.msgsSizeUid, err = b.db.Prepare(`
+		SELECT COALESCE(SUM(bodyLen), 0)
+		FROM msgs
+		WHERE mboxId = ?
+		AND msgId BETWEEN ? AND ?`)
+	if err != nil {
+		return wrapErr(err, "msgsSizeUid prep")
+	}
+
+	b.aclRights, err = b.db.Prepare(`
+		SELECT rights
+		FROM acl
+		WHERE mboxId = ?
+		AND identifier IN (?, ?)`)
+	if err != nil {
+		return wrapErr(err, "aclRights prep")
+	}
+	b.aclEntry, err = b.db.Prepare(`
+		SELECT rights
+		FROM acl
+		WHERE mboxId = ?
+		AND identifier = ?`)
+	if err != nil {
+		return wrapErr(err, "aclEntry prep")
+	}
+	b.aclList, err = b.db.Prepare(`
+		SELECT identifier, rights
+		FROM acl
+		WHERE mboxId = ?
+		ORDER BY identifier`)
+	if err != nil {
+		return wrapErr(err, "aclList prep")
+	}
+	b.aclAdd, err = b.db.Prepare(`
+		INSERT INTO acl(mboxId, identifier, rights)
+		VALUES (?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "aclAdd prep")
+	}
+	b.aclDel, err = b.db.Prepare(`
+		DELETE FROM acl
+		WHERE mboxId = ?
+		AND identifier = ?`)
+	if err != nil {
+		return wrapErr(err, "aclDel prep")
+	}
+	b.aclDelIdentifier, err = b.db.Prepare(`
+		DELETE FROM acl
+		WHERE identifier = ?`)
+	if err != nil {
+		return wrapErr(err, "aclDelIdentifier prep")
+	}
+	b.aclRenameIdentifier, err = b.db.Prepare(`
+		UPDATE acl
+		SET identifier = ?
+		WHERE identifier = ?`)
+	if err != nil {
+		return wrapErr(err, "aclRenameIdentifier prep")
+	}
+	b.sharedMboxes, err = b.db.Prepare(`
+		SELECT mboxes.id, users.username, mboxes.name, acl.rights
+		FROM acl
+		INNER JOIN mboxes
+		ON mboxes.id = acl.mboxId
+		INNER JOIN users
+		ON users.id = mboxes.uid
+		WHERE acl.identifier IN (?, ?)
+		AND mboxes.uid != ?
+		ORDER BY mboxes.id`)
+	if err != nil {
+		return wrapErr(err, "sharedMboxes prep")
+	}
+
 	b.lastUid, err = b.db.Prepare(`SELECT max(msgId) FROM msgs WHERE mboxId = ?`)
 	if err != nil {
 		return wrapErr(err, "lastUid prep")
@@ -42,7 +42,7 @@ var cachedHeaderFields = map[string]struct{}{
 	"Delivered-To": {},
 }
 
-func (b *Backend) buildFetchStmt(items []imap.FetchItem) (stmt, cacheKey string, err error) {
+func (b *Backend) buildFetchStmt(items []imap.FetchItem, changedSince bool) (stmt, cacheKey string, err error) {
 	colNames := make(map[string]struct{}, len(items)+1)
 	needFlags := false
 
@@ -61,6 +61,12 @@ func (b *Backend) buildFetchStmt(items []imap.FetchItem) (stmt, cacheKey string,
 			needFlags = true
 		case imap.FetchBody, imap.FetchBodyStructure:
 			colNames["bodyStructure"] = struct{}{}
+		case FetchModSeq:
+			colNames["modseq"] = struct{}{}
+		case FetchEmailId:
+			colNames["emailId"] = struct{}{}
+		case FetchThreadId:
+			colNames["threadId"] = struct{}{}
 		default:
 			_, part, err := getNeededPart(item)
 			if err != nil {
@@ -73,6 +79,9 @@ func (b *Backend) buildFetchStmt(items []imap.FetchItem) (stmt, cacheKey string,
 			case needHeader, needFullBody:
 				colNames["extBodyKey"] = struct{}{}
 				colNames["compressAlgo"] = struct{}{}
+				// Used to verify the body.
+				colNames["bodyLen"] = struct{}{}
+				colNames["bodyHash"] = struct{}{}
 			}
 		}
 	}
@@ -90,15 +99,21 @@ func (b *Backend) buildFetchStmt(items []imap.FetchItem) (stmt, cacheKey string,
 	sort.Strings(cols)
 
 	columns := strings.Join(cols, ", ")
+	cacheKey = columns
+	condition := `msgs.mboxId = ? AND msgs.msgId BETWEEN ? AND ?`
+	if changedSince {
+		condition += ` AND msgs.modseq > ?`
+		cacheKey += " changedsince"
+	}
 	return `SELECT ` + columns + `
 		FROM msgs
 		` + extraParams + `
-		WHERE msgs.mboxId = ? AND msgs.msgId BETWEEN ? AND ?
-		GROUP BY msgs.mboxId, msgs.msgId`, columns, nil
+		WHERE ` + condition + `
+		GROUP BY msgs.mboxId, msgs.msgId`, cacheKey, nil
 }
 
-func (b *Backend) getFetchStmt(items []imap.FetchItem) (*sql.Stmt, error) {
-	str, key, err := b.buildFetchStmt(items)
+func (b *Backend) getFetchStmt(items []imap.FetchItem, changedSince bool) (*sql.Stmt, error) {
+	str, key, err := b.buildFetchStmt(items, changedSince)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,217 @@
+package imapsql
+
+import (
+	"strings"
+)
+
+// initFTSSchema creates tables used for full-text index.
+//
+// It returns false if full-text index is not supported by the used RDBMS.
+func (b *Backend) initFTSSchema() (bool, error) {
+	switch b.db.driver {
+	case "sqlite3":
+		// Message blobs are identified by string keys, but FTS5 tables
+		// can only use integer rowid so we keep the mapping separately.
+		_, err := b.db.Exec(`
+			CREATE TABLE IF NOT EXISTS msgs_fts_keys (
+				id INTEGER PRIMARY KEY,
+				extBodyKey VARCHAR(255) NOT NULL UNIQUE
+			)`)
+		if err != nil {
+			return false, wrapErr(err, "create table msgs_fts_keys")
+		}
+
+		// trigram tokenizer provides case-insensitive substring matching
+		// as required by RFC 3501.
+		_, err = b.db.Exec(`
+			CREATE VIRTUAL TABLE IF NOT EXISTS msgs_fts
+			USING fts5(header, body, tokenize = 'trigram')`)
+		if err != nil {
+			if strings.Contains(err.Error(), "no such module") || strings.Contains(err.Error(), "no such tokenizer") {
+				return false, nil
+			}
+			return false, wrapErr(err, "create table msgs_fts")
+		}
+		return true, nil
+	case "postgres":
+		_, err := b.db.Exec(`
+			CREATE TABLE IF NOT EXISTS msgs_fts (
+				extBodyKey VARCHAR(255) NOT NULL PRIMARY KEY,
+				header TEXT NOT NULL,
+				body TEXT NOT NULL
+			)`)
+		if err != nil {
+			return false, wrapErr(err, "create table msgs_fts")
+		}
+		_, err = b.db.Exec(`
+			CREATE INDEX IF NOT EXISTS msgs_fts_header
+			ON msgs_fts USING GIN (to_tsvector('simple', header))`)
+		if err != nil {
+			return false, wrapErr(err, "create index msgs_fts_header")
+		}
+		_, err = b.db.Exec(`
+			CREATE INDEX IF NOT EXISTS msgs_fts_body
+			ON msgs_fts USING GIN (to_tsvector('simple', body))`)
+		if err != nil {
+			return false, wrapErr(err, "create index msgs_fts_body")
+		}
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (b *Backend) prepareFTSStmts() error {
+	var err error
+
+	if b.db.driver == "sqlite3" {
+		b.ftsAddKey, err = b.db.Prepare(`
+			INSERT INTO msgs_fts_keys(extBodyKey)
+			VALUES (?)
+			ON CONFLICT DO NOTHING`)
+		if err != nil {
+			return wrapErr(err, "ftsAddKey prep")
+		}
+		b.ftsAdd, err = b.db.Prepare(`
+			INSERT INTO msgs_fts(rowid, header, body)
+			SELECT id, ?, ?
+			FROM msgs_fts_keys
+			WHERE extBodyKey = ?`)
+		if err != nil {
+			return wrapErr(err, "ftsAdd prep")
+		}
+		b.ftsDelKey, err = b.db.Prepare(`
+			DELETE FROM msgs_fts
+			WHERE rowid IN (
+				SELECT id
+				FROM msgs_fts_keys
+				WHERE extBodyKey = ?
+			)`)
+		if err != nil {
+			return wrapErr(err, "ftsDelKey prep")
+		}
+		b.ftsDelKeyRow, err = b.db.Prepare(`
+			DELETE FROM msgs_fts_keys
+			WHERE extBodyKey = ?`)
+		if err != nil {
+			return wrapErr(err, "ftsDelKeyRow prep")
+		}
+		b.ftsClear, err = b.db.Prepare(`
+			DELETE FROM msgs_fts`)
+		if err != nil {
+			return wrapErr(err, "ftsClear prep")
+		}
+		b.ftsClearKeys, err = b.db.Prepare(`
+			DELETE FROM msgs_fts_keys`)
+		if err != nil {
+			return wrapErr(err, "ftsClearKeys prep")
+		}
+
+		b.ftsSearchHeader, err = b.db.Prepare(b.ftsSearchQuery("header"))
+		if err != nil {
+			return wrapErr(err, "ftsSearchHeader prep")
+		}
+		b.ftsSearchBody, err = b.db.Prepare(b.ftsSearchQuery("body"))
+		if err != nil {
+			return wrapErr(err, "ftsSearchBody prep")
+		}
+		b.ftsSearchText, err = b.db.Prepare(`
+			SELECT msgs.msgId
+			FROM msgs
+			INNER JOIN msgs_fts_keys
+			ON msgs_fts_keys.extBodyKey = msgs.extBodyKey
+			WHERE msgs.mboxId = ?
+			AND msgs_fts_keys.id IN (
+				SELECT rowid
+				FROM msgs_fts
+				WHERE header MATCH ?
+				UNION
+				SELECT rowid
+				FROM msgs_fts
+				WHERE body MATCH ?
+			)`)
+		if err != nil {
+			return wrapErr(err, "ftsSearchText prep")
+		}
+		return nil
+	}
+
+	b.ftsAdd, err = b.db.Prepare(`
+		INSERT INTO msgs_fts(header, body, extBodyKey)
+		VALUES (?, ?, ?)
+		ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return wrapErr(err, "ftsAdd prep")
+	}
+	b.ftsDelKey, err = b.db.Prepare(`
+		DELETE FROM msgs_fts
+		WHERE extBodyKey = ?`)
+	if err != nil {
+		return wrapErr(err, "ftsDelKey prep")
+	}
+	b.ftsClear, err = b.db.Prepare(`
+		DELETE FROM msgs_fts`)
+	if err != nil {
+		return wrapErr(err, "ftsClear prep")
+	}
+
+	b.ftsSearchHeader, err = b.db.Prepare(b.ftsSearchQuery("header"))
+	if err != nil {
+		return wrapErr(err, "ftsSearchHeader prep")
+	}
+	b.ftsSearchBody, err = b.db.Prepare(b.ftsSearchQuery("body"))
+	if err != nil {
+		return wrapErr(err, "ftsSearchBody prep")
+	}
+	b.ftsSearchText, err = b.db.Prepare(`
+		SELECT msgs.msgId
+		FROM msgs
+		INNER JOIN msgs_fts
+		ON msgs_fts.extBodyKey = msgs.extBodyKey
+		WHERE msgs.mboxId = ?
+		AND (` + pgMatch("header") + `
+		OR ` + pgMatch("body") + `)`)
+	if err != nil {
+		return wrapErr(err, "ftsSearchText prep")
+	}
+
+	return nil
+}
+
+// ftsSearchQuery returns the query selecting UIDs of messages in the mailbox
+// with the column of the full-text index matching the search string.
+func (b *Backend) ftsSearchQuery(column string) string {
+	if b.db.driver == "sqlite3" {
+		return `
+			SELECT msgs.msgId
+			FROM msgs
+			INNER JOIN msgs_fts_keys
+			ON msgs_fts_keys.extBodyKey = msgs.extBodyKey
+			WHERE msgs.mboxId = ?
+			AND msgs_fts_keys.id IN (
+				SELECT rowid
+				FROM msgs_fts
+				WHERE ` + column + ` MATCH ?
+			)`
+	}
+
+	return `
+		SELECT msgs.msgId
+		FROM msgs
+		INNER JOIN msgs_fts
+		ON msgs_fts.extBodyKey = msgs.extBodyKey
+		WHERE msgs.mboxId = ?
+		AND ` + pgMatch(column)
+}
+
+// pgMatch returns the condition matching the column of the PostgreSQL
+// full-text index against the search string. tsvector matches only whole
+// words so it is used only to narrow down candidates using words that
+// are complete in the search string (see ftsPrefilter), they are checked for
+// the substring then.
+//
+// Parameters are the prefilter string (twice) and the search string.
+func pgMatch(column string) string {
+	return `(? = '' OR to_tsvector('simple', msgs_fts.` + column + `) @@ plainto_tsquery('simple', ?))
+		AND strpos(lower(msgs_fts.` + column + `), lower(?)) > 0`
+}
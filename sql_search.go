@@ -3,7 +3,12 @@ package imapsql
 import (
 	"database/sql"
 	"fmt"
+	nettextproto "net/textproto"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
 )
 
 func buildSearchStmt(withFlags, withoutFlags []string) string {
@@ -76,3 +81,213 @@ func (m *Mailbox) buildFlagSearchQueryArgs(withFlags, withoutFlags []string) []i
 	}
 	return queryArgs
 }
+
+// maxSearchUidRanges is the maximum amount of ranges in UID set that
+// is translated into SQL by compileSearch. Larger sets are matched in Go.
+const maxSearchUidRanges = 64
+
+// compileSearch translates search criteria into SQL condition for msgs
+// table.
+//
+// Parts of the criteria that can't be expressed in SQL (e.g. the ones
+// requiring message body) are returned as residual criteria that
+// should be checked using backendutil.Match for rows matching the
+// condition. residual is nil if condition is sufficient.
+//
+// Criteria should be resolved using MailboxHandle.ResolveCriteria first.
+func compileSearch(criteria *imap.SearchCriteria, headerIndex bool) (cond string, args []interface{}, residual *imap.SearchCriteria) {
+	var conds []string
+	res := &imap.SearchCriteria{
+		Body:       criteria.Body,
+		Text:       criteria.Text,
+		SentSince:  criteria.SentSince,
+		SentBefore: criteria.SentBefore,
+		SeqNum:     criteria.SeqNum,
+	}
+	exact := !searchNeedsBody(res) && res.SeqNum == nil
+
+	for key, values := range criteria.Header {
+		// Only cached header fields are present in msgs_headers.
+		if _, ok := cachedHeaderFields[nettextproto.CanonicalMIMEHeaderKey(key)]; !ok || !headerIndex {
+			if res.Header == nil {
+				res.Header = make(nettextproto.MIMEHeader)
+			}
+			res.Header[key] = values
+			exact = false
+			continue
+		}
+		for _, value := range values {
+			if value == "" {
+				conds = append(conds, `EXISTS (`+searchHeaderSubquery+`)`)
+				args = append(args, nettextproto.CanonicalMIMEHeaderKey(key))
+				continue
+			}
+			conds = append(conds, `EXISTS (`+searchHeaderSubquery+` AND msgs_headers.value LIKE ? ESCAPE '!')`)
+			args = append(args, nettextproto.CanonicalMIMEHeaderKey(key), "%"+escapeLike(strings.ToLower(value))+"%")
+		}
+	}
+
+	if !criteria.Since.IsZero() {
+		conds = append(conds, `msgs.date >= ?`)
+		args = append(args, searchSinceBound(criteria.Since))
+	}
+	if !criteria.Before.IsZero() {
+		conds = append(conds, `msgs.date < ?`)
+		args = append(args, searchBeforeBound(criteria.Before))
+	}
+	if criteria.Larger != 0 {
+		conds = append(conds, `msgs.bodyLen > ?`)
+		args = append(args, criteria.Larger)
+	}
+	if criteria.Smaller != 0 {
+		conds = append(conds, `msgs.bodyLen < ?`)
+		args = append(args, criteria.Smaller)
+	}
+
+	for _, flag := range criteria.WithFlags {
+		// \Recent is per-connection and is not stored in DB.
+		if flag == imap.RecentFlag {
+			res.WithFlags = append(res.WithFlags, flag)
+			exact = false
+			continue
+		}
+		conds = append(conds, `EXISTS (`+searchFlagSubquery+`)`)
+		args = append(args, flag)
+	}
+	for _, flag := range criteria.WithoutFlags {
+		if flag == imap.RecentFlag {
+			res.WithoutFlags = append(res.WithoutFlags, flag)
+			exact = false
+			continue
+		}
+		conds = append(conds, `NOT EXISTS (`+searchFlagSubquery+`)`)
+		args = append(args, flag)
+	}
+
+	if criteria.Uid != nil {
+		if uidCond, ok := compileUidSet(criteria.Uid); ok {
+			conds = append(conds, uidCond)
+		} else {
+			res.Uid = criteria.Uid
+			exact = false
+		}
+	}
+
+	for _, not := range criteria.Not {
+		notCond, notArgs, notRes := compileSearch(not, headerIndex)
+		if notRes != nil {
+			res.Not = append(res.Not, not)
+			exact = false
+			continue
+		}
+		conds = append(conds, `NOT (`+notCond+`)`)
+		args = append(args, notArgs...)
+	}
+	for _, or := range criteria.Or {
+		cond1, args1, res1 := compileSearch(or[0], headerIndex)
+		cond2, args2, res2 := compileSearch(or[1], headerIndex)
+		// Conditions for non-exact branches are still necessary for them
+		// to match so they can be used to narrow the set of rows to check.
+		conds = append(conds, `((`+cond1+`) OR (`+cond2+`))`)
+		args = append(args, args1...)
+		args = append(args, args2...)
+		if res1 != nil || res2 != nil {
+			res.Or = append(res.Or, or)
+			exact = false
+		}
+	}
+
+	if len(conds) == 0 {
+		cond = `1 = 1`
+	} else {
+		cond = strings.Join(conds, ` AND `)
+	}
+	if exact {
+		return cond, args, nil
+	}
+	return cond, args, res
+}
+
+const searchFlagSubquery = `
+	SELECT 1
+	FROM flags
+	WHERE flags.mboxId = msgs.mboxId
+	AND flags.msgId = msgs.msgId
+	AND flags.flag = ?`
+
+const searchHeaderSubquery = `
+	SELECT 1
+	FROM msgs_headers
+	WHERE msgs_headers.mboxId = msgs.mboxId
+	AND msgs_headers.msgId = msgs.msgId
+	AND msgs_headers.field = ?`
+
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// escapeLike escapes special characters in the string to be used in LIKE
+// pattern with '!' as the escape character.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// compileUidSet translates set of UIDs into SQL condition. It returns false
+// if the set contains '*' or is too big.
+func compileUidSet(set *imap.SeqSet) (string, bool) {
+	if len(set.Set) == 0 {
+		return `1 = 0`, true
+	}
+	if len(set.Set) > maxSearchUidRanges {
+		return "", false
+	}
+
+	conds := make([]string, 0, len(set.Set))
+	for _, seq := range set.Set {
+		if seq.Start == 0 || seq.Stop == 0 {
+			return "", false
+		}
+		start, stop := seq.Start, seq.Stop
+		if start > stop {
+			start, stop = stop, start
+		}
+		if start == stop {
+			conds = append(conds, `msgs.msgId = `+strconv.FormatUint(uint64(start), 10))
+		} else {
+			conds = append(conds, `msgs.msgId BETWEEN `+strconv.FormatUint(uint64(start), 10)+
+				` AND `+strconv.FormatUint(uint64(stop), 10))
+		}
+	}
+	return `(` + strings.Join(conds, ` OR `) + `)`, true
+}
+
+// searchSinceBound returns the minimal timestamp of the message matching the
+// SINCE criteria.
+//
+// backendutil.Match compares the date of message in the local timezone
+// truncated to UTC midnight and requires it to be strictly after the
+// criteria value. The bound is computed so the results are the same.
+func searchSinceBound(since time.Time) int64 {
+	since = since.UTC()
+	return time.Date(since.Year(), since.Month(), since.Day()+1, 0, 0, 0, 0, time.Local).Unix()
+}
+
+// searchBeforeBound returns the timestamp all messages matching the BEFORE
+// criteria are older than.
+func searchBeforeBound(before time.Time) int64 {
+	before = before.UTC()
+	day := before.Day()
+	if !time.Date(before.Year(), before.Month(), day, 0, 0, 0, 0, time.UTC).Equal(before) {
+		day++
+	}
+	return time.Date(before.Year(), before.Month(), day, 0, 0, 0, 0, time.Local).Unix()
+}
+
+func (b *Backend) buildSearchFetchStmt(cond string) string {
+	return `
+		SELECT msgs.msgId, date, bodyLen, extBodyKey, compressAlgo, ` + b.db.aggrValuesSet("flag", "{") + `
+		FROM msgs
+		LEFT JOIN flags
+		ON flags.msgId = msgs.msgId AND msgs.mboxId = flags.mboxId
+		WHERE msgs.mboxId = ? AND ` + cond + `
+		GROUP BY msgs.mboxId, msgs.msgId
+		ORDER BY msgs.msgId`
+}
@@ -0,0 +1,283 @@
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"time"
+)
+
+// sqlBlobDefaultChunkSize is the chunk size used if SQLBlobStore.ChunkSize
+// is not set.
+const sqlBlobDefaultChunkSize = 1024 * 1024
+
+// SQLBlobStore struct represents the table in the go-imap-sql database used
+// to store message bodies.
+//
+// It should be passed to New and can't be shared between multiple Backend
+// instances. Since message bodies are stored together with the rest of the
+// data, database backups include them too.
+//
+// Always use field names on initialization because new fields may be added
+// without a major version change.
+type SQLBlobStore struct {
+	// Bodies are split into chunks of ChunkSize bytes stored as separate
+	// rows. If zero, 1 MiB is used.
+	ChunkSize int
+
+	addChunk *sql.Stmt
+	getChunk *sql.Stmt
+	delBlob  *sql.Stmt
+	listBlob *sql.Stmt
+}
+
+// init creates the table and prepares statements. It is called by New
+// after the database is opened.
+func (s *SQLBlobStore) init(d db) error {
+	_, err := d.Exec(`
+		CREATE TABLE IF NOT EXISTS extBlobs (
+			id VARCHAR(255) NOT NULL,
+			chunk INTEGER NOT NULL,
+			data LONGBLOB NOT NULL,
+
+			PRIMARY KEY(id, chunk)
+		)`)
+	if err != nil {
+		return wrapErr(err, "create table extBlobs")
+	}
+
+	s.addChunk, err = d.Prepare(`
+		INSERT INTO extBlobs(id, chunk, data)
+		VALUES (?, ?, ?)`)
+	if err != nil {
+		return wrapErr(err, "addChunk prep")
+	}
+	s.getChunk, err = d.Prepare(`
+		SELECT data
+		FROM extBlobs
+		WHERE id = ? AND chunk = ?`)
+	if err != nil {
+		return wrapErr(err, "getChunk prep")
+	}
+	s.delBlob, err = d.Prepare(`
+		DELETE FROM extBlobs
+		WHERE id = ?`)
+	if err != nil {
+		return wrapErr(err, "delBlob prep")
+	}
+	s.listBlob, err = d.Prepare(`
+		SELECT DISTINCT id
+		FROM extBlobs`)
+	if err != nil {
+		return wrapErr(err, "listBlob prep")
+	}
+	return nil
+}
+
+func (s *SQLBlobStore) chunkSize() int {
+	if s.ChunkSize > 0 {
+		return s.ChunkSize
+	}
+	return sqlBlobDefaultChunkSize
+}
+
+// stmt returns the statement bound to the transaction if it is not nil.
+func (s *SQLBlobStore) stmt(tx *sql.Tx, stmt *sql.Stmt) *sql.Stmt {
+	if tx == nil {
+		return stmt
+	}
+	return tx.Stmt(stmt)
+}
+
+func (s *SQLBlobStore) Open(key string) (ExtStoreObj, error) {
+	return s.openTx(nil, key)
+}
+
+func (s *SQLBlobStore) openTx(tx *sql.Tx, key string) (ExtStoreObj, error) {
+	r := &sqlBlobReader{store: s, tx: tx, key: key}
+	// Load the first chunk to report non-existent keys early.
+	if err := r.nextChunk(); err != nil {
+		return nil, ExternalError{
+			Key:         key,
+			Err:         err,
+			NonExistent: err == sql.ErrNoRows,
+		}
+	}
+	return r, nil
+}
+
+func (s *SQLBlobStore) Create(key string, blobSize int64) (ExtStoreObj, error) {
+	return s.createTx(nil, key, blobSize)
+}
+
+func (s *SQLBlobStore) createTx(tx *sql.Tx, key string, blobSize int64) (ExtStoreObj, error) {
+	w := &sqlBlobWriter{store: s, tx: tx, key: key}
+	bufSize := int64(s.chunkSize())
+	if blobSize > 0 && blobSize < bufSize {
+		bufSize = blobSize
+	}
+	w.buf = make([]byte, 0, bufSize)
+	return w, nil
+}
+
+func (s *SQLBlobStore) Delete(keys []string) error {
+	return s.deleteTx(nil, keys)
+}
+
+func (s *SQLBlobStore) deleteTx(tx *sql.Tx, keys []string) error {
+	for _, key := range keys {
+		if _, err := s.stmt(tx, s.delBlob).Exec(key); err != nil {
+			return ExternalError{
+				Key: key,
+				Err: err,
+			}
+		}
+	}
+	return nil
+}
+
+// listObjects calls fn for each stored blob. Modification time is not
+// tracked, zero time is passed instead.
+func (s *SQLBlobStore) listObjects(fn func(key string, modTime time.Time) error) error {
+	keys, err := scanKeys(s.listBlob.Query())
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := fn(key, time.Time{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlBlobReader reads the blob chunk by chunk so no database connection is
+// kept busy between Read calls.
+type sqlBlobReader struct {
+	store *SQLBlobStore
+	tx    *sql.Tx
+	key   string
+
+	chunk  int
+	buf    []byte
+	closed bool
+}
+
+func (r *sqlBlobReader) nextChunk() error {
+	r.buf = r.buf[:0]
+	err := r.store.stmt(r.tx, r.store.getChunk).QueryRow(r.key, r.chunk).Scan(&r.buf)
+	if err != nil {
+		return err
+	}
+	r.chunk++
+	return nil
+}
+
+func (r *sqlBlobReader) Read(b []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("sqlblobstore: read from closed object")
+	}
+	for len(r.buf) == 0 {
+		if err := r.nextChunk(); err != nil {
+			if err == sql.ErrNoRows {
+				return 0, io.EOF
+			}
+			return 0, ExternalError{Key: r.key, Err: err}
+		}
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *sqlBlobReader) Write([]byte) (int, error) {
+	return 0, errors.New("sqlblobstore: object is opened for reading")
+}
+
+func (r *sqlBlobReader) Sync() error {
+	return nil
+}
+
+func (r *sqlBlobReader) Close() error {
+	r.closed = true
+	r.buf = nil
+	return nil
+}
+
+// sqlBlobWriter buffers one chunk in memory and inserts it once it is
+// filled. The last chunk is inserted by Sync.
+type sqlBlobWriter struct {
+	store *SQLBlobStore
+	tx    *sql.Tx
+	key   string
+
+	chunk int
+	buf   []byte
+	done  bool
+	err   error
+}
+
+func (w *sqlBlobWriter) flush() error {
+	if _, err := w.store.stmt(w.tx, w.store.addChunk).Exec(w.key, w.chunk, w.buf); err != nil {
+		w.err = ExternalError{Key: w.key, Err: err}
+		return w.err
+	}
+	w.chunk++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *sqlBlobWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.done {
+		return 0, errors.New("sqlblobstore: write after sync")
+	}
+
+	written := 0
+	chunkSize := w.store.chunkSize()
+	for len(b) != 0 {
+		n := chunkSize - len(w.buf)
+		if n > len(b) {
+			n = len(b)
+		}
+		w.buf = append(w.buf, b[:n]...)
+		b = b[n:]
+		written += n
+
+		if len(w.buf) == chunkSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *sqlBlobWriter) Read([]byte) (int, error) {
+	return 0, errors.New("sqlblobstore: object is opened for writing")
+}
+
+// Sync inserts the last chunk. Empty blobs are stored as a single empty
+// chunk so they can be distinguished from non-existent ones.
+func (w *sqlBlobWriter) Sync() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.done {
+		return nil
+	}
+	if len(w.buf) != 0 || w.chunk == 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	w.done = true
+	return nil
+}
+
+func (w *sqlBlobWriter) Close() error {
+	w.buf = nil
+	return nil
+}
@@ -0,0 +1,162 @@
+package imapsql
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	backendtests "github.com/foxcpp/go-imap-backend-tests"
+	"gotest.tools/assert"
+)
+
+// initTestBackendSQLStore creates the Backend using SQLBlobStore. Returned
+// directory should be removed after the Backend is cleaned.
+//
+// In-memory SQLite3 database can't be used since it is limited to a single
+// connection and bodies are read outside of transactions.
+func initTestBackendSQLStore(opts Opts, chunkSize int) (*Backend, string) {
+	driver := TestDB
+	dsn := TestDSN
+
+	tempDir, err := ioutil.TempDir("", "go-imap-sql-tests-")
+	if err != nil {
+		panic(err)
+	}
+	if TestDB == "" {
+		driver = "sqlite3"
+		dsn = filepath.Join(tempDir, "test.db")
+	}
+
+	if testing.Verbose() {
+		opts.Log = globalLogger{}
+	} else {
+		opts.Log = DummyLogger{}
+	}
+	opts.PRNG = rand.New(rand.NewSource(0))
+	b, err := New(driver, dsn, &SQLBlobStore{ChunkSize: chunkSize}, opts)
+	if err != nil {
+		panic(err)
+	}
+	return b, tempDir
+}
+
+// runTestsSQLStore runs backend tests using SQLBlobStore.
+func runTestsSQLStore(t *testing.T, opts Opts, chunkSize int) {
+	var tempDirs []string
+	defer func() {
+		for _, dir := range tempDirs {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	backendtests.RunTests(t, func() backendtests.Backend {
+		b, tempDir := initTestBackendSQLStore(opts, chunkSize)
+		tempDirs = append(tempDirs, tempDir)
+		return b
+	}, cleanBackend)
+}
+
+func blobChunks(t *testing.T, b *Backend, key string) int {
+	t.Helper()
+	var count int
+	assert.NilError(t, b.DB.QueryRow(b.db.rewriteSQL(`SELECT COUNT(*) FROM extBlobs WHERE id = ?`), key).Scan(&count))
+	return count
+}
+
+func TestSQLBlobStore(t *testing.T) {
+	b, tempDir := initTestBackendSQLStore(Opts{}, 16)
+	defer os.RemoveAll(tempDir)
+	defer cleanBackend(b)
+	store := b.extStore.(*SQLBlobStore)
+
+	write := func(t *testing.T, key string, data []byte, sizeHint int64) {
+		t.Helper()
+		w, err := store.Create(key, sizeHint)
+		assert.NilError(t, err)
+		_, err = w.Write(data)
+		assert.NilError(t, err)
+		assert.NilError(t, w.Sync())
+		assert.NilError(t, w.Close())
+	}
+	read := func(t *testing.T, key string) []byte {
+		t.Helper()
+		r, err := store.Open(key)
+		assert.NilError(t, err)
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		assert.NilError(t, err)
+		return data
+	}
+
+	t.Run("single chunk", func(t *testing.T) {
+		write(t, "small", []byte("Hello!"), 6)
+		assert.DeepEqual(t, read(t, "small"), []byte("Hello!"))
+		assert.Equal(t, blobChunks(t, b, "small"), 1)
+	})
+	t.Run("multiple chunks", func(t *testing.T) {
+		data := bytes.Repeat([]byte("0123456789"), 10)
+		// Size hint is not required to be exact.
+		write(t, "large", data, -1)
+		assert.DeepEqual(t, read(t, "large"), data)
+		assert.Equal(t, blobChunks(t, b, "large"), 7)
+
+		write(t, "aligned", data[:32], 0)
+		assert.DeepEqual(t, read(t, "aligned"), data[:32])
+		assert.Equal(t, blobChunks(t, b, "aligned"), 2)
+	})
+	t.Run("empty object", func(t *testing.T) {
+		write(t, "empty", nil, 0)
+		assert.Equal(t, len(read(t, "empty")), 0)
+	})
+	t.Run("close without sync", func(t *testing.T) {
+		w, err := store.Create("discarded", 6)
+		assert.NilError(t, err)
+		_, err = w.Write([]byte("Hello!"))
+		assert.NilError(t, err)
+		assert.NilError(t, w.Close())
+		assert.Equal(t, blobChunks(t, b, "discarded"), 0)
+	})
+	t.Run("non-existent key", func(t *testing.T) {
+		_, err := store.Open("missing")
+		assert.Assert(t, err != nil)
+		extErr, ok := err.(ExternalError)
+		assert.Assert(t, ok, "%T", err)
+		assert.Assert(t, extErr.NonExistent)
+	})
+	t.Run("delete", func(t *testing.T) {
+		assert.NilError(t, store.Delete([]string{"small", "large", "missing"}))
+		assert.Equal(t, blobChunks(t, b, "small"), 0)
+		assert.Equal(t, blobChunks(t, b, "large"), 0)
+		assert.Equal(t, blobChunks(t, b, "aligned"), 2)
+	})
+}
+
+func TestSQLBlobStoreRollback(t *testing.T) {
+	b, tempDir := initTestBackendSQLStore(Opts{}, 0)
+	defer os.RemoveAll(tempDir)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt(t.Name(), textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Abort())
+
+	var count int
+	assert.NilError(t, b.DB.QueryRow(`SELECT COUNT(*) FROM extBlobs`).Scan(&count))
+	assert.Equal(t, count, 0)
+}
+
+func TestWithSQLBlobStore(t *testing.T) {
+	// Small chunks make sure most messages are split.
+	runTestsSQLStore(t, Opts{}, 64)
+}
+
+func TestWithSQLBlobStoreLZ4(t *testing.T) {
+	runTestsSQLStore(t, Opts{CompressAlgo: "lz4"}, 64)
+}
@@ -0,0 +1,86 @@
+PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+CREATE TABLE schema_version ( version INTEGER NOT NULL );
+INSERT INTO schema_version VALUES(6);
+CREATE TABLE users (
+			id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			username VARCHAR(255) NOT NULL UNIQUE,
+			msgsizelimit INTEGER DEFAULT NULL,
+
+            -- It does not reference mboxes, since otherwise there will
+            -- be recursive foreign key constraint.
+            inboxId BIGINT DEFAULT 0
+		);
+INSERT INTO users VALUES(1,'alice@example.org',NULL,1);
+INSERT INTO users VALUES(2,'bob',NULL,2);
+CREATE TABLE mboxes (
+			id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+			uid INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name VARCHAR(255) NOT NULL,
+			sub INTEGER NOT NULL DEFAULT 1,
+			mark INTEGER NOT NULL DEFAULT 0,
+			msgsizelimit INTEGER DEFAULT NULL,
+			uidnext INTEGER NOT NULL DEFAULT 1,
+			uidvalidity BIGINT NOT NULL,
+            specialuse VARCHAR(255) DEFAULT NULL,
+
+            msgsCount INTEGER NOT NULL DEFAULT 0,
+
+			UNIQUE(uid, name)
+		);
+INSERT INTO mboxes VALUES(1,1,'INBOX',1,0,NULL,2,2218245350,NULL,1);
+INSERT INTO mboxes VALUES(2,2,'INBOX',1,0,NULL,2,2218245350,NULL,1);
+INSERT INTO mboxes VALUES(3,1,'Archive',1,0,NULL,2,2218245350,NULL,1);
+INSERT INTO mboxes VALUES(4,2,'Shared',1,0,NULL,1,2218245350,NULL,0);
+INSERT INTO mboxes VALUES(5,2,'Shared.Team',1,0,NULL,1,2657790691,NULL,0);
+CREATE TABLE extKeys (
+			id VARCHAR(255) PRIMARY KEY NOT NULL,
+
+			-- REFERENCES constraint is commented out otherwise
+			-- it will be impossible to delete user without
+			-- doing multiple queries to delete mboxes and stuff
+			-- or using deferred constraint checking (not supported by MySQL/MariaDB)
+			uid BIGINT NOT NULL, -- REFERENCES users(id) ON DELETE RESTRICT
+			refs INTEGER NOT NULL DEFAULT 1
+		);
+INSERT INTO extKeys VALUES('5efbdf3cd6c8f8e0db5529b24a196127',1,1);
+INSERT INTO extKeys VALUES('c9e67da638c6a333a0325b44469c8cce',1,1);
+INSERT INTO extKeys VALUES('d220c09fcd20ba4a9eb5be22edeecc25',2,1);
+CREATE TABLE msgs (
+			mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
+			msgId BIGINT NOT NULL,
+			date BIGINT NOT NULL,
+			bodyLen INTEGER NOT NULL,
+			mark INTEGER NOT NULL DEFAULT 0,
+
+			bodyStructure LONGTEXT NOT NULL,
+			cachedHeader LONGTEXT NOT NULL,
+			extBodyKey VARCHAR(255) DEFAULT NULL REFERENCES extKeys(id) ON DELETE RESTRICT,
+
+            seen INTEGER NOT NULL DEFAULT 0,
+
+			compressAlgo VARCHAR(255),
+
+			recent INTEGER NOT NULL DEFAULT 1,
+
+			PRIMARY KEY(mboxId, msgId)
+		);
+INSERT INTO msgs VALUES(1,1,1591005600,187,0,X'7b224d494d4554797065223a2274657874222c224d494d4553756254797065223a22706c61696e222c22506172616d73223a6e756c6c2c224964223a22222c224465736372697074696f6e223a22222c22456e636f64696e67223a22222c2253697a65223a33382c225061727473223a6e756c6c2c22456e76656c6f7065223a6e756c6c2c22426f6479537472756374757265223a6e756c6c2c224c696e6573223a312c22457874656e646564223a747275652c22446973706f736974696f6e223a22222c22446973706f736974696f6e506172616d73223a6e756c6c2c224c616e6775616765223a6e756c6c2c224c6f636174696f6e223a6e756c6c2c224d4435223a22227d',X'7b224d6573736167652d4964223a5b225c753030336331406578616d706c652e6f72675c7530303365225d2c2246726f6d223a5b22426f62205c7530303363626f62406578616d706c652e6f72675c7530303365225d2c22546f223a5b22616c696365406578616d706c652e6f7267225d2c225375626a656374223a5b22517561727465726c79206e756d62657273225d2c2244617465223a5b224d6f6e2c2031204a756e20323032302031303a30303a3030202b30303030225d7d','5efbdf3cd6c8f8e0db5529b24a196127',1,'',1);
+INSERT INTO msgs VALUES(3,1,1591009200,194,0,X'7b224d494d4554797065223a2274657874222c224d494d4553756254797065223a22706c61696e222c22506172616d73223a6e756c6c2c224964223a22222c224465736372697074696f6e223a22222c22456e636f64696e67223a22222c2253697a65223a392c225061727473223a6e756c6c2c22456e76656c6f7065223a6e756c6c2c22426f6479537472756374757265223a6e756c6c2c224c696e6573223a312c22457874656e646564223a747275652c22446973706f736974696f6e223a22222c22446973706f736974696f6e506172616d73223a6e756c6c2c224c616e6775616765223a6e756c6c2c224c6f636174696f6e223a6e756c6c2c224d4435223a22227d',X'7b22546f223a5b22626f62406578616d706c652e6f7267225d2c224d6573736167652d4964223a5b225c753030336332406578616d706c652e6f72675c7530303365225d2c22496e2d5265706c792d546f223a5b225c753030336331406578616d706c652e6f72675c7530303365225d2c2244617465223a5b224d6f6e2c2031204a756e20323032302031313a30303a3030202b30303030225d2c2246726f6d223a5b22416c696365205c7530303363616c696365406578616d706c652e6f72675c7530303365225d2c225375626a656374223a5b2252653a20517561727465726c79206e756d62657273225d7d','c9e67da638c6a333a0325b44469c8cce',0,'',1);
+INSERT INTO msgs VALUES(2,1,1591005600,187,0,X'7b224d494d4554797065223a2274657874222c224d494d4553756254797065223a22706c61696e222c22506172616d73223a6e756c6c2c224964223a22222c224465736372697074696f6e223a22222c22456e636f64696e67223a22222c2253697a65223a33382c225061727473223a6e756c6c2c22456e76656c6f7065223a6e756c6c2c22426f6479537472756374757265223a6e756c6c2c224c696e6573223a312c22457874656e646564223a747275652c22446973706f736974696f6e223a22222c22446973706f736974696f6e506172616d73223a6e756c6c2c224c616e6775616765223a6e756c6c2c224c6f636174696f6e223a6e756c6c2c224d4435223a22227d',X'7b225375626a656374223a5b22517561727465726c79206e756d62657273225d2c224d6573736167652d4964223a5b225c753030336331406578616d706c652e6f72675c7530303365225d2c2244617465223a5b224d6f6e2c2031204a756e20323032302031303a30303a3030202b30303030225d2c2246726f6d223a5b22426f62205c7530303363626f62406578616d706c652e6f72675c7530303365225d2c22546f223a5b22616c696365406578616d706c652e6f7267225d7d','d220c09fcd20ba4a9eb5be22edeecc25',0,'',1);
+CREATE TABLE flags (
+			mboxId BIGINT NOT NULL,
+			msgId BIGINT NOT NULL,
+			flag VARCHAR(255) NOT NULL,
+
+			FOREIGN KEY (mboxId, msgId) REFERENCES msgs(mboxId, msgId) ON DELETE CASCADE,
+			UNIQUE (mboxId, msgId, flag)
+		);
+INSERT INTO flags VALUES(1,1,'\Seen');
+INSERT INTO sqlite_sequence VALUES('users',2);
+INSERT INTO sqlite_sequence VALUES('mboxes',5);
+CREATE UNIQUE INDEX extKeys_uid_id
+        ON extKeys(uid, id);
+CREATE INDEX seen_msgs
+        ON msgs(mboxId, seen);
+COMMIT;
@@ -0,0 +1,99 @@
+package imapsql
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	"gotest.tools/assert"
+)
+
+func threadTestMsg(msgId, subject, refs, inReplyTo string) string {
+	hdr := "From: <foxcpp@foxcpp.dev>\r\n" +
+		"Subject: " + subject + "\r\n"
+	if msgId != "" {
+		hdr += "Message-ID: " + msgId + "\r\n"
+	}
+	if refs != "" {
+		hdr += "References: " + refs + "\r\n"
+	}
+	if inReplyTo != "" {
+		hdr += "In-Reply-To: " + inReplyTo + "\r\n"
+	}
+	return hdr + "\r\n" + "Hello!\r\n"
+}
+
+func TestThreadReferences(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+
+	msgs := []string{
+		threadTestMsg("<1@example.org>", "Hello", "", ""),
+		threadTestMsg("<2@example.org>", "Re: Hello", "", "<1@example.org>"),
+		threadTestMsg("<3@example.org>", "Re: Hello", "<1@example.org> <2@example.org>", ""),
+		// Parent is not in the mailbox.
+		threadTestMsg("<4@example.org>", "Re: Lost", "<missing@example.org>", ""),
+		threadTestMsg("<5@example.org>", "Re: Lost", "<missing@example.org>", ""),
+		// Merged by subject.
+		threadTestMsg("<6@example.org>", "Hello", "", ""),
+		threadTestMsg("<7@example.org>", "Re: Other", "", ""),
+		threadTestMsg("<8@example.org>", "Other", "", ""),
+		// Duplicate Message-Id.
+		threadTestMsg("<1@example.org>", "Duplicate", "", ""),
+		// Reference loop.
+		threadTestMsg("<10@example.org>", "Loop", "<11@example.org> <10@example.org>", ""),
+		threadTestMsg("<11@example.org>", "Another loop", "<10@example.org>", ""),
+	}
+	base := time.Date(2020, time.March, 10, 0, 0, 0, 0, time.UTC)
+	for i, msg := range msgs {
+		date := base.Add(time.Duration(i) * time.Hour)
+		msg = "Date: " + date.Format(time.RFC1123Z) + "\r\n" + msg
+		assert.NilError(t, usr.CreateMessage(t.Name(), []string{}, date, strings.NewReader(msg), nil))
+	}
+
+	_, mboxI, err := usr.GetMailbox(t.Name(), true, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	expected := "(1 (2 3)(6))(4 5)(8 7)(9)(10 11)"
+	for _, uid := range []bool{true, false} {
+		threads, err := mbox.Thread(uid, sortthread.References, &imap.SearchCriteria{})
+		assert.NilError(t, err)
+		assert.Equal(t, formatTestThreads(threads), expected)
+	}
+}
+
+func formatTestThreads(threads []*sortthread.Thread) string {
+	var res strings.Builder
+	var format func(thread *sortthread.Thread)
+	format = func(thread *sortthread.Thread) {
+		res.WriteString(strconv.FormatUint(uint64(thread.Id), 10))
+		if len(thread.Children) == 1 {
+			res.WriteString(" ")
+			format(thread.Children[0])
+			return
+		}
+		for i, child := range thread.Children {
+			if i == 0 {
+				res.WriteString(" ")
+			}
+			res.WriteString("(")
+			format(child)
+			res.WriteString(")")
+		}
+	}
+	for _, thread := range threads {
+		res.WriteString("(")
+		format(thread)
+		res.WriteString(")")
+	}
+	return res.String()
+}
@@ -0,0 +1,321 @@
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+)
+
+// threadContainer is a node of the thread tree built by the REFERENCES
+// threading algorithm (RFC 5256, Section 3).
+type threadContainer struct {
+	// UID of the message, zero for dummy containers created for messages
+	// that are referenced but not present in the mailbox.
+	id          uint32
+	sentDate    int64
+	baseSubject string
+	isReply     bool
+
+	parent   *threadContainer
+	children []*threadContainer
+}
+
+// hasDescendant reports whether c is the same container as other or one of
+// its ancestors.
+func (c *threadContainer) hasDescendant(other *threadContainer) bool {
+	for ; other != nil; other = other.parent {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *threadContainer) addChild(child *threadContainer) {
+	child.parent = c
+	c.children = append(c.children, child)
+}
+
+func (c *threadContainer) unlink() {
+	if c.parent == nil {
+		return
+	}
+	siblings := c.parent.children
+	for i, sibling := range siblings {
+		if sibling == c {
+			c.parent.children = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	c.parent = nil
+}
+
+// sortKey returns the sent date and UID used to order the container among
+// its siblings. Dummy containers use the values of their first child so
+// children should be sorted first.
+func (c *threadContainer) sortKey() (int64, uint32) {
+	for c.id == 0 && len(c.children) != 0 {
+		c = c.children[0]
+	}
+	return c.sentDate, c.id
+}
+
+// subject returns the base subject for the container. Dummy containers use
+// the subject of their first child.
+func (c *threadContainer) subject() string {
+	if c.id == 0 && len(c.children) != 0 {
+		return c.children[0].baseSubject
+	}
+	return c.baseSubject
+}
+
+// parseMsgIds returns message identifiers from the value of Message-Id,
+// References or In-Reply-To header field.
+//
+// Angle brackets are stripped and anything outside of them is ignored.
+func parseMsgIds(value string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(value, '<')
+		if start == -1 {
+			return ids
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end == -1 {
+			return ids
+		}
+		id := strings.Join(strings.Fields(value[start+1:start+end]), "")
+		if id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+}
+
+func (m *Mailbox) referencesThread(tx *sql.Tx, uid bool, seqSet *imap.SeqSet, msgCount int) ([]*sortthread.Thread, error) {
+	idTable := make(map[string]*threadContainer, msgCount)
+	containers := make([]*threadContainer, 0, msgCount)
+
+	getContainer := func(msgId string) *threadContainer {
+		c := idTable[msgId]
+		if c == nil {
+			c = &threadContainer{}
+			idTable[msgId] = c
+			containers = append(containers, c)
+		}
+		return c
+	}
+
+	// (1) Build parent/child links using Message-Id, References and In-Reply-To.
+	_, err := m.headerMetaScan(tx, seqSet, func(k *msgKey) error {
+		var c *threadContainer
+		if ids := parseMsgIds(firstHeaderField(k.CachedHeader["Message-Id"])); len(ids) != 0 {
+			c = getContainer(ids[0])
+			// Messages are scanned in UID order so the message with the
+			// lowest sequence number keeps the Message-Id and duplicates
+			// are considered unique.
+			if c.id != 0 {
+				c = nil
+			}
+		}
+		if c == nil {
+			c = &threadContainer{}
+			containers = append(containers, c)
+		}
+
+		c.id = k.ID
+		c.sentDate = sentDate(k.CachedHeader["Date"], k.ArrivalUnix).Unix()
+		c.baseSubject, c.isReply = sortthread.GetBaseSubject(firstHeaderField(k.CachedHeader["Subject"]))
+
+		refs := parseMsgIds(strings.Join(k.CachedHeader["References"], " "))
+		if len(refs) == 0 {
+			if inReplyTo := parseMsgIds(firstHeaderField(k.CachedHeader["In-Reply-To"])); len(inReplyTo) != 0 {
+				refs = inReplyTo[:1]
+			}
+		}
+
+		var prev *threadContainer
+		for _, ref := range refs {
+			refC := getContainer(ref)
+			if prev != nil && refC.parent == nil && !refC.hasDescendant(prev) {
+				prev.addChild(refC)
+			}
+			prev = refC
+		}
+
+		c.unlink()
+		if prev != nil && !c.hasDescendant(prev) {
+			prev.addChild(c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("Internal server error") // headerMetaScan logs the actual error
+	}
+
+	// (2) Gather the root set, (3) the id table is no longer needed.
+	idTable = nil // Hint for GC.
+	var roots []*threadContainer
+	for _, c := range containers {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+	containers = nil // Hint for GC.
+
+	// (4) Prune dummy containers.
+	roots = pruneThreadContainers(roots, true)
+	sortThreadContainers(roots)
+
+	// (5) Group the root set by base subject.
+	roots = groupThreadsBySubject(roots)
+
+	// (6) Sort the result.
+	sortThreadContainers(roots)
+
+	result := make([]*sortthread.Thread, 0, len(roots))
+	for _, root := range roots {
+		if root.id == 0 {
+			// Threads without a root message can't be represented using
+			// sortthread.Thread, make the first child the root instead.
+			first := root.children[0]
+			first.children = append(first.children, root.children[1:]...)
+			root = first
+		}
+		result = append(result, m.threadFromContainer(uid, root))
+	}
+	return result, nil
+}
+
+// pruneThreadContainers removes dummy containers without children and
+// replaces dummies with their children, except for dummies in the root set
+// with more than one child.
+func pruneThreadContainers(list []*threadContainer, root bool) []*threadContainer {
+	res := make([]*threadContainer, 0, len(list))
+	for _, c := range list {
+		c.children = pruneThreadContainers(c.children, false)
+		if c.id != 0 {
+			res = append(res, c)
+			continue
+		}
+
+		switch {
+		case len(c.children) == 0:
+		case !root || len(c.children) == 1:
+			for _, child := range c.children {
+				child.parent = c.parent
+				res = append(res, child)
+			}
+		default:
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// sortThreadContainers sorts the containers and all their descendants by sent
+// date, using UID for ties.
+func sortThreadContainers(list []*threadContainer) {
+	for _, c := range list {
+		sortThreadContainers(c.children)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		iDate, iId := list[i].sortKey()
+		jDate, jId := list[j].sortKey()
+		if iDate != jDate {
+			return iDate < jDate
+		}
+		return iId < jId
+	})
+}
+
+// groupThreadsBySubject merges threads from the root set with the same base
+// subject as described in RFC 5256, Section 3, step 5.
+func groupThreadsBySubject(roots []*threadContainer) []*threadContainer {
+	table := make(map[string]*threadContainer, len(roots))
+	for _, c := range roots {
+		subject := c.subject()
+		if subject == "" {
+			continue
+		}
+		old := table[subject]
+		if old == nil ||
+			(c.id == 0 && old.id != 0) ||
+			(old.id != 0 && old.isReply && c.id != 0 && !c.isReply) {
+			table[subject] = c
+		}
+	}
+
+	// Position of each root in the result, the table container can be
+	// replaced by a new dummy.
+	index := make(map[*threadContainer]int, len(roots))
+	res := make([]*threadContainer, 0, len(roots))
+	for _, c := range roots {
+		index[c] = len(res)
+		res = append(res, c)
+	}
+	removed := make([]bool, len(res))
+
+	for _, c := range roots {
+		// Already merged into another thread.
+		if c.parent != nil {
+			continue
+		}
+		subject := c.subject()
+		if subject == "" {
+			continue
+		}
+		target := table[subject]
+		if target == c {
+			continue
+		}
+
+		switch {
+		case target.id == 0 && c.id == 0:
+			for _, child := range c.children {
+				target.addChild(child)
+			}
+			c.children = nil
+		case target.id == 0:
+			target.addChild(c)
+		case c.id != 0 && c.isReply && !target.isReply:
+			target.addChild(c)
+		default:
+			dummy := &threadContainer{}
+			i := index[target]
+			dummy.addChild(target)
+			dummy.addChild(c)
+			res[i] = dummy
+			index[dummy] = i
+			table[subject] = dummy
+		}
+		removed[index[c]] = true
+	}
+
+	filtered := res[:0]
+	for i, c := range res {
+		if !removed[i] {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+func (m *Mailbox) threadFromContainer(uid bool, c *threadContainer) *sortthread.Thread {
+	id := c.id
+	if !uid {
+		id, _ = m.handle.UidAsSeq(id)
+	}
+	thread := &sortthread.Thread{Id: id}
+	if len(c.children) != 0 {
+		thread.Children = make([]*sortthread.Thread, 0, len(c.children))
+	}
+	for _, child := range c.children {
+		thread.Children = append(thread.Children, m.threadFromContainer(uid, child))
+	}
+	return thread
+}
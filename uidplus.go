@@ -0,0 +1,200 @@
+package imapsql
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/emersion/go-imap"
+	mess "github.com/foxcpp/go-imap-mess"
+)
+
+// CreateMessageUID is a version of CreateMessage that also returns
+// the UIDVALIDITY of the mailbox and the UID assigned to the new message.
+//
+// The values are suitable for use in the APPENDUID response code
+// defined by RFC 4315 (UIDPLUS).
+func (u *User) CreateMessageUID(mboxName string, flags []string, date time.Time, fullBody imap.Literal) (uidValidity, uid uint32, err error) {
+	_, box, err := u.GetMailbox(mboxName, false, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer box.Close()
+
+	return box.(*Mailbox).CreateMessageUID(flags, date, fullBody)
+}
+
+// CreateMessageUID is a version of CreateMessage that also returns
+// the UIDVALIDITY of the mailbox and the UID assigned to the new message.
+func (m *Mailbox) CreateMessageUID(flags []string, date time.Time, fullBody imap.Literal) (uidValidity, uid uint32, err error) {
+	return m.createMessage(flags, date, fullBody)
+}
+
+// CopyMessagesUID is a version of CopyMessages that also returns the
+// UIDVALIDITY of the target mailbox, the UIDs of the copied messages and
+// the UIDs assigned to the copies.
+//
+// The n-th UID in srcUids corresponds to the n-th UID in destUids
+// so the values are suitable for use in the COPYUID response code
+// defined by RFC 4315 (UIDPLUS). Both sets are empty if no messages
+// were copied.
+func (m *Mailbox) CopyMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (uidValidity uint32, srcUids, destUids *imap.SeqSet, err error) {
+	return m.copyMessagesUid(uid, seqset, dest)
+}
+
+// MoveMessagesUID is a version of MoveMessages that also returns the
+// UIDVALIDITY of the target mailbox, the UIDs of the moved messages and
+// the UIDs assigned to them in the target mailbox.
+//
+// See CopyMessagesUID for details.
+func (m *Mailbox) MoveMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (uidValidity uint32, srcUids, destUids *imap.SeqSet, err error) {
+	return m.moveMessages(uid, seqset, dest)
+}
+
+// UidExpunge permanently removes messages that have the \Deleted flag set
+// and UID from the specified set.
+//
+// This implements the UID EXPUNGE command defined by RFC 4315 (UIDPLUS).
+func (m *Mailbox) UidExpunge(seqset *imap.SeqSet) error {
+	defer m.handle.Sync(true)
+
+	if !m.hasRight(RightExpunge) {
+		return ErrPermissionDenied
+	}
+
+	seqset, err := m.handle.ResolveSeq(true, seqset)
+	if err != nil {
+		if err == mess.ErrNoMessages {
+			return nil
+		}
+		return err
+	}
+
+	tx, err := m.parent.db.Begin(false)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (tx start)", seqset)
+		return wrapErr(err, "UidExpunge")
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	for _, seq := range seqset.Set {
+		if _, err := tx.Stmt(m.parent.markDeletedUid).Exec(m.id, seq.Start, seq.Stop, m.id); err != nil {
+			m.parent.logMboxErr(m, err, "UidExpunge (mark)", seqset)
+			return wrapErr(err, "UidExpunge")
+		}
+	}
+
+	var (
+		uids          imap.SeqSet
+		expungedCount uint32
+	)
+	rows, err := tx.Stmt(m.parent.markedUids).Query(m.id)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (markedUids)", seqset)
+		return wrapErr(err, "UidExpunge")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid uint32
+		var extKey sql.NullString
+		if err := rows.Scan(&uid, &extKey); err != nil {
+			m.parent.logMboxErr(m, err, "UidExpunge (markedUids scan)", seqset)
+			return wrapErr(err, "UidExpunge")
+		}
+		uids.AddNum(uid)
+		expungedCount++
+	}
+	if err := rows.Err(); err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (markedUids)", seqset)
+		return wrapErr(err, "UidExpunge")
+	}
+	rows.Close()
+
+	if expungedCount == 0 {
+		return nil
+	}
+	m.parent.Opts.Log.Debugln("uid expunge: pending removal for uids", uids, expungedCount)
+
+	keys, err := m.expungeExternal(tx, m.parent.decreaseRefForMarked)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (external prepare)", seqset)
+		return err
+	}
+
+	modSeq, err := m.parent.incrementModSeq(tx, m.id)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (modseq)", seqset)
+		return wrapErr(err, "UidExpunge (modseq)")
+	}
+	if _, err := tx.Stmt(m.parent.addExpungedMarked).Exec(modSeq, time.Now().Unix(), m.id); err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (add expunged)", seqset)
+		return wrapErr(err, "UidExpunge (add expunged)")
+	}
+
+	var expungedSize int64
+	if err := tx.Stmt(m.parent.markedSize).QueryRow(m.id).Scan(&expungedSize); err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (marked size)", seqset)
+		return wrapErr(err, "UidExpunge (marked size)")
+	}
+	if err := m.parent.addUsage(tx, m.user.id, m.id, -int64(expungedCount), -expungedSize); err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (usage)", seqset)
+		return wrapErr(err, "UidExpunge (usage)")
+	}
+
+	if _, err := tx.Stmt(m.parent.delMarked).Exec(); err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (delMarked)", seqset)
+		return wrapErr(err, "UidExpunge")
+	}
+
+	if _, err := tx.Stmt(m.parent.decreaseMsgCount).Exec(expungedCount, m.id); err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (decrease counters)", seqset)
+		return wrapErr(err, "UidExpunge (decrease counters)")
+	}
+
+	keys, err = m.parent.deleteZeroRefKeys(tx, keys)
+	if err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (deleteZeroRef)", seqset)
+		return wrapErr(err, "UidExpunge")
+	}
+
+	if err := tx.Commit(); err != nil {
+		m.parent.logMboxErr(m, err, "UidExpunge (tx commit)", seqset)
+		return wrapErr(err, "UidExpunge")
+	}
+
+	m.parent.flushExtDeletes(keys)
+
+	m.handle.RemovedSet(uids)
+
+	return nil
+}
+
+// collectUids adds UIDs of existing messages from the specified range to the
+// set.
+func (m *Mailbox) collectUids(tx *sql.Tx, set *imap.SeqSet, seq imap.Seq) error {
+	rows, err := tx.Stmt(m.parent.msgIdsUid).Query(m.id, seq.Start, seq.Stop)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return err
+		}
+		set.AddNum(uid)
+	}
+	return rows.Err()
+}
+
+// sortSeqSet returns the copy of the set with ranges sorted and merged.
+//
+// COPY and MOVE assign UIDs in the target mailbox in the order of the source
+// set ranges so they are sorted to keep the mapping between source and target
+// UIDs monotonic.
+func sortSeqSet(seqset *imap.SeqSet) *imap.SeqSet {
+	res := &imap.SeqSet{}
+	for _, seq := range seqset.Set {
+		res.AddRange(seq.Start, seq.Stop)
+	}
+	return res
+}
@@ -0,0 +1,120 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestAppendUid(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+
+	status, err := usr.Status(t.Name(), []imap.StatusItem{imap.StatusUidValidity})
+	assert.NilError(t, err)
+
+	for i := uint32(1); i <= 3; i++ {
+		uidValidity, uid, err := usr.(*User).CreateMessageUID(t.Name(), []string{}, time.Now(), strings.NewReader(testMsg))
+		assert.NilError(t, err)
+		assert.Equal(t, uidValidity, status.UidValidity)
+		assert.Equal(t, uid, i)
+	}
+}
+
+func TestCopyUid(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	assert.NilError(t, usr.CreateMailbox(t.Name()+"-dst"))
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for i := 0; i < 5; i++ {
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	dstStatus, err := usr.Status(t.Name()+"-dst", []imap.StatusItem{imap.StatusUidValidity})
+	assert.NilError(t, err)
+
+	// Ranges are out of order and include non-existent UIDs on purpose.
+	seq, _ := imap.ParseSeqSet("4:10,1:2")
+	uidValidity, srcUids, destUids, err := mbox.CopyMessagesUID(true, seq, t.Name()+"-dst")
+	assert.NilError(t, err)
+	assert.Equal(t, uidValidity, dstStatus.UidValidity)
+	assert.Equal(t, srcUids.String(), "1:2,4:5")
+	assert.Equal(t, destUids.String(), "1:4")
+
+	seq, _ = imap.ParseSeqSet("3")
+	uidValidity, srcUids, destUids, err = mbox.MoveMessagesUID(true, seq, t.Name()+"-dst")
+	assert.NilError(t, err)
+	assert.Equal(t, uidValidity, dstStatus.UidValidity)
+	assert.Equal(t, srcUids.String(), "3")
+	assert.Equal(t, destUids.String(), "5")
+	assert.NilError(t, mbox.Poll(true))
+
+	// Make sure the source UIDs actually map to the reported destination UIDs.
+	_, dstI, err := usr.GetMailbox(t.Name()+"-dst", true, &noopConn{})
+	assert.NilError(t, err)
+	defer dstI.Close()
+	ch := make(chan *imap.Message, 10)
+	seq, _ = imap.ParseSeqSet("1:*")
+	assert.NilError(t, dstI.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid}, ch))
+	assert.Assert(t, is.Len(ch, 5))
+}
+
+func TestUidExpunge(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	assert.NilError(t, usr.CreateMailbox(t.Name()))
+	_, mboxI, err := usr.GetMailbox(t.Name(), false, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for i := 0; i < 4; i++ {
+		assert.NilError(t, usr.CreateMessage(mbox.Name(), []string{}, time.Now(), strings.NewReader(testMsg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	seq, _ := imap.ParseSeqSet("1:3")
+	assert.NilError(t, mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}))
+
+	seq, _ = imap.ParseSeqSet("2:4")
+	assert.NilError(t, mbox.UidExpunge(seq))
+	assert.NilError(t, mbox.Poll(true))
+
+	ch := make(chan *imap.Message, 10)
+	seq, _ = imap.ParseSeqSet("1:*")
+	assert.NilError(t, mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, ch))
+	assert.Assert(t, is.Len(ch, 2))
+	msg := <-ch
+	assert.Equal(t, msg.Uid, uint32(1))
+	assert.Assert(t, is.Contains(msg.Flags, imap.DeletedFlag))
+	msg = <-ch
+	assert.Equal(t, msg.Uid, uint32(4))
+
+	status, err := usr.Status(mbox.Name(), []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	assert.Equal(t, status.Messages, uint32(2))
+
+	vanished, err := mbox.Vanished(nil, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, vanished.String(), "2:3")
+}
@@ -18,6 +18,9 @@ type User struct {
 	username string
 	inboxId  uint64
 	parent   *Backend
+
+	// scope of the app password used to log in, ScopeFull otherwise.
+	scope string
 }
 
 func (u *User) Username() string {
@@ -94,27 +97,81 @@ func (u *User) ListMailboxes(subscribed bool) ([]imap.MailboxInfo, error) {
 		res[i] = info
 	}
 
+	shared, err := u.listSharedMailboxes()
+	if err != nil {
+		u.parent.logUserErr(u, err, "ListMailboxes (shared)", subscribed)
+		return nil, wrapErr(err, "ListMailboxes")
+	}
+
+	return append(res, shared...), nil
+}
+
+// listSharedMailboxes returns mailboxes of other users the user has
+// RightLookup on, with names in the "Other Users" or "Shared" namespace.
+func (u *User) listSharedMailboxes() ([]imap.MailboxInfo, error) {
+	rows, err := u.parent.sharedMboxes.Query(u.username, AnyoneIdentifier, u.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		names  []string
+		rights = make(map[string]string)
+	)
+	for rows.Next() {
+		var (
+			id                       uint64
+			owner, name, entryRights string
+		)
+		if err := rows.Scan(&id, &owner, &name, &entryRights); err != nil {
+			return nil, err
+		}
+
+		fullName := OtherUsersPrefix + owner + MailboxPathSep + name
+		if owner == SharedUsername {
+			fullName = SharedPrefix + name
+		}
+		if _, ok := rights[fullName]; !ok {
+			names = append(names, fullName)
+		}
+		rights[fullName] = mergeRights(rights[fullName], entryRights)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make([]imap.MailboxInfo, 0, len(names))
+	for _, name := range names {
+		if !strings.ContainsRune(rights[name], RightLookup) {
+			continue
+		}
+		res = append(res, imap.MailboxInfo{
+			Delimiter: MailboxPathSep,
+			Name:      name,
+		})
+	}
 	return res, nil
 }
 
 func (u *User) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
-	var mbox *Mailbox
-
-	if strings.EqualFold(name, "INBOX") {
-		mbox = &Mailbox{user: *u, id: u.inboxId, name: name, parent: u.parent}
-	} else {
-		row := u.parent.mboxId.QueryRow(u.id, name)
-		id := uint64(0)
-		if err := row.Scan(&id); err != nil {
-			if err == sql.ErrNoRows {
-				return nil, nil, backend.ErrNoSuchMailbox
-			}
-			u.parent.logUserErr(u, err, "GetMailbox", name)
-			return nil, nil, wrapErrf(err, "GetMailbox %s", name)
+	owner, id, _, rights, err := u.resolveMailbox(name)
+	if err != nil {
+		if err == backend.ErrNoSuchMailbox {
+			return nil, nil, err
+		}
+		u.parent.logUserErr(u, err, "GetMailbox", name)
+		return nil, nil, wrapErrf(err, "GetMailbox %s", name)
+	}
+	mbox := &Mailbox{user: *owner, id: id, name: name, parent: u.parent}
+	if owner.id != u.id || u.scope != ScopeFull {
+		mbox.viewer = u
+		mbox.rights = rights
+		if conn != nil && !mbox.hasRight(RightRead) {
+			return nil, nil, ErrPermissionDenied
 		}
-		mbox = &Mailbox{user: *u, id: id, name: name, parent: u.parent}
 	}
-	mbox.readOnly = readOnly
+	mbox.readOnly = readOnly || u.scope == ScopeReadOnly
 
 	if conn == nil {
 		uids, recent, err := mbox.readUids()
@@ -128,7 +185,7 @@ func (u *User) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.
 	}
 
 	mbox.conn = conn
-	uids, recent, status, err := mbox.initSelected(!readOnly)
+	uids, recent, status, err := mbox.initSelected(!mbox.readOnly)
 	if err != nil {
 		u.parent.logUserErr(u, err, "GetMailbox", name)
 		return nil, nil, wrapErrf(err, "GetMailbox %s", name)
@@ -160,12 +217,29 @@ func (u *User) CreateMessageLimit() *uint32 {
 	}
 }
 
+// SetMessageLimit sets the APPENDLIMIT of the user, nil means that the
+// default of the user's domain is used, see DomainSettings. Use
+// NoMsgSizeLimit to remove the limit without using the default.
 func (u *User) SetMessageLimit(val *uint32) error {
-	_, err := u.parent.setUserMsgSizeLimit.Exec(val, u.id)
+	if !u.scopeAllows(RightAdmin) {
+		return ErrPermissionDenied
+	}
+	var limit sql.NullInt64
+	if val != nil {
+		limit = sql.NullInt64{Int64: int64(*val), Valid: true}
+		if *val == NoMsgSizeLimit {
+			limit.Int64 = noLimitValue
+		}
+	}
+	_, err := u.parent.setUserMsgSizeLimit.Exec(limit, u.id)
 	return err
 }
 
 func (u *User) CreateMailbox(name string) error {
+	if isForeignMailbox(name) || !u.scopeAllows(RightCreate) {
+		return ErrPermissionDenied
+	}
+
 	tx, err := u.parent.db.Begin(false)
 	if err != nil {
 		u.parent.logUserErr(u, err, "CreateMailbox (tx start)", name)
@@ -178,7 +252,12 @@ func (u *User) CreateMailbox(name string) error {
 		return wrapErrf(err, "CreateMailbox (parents) %s", name)
 	}
 
-	if _, err := tx.Stmt(u.parent.createMbox).Exec(u.id, name, u.parent.prng.Uint32(), nil); err != nil {
+	objectId, err := newObjectId(mailboxIdPrefix)
+	if err != nil {
+		u.parent.logUserErr(u, err, "CreateMailbox (objectId)", name)
+		return wrapErrf(err, "CreateMailbox %s", name)
+	}
+	if _, err := tx.Stmt(u.parent.createMbox).Exec(u.id, name, u.parent.prng.Uint32(), nil, objectId); err != nil {
 		if isForeignKeyErr(err) {
 			return backend.ErrMailboxAlreadyExists
 		}
@@ -195,6 +274,10 @@ var ErrUnsupportedSpecialAttr = errors.New("imap: special attribute is not suppo
 
 // CreateMailboxSpecial creates a mailbox with SPECIAL-USE attribute set.
 func (u *User) CreateMailboxSpecial(name, specialUseAttr string) error {
+	if isForeignMailbox(name) || !u.scopeAllows(RightCreate) {
+		return ErrPermissionDenied
+	}
+
 	switch specialUseAttr {
 	case imap.AllAttr, imap.FlaggedAttr:
 		return ErrUnsupportedSpecialAttr
@@ -213,7 +296,11 @@ func (u *User) CreateMailboxSpecial(name, specialUseAttr string) error {
 		return wrapErrf(err, "CreateMailboxSpecial (parents) %s", name)
 	}
 
-	if _, err := tx.Stmt(u.parent.createMbox).Exec(u.id, name, u.parent.prng.Uint32(), specialUseAttr); err != nil {
+	objectId, err := newObjectId(mailboxIdPrefix)
+	if err != nil {
+		return wrapErrf(err, "CreateMailboxSpecial %s", name)
+	}
+	if _, err := tx.Stmt(u.parent.createMbox).Exec(u.id, name, u.parent.prng.Uint32(), specialUseAttr, objectId); err != nil {
 		if isForeignKeyErr(err) {
 			return backend.ErrMailboxAlreadyExists
 		}
@@ -227,6 +314,9 @@ func (u *User) DeleteMailbox(name string) error {
 	if strings.ToLower(name) == "inbox" {
 		return errors.New("DeleteMailbox: can't delete INBOX")
 	}
+	if isForeignMailbox(name) || !u.scopeAllows(RightDeleteMbox) {
+		return ErrPermissionDenied
+	}
 
 	tx, err := u.parent.db.BeginLevel(sql.LevelRepeatableRead, false)
 	if err != nil {
@@ -235,31 +325,19 @@ func (u *User) DeleteMailbox(name string) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.Stmt(u.parent.decreaseRefForMbox).Exec(u.id, name); err != nil {
+	if _, err := tx.Stmt(u.parent.decreaseRefForMbox).Exec(u.id, name, u.id, name); err != nil {
 		u.parent.logUserErr(u, err, "DeleteMailbox (decrease ref)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
 
-	rows, err := tx.Stmt(u.parent.zeroRefUser).Query(u.id)
+	keys, err := scanKeys(tx.Stmt(u.parent.zeroRefMbox).Query(u.id, name))
 	if err != nil {
-		u.parent.logUserErr(u, err, "DeleteMailbox (zero ref user)", name)
+		u.parent.logUserErr(u, err, "DeleteMailbox (zero ref mbox)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
-	defer rows.Close()
-
-	keys := make([]string, 0, 16)
-	for rows.Next() {
-		var extKey string
-		if err := rows.Scan(&extKey); err != nil {
-			u.parent.logUserErr(u, err, "DeleteMailbox (extkeys scan)", name)
-			return wrapErrf(err, "DeleteMailbox %s", name)
-		}
-		keys = append(keys, extKey)
-
-	}
 
-	if err := u.parent.extStore.Delete(keys); err != nil {
-		u.parent.logUserErr(u, err, "DeleteMailbox (extstore delete)", name)
+	if _, err := tx.Stmt(u.parent.delMboxUsage).Exec(u.id, name, u.id, name, u.id); err != nil {
+		u.parent.logUserErr(u, err, "DeleteMailbox (usage)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
 
@@ -278,17 +356,26 @@ func (u *User) DeleteMailbox(name string) error {
 		return backend.ErrNoSuchMailbox
 	}
 
-	if _, err := tx.Stmt(u.parent.deleteZeroRef).Exec(u.id); err != nil {
+	keys, err = u.parent.deleteZeroRefKeys(tx, keys)
+	if err != nil {
 		u.parent.logUserErr(u, err, "DeleteMailbox (delete zero ref)", name)
 		return wrapErrf(err, "DeleteMailbox %s", name)
 	}
 
-	err = tx.Commit()
-	u.parent.logUserErr(u, err, "DeleteMailbox (tx commit)", name)
-	return err
+	if err := tx.Commit(); err != nil {
+		u.parent.logUserErr(u, err, "DeleteMailbox (tx commit)", name)
+		return err
+	}
+	u.parent.flushExtDeletes(keys)
+	return nil
 }
 
 func (u *User) RenameMailbox(existingName, newName string) error {
+	if isForeignMailbox(existingName) || isForeignMailbox(newName) ||
+		!u.scopeAllows(RightDeleteMbox) || !u.scopeAllows(RightCreate) {
+		return ErrPermissionDenied
+	}
+
 	tx, err := u.parent.db.Begin(false)
 	if err != nil {
 		u.parent.logUserErr(u, err, "RenameMailbox (tx start)", existingName, newName)
@@ -316,7 +403,12 @@ func (u *User) RenameMailbox(existingName, newName string) error {
 	}
 
 	if strings.EqualFold(existingName, "INBOX") {
-		if _, err := tx.Stmt(u.parent.createMbox).Exec(u.id, existingName, u.parent.prng.Uint32(), nil); err != nil {
+		objectId, err := newObjectId(mailboxIdPrefix)
+		if err != nil {
+			u.parent.logUserErr(u, err, "RenameMailbox (objectId)", existingName, newName)
+			return wrapErrf(err, "RenameMailbox %s, %s", existingName, newName)
+		}
+		if _, err := tx.Stmt(u.parent.createMbox).Exec(u.id, existingName, u.parent.prng.Uint32(), nil, objectId); err != nil {
 			u.parent.logUserErr(u, err, "RenameMailbox (create inbox)", existingName, newName)
 			return wrapErrf(err, "RenameMailbox %s, %s", existingName, newName)
 		}
@@ -351,7 +443,11 @@ func (u *User) createParentDirs(tx *sql.Tx, name string) error {
 		}
 		curDir += part
 
-		if _, err := tx.Stmt(u.parent.createMboxExistsOk).Exec(u.id, curDir, u.parent.prng.Uint32()); err != nil {
+		objectId, err := newObjectId(mailboxIdPrefix)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Stmt(u.parent.createMboxExistsOk).Exec(u.id, curDir, u.parent.prng.Uint32(), objectId); err != nil {
 			return err
 		}
 	}
@@ -364,7 +460,17 @@ func (u *User) Namespaces() (personal, other, shared []namespace.Namespace, err
 			Prefix:    "",
 			Delimiter: MailboxPathSep,
 		},
-	}, nil, nil, nil
+	}, []namespace.Namespace{
+		{
+			Prefix:    OtherUsersPrefix,
+			Delimiter: MailboxPathSep,
+		},
+	}, []namespace.Namespace{
+		{
+			Prefix:    SharedPrefix,
+			Delimiter: MailboxPathSep,
+		},
+	}, nil
 }
 
 func (u *User) CreateMessage(mboxName string, flags []string, date time.Time, fullBody imap.Literal, _ backend.Mailbox) error {
@@ -388,19 +494,19 @@ func (u *User) SetSubscribed(mboxName string, sub bool) error {
 }
 
 func (u *User) Status(mbox string, items []imap.StatusItem) (*imap.MailboxStatus, error) {
-	tx, err := u.parent.db.BeginLevel(sql.LevelReadCommitted, true)
+	_, mboxId, _, rights, err := u.resolveMailbox(mbox)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
+	if !strings.ContainsRune(rights, RightRead) {
+		return nil, ErrPermissionDenied
+	}
 
-	var mboxId uint64
-	if err := tx.Stmt(u.parent.mboxId).QueryRow(u.id, mbox).Scan(&mboxId); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, backend.ErrNoSuchMailbox
-		}
+	tx, err := u.parent.db.BeginLevel(sql.LevelReadCommitted, true)
+	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
 	status := imap.NewMailboxStatus(mbox, items)
 	for _, item := range items {
@@ -436,6 +542,22 @@ func (u *User) Status(mbox string, items []imap.StatusItem) (*imap.MailboxStatus
 				delete(status.Items, imap.StatusUnseen)
 				continue
 			}
+		case StatusMailboxId:
+			var objectId string
+			err := tx.Stmt(u.parent.mboxObjectId).QueryRow(mboxId).Scan(&objectId)
+			if err != nil {
+				u.parent.logUserErr(u, err, "Status: mailboxId scan")
+				return nil, errors.New("I/O error")
+			}
+			status.Items[StatusMailboxId] = []interface{}{imap.RawString(objectId)}
+		case StatusHighestModSeq:
+			var modSeq uint64
+			err := tx.Stmt(u.parent.highestModSeq).QueryRow(mboxId).Scan(&modSeq)
+			if err != nil {
+				u.parent.logUserErr(u, err, "Status: highestModSeq scan")
+				return nil, errors.New("I/O error")
+			}
+			status.Items[StatusHighestModSeq] = modSeq
 		case imap.StatusAppendLimit:
 			var res sql.NullInt64
 			row := tx.Stmt(u.parent.mboxMsgSizeLimit).QueryRow(mboxId)
@@ -0,0 +1,155 @@
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// UserState controls whether the user account can be used. Accounts that are
+// not active keep all their data.
+type UserState int
+
+const (
+	// UserActive is the default state of new accounts.
+	UserActive UserState = iota
+	// UserLocked accounts can't log in, messages are still delivered to
+	// them.
+	UserLocked
+	// UserDisabled accounts can't log in and messages addressed to them are
+	// rejected.
+	UserDisabled
+)
+
+var (
+	ErrUserLocked   = errors.New("imap: user account is locked")
+	ErrUserDisabled = errors.New("imap: user account is disabled")
+)
+
+func (s UserState) String() string {
+	switch s {
+	case UserActive:
+		return "active"
+	case UserLocked:
+		return "locked"
+	case UserDisabled:
+		return "disabled"
+	}
+	return "unknown"
+}
+
+// ParseUserState converts the value returned by UserState.String back to
+// UserState.
+func ParseUserState(s string) (UserState, error) {
+	for _, state := range []UserState{UserActive, UserLocked, UserDisabled} {
+		if state.String() == s {
+			return state, nil
+		}
+	}
+	return 0, errors.New("imap: unknown user state: " + s)
+}
+
+// loginErr returns the error that should be returned by Login for the user in
+// this state, nil if the user can log in.
+func (s UserState) loginErr() error {
+	switch s {
+	case UserActive:
+		return nil
+	case UserLocked:
+		return ErrUserLocked
+	}
+	return ErrUserDisabled
+}
+
+func (b *Backend) stateOf(uid uint64) (UserState, error) {
+	var state UserState
+	err := b.userState.QueryRow(uid).Scan(&state)
+	return state, err
+}
+
+// GetUserState returns the state of the user account.
+func (b *Backend) GetUserState(username string) (UserState, error) {
+	uid, err := b.userId(username, "GetUserState")
+	if err != nil {
+		return 0, err
+	}
+	state, err := b.stateOf(uid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserDoesntExists
+		}
+		return 0, wrapErr(err, "GetUserState")
+	}
+	return state, nil
+}
+
+// SetUserState changes the state of the user account. Already established
+// sessions are not affected.
+func (b *Backend) SetUserState(username string, state UserState) error {
+	if state != UserActive && state != UserLocked && state != UserDisabled {
+		return errors.New("SetUserState: unknown user state")
+	}
+	stats, err := b.setUserState.Exec(state, normalizeUsername(username))
+	if err != nil {
+		return wrapErr(err, "SetUserState")
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		return wrapErr(err, "SetUserState")
+	}
+	if affected == 0 {
+		return ErrUserDoesntExists
+	}
+	return nil
+}
+
+// RenameUser changes the username of the account. Mailboxes, messages and
+// other data of the account are kept, entries of access control lists
+// granting rights to the user and aliases pointing to it are changed too.
+//
+// Mailboxes of the account are visible for other users under the new name
+// in the "Other Users" namespace. Already established sessions continue to
+// use the old name.
+func (b *Backend) RenameUser(oldName, newName string) error {
+	oldName, newName = normalizeUsername(oldName), normalizeUsername(newName)
+	if oldName == SharedUsername || newName == SharedUsername {
+		return ErrPermissionDenied
+	}
+
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		return wrapErr(err, "RenameUser")
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stats, err := tx.Stmt(b.renameUser).Exec(newName, domainOf(newName), oldName)
+	if err != nil {
+		if isForeignKeyErr(err) {
+			return ErrUserAlreadyExists
+		}
+		return wrapErr(err, "RenameUser")
+	}
+	affected, err := stats.RowsAffected()
+	if err != nil {
+		return wrapErr(err, "RenameUser")
+	}
+	if affected == 0 {
+		return ErrUserDoesntExists
+	}
+	if oldName == newName {
+		return tx.Commit()
+	}
+
+	// Entries for the new name were left for an account that does not
+	// exist, they should not grant anything to the renamed user.
+	if _, err := tx.Stmt(b.aclDelIdentifier).Exec(newName); err != nil {
+		return wrapErr(err, "RenameUser")
+	}
+	if _, err := tx.Stmt(b.aclRenameIdentifier).Exec(newName, oldName); err != nil {
+		return wrapErr(err, "RenameUser")
+	}
+	if _, err := tx.Stmt(b.renameAliasTarget).Exec(newName, oldName); err != nil {
+		return wrapErr(err, "RenameUser")
+	}
+
+	return wrapErr(tx.Commit(), "RenameUser")
+}
@@ -0,0 +1,125 @@
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+)
+
+func inboxMessages(t *testing.T, b *Backend, username string) uint32 {
+	t.Helper()
+	u, err := b.GetUser(username)
+	assert.NilError(t, err)
+	status, err := u.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	assert.NilError(t, err)
+	return status.Messages
+}
+
+func TestUserState(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user"))
+
+	state, err := b.GetUserState("User")
+	assert.NilError(t, err)
+	assert.Equal(t, state, UserActive)
+	_, err = b.GetUserState("nobody")
+	assert.Equal(t, err, ErrUserDoesntExists)
+	assert.Equal(t, b.SetUserState("nobody", UserLocked), ErrUserDoesntExists)
+
+	// Locked users still receive messages.
+	assert.NilError(t, b.SetUserState("USER", UserLocked))
+	state, err = b.GetUserState("user")
+	assert.NilError(t, err)
+	assert.Equal(t, state, UserLocked)
+	_, err = b.Login(nil, "user", "")
+	assert.Equal(t, err, ErrUserLocked)
+	delivery := b.NewDelivery()
+	assert.NilError(t, delivery.AddRcpt("user", textproto.Header{}))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(testMsg)))
+	assert.NilError(t, delivery.Commit())
+
+	assert.NilError(t, b.SetUserState("user", UserDisabled))
+	_, err = b.Login(nil, "user", "")
+	assert.Equal(t, err, ErrUserDisabled)
+	delivery = b.NewDelivery()
+	assert.Equal(t, delivery.AddRcpt("User", textproto.Header{}), ErrUserDisabled)
+	assert.NilError(t, delivery.Abort())
+
+	// Data is kept.
+	assert.Equal(t, inboxMessages(t, b, "user"), uint32(1))
+
+	assert.NilError(t, b.SetUserState("user", UserActive))
+	_, err = b.Login(nil, "user", "")
+	assert.NilError(t, err)
+}
+
+func TestUserStateAuthenticate(t *testing.T) {
+	b := initTestBackendOpts(Opts{Authenticate: true, PassHashParams: "4"}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser("user"))
+	assert.NilError(t, b.SetUserPassword("user", "password"))
+	assert.NilError(t, b.SetUserState("user", UserDisabled))
+
+	// State is not disclosed without the correct password.
+	_, err := b.Login(nil, "user", "wrong")
+	assert.Equal(t, err, backend.ErrInvalidCredentials)
+	_, err = b.Login(nil, "user", "password")
+	assert.Equal(t, err, ErrUserDisabled)
+}
+
+func TestRenameUser(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	owner, other := initACLUsers(t, b)
+	oldName := owner.Username()
+	assert.NilError(t, owner.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(testMsg), nil))
+	assert.NilError(t, other.CreateMailbox("Shared"))
+	assert.NilError(t, other.SetACL("Shared", oldName, "lr"))
+	// Left for the account that does not exist.
+	assert.NilError(t, other.SetACL("Shared", "new", "lrswipkxte"))
+
+	assert.Equal(t, b.RenameUser("nobody", "new"), ErrUserDoesntExists)
+	assert.Equal(t, b.RenameUser(oldName, other.Username()), ErrUserAlreadyExists)
+	assert.Equal(t, b.RenameUser(oldName, SharedUsername), ErrPermissionDenied)
+	// Only the case is changed, this is a no-op.
+	assert.NilError(t, b.RenameUser(oldName, strings.ToUpper(oldName)))
+
+	assert.NilError(t, b.RenameUser(strings.ToUpper(oldName), "NEW"))
+	_, err := b.GetUser(oldName)
+	assert.Equal(t, err, ErrUserDoesntExists)
+	renamedI, err := b.GetUser("New")
+	assert.NilError(t, err)
+	renamed := renamedI.(*User)
+	assert.Equal(t, renamed.Username(), "new")
+	assert.Equal(t, renamed.id, owner.id)
+	assert.Equal(t, renamed.inboxId, owner.inboxId)
+
+	// Messages and bodies are still there.
+	_, mbox, err := renamed.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mbox.Close()
+	seq, _ := imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(false, seq, []imap.FetchItem{"BODY.PEEK[]"}, ch))
+	assert.Equal(t, len(ch), 1)
+	checkTestMsg(t, <-ch)
+
+	var keyOwner uint64
+	assert.NilError(t, b.db.QueryRow(`SELECT uid FROM extKeys`).Scan(&keyOwner))
+	assert.Equal(t, keyOwner, owner.id)
+
+	// Rights granted to the old name follow the user, ones granted to the
+	// new name before are dropped.
+	rights, err := renamed.MyRights(OtherUsersPrefix + other.Username() + MailboxPathSep + "Shared")
+	assert.NilError(t, err)
+	assert.Equal(t, rights, "lr")
+	acl, err := other.GetACL("Shared")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, acl, map[string]string{other.Username(): AllRights, "new": "lr"})
+}
@@ -0,0 +1,213 @@
+package imapsql
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+// CorruptedBodyError is returned when the message body read from the
+// external store does not match the length or hash stored in the database.
+type CorruptedBodyError struct {
+	Key string
+
+	// true if the body is shorter than expected.
+	Truncated bool
+
+	// Expected and actual length of the body.
+	ExpectedLen, ActualLen int64
+}
+
+func (err CorruptedBodyError) Error() string {
+	if err.Truncated {
+		return fmt.Sprintf("imapsql: body %s is truncated (%d bytes out of %d)", err.Key, err.ActualLen, err.ExpectedLen)
+	}
+	if err.ExpectedLen != err.ActualLen {
+		return fmt.Sprintf("imapsql: body %s is longer than expected (%d bytes instead of %d)", err.Key, err.ActualLen, err.ExpectedLen)
+	}
+	return fmt.Sprintf("imapsql: body %s hash mismatch", err.Key)
+}
+
+// bodyCheck is the expected length and hash of the message body. Hash is
+// empty for messages added before schema version 14, only length is checked
+// for them.
+type bodyCheck struct {
+	len  int64
+	hash string
+}
+
+// verifyReader checks the body once it is read completely.
+type verifyReader struct {
+	r     io.Reader
+	key   string
+	check bodyCheck
+	hash  hash.Hash
+	n     int64
+}
+
+func (vr *verifyReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	vr.n += int64(n)
+	vr.hash.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	if vr.n != vr.check.len {
+		return n, CorruptedBodyError{
+			Key:         vr.key,
+			Truncated:   vr.n < vr.check.len,
+			ExpectedLen: vr.check.len,
+			ActualLen:   vr.n,
+		}
+	}
+	if vr.check.hash != "" && hex.EncodeToString(vr.hash.Sum(nil)) != vr.check.hash {
+		return n, CorruptedBodyError{
+			Key:         vr.key,
+			ExpectedLen: vr.check.len,
+			ActualLen:   vr.n,
+		}
+	}
+	return n, io.EOF
+}
+
+const (
+	BodyMissing   = "missing"
+	BodyTruncated = "truncated"
+	BodyMismatch  = "mismatch"
+	BodyError     = "error"
+)
+
+// BodyProblem describes the message with the body that can't be read
+// correctly.
+type BodyProblem struct {
+	Username string
+	Mailbox  string
+	UID      uint32
+	Key      string
+
+	// One of BodyMissing, BodyTruncated, BodyMismatch or BodyError.
+	Kind string
+	Err  error
+}
+
+// VerifyBodies reads bodies of all messages of the specified users (or of
+// all users if none are specified) and checks them against lengths and hashes
+// stored in the database. report is called for each message with missing or
+// corrupted body.
+//
+// It returns the number of checked messages.
+func (b *Backend) VerifyBodies(usernames []string, report func(BodyProblem)) (int, error) {
+	if len(usernames) == 0 {
+		var err error
+		usernames, err = b.ListUsers()
+		if err != nil {
+			return 0, err
+		}
+		usernames = append(usernames, SharedUsername)
+	}
+
+	checked := 0
+	for _, username := range usernames {
+		uid, _, err := b.getUserMeta(nil, normalizeUsername(username))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				if username == SharedUsername {
+					continue
+				}
+				return checked, ErrUserDoesntExists
+			}
+			return checked, wrapErr(err, "VerifyBodies")
+		}
+
+		msgs, err := b.listUserBodies(uid)
+		if err != nil {
+			return checked, wrapErr(err, "VerifyBodies")
+		}
+		for _, msg := range msgs {
+			checked++
+			if err := b.verifyBody(msg); err != nil {
+				report(BodyProblem{
+					Username: username,
+					Mailbox:  msg.mbox,
+					UID:      msg.msgId,
+					Key:      msg.key,
+					Kind:     bodyProblemKind(err),
+					Err:      err,
+				})
+			}
+		}
+	}
+	return checked, nil
+}
+
+type verifiedBody struct {
+	mbox         string
+	msgId        uint32
+	key          string
+	compressAlgo string
+	check        bodyCheck
+}
+
+func (b *Backend) listUserBodies(uid uint64) ([]verifiedBody, error) {
+	rows, err := b.userBodies.Query(uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []verifiedBody
+	for rows.Next() {
+		var (
+			msg               verifiedBody
+			key, compressAlgo sql.NullString
+		)
+		if err := rows.Scan(&msg.mbox, &msg.msgId, &key, &compressAlgo, &msg.check.len, &msg.check.hash); err != nil {
+			return nil, err
+		}
+		// Bodies of very old messages were stored in the database.
+		if !key.Valid {
+			continue
+		}
+		msg.key = key.String
+		msg.compressAlgo = compressAlgo.String
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func (b *Backend) verifyBody(msg verifiedBody) error {
+	rdr, err := b.openBody(nil, true, msg.compressAlgo, msg.key, &msg.check)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+	_, err = io.Copy(ioutil.Discard, rdr)
+	return err
+}
+
+func bodyProblemKind(err error) string {
+	var extErr ExternalError
+	if errors.As(err, &extErr) && extErr.NonExistent {
+		return BodyMissing
+	}
+	var corrupted CorruptedBodyError
+	if errors.As(err, &corrupted) {
+		if corrupted.Truncated {
+			return BodyTruncated
+		}
+		return BodyMismatch
+	}
+	// Reported by decompression algorithms and partsReader.
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return BodyTruncated
+	}
+	if errors.Is(err, ErrDecryptionFailed) {
+		return BodyMismatch
+	}
+	return BodyError
+}
@@ -0,0 +1,134 @@
+package imapsql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func msgBodyPath(t *testing.T, b *Backend, mbox *Mailbox, uid uint32) string {
+	t.Helper()
+	var key string
+	assert.NilError(t, b.db.QueryRow(`SELECT extBodyKey FROM msgs WHERE mboxId = ? AND msgId = ?`, mbox.id, uid).Scan(&key))
+	return filepath.Join(b.extStore.(*FSStore).Root, key)
+}
+
+func verifyProblems(t *testing.T, b *Backend, usernames ...string) (int, map[uint32]string) {
+	t.Helper()
+	problems := make(map[uint32]string)
+	checked, err := b.VerifyBodies(usernames, func(p BodyProblem) {
+		problems[p.UID] = p.Kind
+	})
+	assert.NilError(t, err)
+	return checked, problems
+}
+
+func TestVerifyBodies(t *testing.T) {
+	b := initTestBackend().(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	for i := 1; i <= 4; i++ {
+		msg := testMsg + strings.Repeat("\r\nP.S.", i)
+		assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), mbox))
+	}
+	assert.NilError(t, mbox.Poll(true))
+
+	checked, problems := verifyProblems(t, b)
+	assert.Equal(t, checked, 4)
+	assert.Assert(t, is.Len(problems, 0))
+
+	path := msgBodyPath(t, b, mbox, 1)
+	data, err := ioutil.ReadFile(path)
+	assert.NilError(t, err)
+	data[len(data)-3] ^= 1
+	assert.NilError(t, ioutil.WriteFile(path, data, 0600))
+	assert.NilError(t, os.Truncate(msgBodyPath(t, b, mbox, 2), 10))
+	assert.NilError(t, os.Remove(msgBodyPath(t, b, mbox, 3)))
+
+	checked, problems = verifyProblems(t, b, t.Name())
+	assert.Equal(t, checked, 4)
+	assert.DeepEqual(t, problems, map[uint32]string{
+		1: BodyMismatch,
+		2: BodyTruncated,
+		3: BodyMissing,
+	})
+
+	_, err = b.VerifyBodies([]string{"nobody"}, func(BodyProblem) {})
+	assert.Equal(t, err, ErrUserDoesntExists)
+
+	// Corrupted message is returned unless verification is enabled.
+	seq := imap.SeqSet{}
+	seq.AddNum(1)
+	ch := make(chan *imap.Message, 1)
+	assert.NilError(t, mbox.ListMessages(true, &seq, []imap.FetchItem{"BODY.PEEK[]"}, ch))
+	assert.Assert(t, is.Len(ch, 1))
+
+	b.Opts.VerifyBodies = true
+	for _, item := range []imap.FetchItem{"BODY.PEEK[]", "BODY.PEEK[TEXT]"} {
+		ch = make(chan *imap.Message, 1)
+		assert.NilError(t, mbox.ListMessages(true, &seq, []imap.FetchItem{item}, ch))
+		assert.Assert(t, is.Len(ch, 0), "Corrupted body is returned for %v", item)
+	}
+
+	seq = imap.SeqSet{}
+	seq.AddNum(4)
+	ch = make(chan *imap.Message, 1)
+	assert.NilError(t, mbox.ListMessages(true, &seq, []imap.FetchItem{"BODY.PEEK[]"}, ch))
+	assert.Assert(t, is.Len(ch, 1))
+}
+
+func TestVerifyBodiesStored(t *testing.T) {
+	// Hashes should match for all ways messages are added.
+	b := initTestBackendOpts(Opts{
+		MasterKeys:          [][]byte{testMasterKey(1)},
+		AttachmentThreshold: 1024,
+		CompressAlgo:        "lz4",
+		VerifyBodies:        true,
+	}).(*Backend)
+	defer cleanBackend(b)
+	assert.NilError(t, b.CreateUser(t.Name()))
+	usr, err := b.GetUser(t.Name())
+	assert.NilError(t, err)
+	_, mboxI, err := usr.GetMailbox("INBOX", true, &noopConn{})
+	assert.NilError(t, err)
+	defer mboxI.Close()
+	mbox := mboxI.(*Mailbox)
+
+	msg := attachmentMsg("Verify", "Hello!", testAttachment(16*1024), "\r\n")
+	assert.NilError(t, usr.CreateMessage("INBOX", []string{}, time.Now(), strings.NewReader(msg), mbox))
+
+	delivery := b.NewDelivery()
+	hdr := textproto.Header{}
+	hdr.Add("Delivered-To", "1@example.org")
+	assert.NilError(t, delivery.AddRcpt(t.Name(), hdr))
+	assert.NilError(t, delivery.BodyRaw(strings.NewReader(msg)))
+	assert.NilError(t, delivery.Commit())
+
+	assert.NilError(t, usr.CreateMailbox("Copy"))
+	assert.NilError(t, mbox.Poll(true))
+	seq, _ := imap.ParseSeqSet("1:*")
+	assert.NilError(t, mbox.CopyMessages(true, seq, "Copy"))
+
+	checked, problems := verifyProblems(t, b)
+	assert.Equal(t, checked, 4)
+	assert.Assert(t, is.Len(problems, 0))
+
+	ch := make(chan *imap.Message, 10)
+	assert.NilError(t, mbox.ListMessages(true, seq, []imap.FetchItem{"BODY.PEEK[]"}, ch))
+	assert.Assert(t, is.Len(ch, 2))
+}